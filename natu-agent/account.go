@@ -0,0 +1,248 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------------------------
+// Cambios de cuentas y grupos
+// ----------------------------
+//
+// shadow-utils (useradd, usermod, userdel, groupadd, groupdel, gpasswd) y
+// pam_unix(passwd|chpasswd:chauthtok) dejan en auth.log cada alta, baja y
+// cambio de grupo. Los convertimos en eventos account_change con el tipo de
+// cambio, la cuenta afectada y, si se puede saber, quién lo hizo.
+
+var (
+	reAcctNewUser      = regexp.MustCompile(`^new user: name=([^,]+), UID=(\d+), GID=(\d+), home=([^,]+), shell=([^,]+)`)
+	reAcctNewGroup     = regexp.MustCompile(`^new group: name=([^,]+), GID=(\d+)`)
+	reAcctAddToGroup   = regexp.MustCompile(`^add '([^']+)' to (shadow )?group '([^']+)'`)
+	reAcctDelFromGroup = regexp.MustCompile(`^delete '([^']+)' from (shadow )?group '([^']+)'`)
+	reAcctDelUser      = regexp.MustCompile(`^delete user '([^']+)'`)
+	reAcctDelGroup     = regexp.MustCompile(`^(?:removed group '([^']+)' owned by|group '([^']+)' removed$)`)
+	reAcctModUser      = regexp.MustCompile(`^(?:change|lock|unlock) user (?:name )?'([^']+)'`)
+	reGpasswdMember    = regexp.MustCompile(`^user (\S+) (added|removed) by (\S+) (?:to|from) group (\S+)`)
+	reGpasswdSet       = regexp.MustCompile(`^members of group (\S+) set by (\S+) to (.*)$`)
+	rePamChauthtok     = regexp.MustCompile(`^pam_unix\((?:passwd|chpasswd):chauthtok\): password changed for (\S+)`)
+)
+
+// Programas de gestión de cuentas que parseamos
+var accountPrograms = map[string]bool{
+	"useradd":  true,
+	"usermod":  true,
+	"userdel":  true,
+	"groupadd": true,
+	"groupdel": true,
+	"groupmod": true,
+	"gpasswd":  true,
+	"chpasswd": true,
+	"passwd":   true,
+}
+
+func parseAccountMessage(e authEntry) *Event {
+	msg := e.Msg
+
+	var (
+		changeType string
+		target     string
+		group      string
+		actor      string
+		severity   = 2
+		extra      = map[string]interface{}{}
+	)
+
+	switch {
+	case reAcctNewUser.MatchString(msg):
+		m := reAcctNewUser.FindStringSubmatch(msg)
+		changeType, target, severity = "user_created", m[1], 4
+		extra["uid"], _ = strconv.Atoi(m[2])
+		extra["gid"], _ = strconv.Atoi(m[3])
+		extra["home"] = m[4]
+		extra["shell"] = strings.TrimSpace(m[5])
+		if m[2] == "0" {
+			severity = 5
+		}
+
+	case reAcctNewGroup.MatchString(msg):
+		m := reAcctNewGroup.FindStringSubmatch(msg)
+		changeType, group = "group_created", m[1]
+		extra["gid"], _ = strconv.Atoi(m[2])
+
+	case reAcctAddToGroup.MatchString(msg):
+		m := reAcctAddToGroup.FindStringSubmatch(msg)
+		// Cada cambio se escribe para /etc/group y para /etc/gshadow
+		if m[2] != "" {
+			return nil
+		}
+		changeType, target, group, severity = "group_member_added", m[1], m[3], 3
+
+	case reAcctDelFromGroup.MatchString(msg):
+		m := reAcctDelFromGroup.FindStringSubmatch(msg)
+		if m[2] != "" {
+			return nil
+		}
+		changeType, target, group = "group_member_removed", m[1], m[3]
+
+	case reAcctDelUser.MatchString(msg):
+		m := reAcctDelUser.FindStringSubmatch(msg)
+		changeType, target, severity = "user_deleted", m[1], 3
+
+	case reAcctDelGroup.MatchString(msg):
+		m := reAcctDelGroup.FindStringSubmatch(msg)
+		changeType, group = "group_deleted", m[1]
+		if group == "" {
+			group = m[2]
+		}
+
+	case reAcctModUser.MatchString(msg):
+		m := reAcctModUser.FindStringSubmatch(msg)
+		changeType, target = "user_modified", m[1]
+		extra["detail"] = msg
+		// usermod -o -u 0: la cuenta pasa a ser root
+		if strings.Contains(msg, " UID from ") && strings.HasSuffix(msg, " to '0'") {
+			severity = 5
+		}
+
+	case reGpasswdMember.MatchString(msg):
+		m := reGpasswdMember.FindStringSubmatch(msg)
+		changeType, target, actor, group, severity = "group_member_added", m[1], m[3], m[4], 3
+		if m[2] == "removed" {
+			changeType, severity = "group_member_removed", 2
+		}
+
+	case reGpasswdSet.MatchString(msg):
+		m := reGpasswdSet.FindStringSubmatch(msg)
+		changeType, group, actor, severity = "group_members_set", m[1], m[2], 3
+		extra["members"] = strings.TrimSpace(m[3])
+
+	case rePamChauthtok.MatchString(msg):
+		m := rePamChauthtok.FindStringSubmatch(msg)
+		changeType, target = "password_changed", m[1]
+
+	default:
+		return nil
+	}
+
+	payload := map[string]interface{}{
+		"raw_line":    e.RawLine,
+		"program":     e.Program,
+		"change_type": changeType,
+	}
+	if target != "" {
+		payload["target"] = target
+		payload["is_root"] = target == "root"
+	}
+	if group != "" {
+		payload["group"] = group
+	}
+	if actor != "" {
+		payload["actor"] = actor
+		payload["actor_source"] = "log"
+	}
+	for k, v := range extra {
+		payload[k] = v
+	}
+
+	return &Event{
+		Ts:        e.Ts,
+		Source:    "auth",
+		EventType: "account_change",
+		Severity:  severity,
+		Payload:   payload,
+	}
+}
+
+// ----------------------------
+// Autor de los cambios de cuenta
+// ----------------------------
+//
+// useradd y compañía no registran quién los ejecutó. Casi siempre se lanzan
+// con sudo, así que recordamos los últimos sudo_command de herramientas de
+// cuentas y asignamos su sudo_user al account_change que llega justo después.
+
+const accountActorWindow = 2 * time.Minute
+
+// Envoltorios de Debian que acaban llamando a useradd/usermod/...
+var accountWrapperPrograms = map[string]bool{
+	"adduser":  true,
+	"deluser":  true,
+	"addgroup": true,
+	"delgroup": true,
+	"newusers": true,
+}
+
+type recentAccountSudo struct {
+	SudoUser string
+	Program  string
+	Ts       time.Time
+}
+
+type AccountActorTracker struct {
+	mu     sync.Mutex
+	recent []recentAccountSudo
+}
+
+func NewAccountActorTracker() *AccountActorTracker {
+	return &AccountActorTracker{}
+}
+
+// Observe recuerda los sudo de herramientas de cuentas y completa el actor de
+// los account_change que no lo traen en el log.
+func (at *AccountActorTracker) Observe(ev *Event) {
+	if ev == nil {
+		return
+	}
+
+	at.mu.Lock()
+	defer at.mu.Unlock()
+
+	switch ev.EventType {
+	case "sudo_command":
+		fields := strings.Fields(payloadString(ev.Payload, "command"))
+		if len(fields) == 0 {
+			return
+		}
+		prog := filepath.Base(fields[0])
+		if !accountPrograms[prog] && !accountWrapperPrograms[prog] {
+			return
+		}
+		// Sin account_change que los consuma también hay que purgarlos
+		at.expireLocked(ev.Ts)
+		at.recent = append(at.recent, recentAccountSudo{
+			SudoUser: payloadString(ev.Payload, "sudo_user"),
+			Program:  prog,
+			Ts:       ev.Ts,
+		})
+
+	case "account_change":
+		at.expireLocked(ev.Ts)
+		if payloadString(ev.Payload, "actor") != "" {
+			return
+		}
+		// El sudo más reciente del mismo programa o de un envoltorio
+		prog := payloadString(ev.Payload, "program")
+		for i := len(at.recent) - 1; i >= 0; i-- {
+			r := at.recent[i]
+			if r.Program == prog || accountWrapperPrograms[r.Program] {
+				ev.Payload["actor"] = r.SudoUser
+				ev.Payload["actor_source"] = "sudo"
+				return
+			}
+		}
+	}
+}
+
+func (at *AccountActorTracker) expireLocked(now time.Time) {
+	keep := at.recent[:0]
+	for _, r := range at.recent {
+		if now.Sub(r.Ts) <= accountActorWindow {
+			keep = append(keep, r)
+		}
+	}
+	at.recent = keep
+}
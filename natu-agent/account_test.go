@@ -0,0 +1,101 @@
+package main
+
+import "testing"
+
+func TestParseAccountMessage(t *testing.T) {
+	const ts = "2025-12-08T08:54:37.490977+00:00 isov3 "
+	checkParse(t, []parseCase{
+		{
+			name:     "alta de usuario",
+			line:     ts + "useradd[4321]: new user: name=deploy, UID=1001, GID=1001, home=/home/deploy, shell=/bin/bash, from=/dev/pts/0",
+			wantType: "account_change", severity: 4,
+			want: map[string]interface{}{"change_type": "user_created", "target": "deploy", "is_root": false, "uid": 1001, "gid": 1001, "home": "/home/deploy", "shell": "/bin/bash", "program": "useradd"},
+		},
+		{
+			name:     "alta de usuario con UID 0",
+			line:     ts + "useradd[4322]: new user: name=toor, UID=0, GID=0, home=/root, shell=/bin/bash, from=none",
+			wantType: "account_change", severity: 5,
+			want: map[string]interface{}{"change_type": "user_created", "target": "toor", "uid": 0},
+		},
+		{
+			name:     "alta de grupo",
+			line:     ts + "useradd[4321]: new group: name=deploy, GID=1001",
+			wantType: "account_change", severity: 2,
+			want: map[string]interface{}{"change_type": "group_created", "group": "deploy", "gid": 1001, "target": nil},
+		},
+		{
+			name:     "usuario añadido a un grupo",
+			line:     ts + "usermod[4400]: add 'deploy' to group 'sudo'",
+			wantType: "account_change", severity: 3,
+			want: map[string]interface{}{"change_type": "group_member_added", "target": "deploy", "group": "sudo", "actor": nil},
+		},
+		{
+			name: "la copia en gshadow no se repite",
+			line: ts + "usermod[4400]: add 'deploy' to shadow group 'sudo'",
+		},
+		{
+			name:     "usuario quitado de un grupo",
+			line:     ts + "usermod[4401]: delete 'deploy' from group 'docker'",
+			wantType: "account_change",
+			want:     map[string]interface{}{"change_type": "group_member_removed", "target": "deploy", "group": "docker"},
+		},
+		{
+			name:     "gpasswd registra quién quita",
+			line:     ts + "gpasswd[4500]: user deploy removed by root from group sudo",
+			wantType: "account_change", severity: 2,
+			want: map[string]interface{}{"change_type": "group_member_removed", "target": "deploy", "group": "sudo", "actor": "root", "actor_source": "log"},
+		},
+		{
+			name:     "gpasswd fija los miembros",
+			line:     ts + "gpasswd[4501]: members of group docker set by root to alice,bob",
+			wantType: "account_change", severity: 3,
+			want: map[string]interface{}{"change_type": "group_members_set", "group": "docker", "actor": "root", "members": "alice,bob"},
+		},
+		{
+			name:     "baja de usuario",
+			line:     ts + "userdel[4600]: delete user 'deploy'",
+			wantType: "account_change", severity: 3,
+			want: map[string]interface{}{"change_type": "user_deleted", "target": "deploy"},
+		},
+		{
+			name:     "userdel borra el grupo propio",
+			line:     ts + "userdel[4600]: removed group 'deploy' owned by 'deploy'",
+			wantType: "account_change",
+			want:     map[string]interface{}{"change_type": "group_deleted", "group": "deploy"},
+		},
+		{
+			name:     "baja de grupo",
+			line:     ts + "groupdel[4601]: group 'oldteam' removed",
+			wantType: "account_change",
+			want:     map[string]interface{}{"change_type": "group_deleted", "group": "oldteam"},
+		},
+		{
+			name:     "cuenta que pasa a UID 0",
+			line:     ts + "usermod[4700]: change user 'svc' UID from '1002' to '0'",
+			wantType: "account_change", severity: 5,
+			want: map[string]interface{}{"change_type": "user_modified", "target": "svc", "detail": "change user 'svc' UID from '1002' to '0'"},
+		},
+		{
+			name:     "bloqueo de cuenta",
+			line:     ts + "usermod[4701]: lock user 'bob' password",
+			wantType: "account_change", severity: 2,
+			want: map[string]interface{}{"change_type": "user_modified", "target": "bob"},
+		},
+		{
+			name:     "cambio de contraseña con passwd",
+			line:     ts + "passwd[4800]: pam_unix(passwd:chauthtok): password changed for alice",
+			wantType: "account_change",
+			want:     map[string]interface{}{"change_type": "password_changed", "target": "alice", "program": "passwd"},
+		},
+		{
+			name:     "cambio de contraseña con chpasswd",
+			line:     ts + "chpasswd[4801]: pam_unix(chpasswd:chauthtok): password changed for root",
+			wantType: "account_change",
+			want:     map[string]interface{}{"change_type": "password_changed", "target": "root", "is_root": true},
+		},
+		{
+			name: "error de useradd",
+			line: ts + "useradd[4323]: failed adding user 'x', data deleted",
+		},
+	})
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ----------------------------
+// Acciones remotas (ban / unban)
+// ----------------------------
+//
+// Con actions.enabled el agente pregunta cada poll_seconds a natu-core si hay
+// acciones para este host, las ejecuta con fail2ban-client o ipset y devuelve
+// el resultado. Los comandos se lanzan sin shell y con la IP y la jail ya
+// validadas; sólo se aceptan los métodos de actions.methods. Si el envío del
+// resultado falla se reintenta en la siguiente vuelta. Con fleet_opt_out el
+// host no recibe los bans federados desde otros hosts.
+
+type RemoteAction struct {
+	ID         int64  `json:"id"`
+	Action     string `json:"action"`
+	IP         string `json:"ip"`
+	Jail       string `json:"jail"`
+	Method     string `json:"method"`
+	IpsetSet   string `json:"ipset_set,omitempty"`
+	TTLSeconds *int   `json:"ttl_seconds,omitempty"`
+}
+
+type RemoteActionResult struct {
+	ActionID int64  `json:"action_id"`
+	Success  bool   `json:"success"`
+	Output   string `json:"output"`
+}
+
+type actionPollRequest struct {
+	AgentSecret string `json:"agent_secret"`
+	Hostname    string `json:"hostname"`
+	FleetOptOut bool   `json:"fleet_opt_out"`
+}
+
+type actionPollResponse struct {
+	Actions []RemoteAction `json:"actions"`
+}
+
+type actionResultRequest struct {
+	AgentSecret string               `json:"agent_secret"`
+	Hostname    string               `json:"hostname"`
+	Results     []RemoteActionResult `json:"results"`
+}
+
+var reActionName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+func startActionLoop(hostname string) {
+	var unsent []RemoteActionResult
+
+	for {
+		cfg := activeConfig.Load()
+		if cfg.Actions.Enabled {
+			conn := activeServer.Load()
+
+			actions, err := pollActions(conn, hostname, cfg.Actions.FleetOptOut)
+			if err != nil {
+				log.Printf("error consultando acciones remotas: %v", err)
+			}
+			for _, a := range actions {
+				res := executeAction(cfg.Actions, a)
+				if res.Success {
+					log.Printf("Acción remota #%d ejecutada: %s %s (%s)", a.ID, a.Action, a.IP, a.Method)
+				} else {
+					log.Printf("⚠️  Acción remota #%d falló: %s", a.ID, res.Output)
+				}
+				unsent = append(unsent, res)
+			}
+
+			if len(unsent) > 0 {
+				if err := postActionResults(conn, hostname, unsent); err != nil {
+					log.Printf("error enviando resultados de acciones (%d pendientes): %v", len(unsent), err)
+				} else {
+					unsent = nil
+				}
+			}
+		}
+
+		time.Sleep(time.Duration(cfg.Actions.PollSeconds) * time.Second)
+	}
+}
+
+func pollActions(conn *serverConn, hostname string, fleetOptOut bool) ([]RemoteAction, error) {
+	b, err := json.Marshal(actionPollRequest{AgentSecret: conn.secret, Hostname: hostname, FleetOptOut: fleetOptOut})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := conn.client.Post(conn.url+"/api/v1/agent/actions/poll", "application/json", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http %d", resp.StatusCode)
+	}
+
+	var out actionPollResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("respuesta inválida: %w", err)
+	}
+	return out.Actions, nil
+}
+
+func postActionResults(conn *serverConn, hostname string, results []RemoteActionResult) error {
+	b, err := json.Marshal(actionResultRequest{AgentSecret: conn.secret, Hostname: hostname, Results: results})
+	if err != nil {
+		return err
+	}
+
+	resp, err := conn.client.Post(conn.url+"/api/v1/agent/actions/result", "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("http %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// executeAction valida la acción y lanza el comando correspondiente.
+func executeAction(ac ActionsConfig, a RemoteAction) RemoteActionResult {
+	res := RemoteActionResult{ActionID: a.ID}
+
+	cmd, err := actionCommand(ac, a)
+	if err != nil {
+		res.Output = err.Error()
+		return res
+	}
+
+	out, err := cmd.CombinedOutput()
+	res.Output = strings.TrimSpace(string(out))
+	if err != nil {
+		if res.Output != "" {
+			res.Output += ": "
+		}
+		res.Output += err.Error()
+		return res
+	}
+	res.Success = true
+	return res
+}
+
+func actionCommand(ac ActionsConfig, a RemoteAction) (*exec.Cmd, error) {
+	if a.Action != "ban" && a.Action != "unban" {
+		return nil, fmt.Errorf("acción %q desconocida", a.Action)
+	}
+	if net.ParseIP(a.IP) == nil {
+		if _, _, err := net.ParseCIDR(a.IP); err != nil {
+			return nil, fmt.Errorf("ip %q inválida", a.IP)
+		}
+	}
+
+	allowed := false
+	for _, m := range ac.Methods {
+		if m == a.Method {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return nil, fmt.Errorf("método %q no permitido en este agente (actions.methods)", a.Method)
+	}
+
+	switch a.Method {
+	case "fail2ban":
+		if !reActionName.MatchString(a.Jail) {
+			return nil, fmt.Errorf("jail %q inválida", a.Jail)
+		}
+		verb := "banip"
+		if a.Action == "unban" {
+			verb = "unbanip"
+		}
+		return exec.Command(fail2banClientPath, "set", a.Jail, verb, a.IP), nil
+
+	case "ipset":
+		if !reActionName.MatchString(a.IpsetSet) {
+			return nil, fmt.Errorf("set %q inválido", a.IpsetSet)
+		}
+		if a.Action == "unban" {
+			return exec.Command(ipsetPath, "del", a.IpsetSet, a.IP, "-exist"), nil
+		}
+		args := []string{"add", a.IpsetSet, a.IP, "-exist"}
+		if a.TTLSeconds != nil && *a.TTLSeconds > 0 {
+			args = append(args, "timeout", strconv.Itoa(*a.TTLSeconds))
+		}
+		return exec.Command(ipsetPath, args...), nil
+	}
+	return nil, fmt.Errorf("método %q desconocido", a.Method)
+}
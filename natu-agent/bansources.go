@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ----------------------------
+// Fuentes de bans: ipset y nftables
+// ----------------------------
+//
+// Además de preguntar a fail2ban, el agente puede leer directamente los sets
+// del firewall (bans.sources en la configuración). Así aparecen también las
+// IPs añadidas a mano o por otras herramientas. Cada miembro de un set se
+// etiqueta como "ipset:<set>" o "nft:<family>/<table>/<set>"; si la IP ya la
+// tiene baneada fail2ban se anota el set en ese ban (sets) en lugar de
+// duplicarla, y si no se crea un ban propio con esa etiqueta como jail.
+
+const (
+	ipsetPath = "/usr/sbin/ipset"
+	nftPath   = "/usr/sbin/nft"
+)
+
+// setMember es una IP (o red) presente en un set del firewall. Timeout es el
+// tiempo restante; nil si la entrada es permanente.
+type setMember struct {
+	IP      string
+	Timeout *int64
+}
+
+func ipsetLabel(name string) string {
+	return "ipset:" + name
+}
+
+func nftLabel(ref NftSetRef) string {
+	return "nft:" + ref.Family + "/" + ref.Table + "/" + ref.Name
+}
+
+// collectIpsetBans lee un set con "ipset list -o xml" y, si esa salida no
+// está disponible o no se entiende, con "ipset save".
+func collectIpsetBans(name string) ([]setMember, error) {
+	out, err := exec.Command(ipsetPath, "list", "-o", "xml", name).Output()
+	if err == nil {
+		if members, perr := parseIpsetXML(out, name); perr == nil {
+			return members, nil
+		}
+	}
+
+	out, err = exec.Command(ipsetPath, "save", name).Output()
+	if err != nil {
+		return nil, fmt.Errorf("ipset save %s: %w", name, err)
+	}
+	return parseIpsetSave(string(out), name), nil
+}
+
+type ipsetXML struct {
+	Sets []struct {
+		Name    string `xml:"name,attr"`
+		Members []struct {
+			Elem    string `xml:"elem"`
+			Timeout *int64 `xml:"timeout"`
+		} `xml:"members>member"`
+	} `xml:"ipset"`
+}
+
+func parseIpsetXML(out []byte, name string) ([]setMember, error) {
+	var doc ipsetXML
+	if err := xml.Unmarshal(out, &doc); err != nil {
+		return nil, fmt.Errorf("ipset %s: XML inválido: %w", name, err)
+	}
+
+	members := []setMember{}
+	for _, set := range doc.Sets {
+		if set.Name != name {
+			continue
+		}
+		for _, m := range set.Members {
+			ip := normalizeSetElem(m.Elem)
+			if ip == "" {
+				continue
+			}
+			members = append(members, setMember{IP: ip, Timeout: positiveTimeout(m.Timeout)})
+		}
+	}
+	return members, nil
+}
+
+// parseIpsetSave lee líneas "add ssh-banned 1.2.3.4 timeout 593".
+func parseIpsetSave(out, name string) []setMember {
+	members := []setMember{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "add" || fields[1] != name {
+			continue
+		}
+		ip := normalizeSetElem(fields[2])
+		if ip == "" {
+			continue
+		}
+
+		m := setMember{IP: ip}
+		for i := 3; i+1 < len(fields); i++ {
+			if fields[i] != "timeout" {
+				continue
+			}
+			if n, err := strconv.ParseInt(fields[i+1], 10, 64); err == nil {
+				m.Timeout = positiveTimeout(&n)
+			}
+		}
+		members = append(members, m)
+	}
+	return members
+}
+
+// collectNftBans lee un set con nombre con "nft -j list set".
+func collectNftBans(ref NftSetRef) ([]setMember, error) {
+	out, err := exec.Command(nftPath, "-j", "list", "set", ref.Family, ref.Table, ref.Name).Output()
+	if err != nil {
+		return nil, fmt.Errorf("nft list set %s: %w", ref.String(), err)
+	}
+	return parseNftSet(out, ref)
+}
+
+type nftJSON struct {
+	Nftables []struct {
+		Set *struct {
+			Family string            `json:"family"`
+			Table  string            `json:"table"`
+			Name   string            `json:"name"`
+			Elem   []json.RawMessage `json:"elem"`
+		} `json:"set"`
+	} `json:"nftables"`
+}
+
+// parseNftSet entiende los elementos simples ("1.2.3.4"), con timeout
+// ({"elem": {"val": ..., "timeout": 600, "expires": 593}}) y prefijos
+// ({"prefix": {"addr": ..., "len": 24}}). Rangos y concatenaciones se ignoran.
+func parseNftSet(out []byte, ref NftSetRef) ([]setMember, error) {
+	var doc nftJSON
+	if err := json.Unmarshal(out, &doc); err != nil {
+		return nil, fmt.Errorf("nft %s: JSON inválido: %w", ref.String(), err)
+	}
+
+	members := []setMember{}
+	for _, obj := range doc.Nftables {
+		if obj.Set == nil || obj.Set.Name != ref.Name || obj.Set.Table != ref.Table {
+			continue
+		}
+		for _, raw := range obj.Set.Elem {
+			var wrapped struct {
+				Elem *struct {
+					Val     json.RawMessage `json:"val"`
+					Expires *int64          `json:"expires"`
+				} `json:"elem"`
+			}
+			m := setMember{}
+			if err := json.Unmarshal(raw, &wrapped); err == nil && wrapped.Elem != nil {
+				m.IP = nftElemAddr(wrapped.Elem.Val)
+				m.Timeout = positiveTimeout(wrapped.Elem.Expires)
+			} else {
+				m.IP = nftElemAddr(raw)
+			}
+			if m.IP == "" {
+				continue
+			}
+			members = append(members, m)
+		}
+	}
+	return members, nil
+}
+
+func nftElemAddr(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return normalizeSetElem(s)
+	}
+
+	var p struct {
+		Prefix *struct {
+			Addr string `json:"addr"`
+			Len  int    `json:"len"`
+		} `json:"prefix"`
+	}
+	if err := json.Unmarshal(raw, &p); err == nil && p.Prefix != nil && p.Prefix.Addr != "" {
+		return p.Prefix.Addr + "/" + strconv.Itoa(p.Prefix.Len)
+	}
+	return ""
+}
+
+// normalizeSetElem quita la parte de puerto/interfaz de sets tipo hash:ip,port.
+func normalizeSetElem(elem string) string {
+	elem = strings.TrimSpace(elem)
+	if i := strings.IndexByte(elem, ','); i >= 0 {
+		elem = elem[:i]
+	}
+	return elem
+}
+
+// positiveTimeout: 0 o ausente significa entrada permanente.
+func positiveTimeout(t *int64) *int64 {
+	if t == nil || *t <= 0 {
+		return nil
+	}
+	v := *t
+	return &v
+}
+
+// mergeSetBans añade los miembros de un set al listado. Si fail2ban ya tiene
+// la IP se anota el set y el tiempo restante en sus bans; si no, se crea un
+// ban con la etiqueta del set como jail.
+func mergeSetBans(bans []SSHBan, source, label string, members []setMember, now time.Time) []SSHBan {
+	for _, m := range members {
+		var expiresAt *time.Time
+		if m.Timeout != nil {
+			t := now.Add(time.Duration(*m.Timeout) * time.Second)
+			expiresAt = &t
+		}
+
+		found := false
+		for i := range bans {
+			b := &bans[i]
+			if b.IP != m.IP {
+				continue
+			}
+			if b.Jail == label {
+				found = true
+				continue
+			}
+			if b.Source != "fail2ban" {
+				continue
+			}
+			found = true
+			b.Sets = append(b.Sets, label)
+			if b.TimeoutSeconds == nil && m.Timeout != nil {
+				b.TimeoutSeconds = m.Timeout
+				b.ExpiresAt = expiresAt
+			}
+		}
+		if found {
+			continue
+		}
+
+		bans = append(bans, SSHBan{
+			IP:             m.IP,
+			Jail:           label,
+			Source:         source,
+			Reason:         "set member",
+			TimeoutSeconds: m.Timeout,
+			ExpiresAt:      expiresAt,
+			Sets:           []string{label},
+		})
+	}
+	return bans
+}
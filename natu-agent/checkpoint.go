@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ----------------------------
+// Checkpoints de lectura
+// ----------------------------
+//
+// Guardamos por cada fichero seguido el inode, el offset ya consumido y el
+// hash de la última línea procesada (y si no tenía '\n' final, cuando se
+// entregó al rotar el fichero). Con eso, al reiniciar sabemos si el fichero
+// es el mismo, si lo truncaron o si logrotate lo movió a auth.log.1.
+// Para journald basta con el cursor de la última entrada.
+
+type Checkpoint struct {
+	Inode        uint64    `json:"inode,omitempty"`
+	Offset       int64     `json:"offset,omitempty"`
+	LastLineHash string    `json:"last_line_hash,omitempty"`
+	PartialLine  bool      `json:"partial_line,omitempty"`
+	Cursor       string    `json:"cursor,omitempty"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+type CheckpointStore struct {
+	path string
+
+	mu   sync.Mutex
+	data map[string]Checkpoint
+}
+
+func OpenCheckpointStore(dir string) (*CheckpointStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creando directorio de estado %s: %w", dir, err)
+	}
+
+	cs := &CheckpointStore{
+		path: filepath.Join(dir, "checkpoints.json"),
+		data: make(map[string]Checkpoint),
+	}
+
+	b, err := os.ReadFile(cs.path)
+	if os.IsNotExist(err) {
+		return cs, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("leyendo checkpoints: %w", err)
+	}
+	if err := json.Unmarshal(b, &cs.data); err != nil {
+		return nil, fmt.Errorf("checkpoints corruptos en %s: %w", cs.path, err)
+	}
+	return cs, nil
+}
+
+func (cs *CheckpointStore) Get(key string) (Checkpoint, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cp, ok := cs.data[key]
+	return cp, ok
+}
+
+// Set actualiza el checkpoint en memoria y lo persiste en disco.
+func (cs *CheckpointStore) Set(key string, cp Checkpoint) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cp.UpdatedAt = time.Now().UTC()
+	cs.data[key] = cp
+
+	b, err := json.MarshalIndent(cs.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(cs.path, b)
+}
+
+// writeFileAtomic escribe en un temporal, hace fsync y renombra, para que un
+// crash nunca deje el fichero de estado a medias.
+func writeFileAtomic(path string, b []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func lineHash(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ----------------------------
+// Configuración del agente
+// ----------------------------
+//
+// La configuración sale de un fichero JSON (--config, NATU_AGENT_CONFIG o
+// /etc/natu-agent/agent.json) sobre los valores por defecto, y las variables
+// de entorno NATU_* de siempre pisan al fichero. Con SIGHUP se vuelve a leer:
+// servidor, TLS, fuentes de bans, acciones, batching, labels y reglas se
+// aplican en caliente; las entradas, el directorio de estado y el puerto HTTP
+// requieren reiniciar. La posición de lectura de auth.log/journald no se toca
+// al recargar.
+
+const defaultConfigPath = "/etc/natu-agent/agent.json"
+
+const (
+	defaultAuthLogPath     = "/var/log/auth.log"
+	defaultFail2banLogPath = "/var/log/fail2ban.log"
+)
+
+type AgentConfig struct {
+	Hostname  string            `json:"hostname,omitempty"`
+	StateDir  string            `json:"state_dir"`
+	RulesFile string            `json:"rules_file"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Server    ServerConfig      `json:"server"`
+	Inputs    InputsConfig      `json:"inputs"`
+	HTTP      HTTPConfig        `json:"http"`
+	Bans      BansConfig        `json:"bans"`
+	Batching  BatchingConfig    `json:"batching"`
+	Actions   ActionsConfig     `json:"actions"`
+}
+
+type ServerConfig struct {
+	URL            string    `json:"url"`
+	Secret         string    `json:"secret"`
+	TimeoutSeconds int       `json:"timeout_seconds"`
+	TLS            TLSConfig `json:"tls"`
+}
+
+type TLSConfig struct {
+	CAFile             string `json:"ca_file,omitempty"`
+	CertFile           string `json:"cert_file,omitempty"`
+	KeyFile            string `json:"key_file,omitempty"`
+	ServerName         string `json:"server_name,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
+}
+
+type InputsConfig struct {
+	// auto | file | journald
+	Auth        string `json:"auth"`
+	AuthLog     string `json:"auth_log"`
+	Fail2banLog string `json:"fail2ban_log"`
+}
+
+type HTTPConfig struct {
+	Addr string `json:"addr"`
+}
+
+type BansConfig struct {
+	SyncSeconds int `json:"sync_seconds"`
+	// fail2ban | ipset | nft; se combinan en un único listado
+	Sources []string `json:"sources"`
+	// Vacío: todas las jails que liste fail2ban-client status
+	Jails     []string    `json:"jails"`
+	IpsetSets []string    `json:"ipset_sets"`
+	NftSets   []NftSetRef `json:"nft_sets"`
+}
+
+func (b BansConfig) uses(source string) bool {
+	for _, s := range b.Sources {
+		if s == source {
+			return true
+		}
+	}
+	return false
+}
+
+// NftSetRef identifica un set con nombre de nftables.
+type NftSetRef struct {
+	Family string `json:"family"`
+	Table  string `json:"table"`
+	Name   string `json:"name"`
+}
+
+func (r NftSetRef) String() string {
+	return r.Family + " " + r.Table + " " + r.Name
+}
+
+// Acciones remotas (ban/unban pedidos desde natu-core). Desactivadas salvo
+// que se habiliten explícitamente.
+type ActionsConfig struct {
+	Enabled     bool `json:"enabled"`
+	PollSeconds int  `json:"poll_seconds"`
+	// fail2ban | ipset
+	Methods []string `json:"methods"`
+	// No recibir los bans federados de la flota (se sigue contando como origen)
+	FleetOptOut bool `json:"fleet_opt_out"`
+}
+
+type BatchingConfig struct {
+	SpoolDir     string `json:"spool_dir,omitempty"`
+	BatchSize    int    `json:"batch_size"`
+	BatchSeconds int    `json:"batch_seconds"`
+	SpoolMaxMB   int    `json:"spool_max_mb"`
+}
+
+// Configuración en uso; se sustituye entera al recargar
+var activeConfig atomic.Pointer[AgentConfig]
+
+func defaultAgentConfig() *AgentConfig {
+	return &AgentConfig{
+		StateDir:  "/var/lib/natu-agent",
+		RulesFile: defaultRulesPath,
+		Server: ServerConfig{
+			URL:            "http://127.0.0.1:5010",
+			TimeoutSeconds: 5,
+		},
+		Inputs: InputsConfig{
+			Auth:        "auto",
+			AuthLog:     defaultAuthLogPath,
+			Fail2banLog: defaultFail2banLogPath,
+		},
+		HTTP: HTTPConfig{Addr: ":5011"},
+		Bans: BansConfig{
+			SyncSeconds: 60,
+			Sources:     []string{"fail2ban"},
+			IpsetSets:   []string{"ssh-banned"},
+		},
+		Batching: BatchingConfig{
+			BatchSize:    200,
+			BatchSeconds: 2,
+			SpoolMaxMB:   512,
+		},
+		Actions: ActionsConfig{
+			PollSeconds: 15,
+			Methods:     []string{"fail2ban", "ipset"},
+		},
+	}
+}
+
+// configPathFromEnv es la ruta por defecto cuando no se pasa --config.
+func configPathFromEnv() string {
+	if v := os.Getenv("NATU_AGENT_CONFIG"); v != "" {
+		return v
+	}
+	return defaultConfigPath
+}
+
+// LoadConfig lee el fichero, aplica las variables de entorno y valida. Si el
+// fichero no existe y no se pidió explícitamente se usan sólo defaults + env,
+// como antes de que existiera el fichero.
+func LoadConfig(path string, explicit bool) (*AgentConfig, error) {
+	cfg := defaultAgentConfig()
+
+	b, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err) && !explicit:
+	case err != nil:
+		return nil, fmt.Errorf("leyendo configuración %s: %w", path, err)
+	default:
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(cfg); err != nil {
+			return nil, fmt.Errorf("configuración %s: JSON inválido: %w", path, err)
+		}
+	}
+
+	cfg.applyEnv()
+	if cfg.Hostname == "" {
+		cfg.Hostname, _ = os.Hostname()
+		if cfg.Hostname == "" {
+			cfg.Hostname = "unknown"
+		}
+	}
+	if cfg.Batching.SpoolDir == "" {
+		cfg.Batching.SpoolDir = filepath.Join(cfg.StateDir, "spool")
+	}
+
+	if problems := cfg.validate(); len(problems) > 0 {
+		return nil, fmt.Errorf("configuración %s inválida:\n  %s", path, strings.Join(problems, "\n  "))
+	}
+	return cfg, nil
+}
+
+func (cfg *AgentConfig) applyEnv() {
+	envString := func(name string, dst *string) {
+		if v := os.Getenv(name); v != "" {
+			*dst = v
+		}
+	}
+	envInt := func(name string, dst *int) {
+		if v := os.Getenv(name); v != "" {
+			if iv, err := strconv.Atoi(v); err == nil {
+				*dst = iv
+			}
+		}
+	}
+
+	envString("NATU_SERVER_URL", &cfg.Server.URL)
+	envString("NATU_AGENT_SECRET", &cfg.Server.Secret)
+	envString("NATU_AGENT_HTTP_ADDR", &cfg.HTTP.Addr)
+	envString("NATU_AGENT_STATE_DIR", &cfg.StateDir)
+	envString("NATU_AGENT_RULES_FILE", &cfg.RulesFile)
+	envString("NATU_AGENT_INPUT", &cfg.Inputs.Auth)
+	envString("NATU_AGENT_SPOOL_DIR", &cfg.Batching.SpoolDir)
+	envInt("NATU_AGENT_BAN_SYNC_SECONDS", &cfg.Bans.SyncSeconds)
+	envInt("NATU_AGENT_BATCH_SIZE", &cfg.Batching.BatchSize)
+	envInt("NATU_AGENT_BATCH_SECONDS", &cfg.Batching.BatchSeconds)
+	envInt("NATU_AGENT_SPOOL_MAX_MB", &cfg.Batching.SpoolMaxMB)
+	if v := os.Getenv("NATU_AGENT_BAN_SOURCES"); v != "" {
+		cfg.Bans.Sources = nil
+		for _, src := range strings.Split(v, ",") {
+			if src = strings.TrimSpace(src); src != "" {
+				cfg.Bans.Sources = append(cfg.Bans.Sources, src)
+			}
+		}
+	}
+	cfg.Inputs.Auth = strings.ToLower(cfg.Inputs.Auth)
+}
+
+func (cfg *AgentConfig) validate() []string {
+	var problems []string
+
+	if cfg.Server.Secret == "" {
+		problems = append(problems, "server.secret vacío (o NATU_AGENT_SECRET no definido)")
+	}
+	if u, err := url.Parse(cfg.Server.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problems = append(problems, fmt.Sprintf("server.url %q inválida (use http:// o https://)", cfg.Server.URL))
+	}
+	if cfg.Server.TimeoutSeconds < 1 || cfg.Server.TimeoutSeconds > 120 {
+		problems = append(problems, "server.timeout_seconds fuera de rango (1-120)")
+	}
+	if _, err := cfg.Server.TLS.build(); err != nil {
+		problems = append(problems, "server.tls: "+err.Error())
+	}
+
+	switch cfg.Inputs.Auth {
+	case "auto", "file", "journald":
+	default:
+		problems = append(problems, fmt.Sprintf("inputs.auth %q inválido (use auto, file o journald)", cfg.Inputs.Auth))
+	}
+	if cfg.Inputs.AuthLog == "" {
+		problems = append(problems, "inputs.auth_log vacío")
+	}
+	if cfg.StateDir == "" {
+		problems = append(problems, "state_dir vacío")
+	}
+	if cfg.HTTP.Addr == "" {
+		problems = append(problems, "http.addr vacío")
+	}
+
+	if cfg.Bans.SyncSeconds < 15 {
+		problems = append(problems, "bans.sync_seconds debe ser >= 15")
+	}
+	for _, j := range cfg.Bans.Jails {
+		if j == "" || strings.ContainsAny(j, " \t/") {
+			problems = append(problems, fmt.Sprintf("bans.jails: nombre de jail %q inválido", j))
+		}
+	}
+	if len(cfg.Bans.Sources) == 0 {
+		problems = append(problems, "bans.sources vacío (use fail2ban, ipset y/o nft)")
+	}
+	seenSources := map[string]bool{}
+	for _, src := range cfg.Bans.Sources {
+		switch src {
+		case "fail2ban", "ipset", "nft":
+		default:
+			problems = append(problems, fmt.Sprintf("bans.sources: fuente %q inválida (use fail2ban, ipset o nft)", src))
+		}
+		if seenSources[src] {
+			problems = append(problems, fmt.Sprintf("bans.sources: fuente %q repetida", src))
+		}
+		seenSources[src] = true
+	}
+	if seenSources["ipset"] && len(cfg.Bans.IpsetSets) == 0 {
+		problems = append(problems, "bans.ipset_sets vacío con la fuente ipset activa")
+	}
+	for _, name := range cfg.Bans.IpsetSets {
+		if name == "" || strings.ContainsAny(name, " \t/") {
+			problems = append(problems, fmt.Sprintf("bans.ipset_sets: nombre de set %q inválido", name))
+		}
+	}
+	if seenSources["nft"] && len(cfg.Bans.NftSets) == 0 {
+		problems = append(problems, "bans.nft_sets vacío con la fuente nft activa")
+	}
+	for _, ns := range cfg.Bans.NftSets {
+		switch ns.Family {
+		case "ip", "ip6", "inet", "arp", "bridge", "netdev":
+		default:
+			problems = append(problems, fmt.Sprintf("bans.nft_sets: family %q inválida en %q", ns.Family, ns.String()))
+		}
+		if ns.Table == "" || ns.Name == "" || strings.ContainsAny(ns.Table+ns.Name, " \t/") {
+			problems = append(problems, fmt.Sprintf("bans.nft_sets: table/name inválidos en %q", ns.String()))
+		}
+	}
+
+	if cfg.Batching.BatchSize < 1 || cfg.Batching.BatchSize > 5000 {
+		problems = append(problems, "batching.batch_size fuera de rango (1-5000)")
+	}
+	if cfg.Batching.BatchSeconds < 1 || cfg.Batching.BatchSeconds > 300 {
+		problems = append(problems, "batching.batch_seconds fuera de rango (1-300)")
+	}
+	if cfg.Batching.SpoolMaxMB < 1 {
+		problems = append(problems, "batching.spool_max_mb debe ser >= 1")
+	}
+
+	if cfg.Actions.PollSeconds < 5 || cfg.Actions.PollSeconds > 3600 {
+		problems = append(problems, "actions.poll_seconds fuera de rango (5-3600)")
+	}
+	for _, m := range cfg.Actions.Methods {
+		if m != "fail2ban" && m != "ipset" {
+			problems = append(problems, fmt.Sprintf("actions.methods: método %q inválido (use fail2ban o ipset)", m))
+		}
+	}
+
+	for k := range cfg.Labels {
+		if k == "" || strings.ContainsAny(k, " \t") {
+			problems = append(problems, fmt.Sprintf("labels: clave %q inválida", k))
+		}
+	}
+	return problems
+}
+
+// build arma el tls.Config del cliente. nil significa TLS por defecto.
+func (t TLSConfig) build() (*tls.Config, error) {
+	if t == (TLSConfig{}) {
+		return nil, nil
+	}
+
+	tc := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("leyendo ca_file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca_file %s no contiene certificados PEM", t.CAFile)
+		}
+		tc.RootCAs = pool
+	}
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return nil, fmt.Errorf("cert_file y key_file van juntos")
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cargando certificado cliente: %w", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
+
+func (cfg *AgentConfig) spoolConfig() SpoolConfig {
+	return SpoolConfig{
+		Dir:          cfg.Batching.SpoolDir,
+		BatchSize:    cfg.Batching.BatchSize,
+		BatchMaxWait: time.Duration(cfg.Batching.BatchSeconds) * time.Second,
+		MaxBytes:     int64(cfg.Batching.SpoolMaxMB) << 20,
+		MinBackoff:   1 * time.Second,
+		MaxBackoff:   5 * time.Minute,
+	}
+}
+
+// ----------------------------
+// Conexión con natu-core
+// ----------------------------
+
+type serverConn struct {
+	client *http.Client
+	url    string
+	secret string
+}
+
+// Cliente en uso; se reconstruye al recargar la configuración
+var activeServer atomic.Pointer[serverConn]
+
+func newServerConn(sc ServerConfig) (*serverConn, error) {
+	tc, err := sc.TLS.build()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tc
+
+	return &serverConn{
+		client: &http.Client{
+			Timeout:   time.Duration(sc.TimeoutSeconds) * time.Second,
+			Transport: transport,
+		},
+		url:    strings.TrimRight(sc.URL, "/"),
+		secret: sc.Secret,
+	}, nil
+}
+
+// applyConfig publica la configuración y el cliente nuevos. Devuelve los
+// cambios que no se aplican hasta reiniciar, para avisar en el log.
+func applyConfig(cfg *AgentConfig, spool *Spool) ([]string, error) {
+	conn, err := newServerConn(cfg.Server)
+	if err != nil {
+		return nil, err
+	}
+
+	var restart []string
+	if old := activeConfig.Load(); old != nil {
+		if old.Hostname != cfg.Hostname {
+			restart = append(restart, "hostname")
+		}
+		if old.StateDir != cfg.StateDir {
+			restart = append(restart, "state_dir")
+		}
+		if old.Inputs != cfg.Inputs {
+			restart = append(restart, "inputs")
+		}
+		if old.HTTP != cfg.HTTP {
+			restart = append(restart, "http")
+		}
+		if old.Batching.SpoolDir != cfg.Batching.SpoolDir {
+			restart = append(restart, "batching.spool_dir")
+		}
+		if !reflect.DeepEqual(old.Labels, cfg.Labels) {
+			log.Printf("labels actualizadas: %v", cfg.Labels)
+		}
+	}
+
+	activeServer.Store(conn)
+	activeConfig.Store(cfg)
+	if spool != nil {
+		spool.SetLimits(cfg.spoolConfig())
+	}
+	return restart, nil
+}
+
+// ReloadConfig vuelve a leer la configuración; si no es válida se mantiene
+// la actual.
+func ReloadConfig(path string, explicit bool, spool *Spool) bool {
+	cfg, err := LoadConfig(path, explicit)
+	if err != nil {
+		log.Printf("⚠️  %v (se mantiene la configuración anterior)", err)
+		return false
+	}
+	restart, err := applyConfig(cfg, spool)
+	if err != nil {
+		log.Printf("⚠️  configuración %s: %v (se mantiene la anterior)", path, err)
+		return false
+	}
+	if len(restart) > 0 {
+		log.Printf("⚠️  cambios que requieren reiniciar el agente: %s", strings.Join(restart, ", "))
+	}
+	log.Printf("Configuración recargada desde %s", path)
+	return true
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------------------------
+// fail2ban.log
+// ----------------------------
+//
+// El agente sigue fail2ban.log igual que auth.log (mismo tailer y mismos
+// checkpoints) y emite un evento por cada línea de acción:
+//
+//	2024-05-27 15:31:40,001 fail2ban.filter  [811]: INFO    [sshd] Found 172.236.228.208 - 2024-05-27 15:31:40
+//	2024-05-27 15:31:42,123 fail2ban.actions [811]: NOTICE  [sshd] Ban 172.236.228.208
+//	2024-05-27 15:35:42,321 fail2ban.actions [811]: NOTICE  [sshd] Unban 172.236.228.208
+//	2024-05-27 16:00:01,555 fail2ban.actions [811]: NOTICE  [sshd] Restore Ban 172.236.228.208
+//
+// Los bans vigentes se recuerdan en f2b_bans.json (jail|ip -> hora del ban),
+// de donde sale el banned_at de la sincronización y la duración del unban.
+
+var reF2BLine = regexp.MustCompile(`^([0-9]{4}-[0-9]{2}-[0-9]{2} [0-9]{2}:[0-9]{2}:[0-9]{2},[0-9]{3}) fail2ban\.[a-z.]+\s*(?:\[[0-9]+\])?:\s*([A-Z]+)\s+(?:\[([^\]]+)\] )?(Found|Ban|Unban|Restore Ban) ([0-9a-fA-F.:]+)`)
+
+const f2bTimeLayout = "2006-01-02 15:04:05,000"
+
+var f2bEventTypes = map[string]struct {
+	eventType string
+	severity  int
+}{
+	"Found":       {"f2b_found", 2},
+	"Ban":         {"f2b_ban", 3},
+	"Restore Ban": {"f2b_restore", 3},
+	"Unban":       {"f2b_unban", 1},
+}
+
+// parseFail2banLine devuelve nil para las líneas que no son Found/Ban/Unban.
+func parseFail2banLine(line string) *Event {
+	m := reF2BLine.FindStringSubmatch(line)
+	if m == nil {
+		return nil
+	}
+
+	ts, err := time.ParseInLocation(f2bTimeLayout, m[1], logLocation)
+	if err != nil {
+		return nil
+	}
+
+	// Las líneas antiguas de fail2ban no llevan jail: se asumen de sshd
+	jail := m[3]
+	if jail == "" {
+		jail = "sshd"
+	}
+	kind := f2bEventTypes[m[4]]
+
+	return &Event{
+		Ts:        ts.UTC(),
+		Source:    "fail2ban",
+		EventType: kind.eventType,
+		Severity:  kind.severity,
+		Payload: map[string]interface{}{
+			"jail":     jail,
+			"ip":       m[5],
+			"action":   m[4],
+			"level":    m[2],
+			"raw_line": line,
+		},
+	}
+}
+
+// ----------------------------
+// Bans vigentes según el log
+// ----------------------------
+
+// Lo comparten el tailer de fail2ban.log y la sincronización de bans
+var banTimes *BanTimeTracker
+
+type BanTimeTracker struct {
+	path string
+
+	mu   sync.Mutex
+	bans map[string]time.Time
+}
+
+func OpenBanTimeTracker(dir string) (*BanTimeTracker, error) {
+	bt := &BanTimeTracker{
+		path: filepath.Join(dir, "f2b_bans.json"),
+		bans: make(map[string]time.Time),
+	}
+
+	b, err := os.ReadFile(bt.path)
+	if os.IsNotExist(err) {
+		return bt, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("leyendo bans de fail2ban: %w", err)
+	}
+	if err := json.Unmarshal(b, &bt.bans); err != nil {
+		return nil, fmt.Errorf("bans de fail2ban corruptos en %s: %w", bt.path, err)
+	}
+	return bt, nil
+}
+
+// Observe actualiza el mapa con un evento f2b_*. En los unban añade al
+// payload la hora del ban y la duración, si se conocen.
+func (bt *BanTimeTracker) Observe(ev *Event) {
+	jail := payloadString(ev.Payload, "jail")
+	ip := payloadString(ev.Payload, "ip")
+	key := jail + "|" + ip
+
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	switch ev.EventType {
+	case "f2b_ban":
+		bt.bans[key] = ev.Ts
+	case "f2b_restore":
+		// Tras reiniciar fail2ban el ban sigue siendo el original
+		if _, ok := bt.bans[key]; !ok {
+			bt.bans[key] = ev.Ts
+		}
+	case "f2b_unban":
+		if bannedAt, ok := bt.bans[key]; ok {
+			ev.Payload["banned_at"] = bannedAt.Format(time.RFC3339)
+			ev.Payload["duration_seconds"] = int64(ev.Ts.Sub(bannedAt).Seconds())
+			delete(bt.bans, key)
+		}
+	default:
+		return
+	}
+	bt.saveLocked()
+}
+
+func (bt *BanTimeTracker) BannedAt(jail, ip string) (time.Time, bool) {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	ts, ok := bt.bans[jail+"|"+ip]
+	return ts, ok
+}
+
+// Prune olvida los bans de esas jails que fail2ban ya no tiene activos
+// (unban perdido con el agente parado o log rotado). Sólo toca los anteriores
+// a listedAt, para no borrar un ban leído del log después del listado.
+func (bt *BanTimeTracker) Prune(jails []string, active []SSHBan, listedAt time.Time) {
+	inJails := map[string]bool{}
+	for _, j := range jails {
+		inJails[j] = true
+	}
+	keep := map[string]bool{}
+	for _, b := range active {
+		keep[b.Jail+"|"+b.IP] = true
+	}
+
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	changed := false
+	for key, ts := range bt.bans {
+		jail, _, _ := strings.Cut(key, "|")
+		if inJails[jail] && !keep[key] && ts.Before(listedAt) {
+			delete(bt.bans, key)
+			changed = true
+		}
+	}
+	if changed {
+		bt.saveLocked()
+	}
+}
+
+func (bt *BanTimeTracker) saveLocked() {
+	b, err := json.MarshalIndent(bt.bans, "", "  ")
+	if err != nil {
+		return
+	}
+	if err := writeFileAtomic(bt.path, b); err != nil {
+		log.Printf("error guardando bans de fail2ban: %v", err)
+	}
+}
@@ -3,12 +3,3 @@ module natu-agent
 go 1.24.0
 
 toolchain go1.24.11
-
-require github.com/hpcloud/tail v1.0.0
-
-require (
-	github.com/fsnotify/fsnotify v1.9.0 // indirect
-	golang.org/x/sys v0.38.0 // indirect
-	gopkg.in/fsnotify.v1 v1.4.7 // indirect
-	gopkg.in/tomb.v1 v1.0.0-20141024135613-dd632973f1e7 // indirect
-)
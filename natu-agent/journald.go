@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// ----------------------------
+// Entrada journald
+// ----------------------------
+//
+// Para hosts sin /var/log/auth.log seguimos `journalctl -o json --follow`
+// filtrando por SYSLOG_IDENTIFIER. Cada entrada se convierte en el mismo
+// authEntry que produce una línea de auth.log, así que el parseo y los
+// eventos resultantes son idénticos. El __CURSOR de la última entrada
+// procesada se guarda como checkpoint para reanudar sin huecos.
+
+const journalctlPath = "/usr/bin/journalctl"
+
+const journaldCheckpointKey = "journald"
+
+// Identificadores de syslog que nos interesan del journal
+var journaldIdentifiers = []string{
+	"sshd",
+	"sshd-session",
+	"sudo",
+	"su",
+	"useradd",
+	"usermod",
+	"userdel",
+	"groupadd",
+	"groupdel",
+	"groupmod",
+	"gpasswd",
+	"chpasswd",
+	"passwd",
+}
+
+type JournaldReader struct {
+	store   *CheckpointStore
+	restart chan struct{}
+
+	cursor   string
+	lastSave time.Time
+	dirty    bool
+}
+
+func NewJournaldReader(store *CheckpointStore) *JournaldReader {
+	jr := &JournaldReader{store: store, restart: make(chan struct{}, 1)}
+	if cp, ok := store.Get(journaldCheckpointKey); ok {
+		jr.cursor = cp.Cursor
+	}
+	return jr
+}
+
+func (jr *JournaldReader) args() []string {
+	args := []string{"-o", "json", "--follow", "--no-pager"}
+	if jr.cursor != "" {
+		args = append(args, "--after-cursor="+jr.cursor)
+	} else {
+		// Primer arranque sin cursor: todo lo del boot actual
+		args = append(args, "--boot", "--lines=all")
+	}
+	// Con una regla para cualquier programa ("*") no se puede filtrar
+	ids := journaldIdentifiers
+	if rs := activeRules.Load(); rs != nil {
+		for _, r := range rs.Rules {
+			if r.Program == "*" {
+				return args
+			}
+		}
+		ids = append(append([]string{}, ids...), rs.Programs()...)
+	}
+	for _, id := range ids {
+		args = append(args, "SYSLOG_IDENTIFIER="+id)
+	}
+	return args
+}
+
+// Restart relanza journalctl para que tome los programas de las reglas
+// recargadas. Se reanuda desde el cursor, así que no se pierde nada.
+func (jr *JournaldReader) Restart() {
+	select {
+	case jr.restart <- struct{}{}:
+	default:
+	}
+}
+
+// Run no retorna: si journalctl termina se relanza desde el último cursor.
+// handle recibe también el __CURSOR de la entrada, que la identifica.
+func (jr *JournaldReader) Run(handle func(e authEntry, cursor string) (bool, error)) {
+	backoff := time.Second
+	for {
+		started := time.Now()
+		if err := jr.follow(handle); err != nil {
+			log.Printf("journald: %v", err)
+		}
+		if jr.dirty {
+			jr.saveCheckpoint()
+		}
+
+		if time.Since(started) > time.Minute {
+			backoff = time.Second
+		}
+		log.Printf("journald: journalctl terminó, relanzando en %s", backoff)
+		time.Sleep(backoff)
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+func (jr *JournaldReader) follow(handle func(e authEntry, cursor string) (bool, error)) error {
+	cmd := exec.Command(journalctlPath, jr.args()...)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("lanzando journalctl: %w", err)
+	}
+	defer func() { _ = cmd.Wait() }()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-jr.restart:
+			log.Printf("journald: relanzando journalctl con las reglas nuevas")
+			_ = cmd.Process.Kill()
+		case <-done:
+		}
+	}()
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+
+	for scanner.Scan() {
+		var fields map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &fields); err != nil {
+			log.Printf("journald: entrada JSON inválida: %v", err)
+			continue
+		}
+
+		cursor := journalString(fields["__CURSOR"])
+		entry, ok := journalEntry(fields)
+
+		emitted := false
+		if ok {
+			for {
+				emitted, err = handle(entry, cursor)
+				if err == nil {
+					break
+				}
+				log.Printf("journald: error procesando entrada, reintentando: %v", err)
+				time.Sleep(time.Second)
+			}
+		}
+
+		if cursor != "" {
+			jr.cursor = cursor
+			jr.dirty = true
+		}
+		if emitted || time.Since(jr.lastSave) >= 2*time.Second {
+			jr.saveCheckpoint()
+		}
+	}
+
+	_ = stdout.Close()
+	return scanner.Err()
+}
+
+func (jr *JournaldReader) saveCheckpoint() {
+	if err := jr.store.Set(journaldCheckpointKey, Checkpoint{Cursor: jr.cursor}); err != nil {
+		log.Printf("journald: error guardando cursor: %v", err)
+		return
+	}
+	jr.lastSave = time.Now()
+	jr.dirty = false
+}
+
+// journalEntry traduce los campos del journal al authEntry de auth.log:
+// __REALTIME_TIMESTAMP -> Ts, _HOSTNAME -> Host, _PID -> PID.
+func journalEntry(fields map[string]interface{}) (authEntry, bool) {
+	var e authEntry
+
+	e.Msg = journalString(fields["MESSAGE"])
+	e.Program = journalString(fields["SYSLOG_IDENTIFIER"])
+	if e.Program == "" {
+		e.Program = journalString(fields["_COMM"])
+	}
+	if e.Msg == "" || e.Program == "" {
+		return e, false
+	}
+
+	e.Host = journalString(fields["_HOSTNAME"])
+
+	pidStr := journalString(fields["_PID"])
+	if pidStr == "" {
+		pidStr = journalString(fields["SYSLOG_PID"])
+	}
+	e.PID, _ = strconv.Atoi(pidStr)
+
+	e.Ts = time.Now().UTC()
+	e.TsFormat = tsFormatJournald
+	if us, err := strconv.ParseInt(journalString(fields["__REALTIME_TIMESTAMP"]), 10, 64); err == nil {
+		e.Ts = time.UnixMicro(us).UTC()
+	}
+
+	// raw_line con el mismo formato que auth.log para que la UI lo muestre igual
+	tag := e.Program
+	if e.PID > 0 {
+		tag = fmt.Sprintf("%s[%d]", e.Program, e.PID)
+	}
+	e.RawLine = fmt.Sprintf("%s %s %s: %s", e.Ts.Format(time.RFC3339Nano), e.Host, tag, e.Msg)
+
+	return e, true
+}
+
+// journalString devuelve el valor como texto. journald serializa como array
+// de bytes los campos que no son UTF-8 válido.
+func journalString(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case []interface{}:
+		b := make([]byte, 0, len(t))
+		for _, x := range t {
+			if f, ok := x.(float64); ok {
+				b = append(b, byte(f))
+			}
+		}
+		return string(b)
+	default:
+		return ""
+	}
+}
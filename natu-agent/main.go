@@ -1,22 +1,23 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/json"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
-	"regexp"
-	"strconv"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
-
-	"github.com/hpcloud/tail"
 )
 
 type Event struct {
+	// Identificador estable (ver eventIDs): natu-core descarta los repetidos
+	ID        string                 `json:"id,omitempty"`
 	Ts        time.Time              `json:"ts"`
 	Source    string                 `json:"source"`
 	EventType string                 `json:"event_type"`
@@ -36,6 +37,10 @@ type SSHBan struct {
 	BannedAt *time.Time `json:"banned_at,omitempty"`
 	Source   string     `json:"source,omitempty"`
 	Reason   string     `json:"reason,omitempty"`
+	// Tiempo restante según el set del firewall; nil si es permanente
+	TimeoutSeconds *int64     `json:"timeout_seconds,omitempty"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	Sets           []string   `json:"sets,omitempty"`
 }
 
 type SSHBanSyncRequest struct {
@@ -49,104 +54,233 @@ type SSHBanListResponse struct {
 	Bans        []SSHBan  `json:"bans"`
 }
 
-var (
-	reFailed = regexp.MustCompile(`Failed password for (invalid user )?(\S+) from ([0-9a-fA-F\.:]+) port (\d+) ssh2`)
-	reAccept = regexp.MustCompile(`Accepted (publickey|password) for (\S+) from ([0-9a-fA-F\.:]+) port (\d+) ssh2(?:: (\S+)\s+(\S+))?`)
-	// Ejemplo de línea:
-	// 2025-12-08T08:54:37.490977+00:00 isov3 sudo:     root : TTY=pts/4 ; PWD=/root ; USER=root ; COMMAND=/usr/bin/ls /root
-	reSudoCmd = regexp.MustCompile(`sudo:\s+(\S+)\s*:\s+TTY=([^;]+);\s+PWD=([^;]+);\s+USER=([^;]+);\s+COMMAND=(.+)$`)
-	reBanLine = regexp.MustCompile(`^([0-9]{4}-[0-9]{2}-[0-9]{2} [0-9]{2}:[0-9]{2}:[0-9]{2},[0-9]{3}).*Ban ([0-9a-fA-F\.:]+)`) // fail2ban log
-)
+func main() {
+	configPath := flag.String("config", configPathFromEnv(), "fichero de configuración JSON")
+	checkOnly := flag.Bool("check-config", false, "valida la configuración y las reglas y termina")
+	flag.Parse()
+
+	explicit := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			explicit = true
+		}
+	})
+	if os.Getenv("NATU_AGENT_CONFIG") != "" {
+		explicit = true
+	}
 
-const authLogPath = "/var/log/auth.log"
-const fail2banLogPath = "/var/log/fail2ban.log"
+	cfg, err := LoadConfig(*configPath, explicit)
+	if err != nil {
+		if *checkOnly {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		log.Fatalf("%v", err)
+	}
 
-func main() {
-	serverURL := os.Getenv("NATU_SERVER_URL")
-	if serverURL == "" {
-		serverURL = "http://127.0.0.1:5010"
+	// Reglas de parseo del fichero: si no son válidas no arrancamos
+	rules, err := LoadRules(cfg.RulesFile)
+	if err != nil {
+		if *checkOnly {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		log.Fatalf("%v", err)
+	}
+
+	if *checkOnly {
+		fmt.Printf("configuración válida (%s), %d reglas en %s\n", *configPath, len(rules.Rules), cfg.RulesFile)
+		return
+	}
+
+	if _, err := applyConfig(cfg, nil); err != nil {
+		log.Fatalf("configuración: %v", err)
 	}
-	secret := os.Getenv("NATU_AGENT_SECRET")
-	if secret == "" {
-		log.Fatal("NATU_AGENT_SECRET no está definido")
+	activeRules.Store(rules)
+	if len(rules.Rules) > 0 {
+		log.Printf("Cargadas %d reglas de %s", len(rules.Rules), cfg.RulesFile)
 	}
 
-	log.Printf("natu-agent empezando. Enviando a %s", serverURL)
+	hostname := cfg.Hostname
+	log.Printf("natu-agent empezando. Enviando a %s", cfg.Server.URL)
 
-	hostname, _ := os.Hostname()
-	if hostname == "" {
-		hostname = "unknown"
+	store, err := OpenCheckpointStore(cfg.StateDir)
+	if err != nil {
+		log.Fatalf("Error abriendo checkpoints: %v", err)
 	}
 
-	// Arranca el endpoint local para exponer los bans actuales
-	go startHTTPServer()
-
-	t, err := tail.TailFile(authLogPath, tail.Config{
-		Follow:    true,
-		ReOpen:    true,
-		Logger:    tail.DiscardingLogger,
-		MustExist: true,
-		Poll:      true,
-	})
+	banTimes, err = OpenBanTimeTracker(cfg.StateDir)
 	if err != nil {
-		log.Fatalf("Error abriendo %s: %v", authLogPath, err)
+		log.Fatalf("Error abriendo estado de bans: %v", err)
 	}
 
-	client := &http.Client{Timeout: 5 * time.Second}
+	// Arranca el endpoint local para exponer los bans actuales
+	go startHTTPServer(cfg.HTTP.Addr)
+
+	// Cola en disco: los eventos se agrupan en lotes y se reintentan hasta
+	// que natu-core los confirma, también entre reinicios del agente.
+	spool, err := OpenSpool(cfg.spoolConfig())
+	if err != nil {
+		log.Fatalf("Error abriendo spool: %v", err)
+	}
+	go spool.Run(&batchSender{hostname: hostname})
 
 	// Sincronización periódica de bans activos hacia natu-core
-	go startBanSyncLoop(client, serverURL, secret, hostname)
+	go startBanSyncLoop(hostname)
 
-	for line := range t.Lines {
-		if line == nil {
-			continue
-		}
-		ev := parseAuthLine(line.Text)
-		if ev == nil {
-			continue
-		}
+	// Ban/unban pedidos desde natu-core (si actions.enabled)
+	go startActionLoop(hostname)
+
+	sessions, err := OpenSessionTracker(cfg.StateDir, hostname)
+	if err != nil {
+		log.Fatalf("Error abriendo estado de sesiones: %v", err)
+	}
 
-		req := BatchRequest{
-			AgentSecret: secret,
-			Hostname:    hostname,
-			Events:      []Event{*ev},
+	rootShells, err := OpenRootShellTracker(cfg.StateDir, hostname, sessions)
+	if err != nil {
+		log.Fatalf("Error abriendo estado de shells de root: %v", err)
+	}
+
+	// enqueue no falla: si el disco da error se reintenta, porque el estado de
+	// sesiones ya avanzó y repetir la línea lo desordenaría. origin identifica
+	// la línea o entrada del journal de la que salen los eventos.
+	enqueue := func(origin string, events []Event) {
+		eventIDs(origin, events)
+		for _, ev := range events {
+			addLabels(&ev)
+			for {
+				err := spool.Enqueue(ev)
+				if err == nil {
+					break
+				}
+				log.Printf("Error encolando evento, reintentando: %v", err)
+				time.Sleep(time.Second)
+			}
+
+			switch ev.EventType {
+			case "ssh_failed_login":
+				log.Printf("Evento encolado (failed): %s", ev.Payload["raw_line"])
+			case "ssh_login_success":
+				log.Printf("Evento encolado (success): %s", ev.Payload["raw_line"])
+			case "sudo_command":
+				log.Printf("Evento encolado (sudo): %s", ev.Payload["raw_line"])
+			case "sudo_auth_failure", "sudo_denied":
+				log.Printf("Evento encolado (sudo fallido): %s", ev.Payload["raw_line"])
+			case "account_change":
+				log.Printf("Evento encolado (cuenta %s): %s", ev.Payload["change_type"], ev.Payload["raw_line"])
+			case "root_shell_start":
+				log.Printf("Shell de root abierta: user=%s método=%s ip=%s", ev.Payload["sudo_user"], ev.Payload["method"], ev.Payload["remote_ip"])
+			case "root_shell_end":
+				log.Printf("Shell de root cerrada: user=%s duración=%vs", ev.Payload["sudo_user"], ev.Payload["duration_seconds"])
+			case "ssh_session_end":
+				log.Printf("Sesión SSH cerrada: user=%s ip=%s duración=%vs", ev.Payload["username"], ev.Payload["remote_ip"], ev.Payload["duration_seconds"])
+			case "f2b_ban", "f2b_restore", "f2b_unban":
+				log.Printf("Evento encolado (%s): jail=%s ip=%s", ev.EventType, ev.Payload["jail"], ev.Payload["ip"])
+			}
 		}
+	}
 
-		b, err := json.Marshal(req)
-		if err != nil {
-			log.Printf("Error serializando evento: %v", err)
-			continue
+	accounts := NewAccountActorTracker()
+
+	// Las sesiones SSH y las shells de root se encadenan: un ssh_session_end
+	// cierra también las shells abiertas desde esa sesión.
+	observeShells := func(events []Event) []Event {
+		var out []Event
+		for _, ev := range events {
+			out = append(out, rootShells.Observe(ev)...)
 		}
+		return out
+	}
 
-		resp, err := client.Post(serverURL+"/api/v1/events/batch", "application/json", bytes.NewReader(b))
-		if err != nil {
-			log.Printf("Error enviando evento: %v", err)
-			continue
+	emit := func(origin string, ev *Event) (bool, error) {
+		accounts.Observe(ev)
+		events := observeShells(sessions.Observe(ev))
+		if len(events) == 0 {
+			return false, nil
 		}
-		_ = resp.Body.Close()
+		enqueue(origin, events)
+		return true, nil
+	}
 
-		if resp.StatusCode != http.StatusOK {
-			log.Printf("Error enviando evento: http %d", resp.StatusCode)
-			continue
+	// Sesiones y shells cuyo proceso murió sin dejar rastro en el log
+	go func() {
+		ticker := time.NewTicker(5 * time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			now := time.Now()
+			enqueue("", observeShells(sessions.Reap(now)))
+			enqueue("", rootShells.Reap(now))
 		}
+	}()
+
+	// fail2ban.log: historial de Found/Ban/Unban con su propio checkpoint
+	if cfg.Bans.uses("fail2ban") {
+		go NewFileTailer(cfg.Inputs.Fail2banLog, store).Run(func(text, origin string) (bool, error) {
+			ev := parseFail2banLine(text)
+			if ev == nil {
+				return false, nil
+			}
+			banTimes.Observe(ev)
+			enqueue(origin, []Event{*ev})
+			return true, nil
+		})
+	}
+
+	input := resolveAuthInput(cfg.Inputs)
+	var journal *JournaldReader
+	if input == "journald" {
+		journal = NewJournaldReader(store)
+	}
 
-		switch ev.EventType {
-		case "ssh_failed_login":
-			log.Printf("Evento enviado (failed): %s", line.Text)
-		case "ssh_login_success":
-			log.Printf("Evento enviado (success): %s", line.Text)
-		case "sudo_command":
-			log.Printf("Evento enviado (sudo): %s", line.Text)
+	// SIGHUP recarga configuración y reglas sin reiniciar el agente ni
+	// perder la posición de lectura
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			ReloadConfig(*configPath, explicit, spool)
+			ReloadRules(activeConfig.Load().RulesFile)
+			if journal != nil {
+				journal.Restart()
+			}
 		}
+	}()
+
+	switch input {
+	case "journald":
+		log.Printf("Leyendo eventos de journald")
+		journal.Run(func(e authEntry, cursor string) (bool, error) {
+			origin := ""
+			if cursor != "" {
+				origin = "journal:" + cursor
+			}
+			return emit(origin, parseAuthEntry(e))
+		})
+	default:
+		// Sigue auth.log desde el último checkpoint, drenando antes los rotados
+		log.Printf("Leyendo eventos de %s", cfg.Inputs.AuthLog)
+		NewFileTailer(cfg.Inputs.AuthLog, store).Run(func(text, origin string) (bool, error) {
+			return emit(origin, parseAuthLine(text))
+		})
 	}
 }
 
-func startHTTPServer() {
-	addr := os.Getenv("NATU_AGENT_HTTP_ADDR")
-	if addr == "" {
-		addr = ":5011"
+// resolveAuthInput elige la fuente de eventos: inputs.auth=file|journald|auto.
+// En modo auto (por defecto) se usa journald si el host no tiene auth.log.
+func resolveAuthInput(in InputsConfig) string {
+	switch in.Auth {
+	case "file", "journald":
+		return in.Auth
+	}
+	if _, err := os.Stat(in.AuthLog); err != nil {
+		if _, jerr := os.Stat(journalctlPath); jerr == nil {
+			return "journald"
+		}
 	}
+	return "file"
+}
 
+func startHTTPServer(addr string) {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/v1/ssh/bans", handleLocalBans)
 
@@ -180,29 +314,24 @@ func handleLocalBans(w http.ResponseWriter, r *http.Request) {
 	_ = enc.Encode(resp)
 }
 
-func startBanSyncLoop(client *http.Client, serverURL, secret, hostname string) {
-	syncEvery := 60 * time.Second
-	if v := os.Getenv("NATU_AGENT_BAN_SYNC_SECONDS"); v != "" {
-		if iv, err := strconv.Atoi(v); err == nil && iv >= 15 {
-			syncEvery = time.Duration(iv) * time.Second
-		}
-	}
-
+func startBanSyncLoop(hostname string) {
 	syncOnce := func() {
+		conn := activeServer.Load()
+
 		bans, err := collectCurrentBans()
 		if err != nil {
 			log.Printf("error recopilando bans: %v", err)
 			return
 		}
 
-		payload := SSHBanSyncRequest{AgentSecret: secret, Hostname: hostname, Bans: bans}
+		payload := SSHBanSyncRequest{AgentSecret: conn.secret, Hostname: hostname, Bans: bans}
 		b, err := json.Marshal(payload)
 		if err != nil {
 			log.Printf("error serializando bans: %v", err)
 			return
 		}
 
-		resp, err := client.Post(serverURL+"/api/v1/ssh_bans", "application/json", bytes.NewReader(b))
+		resp, err := conn.client.Post(conn.url+"/api/v1/ssh_bans", "application/json", bytes.NewReader(b))
 		if err != nil {
 			log.Printf("error enviando bans: %v", err)
 			return
@@ -217,242 +346,137 @@ func startBanSyncLoop(client *http.Client, serverURL, secret, hostname string) {
 		log.Printf("bans sincronizados (%d IPs)", len(bans))
 	}
 
-	// Primer sync inmediato
-	syncOnce()
-
-	ticker := time.NewTicker(syncEvery)
-	go func() {
-		for range ticker.C {
-			syncOnce()
-		}
-	}()
-}
-
-func collectCurrentBans() ([]SSHBan, error) {
-	statusCmd := exec.Command("/usr/bin/fail2ban-client", "status", "sshd")
-	out, err := statusCmd.Output()
-	if err != nil {
-		return nil, err
+	// Primer sync inmediato; el intervalo se relee en cada vuelta para que
+	// un SIGHUP lo cambie sin reiniciar
+	for {
+		syncOnce()
+		time.Sleep(time.Duration(activeConfig.Load().Bans.SyncSeconds) * time.Second)
 	}
+}
 
-	ips := parseBannedIPs(string(out))
-	timestamps := parseBanTimestamps()
+const fail2banClientPath = "/usr/bin/fail2ban-client"
 
-	var bans []SSHBan
-	for _, ip := range ips {
-		ban := SSHBan{
-			IP:     ip,
-			Jail:   "sshd",
-			Source: "fail2ban",
-			Reason: "active ban",
-		}
+// collectCurrentBans junta los bans de las fuentes configuradas (fail2ban,
+// ipset, nft). Si una fuente falla no se envía nada: un listado parcial
+// borraría en natu-core los bans que faltan.
+func collectCurrentBans() ([]SSHBan, error) {
+	cfg := activeConfig.Load()
+	now := time.Now().UTC()
 
-		if ts, ok := timestamps[ip]; ok {
-			ban.BannedAt = &ts
+	// fail2ban va primero para que los sets se fusionen sobre sus bans
+	bans := []SSHBan{}
+	if cfg.Bans.uses("fail2ban") {
+		f2b, err := collectFail2banBans(cfg)
+		if err != nil {
+			return nil, err
 		}
-
-		bans = append(bans, ban)
+		bans = append(bans, f2b...)
 	}
 
-	return bans, nil
-}
-
-func parseBannedIPs(out string) []string {
-	for _, line := range strings.Split(out, "\n") {
-		if strings.Contains(line, "Banned IP list:") {
-			parts := strings.SplitN(line, ":", 2)
-			if len(parts) < 2 {
-				continue
+	for _, src := range cfg.Bans.Sources {
+		switch src {
+		case "ipset":
+			for _, name := range cfg.Bans.IpsetSets {
+				members, err := collectIpsetBans(name)
+				if err != nil {
+					return nil, err
+				}
+				bans = mergeSetBans(bans, "ipset", ipsetLabel(name), members, now)
+			}
+		case "nft":
+			for _, ref := range cfg.Bans.NftSets {
+				members, err := collectNftBans(ref)
+				if err != nil {
+					return nil, err
+				}
+				bans = mergeSetBans(bans, "nft", nftLabel(ref), members, now)
 			}
-			fields := strings.Fields(parts[1])
-			return fields
 		}
 	}
-	return []string{}
-}
-
-func parseBanTimestamps() map[string]time.Time {
-	cmd := exec.Command("tail", "-n", "400", fail2banLogPath)
-	out, err := cmd.Output()
-	if err != nil {
-		return map[string]time.Time{}
-	}
-
-	tsMap := make(map[string]time.Time)
-	scanner := bufio.NewScanner(strings.NewReader(string(out)))
-	layout := "2006-01-02 15:04:05,000"
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		m := reBanLine.FindStringSubmatch(line)
-		if m == nil {
-			continue
-		}
+	return bans, nil
+}
 
-		ts, err := time.ParseInLocation(layout, m[1], time.Local)
+// collectFail2banBans recorre las jails configuradas o, si no hay ninguna,
+// todas las que tenga fail2ban.
+func collectFail2banBans(cfg *AgentConfig) ([]SSHBan, error) {
+	listedAt := time.Now().UTC()
+	jails := cfg.Bans.Jails
+	if len(jails) == 0 {
+		out, err := exec.Command(fail2banClientPath, "status").Output()
 		if err != nil {
-			continue
+			return nil, fmt.Errorf("fail2ban-client status: %w", err)
 		}
-
-		ip := m[2]
-		tsMap[ip] = ts.UTC()
-	}
-
-	return tsMap
-}
-
-func parseAuthLine(line string) *Event {
-	// Todas tus líneas tienen timestamp inicial RFC3339Nano, igual que en SSH:
-	// 2025-12-08T08:54:37.490977+00:00 isov3 ...
-	parts := strings.SplitN(line, " ", 2)
-	if len(parts) < 2 {
-		return nil
-	}
-	tsStr := parts[0]
-	rest := parts[1]
-
-	ts, err := time.Parse(time.RFC3339Nano, tsStr)
-	if err != nil {
-		ts = time.Now().UTC()
+		jails = parseJailList(string(out))
 	}
 
-	// 1) Rama SSH (igual que antes, pero usando 'rest' en vez de 'line')
-	if strings.Contains(rest, "sshd[") {
-		var msg string
-		if idx := strings.Index(rest, "sshd["); idx != -1 {
-			if colon := strings.Index(rest[idx:], ":"); colon != -1 {
-				msg = strings.TrimSpace(rest[idx+colon+1:])
-			} else {
-				msg = strings.TrimSpace(rest[idx:])
-			}
-		} else {
-			msg = rest
-		}
-
-		if m := reFailed.FindStringSubmatch(msg); m != nil {
-			username := m[2]
-			remoteIP := m[3]
-			portStr := m[4]
-			dstPort, _ := strconv.Atoi(portStr)
-
-			isRoot := username == "root"
-
-			payload := map[string]interface{}{
-				"raw_line":    line,
-				"username":    username,
-				"remote_ip":   remoteIP,
-				"auth_method": "password",
-				"is_root":     isRoot,
-				"dst_port":    dstPort,
-			}
-
-			return &Event{
-				Ts:        ts,
-				Source:    "auth",
-				EventType: "ssh_failed_login",
-				Severity:  3,
-				Payload:   payload,
-			}
+	var bans []SSHBan
+	for _, jail := range jails {
+		statusCmd := exec.Command(fail2banClientPath, "status", jail)
+		out, err := statusCmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("fail2ban-client status %s: %w", jail, err)
 		}
 
-		if m := reAccept.FindStringSubmatch(msg); m != nil {
-			authMethod := m[1]
-			username := m[2]
-			remoteIP := m[3]
-			portStr := m[4]
-			dstPort, _ := strconv.Atoi(portStr)
-			keyType := ""
-			keyFingerprint := ""
-
-			if len(m) >= 7 {
-				if m[5] != "" {
-					keyType = m[5]
-				}
-				if m[6] != "" {
-					keyFingerprint = m[6]
-				}
+		for _, ip := range parseBannedIPs(string(out)) {
+			ban := SSHBan{
+				IP:     ip,
+				Jail:   jail,
+				Source: "fail2ban",
+				Reason: "active ban",
 			}
 
-			isRoot := username == "root"
-
-			payload := map[string]interface{}{
-				"raw_line":    line,
-				"username":    username,
-				"remote_ip":   remoteIP,
-				"auth_method": authMethod,
-				"is_root":     isRoot,
-				"dst_port":    dstPort,
-			}
-			if keyType != "" {
-				payload["key_type"] = keyType
-			}
-			if keyFingerprint != "" {
-				payload["key_fingerprint"] = keyFingerprint
+			if ts, ok := banTimes.BannedAt(jail, ip); ok {
+				ban.BannedAt = &ts
 			}
 
-			return &Event{
-				Ts:        ts,
-				Source:    "auth",
-				EventType: "ssh_login_success",
-				Severity:  2,
-				Payload:   payload,
-			}
+			bans = append(bans, ban)
 		}
-
-		// Si era una línea de sshd pero no encajó en failed/success, la ignoramos
-		return nil
 	}
 
-	// 2) Rama sudo COMMAND=
-	if strings.Contains(rest, "sudo:") {
-		// Queremos la parte desde "sudo:" en adelante
-		idx := strings.Index(rest, "sudo:")
-		if idx == -1 {
-			return nil
-		}
-		msg := strings.TrimSpace(rest[idx:]) // "sudo:     root : TTY=... ; PWD=... ; USER=... ; COMMAND=..."
-
-		// Ignorar las líneas de pam_unix(sudo:session)
-		if strings.Contains(msg, "pam_unix(sudo:session)") {
-			return nil
-		}
-
-		m := reSudoCmd.FindStringSubmatch(msg)
-		if m == nil {
-			return nil
-		}
-
-		sudoUser := m[1]
-		tty := strings.TrimSpace(m[2])
-		pwd := strings.TrimSpace(m[3])
-		targetUser := strings.TrimSpace(m[4])
-		command := strings.TrimSpace(m[5])
-
-		payload := map[string]interface{}{
-			"raw_line":    line,
-			"sudo_user":   sudoUser,
-			"target_user": targetUser,
-			"tty":         tty,
-			"pwd":         pwd,
-			"command":     command,
-		}
+	banTimes.Prune(jails, bans, listedAt)
+	return bans, nil
+}
 
-		if targetUser == "root" {
-			payload["is_target_root"] = true
+// parseJailList lee "Jail list:	sshd, recidive" de fail2ban-client status.
+func parseJailList(out string) []string {
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.Contains(line, "Jail list:") {
+			continue
 		}
-		if sudoUser == "root" {
-			payload["is_sudo_root"] = true
+		parts := strings.SplitN(line, ":", 2)
+		var jails []string
+		for _, j := range strings.Split(parts[1], ",") {
+			if j = strings.TrimSpace(j); j != "" {
+				jails = append(jails, j)
+			}
 		}
+		return jails
+	}
+	return []string{}
+}
 
-		return &Event{
-			Ts:        ts,
-			Source:    "auth",
-			EventType: "sudo_command",
-			Severity:  3,
-			Payload:   payload,
+func parseBannedIPs(out string) []string {
+	for _, line := range strings.Split(out, "\n") {
+		if strings.Contains(line, "Banned IP list:") {
+			parts := strings.SplitN(line, ":", 2)
+			if len(parts) < 2 {
+				continue
+			}
+			fields := strings.Fields(parts[1])
+			return fields
 		}
 	}
+	return []string{}
+}
 
-	// 3) Otras líneas de auth.log que no sean sshd ni sudo command => las ignoramos
-	return nil
+// addLabels añade las labels de la configuración al payload del evento.
+func addLabels(ev *Event) {
+	labels := activeConfig.Load().Labels
+	if len(labels) == 0 || ev.Payload == nil {
+		return
+	}
+	if _, ok := ev.Payload["labels"]; !ok {
+		ev.Payload["labels"] = labels
+	}
 }
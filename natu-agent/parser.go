@@ -0,0 +1,408 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ipPattern = `([0-9a-fA-F\.:]+)`
+
+var (
+	reFailed = regexp.MustCompile(`Failed (password|keyboard-interactive/pam) for (invalid user )?(\S+) from ` + ipPattern + ` port (\d+) ssh2`)
+	reAccept = regexp.MustCompile(`Accepted (publickey|password|keyboard-interactive/pam|hostbased|gssapi-with-mic|gssapi-keyex) for (\S+) from ` + ipPattern + ` port (\d+)(?: ssh2)?(?:: (\S+)\s+(\S+))?`)
+	// Ejemplo de línea:
+	// 2025-12-08T08:54:37.490977+00:00 isov3 sudo:     root : TTY=pts/4 ; PWD=/root ; USER=root ; COMMAND=/usr/bin/ls /root
+	// (el regex se aplica sobre el mensaje, ya sin "sudo:")
+	reSudoCmd = regexp.MustCompile(`^(\S+)\s*:\s+TTY=([^;]+);\s+PWD=([^;]+);\s+USER=([^;]+);\s+COMMAND=(.+)$`)
+	// Intentos fallidos o denegados: "bob : 3 incorrect password attempts ; TTY=... ; COMMAND=..."
+	reSudoProblem  = regexp.MustCompile(`^(\S+)\s*:\s+([^;]+?)\s*;\s+TTY=([^;]+);\s+PWD=([^;]+);\s+USER=([^;]+);.*?COMMAND=(.+)$`)
+	reSudoAttempts = regexp.MustCompile(`^(\d+) incorrect password attempts?$`)
+
+	// Mensajes de sshd previos a la autenticación: escáneres y bots que nunca
+	// llegan a probar una contraseña sólo aparecen aquí.
+	reInvalidUser  = regexp.MustCompile(`^Invalid user (\S*) from ` + ipPattern + `(?: port (\d+))?`)
+	reConnClosed   = regexp.MustCompile(`^Connection closed by (?:(authenticating|invalid) user (\S*) )?` + ipPattern + ` port (\d+)( \[preauth\])?`)
+	reMaxAuth      = regexp.MustCompile(`maximum authentication attempts exceeded for (invalid user )?(\S+) from ` + ipPattern + ` port (\d+)`)
+	reNoIdent      = regexp.MustCompile(`^Did not receive identification string from ` + ipPattern + `(?: port (\d+))?`)
+	reBanner       = regexp.MustCompile(`^banner exchange: Connection from ` + ipPattern + ` port (\d+): (.+)$`)
+	rePamSSHD      = regexp.MustCompile(`^pam_unix\(sshd:session\): session (opened|closed) for user (\S+?)(?:\(uid=\d+\))?(?: by |$)`)
+	reDisconnected = regexp.MustCompile(`^Disconnected from (?:(authenticating|invalid) user (\S*) |user (\S+) )?` + ipPattern + ` port (\d+)( \[preauth\])?`)
+
+	// su y sesiones pam de su/sudo, para seguir las shells de root
+	reSuTo      = regexp.MustCompile(`^(?:\(to (\S+)\) (\S+) on (\S+)|Successful su for (\S+) by (\S+))$`)
+	rePamSuSudo = regexp.MustCompile(`^pam_unix\((su|su-l|sudo|sudo-i):session\): session (opened|closed) for user (\S+?)(?:\(uid=(\d+)\))?(?: by (\S*?)(?:\(uid=\d+\))?)?$`)
+)
+
+// authEntry es una línea de log ya separada en cabecera y mensaje. La
+// construye parseAuthLine desde auth.log o la entrada de journald.
+type authEntry struct {
+	Ts       time.Time
+	TsFormat string
+	Host     string
+	Program  string
+	PID      int
+	Msg      string
+	RawLine  string
+}
+
+func parseAuthLine(line string) *Event {
+	ts, rest, format := parseSyslogPrefix(line, time.Now())
+	if rest == "" {
+		return nil
+	}
+
+	entry, ok := splitSyslogHeader(rest)
+	if !ok {
+		return nil
+	}
+	entry.Ts = ts
+	entry.TsFormat = format
+	entry.RawLine = line
+
+	return parseAuthEntry(entry)
+}
+
+// splitSyslogHeader separa "host programa[pid]: mensaje".
+func splitSyslogHeader(rest string) (authEntry, bool) {
+	var e authEntry
+
+	sp := strings.IndexByte(rest, ' ')
+	if sp <= 0 {
+		return e, false
+	}
+	e.Host = rest[:sp]
+	rest = strings.TrimLeft(rest[sp+1:], " ")
+
+	colon := strings.Index(rest, ":")
+	if colon <= 0 {
+		return e, false
+	}
+	tag := rest[:colon]
+	if strings.ContainsAny(tag, " \t") {
+		return e, false
+	}
+	e.Msg = strings.TrimSpace(rest[colon+1:])
+
+	e.Program = tag
+	if lb := strings.IndexByte(tag, '['); lb > 0 && strings.HasSuffix(tag, "]") {
+		e.Program = tag[:lb]
+		e.PID, _ = strconv.Atoi(tag[lb+1 : len(tag)-1])
+	}
+	return e, true
+}
+
+func parseAuthEntry(e authEntry) *Event {
+	// Las reglas del fichero van primero para poder redefinir las internas
+	ev := applyCustomRules(e)
+	if ev == nil {
+		ev = parseBuiltinEntry(e)
+	}
+	// El resto de líneas de auth.log (cron, systemd-logind...) las ignoramos
+	if ev == nil {
+		return nil
+	}
+
+	if e.PID > 0 {
+		ev.Payload["pid"] = e.PID
+	}
+	if e.Host != "" {
+		ev.Payload["log_host"] = e.Host
+	}
+	if e.TsFormat != "" {
+		ev.Payload["ts_format"] = e.TsFormat
+	}
+	return ev
+}
+
+func parseBuiltinEntry(e authEntry) *Event {
+	switch e.Program {
+	case "sshd", "sshd-session":
+		return parseSSHDMessage(e)
+	case "sudo":
+		return parseSudoMessage(e)
+	case "su":
+		return parseSuMessage(e)
+	}
+	if accountPrograms[e.Program] {
+		return parseAccountMessage(e)
+	}
+	return nil
+}
+
+// sshEvent arma el evento SSH con los campos comunes del payload.
+func sshEvent(e authEntry, eventType string, severity int, username, remoteIP, portStr string) *Event {
+	dstPort, _ := strconv.Atoi(portStr)
+
+	payload := map[string]interface{}{
+		"raw_line":  e.RawLine,
+		"remote_ip": remoteIP,
+		"dst_port":  dstPort,
+	}
+	if username != "" {
+		payload["username"] = username
+		payload["is_root"] = username == "root"
+	}
+
+	return &Event{
+		Ts:        e.Ts,
+		Source:    "auth",
+		EventType: eventType,
+		Severity:  severity,
+		Payload:   payload,
+	}
+}
+
+func parseSSHDMessage(e authEntry) *Event {
+	msg := e.Msg
+
+	if m := reFailed.FindStringSubmatch(msg); m != nil {
+		ev := sshEvent(e, "ssh_failed_login", 3, m[3], m[4], m[5])
+		ev.Payload["auth_method"] = m[1]
+		if m[2] != "" {
+			ev.Payload["invalid_user"] = true
+		}
+		return ev
+	}
+
+	if m := reAccept.FindStringSubmatch(msg); m != nil {
+		ev := sshEvent(e, "ssh_login_success", 2, m[2], m[3], m[4])
+		ev.Payload["auth_method"] = m[1]
+		if m[5] != "" {
+			ev.Payload["key_type"] = m[5]
+		}
+		if m[6] != "" {
+			ev.Payload["key_fingerprint"] = m[6]
+		}
+		return ev
+	}
+
+	if m := reInvalidUser.FindStringSubmatch(msg); m != nil {
+		ev := sshEvent(e, "ssh_invalid_user", 3, m[1], m[2], m[3])
+		ev.Payload["invalid_user"] = true
+		return ev
+	}
+
+	if m := reMaxAuth.FindStringSubmatch(msg); m != nil {
+		ev := sshEvent(e, "ssh_max_auth_exceeded", 4, m[2], m[3], m[4])
+		if m[1] != "" {
+			ev.Payload["invalid_user"] = true
+		}
+		return ev
+	}
+
+	if m := reConnClosed.FindStringSubmatch(msg); m != nil {
+		ev := sshEvent(e, "ssh_preauth_closed", 2, m[2], m[3], m[4])
+		if m[1] == "invalid" {
+			ev.Payload["invalid_user"] = true
+		}
+		ev.Payload["preauth"] = m[5] != ""
+		return ev
+	}
+
+	if m := reNoIdent.FindStringSubmatch(msg); m != nil {
+		return sshEvent(e, "ssh_no_identification", 2, "", m[1], m[2])
+	}
+
+	if m := reBanner.FindStringSubmatch(msg); m != nil {
+		ev := sshEvent(e, "ssh_banner_exchange_failed", 2, "", m[1], m[2])
+		ev.Payload["reason"] = strings.TrimSpace(strings.TrimSuffix(m[3], "[preauth]"))
+		return ev
+	}
+
+	if m := reDisconnected.FindStringSubmatch(msg); m != nil {
+		username := m[2]
+		if m[3] != "" {
+			username = m[3]
+		}
+		preauth := m[6] != ""
+		severity := 1
+		if preauth {
+			severity = 2
+		}
+		ev := sshEvent(e, "ssh_disconnected", severity, username, m[4], m[5])
+		if m[1] == "invalid" {
+			ev.Payload["invalid_user"] = true
+		}
+		ev.Payload["preauth"] = preauth
+		return ev
+	}
+
+	// Apertura/cierre de sesión pam: eventos internos que consume SessionTracker
+	if m := rePamSSHD.FindStringSubmatch(msg); m != nil {
+		eventType := evPamSessionOpened
+		if m[1] == "closed" {
+			eventType = evPamSessionClosed
+		}
+		return &Event{
+			Ts:        e.Ts,
+			Source:    "auth",
+			EventType: eventType,
+			Severity:  1,
+			Payload: map[string]interface{}{
+				"raw_line": e.RawLine,
+				"username": m[2],
+			},
+		}
+	}
+
+	// El resto de mensajes de sshd (negociación, debug...) no generan evento
+	return nil
+}
+
+func parseSudoMessage(e authEntry) *Event {
+	msg := e.Msg // "root : TTY=... ; PWD=... ; USER=... ; COMMAND=..."
+
+	// pam_unix(sudo:session) / pam_unix(sudo-i:session): sólo para RootShellTracker
+	if strings.HasPrefix(msg, "pam_unix(sudo") {
+		return parsePamSuSudo(e)
+	}
+
+	m := reSudoCmd.FindStringSubmatch(msg)
+	if m == nil {
+		return parseSudoProblem(e)
+	}
+
+	sudoUser := m[1]
+	tty := strings.TrimSpace(m[2])
+	pwd := strings.TrimSpace(m[3])
+	targetUser := strings.TrimSpace(m[4])
+	command := strings.TrimSpace(m[5])
+
+	payload := sudoPayload(e, sudoUser, tty, pwd, targetUser, command)
+
+	return &Event{
+		Ts:        e.Ts,
+		Source:    "auth",
+		EventType: "sudo_command",
+		Severity:  3,
+		Payload:   payload,
+	}
+}
+
+func sudoPayload(e authEntry, sudoUser, tty, pwd, targetUser, command string) map[string]interface{} {
+	payload := map[string]interface{}{
+		"raw_line":    e.RawLine,
+		"sudo_user":   sudoUser,
+		"target_user": targetUser,
+		"tty":         tty,
+		"pwd":         pwd,
+		"command":     command,
+	}
+
+	if targetUser == "root" {
+		payload["is_target_root"] = true
+	}
+	if sudoUser == "root" {
+		payload["is_sudo_root"] = true
+	}
+	return payload
+}
+
+// parseSudoProblem cubre las líneas de sudo que no llegan a ejecutar nada:
+// contraseñas erróneas (sudo_auth_failure) y denegaciones de la política
+// (sudo_denied). Son los intentos de escalada que más interesan.
+func parseSudoProblem(e authEntry) *Event {
+	m := reSudoProblem.FindStringSubmatch(e.Msg)
+	if m == nil || strings.HasPrefix(m[2], "TTY=") {
+		return nil
+	}
+
+	problem := strings.TrimSpace(m[2])
+	payload := sudoPayload(e, m[1], strings.TrimSpace(m[3]), strings.TrimSpace(m[4]), strings.TrimSpace(m[5]), strings.TrimSpace(m[6]))
+	payload["problem"] = problem
+
+	eventType := ""
+	switch {
+	case reSudoAttempts.MatchString(problem):
+		eventType = "sudo_auth_failure"
+		attempts, _ := strconv.Atoi(reSudoAttempts.FindStringSubmatch(problem)[1])
+		payload["attempts"] = attempts
+		payload["reason"] = "incorrect_password"
+	case problem == "a password is required":
+		eventType = "sudo_auth_failure"
+		payload["attempts"] = 0
+		payload["reason"] = "password_required"
+	case problem == "user NOT in sudoers":
+		eventType = "sudo_denied"
+		payload["reason"] = "not_in_sudoers"
+	case problem == "command not allowed":
+		eventType = "sudo_denied"
+		payload["reason"] = "command_not_allowed"
+	case strings.HasPrefix(problem, "user NOT authorized on host"):
+		eventType = "sudo_denied"
+		payload["reason"] = "not_authorized_on_host"
+	default:
+		return nil
+	}
+
+	return &Event{
+		Ts:        e.Ts,
+		Source:    "auth",
+		EventType: eventType,
+		Severity:  4,
+		Payload:   payload,
+	}
+}
+
+// parseSuMessage reconoce "(to root) alice on pts/0" y las sesiones pam de su.
+// Ambos son eventos internos que consume RootShellTracker.
+func parseSuMessage(e authEntry) *Event {
+	if strings.HasPrefix(e.Msg, "pam_unix(su") {
+		return parsePamSuSudo(e)
+	}
+
+	m := reSuTo.FindStringSubmatch(e.Msg)
+	if m == nil {
+		return nil
+	}
+	target, user, tty := m[1], m[2], m[3]
+	if m[4] != "" {
+		target, user = m[4], m[5]
+	}
+
+	return &Event{
+		Ts:        e.Ts,
+		Source:    "auth",
+		EventType: evSuSwitch,
+		Severity:  1,
+		Payload: map[string]interface{}{
+			"raw_line":    e.RawLine,
+			"sudo_user":   user,
+			"target_user": target,
+			"tty":         tty,
+		},
+	}
+}
+
+func parsePamSuSudo(e authEntry) *Event {
+	m := rePamSuSudo.FindStringSubmatch(e.Msg)
+	if m == nil {
+		return nil
+	}
+
+	eventType := evPamRootOpened
+	if m[2] == "closed" {
+		eventType = evPamRootClosed
+	}
+	payload := map[string]interface{}{
+		"raw_line":    e.RawLine,
+		"service":     m[1],
+		"target_user": m[3],
+	}
+	if m[4] != "" {
+		payload["target_uid"], _ = strconv.Atoi(m[4])
+	}
+	if m[5] != "" {
+		payload["sudo_user"] = m[5]
+	}
+
+	return &Event{
+		Ts:        e.Ts,
+		Source:    "auth",
+		EventType: eventType,
+		Severity:  1,
+		Payload:   payload,
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import "testing"
+
+// parseCase es una línea real de auth.log y lo que debe salir de ella. want
+// sólo lista los campos del payload que se comprueban; wantType vacío
+// significa que la línea no genera evento.
+type parseCase struct {
+	name     string
+	line     string
+	wantType string
+	severity int
+	want     map[string]interface{}
+}
+
+func checkParse(t *testing.T, tests []parseCase) {
+	t.Helper()
+	for _, tt := range tests {
+		ev := parseAuthLine(tt.line)
+		if tt.wantType == "" {
+			if ev != nil {
+				t.Errorf("%s: se esperaba nil, salió %s %v", tt.name, ev.EventType, ev.Payload)
+			}
+			continue
+		}
+		if ev == nil {
+			t.Errorf("%s: no se reconoció la línea", tt.name)
+			continue
+		}
+		if ev.EventType != tt.wantType {
+			t.Errorf("%s: event_type = %s, se esperaba %s", tt.name, ev.EventType, tt.wantType)
+		}
+		if tt.severity != 0 && ev.Severity != tt.severity {
+			t.Errorf("%s: severity = %d, se esperaba %d", tt.name, ev.Severity, tt.severity)
+		}
+		if ev.Payload["raw_line"] != tt.line {
+			t.Errorf("%s: raw_line = %v", tt.name, ev.Payload["raw_line"])
+		}
+		for k, want := range tt.want {
+			if got, ok := ev.Payload[k]; !ok && want != nil || ok && got != want {
+				t.Errorf("%s: payload[%s] = %#v, se esperaba %#v", tt.name, k, got, want)
+			}
+		}
+	}
+}
+
+func TestParseSSHD(t *testing.T) {
+	const ts = "2025-12-08T08:54:37.490977+00:00 isov3 "
+	checkParse(t, []parseCase{
+		{
+			name:     "contraseña fallida de usuario inexistente",
+			line:     ts + "sshd[1234]: Failed password for invalid user admin from 203.0.113.7 port 51122 ssh2",
+			wantType: "ssh_failed_login", severity: 3,
+			want: map[string]interface{}{"username": "admin", "remote_ip": "203.0.113.7", "dst_port": 51122, "invalid_user": true, "auth_method": "password", "pid": 1234, "log_host": "isov3"},
+		},
+		{
+			name:     "keyboard-interactive fallido desde IPv6",
+			line:     ts + "sshd[1234]: Failed keyboard-interactive/pam for root from 2001:db8::7 port 40022 ssh2",
+			wantType: "ssh_failed_login",
+			want:     map[string]interface{}{"username": "root", "is_root": true, "remote_ip": "2001:db8::7", "auth_method": "keyboard-interactive/pam", "invalid_user": nil},
+		},
+		{
+			name:     "clave pública con huella",
+			line:     ts + "sshd[2001]: Accepted publickey for alice from 198.51.100.4 port 50022 ssh2: ED25519 SHA256:Zm9vYmFy",
+			wantType: "ssh_login_success", severity: 2,
+			want: map[string]interface{}{"username": "alice", "auth_method": "publickey", "key_type": "ED25519", "key_fingerprint": "SHA256:Zm9vYmFy"},
+		},
+		{
+			name:     "gssapi en sshd-session (OpenSSH 9.8)",
+			line:     ts + "sshd-session[2002]: Accepted gssapi-with-mic for bob from 198.51.100.4 port 50023 ssh2",
+			wantType: "ssh_login_success",
+			want:     map[string]interface{}{"username": "bob", "auth_method": "gssapi-with-mic", "pid": 2002},
+		},
+		{
+			name:     "usuario inexistente",
+			line:     ts + "sshd[3001]: Invalid user oracle from 203.0.113.9 port 44312",
+			wantType: "ssh_invalid_user", severity: 3,
+			want: map[string]interface{}{"username": "oracle", "remote_ip": "203.0.113.9", "dst_port": 44312, "invalid_user": true},
+		},
+		{
+			name:     "usuario inexistente vacío",
+			line:     ts + "sshd[3002]: Invalid user  from 203.0.113.9 port 44313",
+			wantType: "ssh_invalid_user",
+			want:     map[string]interface{}{"username": nil, "remote_ip": "203.0.113.9"},
+		},
+		{
+			name:     "máximo de intentos",
+			line:     ts + "sshd[3003]: error: maximum authentication attempts exceeded for invalid user admin from 203.0.113.7 port 51122 ssh2 [preauth]",
+			wantType: "ssh_max_auth_exceeded", severity: 4,
+			want: map[string]interface{}{"username": "admin", "invalid_user": true},
+		},
+		{
+			name:     "cierre durante la autenticación",
+			line:     ts + "sshd[3004]: Connection closed by authenticating user root 203.0.113.7 port 51122 [preauth]",
+			wantType: "ssh_preauth_closed",
+			want:     map[string]interface{}{"username": "root", "preauth": true, "invalid_user": nil},
+		},
+		{
+			name:     "cierre sin usuario",
+			line:     ts + "sshd[3005]: Connection closed by 203.0.113.7 port 51123 [preauth]",
+			wantType: "ssh_preauth_closed",
+			want:     map[string]interface{}{"username": nil, "remote_ip": "203.0.113.7", "preauth": true},
+		},
+		{
+			name:     "escáner sin identificación",
+			line:     ts + "sshd[3006]: Did not receive identification string from 203.0.113.10 port 40000",
+			wantType: "ssh_no_identification",
+			want:     map[string]interface{}{"remote_ip": "203.0.113.10", "dst_port": 40000},
+		},
+		{
+			name:     "banner inválido",
+			line:     ts + "sshd[3007]: banner exchange: Connection from 203.0.113.11 port 40001: invalid format [preauth]",
+			wantType: "ssh_banner_exchange_failed",
+			want:     map[string]interface{}{"remote_ip": "203.0.113.11", "reason": "invalid format"},
+		},
+		{
+			name:     "desconexión de usuario inexistente antes de autenticar",
+			line:     ts + "sshd[3008]: Disconnected from invalid user admin 203.0.113.7 port 51122 [preauth]",
+			wantType: "ssh_disconnected", severity: 2,
+			want: map[string]interface{}{"username": "admin", "invalid_user": true, "preauth": true},
+		},
+		{
+			name:     "desconexión de sesión",
+			line:     ts + "sshd[2001]: Disconnected from user alice 198.51.100.4 port 50022",
+			wantType: "ssh_disconnected", severity: 1,
+			want: map[string]interface{}{"username": "alice", "preauth": false},
+		},
+		{
+			name: "otros mensajes de sshd",
+			line: ts + "sshd[3009]: Received disconnect from 203.0.113.7 port 51122:11: Bye Bye [preauth]",
+		},
+		{
+			name: "sshd arrancando",
+			line: ts + "sshd[1]: Server listening on 0.0.0.0 port 22.",
+		},
+	})
+}
+
+func TestParseSudo(t *testing.T) {
+	const ts = "2025-12-08T08:54:37.490977+00:00 isov3 "
+	checkParse(t, []parseCase{
+		{
+			name:     "comando como root",
+			line:     ts + "sudo:     root : TTY=pts/4 ; PWD=/root ; USER=root ; COMMAND=/usr/bin/ls /root",
+			wantType: "sudo_command", severity: 3,
+			want: map[string]interface{}{"sudo_user": "root", "target_user": "root", "tty": "pts/4", "pwd": "/root", "command": "/usr/bin/ls /root", "is_target_root": true, "is_sudo_root": true},
+		},
+		{
+			name:     "comando como otro usuario",
+			line:     ts + "sudo:    alice : TTY=pts/0 ; PWD=/srv/app ; USER=www-data ; COMMAND=/usr/bin/php artisan migrate",
+			wantType: "sudo_command",
+			want:     map[string]interface{}{"sudo_user": "alice", "target_user": "www-data", "command": "/usr/bin/php artisan migrate", "is_target_root": nil},
+		},
+		{
+			name:     "tres contraseñas erróneas",
+			line:     ts + "sudo:      bob : 3 incorrect password attempts ; TTY=pts/1 ; PWD=/home/bob ; USER=root ; COMMAND=/usr/bin/apt update",
+			wantType: "sudo_auth_failure", severity: 4,
+			want: map[string]interface{}{"sudo_user": "bob", "attempts": 3, "reason": "incorrect_password", "command": "/usr/bin/apt update", "tty": "pts/1"},
+		},
+		{
+			name:     "una contraseña errónea",
+			line:     ts + "sudo:      bob : 1 incorrect password attempt ; TTY=pts/1 ; PWD=/home/bob ; USER=root ; COMMAND=/usr/bin/id",
+			wantType: "sudo_auth_failure",
+			want:     map[string]interface{}{"attempts": 1, "reason": "incorrect_password"},
+		},
+		{
+			name:     "sin terminal para pedir contraseña",
+			line:     ts + "sudo:    alice : a password is required ; TTY=unknown ; PWD=/home/alice ; USER=root ; COMMAND=/usr/bin/id",
+			wantType: "sudo_auth_failure",
+			want:     map[string]interface{}{"attempts": 0, "reason": "password_required", "tty": "unknown"},
+		},
+		{
+			name:     "fuera de sudoers",
+			line:     ts + "sudo:      eve : user NOT in sudoers ; TTY=pts/2 ; PWD=/home/eve ; USER=root ; COMMAND=/bin/bash",
+			wantType: "sudo_denied", severity: 4,
+			want: map[string]interface{}{"sudo_user": "eve", "reason": "not_in_sudoers", "command": "/bin/bash", "problem": "user NOT in sudoers"},
+		},
+		{
+			name:     "comando no permitido",
+			line:     ts + "sudo:    alice : command not allowed ; TTY=pts/0 ; PWD=/home/alice ; USER=root ; COMMAND=/usr/bin/vim /etc/shadow",
+			wantType: "sudo_denied",
+			want:     map[string]interface{}{"reason": "command_not_allowed", "command": "/usr/bin/vim /etc/shadow"},
+		},
+		{
+			name:     "no autorizado en el host",
+			line:     ts + "sudo:     carl : user NOT authorized on host ; TTY=pts/3 ; PWD=/home/carl ; USER=root ; COMMAND=/usr/sbin/reboot",
+			wantType: "sudo_denied",
+			want:     map[string]interface{}{"reason": "not_authorized_on_host"},
+		},
+		{
+			name: "fallo de pam_unix(sudo:auth)",
+			line: ts + "sudo: pam_unix(sudo:auth): authentication failure; logname=bob uid=1000 euid=0 tty=/dev/pts/1 ruser=bob rhost=  user=bob",
+		},
+		{
+			name: "otro problema de sudo",
+			line: ts + "sudo:      bob : unable to resolve host isov3: Name or service not known ; TTY=pts/1 ; PWD=/home/bob ; USER=root ; COMMAND=/usr/bin/id",
+		},
+	})
+}
+
+func TestParseSu(t *testing.T) {
+	const ts = "2025-12-08T08:54:37.490977+00:00 isov3 "
+	checkParse(t, []parseCase{
+		{
+			name:     "su a root",
+			line:     ts + "su[5001]: (to root) alice on pts/0",
+			wantType: evSuSwitch,
+			want:     map[string]interface{}{"sudo_user": "alice", "target_user": "root", "tty": "pts/0", "pid": 5001},
+		},
+		{
+			name:     "su correcto (formato antiguo)",
+			line:     ts + "su[5002]: Successful su for root by alice",
+			wantType: evSuSwitch,
+			want:     map[string]interface{}{"sudo_user": "alice", "target_user": "root"},
+		},
+		{
+			name:     "sesión de su -",
+			line:     ts + "su[5001]: pam_unix(su-l:session): session opened for user root(uid=0) by alice(uid=1000)",
+			wantType: evPamRootOpened,
+			want:     map[string]interface{}{"service": "su-l", "target_user": "root", "target_uid": 0, "sudo_user": "alice"},
+		},
+		{
+			name:     "cierre de su -",
+			line:     ts + "su[5001]: pam_unix(su-l:session): session closed for user root",
+			wantType: evPamRootClosed,
+			want:     map[string]interface{}{"service": "su-l", "target_user": "root", "target_uid": nil, "sudo_user": nil},
+		},
+		{
+			name:     "sesión de sudo -i",
+			line:     ts + "sudo[6001]: pam_unix(sudo-i:session): session opened for user root(uid=0) by alice(uid=1000)",
+			wantType: evPamRootOpened,
+			want:     map[string]interface{}{"service": "sudo-i", "sudo_user": "alice", "pid": 6001},
+		},
+		{
+			name:     "sesión de sudo sin PID ni usuario",
+			line:     ts + "sudo: pam_unix(sudo:session): session opened for user root by (uid=0)",
+			wantType: evPamRootOpened,
+			want:     map[string]interface{}{"service": "sudo", "target_user": "root", "sudo_user": nil, "pid": nil},
+		},
+		{
+			name: "su fallido",
+			line: ts + "su[5003]: FAILED SU (to root) alice on pts/0",
+		},
+		{
+			name: "autenticación de su",
+			line: ts + "su[5003]: pam_unix(su:auth): authentication failure; logname=alice uid=1000 euid=0 tty=/dev/pts/0 ruser=alice rhost=  user=root",
+		},
+	})
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------------------------
+// Shells de root (su, sudo -i, sudo su -)
+// ----------------------------
+//
+// Una shell de root empieza con la sesión pam de su/su-l/sudo-i, o con la de
+// sudo cuando el comando era una shell (sudo bash, sudo -s). Se emite
+// root_shell_start con el usuario real y la sesión SSH desde la que entró, y
+// root_shell_end con la duración cuando pam cierra la sesión. Con "sudo su -"
+// la shell la abre su, así que el sudo previo sólo aporta el usuario real.
+//
+// Como en las sesiones SSH, no se siguen las shells anteriores al arranque
+// del host, y las que Reap cierra sin log terminan en su última línea vista.
+
+const (
+	evSuSwitch      = "su_switch"
+	evPamRootOpened = "root_pam_session_opened"
+	evPamRootClosed = "root_pam_session_closed"
+)
+
+// Tiempo máximo entre el sudo_command y la sesión pam que abre
+const rootShellPendingWindow = 10 * time.Second
+
+var rootShellPrograms = map[string]bool{
+	"bash": true, "sh": true, "zsh": true, "dash": true, "ksh": true,
+	"fish": true, "csh": true, "tcsh": true,
+}
+
+type rootShell struct {
+	ID           string    `json:"id"`
+	PID          int       `json:"pid,omitempty"`
+	Service      string    `json:"service"`
+	Method       string    `json:"method"`
+	SudoUser     string    `json:"sudo_user"`
+	TargetUser   string    `json:"target_user"`
+	TTY          string    `json:"tty,omitempty"`
+	SSHSessionID string    `json:"ssh_session_id,omitempty"`
+	RemoteIP     string    `json:"remote_ip,omitempty"`
+	StartedAt    time.Time `json:"started_at"`
+	// Última línea de log de este PID
+	LastSeen time.Time `json:"last_seen"`
+}
+
+type pendingSudo struct {
+	Method string
+	TTY    string
+	Ts     time.Time
+}
+
+type RootShellTracker struct {
+	hostname string
+	path     string
+	sessions *SessionTracker
+
+	mu     sync.Mutex
+	shells map[string]*rootShell
+
+	// Estado en memoria: sólo sirve durante unos segundos
+	pendingSudo map[string]pendingSudo // sudo_user -> último sudo de shell o su
+	pendingSu   map[int]*Event         // pid -> "(to root) alice on pts/0"
+	untracked   map[string]int         // service|target -> sesiones pam sin PID que no son shells
+}
+
+func OpenRootShellTracker(dir, hostname string, sessions *SessionTracker) (*RootShellTracker, error) {
+	rt := &RootShellTracker{
+		hostname:    hostname,
+		path:        filepath.Join(dir, "rootshells.json"),
+		sessions:    sessions,
+		shells:      make(map[string]*rootShell),
+		pendingSudo: make(map[string]pendingSudo),
+		pendingSu:   make(map[int]*Event),
+		untracked:   make(map[string]int),
+	}
+
+	b, err := os.ReadFile(rt.path)
+	if os.IsNotExist(err) {
+		return rt, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("leyendo shells de root: %w", err)
+	}
+	if err := json.Unmarshal(b, &rt.shells); err != nil {
+		log.Printf("⚠️  shells de root corruptas en %s, se descartan: %v", rt.path, err)
+		rt.shells = make(map[string]*rootShell)
+	}
+	return rt, nil
+}
+
+// Observe recibe los eventos que salen de SessionTracker y devuelve los que
+// hay que enviar, con los root_shell_start/end derivados. Los eventos
+// internos de su/pam no se envían.
+func (rt *RootShellTracker) Observe(ev Event) []Event {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	pid := payloadInt(ev.Payload, "pid")
+	if pid > 0 {
+		for _, s := range rt.shells {
+			if s.PID == pid && ev.Ts.After(s.LastSeen) {
+				s.LastSeen = ev.Ts
+			}
+		}
+	}
+
+	switch ev.EventType {
+	case "sudo_command":
+		rt.rememberSudo(ev)
+		return []Event{ev}
+
+	case evSuSwitch:
+		if pid > 0 {
+			e := ev
+			rt.pendingSu[pid] = &e
+		}
+		return nil
+
+	case evPamRootOpened:
+		if s := rt.openLocked(ev, pid); s != nil {
+			rt.saveLocked()
+			return []Event{rt.shellEvent(s, "root_shell_start", ev.Ts, payloadString(ev.Payload, "raw_line"), "")}
+		}
+		return nil
+
+	case evPamRootClosed:
+		if s := rt.closeLocked(ev, pid); s != nil {
+			rt.saveLocked()
+			return []Event{rt.shellEvent(s, "root_shell_end", ev.Ts, payloadString(ev.Payload, "raw_line"), "session_closed")}
+		}
+		return nil
+
+	case "ssh_session_end":
+		// Al cerrar la sesión SSH se cierran sus shells aunque pam no lo registre
+		out := []Event{ev}
+		sid := payloadString(ev.Payload, "session_id")
+		for id, s := range rt.shells {
+			if sid == "" || s.SSHSessionID != sid {
+				continue
+			}
+			delete(rt.shells, id)
+			out = append(out, rt.shellEvent(s, "root_shell_end", ev.Ts, "", "ssh_session_end"))
+		}
+		if len(out) > 1 {
+			rt.saveLocked()
+		}
+		return out
+	}
+
+	return []Event{ev}
+}
+
+// rememberSudo guarda los sudo que abren shell (sudo bash, sudo -s/-i) o que
+// lanzan su, para atribuir la sesión pam que llega justo después.
+func (rt *RootShellTracker) rememberSudo(ev Event) {
+	fields := strings.Fields(payloadString(ev.Payload, "command"))
+	if len(fields) == 0 {
+		return
+	}
+	prog := strings.TrimPrefix(filepath.Base(fields[0]), "-")
+
+	method := ""
+	switch {
+	case prog == "su":
+		method = "sudo su"
+	case rootShellPrograms[prog]:
+		method = "sudo shell"
+	default:
+		return
+	}
+	rt.pendingSudo[payloadString(ev.Payload, "sudo_user")] = pendingSudo{
+		Method: method,
+		TTY:    payloadString(ev.Payload, "tty"),
+		Ts:     ev.Ts,
+	}
+}
+
+func (rt *RootShellTracker) takePendingSudo(user string, ts time.Time) (pendingSudo, bool) {
+	p, ok := rt.pendingSudo[user]
+	if !ok {
+		return p, false
+	}
+	delete(rt.pendingSudo, user)
+	if ts.Sub(p.Ts) > rootShellPendingWindow || p.Ts.Sub(ts) > rootShellPendingWindow {
+		return p, false
+	}
+	return p, true
+}
+
+func (rt *RootShellTracker) openLocked(ev Event, pid int) *rootShell {
+	service := payloadString(ev.Payload, "service")
+	target := payloadString(ev.Payload, "target_user")
+	user := payloadString(ev.Payload, "sudo_user")
+
+	if uid, ok := ev.Payload["target_uid"].(int); target != "root" && !(ok && uid == 0) {
+		return nil
+	}
+	if rt.sessions.beforeBoot(ev.Ts) {
+		return nil
+	}
+
+	s := &rootShell{
+		PID:        pid,
+		Service:    service,
+		SudoUser:   user,
+		TargetUser: target,
+		StartedAt:  ev.Ts,
+		LastSeen:   ev.Ts,
+	}
+
+	switch service {
+	case "su", "su-l":
+		s.Method = service
+		if su := rt.pendingSu[pid]; su != nil {
+			delete(rt.pendingSu, pid)
+			s.TTY = payloadString(su.Payload, "tty")
+			if s.SudoUser == "" {
+				s.SudoUser = payloadString(su.Payload, "sudo_user")
+			}
+		}
+		if p, ok := rt.takePendingSudo(s.SudoUser, ev.Ts); ok && p.Method == "sudo su" {
+			s.Method = "sudo su"
+			if s.TTY == "" {
+				s.TTY = p.TTY
+			}
+		}
+
+	case "sudo-i":
+		s.Method = "sudo -i"
+		if p, ok := rt.takePendingSudo(user, ev.Ts); ok {
+			s.TTY = p.TTY
+		}
+
+	case "sudo":
+		// Con "sudo su -" el pendiente se deja para la sesión de su
+		p, ok := rt.pendingSudo[user]
+		if ok && p.Method == "sudo shell" {
+			p, ok = rt.takePendingSudo(user, ev.Ts)
+		} else {
+			ok = false
+		}
+		if !ok {
+			// sudo de un comando normal: sólo contamos la sesión para no
+			// confundir su cierre (sin PID) con el de una shell
+			if pid <= 0 {
+				rt.untracked[service+"|"+target]++
+			}
+			return nil
+		}
+		s.Method = "sudo shell"
+		s.TTY = p.TTY
+
+	default:
+		return nil
+	}
+
+	if ssh := rt.sessions.ActiveFor(s.SudoUser); ssh != nil {
+		s.SSHSessionID = ssh.ID
+		s.RemoteIP = ssh.RemoteIP
+	}
+
+	s.ID = rt.shellID(s)
+	rt.shells[s.ID] = s
+	return s
+}
+
+func (rt *RootShellTracker) closeLocked(ev Event, pid int) *rootShell {
+	service := payloadString(ev.Payload, "service")
+	target := payloadString(ev.Payload, "target_user")
+
+	if pid > 0 {
+		for id, s := range rt.shells {
+			if s.PID == pid {
+				delete(rt.shells, id)
+				return s
+			}
+		}
+		return nil
+	}
+
+	// Sin PID (sudo en syslog): primero se cierran los sudo normales abiertos
+	key := service + "|" + target
+	if rt.untracked[key] > 0 {
+		rt.untracked[key]--
+		return nil
+	}
+
+	var last *rootShell
+	for _, s := range rt.shells {
+		if s.PID > 0 || s.Service != service || s.TargetUser != target {
+			continue
+		}
+		if last == nil || s.StartedAt.After(last.StartedAt) {
+			last = s
+		}
+	}
+	if last != nil {
+		delete(rt.shells, last.ID)
+	}
+	return last
+}
+
+// Reap cierra las shells cuyo proceso ya no existe o ya no es su, sudo o una
+// shell (PID reutilizado), y las anteriores al arranque del host aunque no
+// tengan PID. Se cierran en su última línea vista.
+func (rt *RootShellTracker) Reap(now time.Time) []Event {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	var out []Event
+	for id, s := range rt.shells {
+		if !rt.sessions.beforeBoot(s.StartedAt) && (s.PID <= 0 || rootShellAlive(s.PID)) {
+			continue
+		}
+		end := s.LastSeen
+		if end.Before(s.StartedAt) {
+			// rootshells.json de versiones sin last_seen
+			end = s.StartedAt
+		}
+		delete(rt.shells, id)
+		out = append(out, rt.shellEvent(s, "root_shell_end", end.UTC(), "", "process_gone"))
+	}
+	for pid, su := range rt.pendingSu {
+		if now.Sub(su.Ts) > rootShellPendingWindow {
+			delete(rt.pendingSu, pid)
+		}
+	}
+	if len(out) > 0 {
+		rt.saveLocked()
+	}
+	return out
+}
+
+// rootShellAlive: el PID existe y sigue siendo su, sudo o una shell.
+func rootShellAlive(pid int) bool {
+	comm, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/comm")
+	if err != nil {
+		return false
+	}
+	name := strings.TrimSpace(string(comm))
+	return name == "su" || name == "sudo" || rootShellPrograms[name]
+}
+
+func (rt *RootShellTracker) shellID(s *rootShell) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%d|%d", rt.hostname, s.Service, s.PID, s.StartedAt.UnixNano())))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (rt *RootShellTracker) shellEvent(s *rootShell, eventType string, ts time.Time, rawLine, endReason string) Event {
+	payload := map[string]interface{}{
+		"shell_id":       s.ID,
+		"method":         s.Method,
+		"command":        s.Method,
+		"sudo_user":      s.SudoUser,
+		"target_user":    s.TargetUser,
+		"is_target_root": true,
+		"tty":            s.TTY,
+		"started_at":     s.StartedAt,
+	}
+	if s.PID > 0 {
+		payload["pid"] = s.PID
+	}
+	if rawLine != "" {
+		payload["raw_line"] = rawLine
+	}
+	if s.SSHSessionID != "" {
+		payload["ssh_session_id"] = s.SSHSessionID
+	}
+	if s.RemoteIP != "" {
+		payload["remote_ip"] = s.RemoteIP
+	}
+
+	severity := 4
+	if eventType == "root_shell_end" {
+		severity = 2
+		payload["ended_at"] = ts
+		payload["duration_seconds"] = int64(ts.Sub(s.StartedAt).Seconds())
+		payload["end_reason"] = endReason
+	}
+
+	return Event{
+		Ts:        ts,
+		Source:    "auth",
+		EventType: eventType,
+		Severity:  severity,
+		Payload:   payload,
+	}
+}
+
+func (rt *RootShellTracker) saveLocked() {
+	b, err := json.Marshal(rt.shells)
+	if err != nil {
+		log.Printf("shells de root: error serializando: %v", err)
+		return
+	}
+	if err := writeFileAtomic(rt.path, b); err != nil {
+		log.Printf("shells de root: error guardando %s: %v", rt.path, err)
+	}
+}
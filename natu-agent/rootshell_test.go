@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// shellFeed pasa cada línea por SessionTracker y RootShellTracker, como el
+// emit de main, y devuelve los eventos que se enviarían.
+func shellFeed(t *testing.T, st *SessionTracker, rt *RootShellTracker, line string) []Event {
+	t.Helper()
+	var out []Event
+	for _, ev := range observeLine(t, st, line) {
+		out = append(out, rt.Observe(ev)...)
+	}
+	return out
+}
+
+func newTestRootShellTracker(t *testing.T, boot time.Time) (*SessionTracker, *RootShellTracker) {
+	t.Helper()
+	st := newTestSessionTracker(t, boot)
+	rt, err := OpenRootShellTracker(t.TempDir(), "isov3", st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st, rt
+}
+
+// shellEvents se queda con los root_shell_start/end.
+func shellEvents(evs []Event) []Event {
+	var out []Event
+	for _, ev := range evs {
+		if ev.EventType == "root_shell_start" || ev.EventType == "root_shell_end" {
+			out = append(out, ev)
+		}
+	}
+	return out
+}
+
+func TestRootShellTracker(t *testing.T) {
+	st, rt := newTestRootShellTracker(t, time.Date(2025, 12, 8, 6, 0, 0, 0, time.UTC))
+	const ts = "2025-12-08T08:%s+00:00 isov3 "
+	line := func(at, rest string) string { return fmt.Sprintf(ts, at) + rest }
+
+	shellFeed(t, st, rt, line("00:00", "sshd[2001]: Accepted publickey for alice from 198.51.100.4 port 50022 ssh2"))
+	sshID := st.ActiveFor("alice").ID
+
+	// sudo bash: el sudo_command marca la sesión pam que llega justo después
+	out := shellFeed(t, st, rt, line("01:00", "sudo[6001]:    alice : TTY=pts/0 ; PWD=/home/alice ; USER=root ; COMMAND=/bin/bash"))
+	if len(out) != 1 || out[0].EventType != "sudo_command" {
+		t.Fatalf("sudo bash: eventos %v", eventTypes(out))
+	}
+	out = shellEvents(shellFeed(t, st, rt, line("01:00", "sudo[6001]: pam_unix(sudo:session): session opened for user root(uid=0) by alice(uid=1000)")))
+	if len(out) != 1 || out[0].EventType != "root_shell_start" {
+		t.Fatalf("sudo bash: eventos %v", eventTypes(out))
+	}
+	start := out[0].Payload
+	if start["method"] != "sudo shell" || start["sudo_user"] != "alice" || start["tty"] != "pts/0" || start["ssh_session_id"] != sshID || start["remote_ip"] != "198.51.100.4" {
+		t.Errorf("sudo bash: root_shell_start %v", start)
+	}
+	out = shellEvents(shellFeed(t, st, rt, line("11:00", "sudo[6001]: pam_unix(sudo:session): session closed for user root")))
+	if len(out) != 1 || out[0].Payload["shell_id"] != start["shell_id"] || out[0].Payload["duration_seconds"] != int64(600) || out[0].Payload["end_reason"] != "session_closed" {
+		t.Errorf("sudo bash: cierre %v", out)
+	}
+
+	// sudo su -: la shell es la sesión de su, el sudo sólo aporta el usuario
+	shellFeed(t, st, rt, line("12:00", "sudo[6101]:    alice : TTY=pts/1 ; PWD=/home/alice ; USER=root ; COMMAND=/usr/bin/su -"))
+	if out := shellEvents(shellFeed(t, st, rt, line("12:00", "sudo[6101]: pam_unix(sudo:session): session opened for user root(uid=0) by alice(uid=1000)"))); len(out) != 0 {
+		t.Errorf("sudo su -: la sesión de sudo abrió shell: %v", out)
+	}
+	shellFeed(t, st, rt, line("12:00", "su[6102]: (to root) root on pts/1"))
+	out = shellEvents(shellFeed(t, st, rt, line("12:00", "su[6102]: pam_unix(su-l:session): session opened for user root(uid=0) by alice(uid=0)")))
+	if len(out) != 1 || out[0].Payload["method"] != "sudo su" || out[0].Payload["tty"] != "pts/1" || out[0].Payload["pid"] != 6102 {
+		t.Errorf("sudo su -: eventos %v", out)
+	}
+
+	// sudo de un comando normal en syslog sin PID: su cierre no cierra shells
+	shellFeed(t, st, rt, line("13:00", "sudo:    alice : TTY=pts/0 ; PWD=/home/alice ; USER=root ; COMMAND=/usr/bin/id"))
+	shellFeed(t, st, rt, line("13:00", "sudo: pam_unix(sudo:session): session opened for user root(uid=0) by alice(uid=1000)"))
+	if out := shellEvents(shellFeed(t, st, rt, line("13:00", "sudo: pam_unix(sudo:session): session closed for user root"))); len(out) != 0 {
+		t.Errorf("sudo id: eventos %v", out)
+	}
+
+	// Al cerrar la sesión SSH se cierra la shell de su que quedaba abierta
+	out = shellEvents(shellFeed(t, st, rt, line("30:00", "sshd[2001]: pam_unix(sshd:session): session closed for user alice")))
+	if len(out) != 1 || out[0].Payload["end_reason"] != "ssh_session_end" || out[0].Payload["method"] != "sudo su" {
+		t.Errorf("fin de la sesión SSH: eventos %v", out)
+	}
+	if len(rt.shells) != 0 {
+		t.Errorf("quedan shells abiertas: %v", rt.shells)
+	}
+
+	// Un sudo -i anterior al arranque no se sigue
+	out = shellEvents(shellFeed(t, st, rt, "2025-12-08T05:00:00+00:00 isov3 sudo[7001]: pam_unix(sudo-i:session): session opened for user root(uid=0) by alice(uid=1000)"))
+	if len(out) != 0 {
+		t.Errorf("sudo -i anterior al arranque: eventos %v", out)
+	}
+}
+
+func TestRootShellReap(t *testing.T) {
+	boot := time.Date(2025, 12, 8, 6, 0, 0, 0, time.UTC)
+	_, rt := newTestRootShellTracker(t, boot)
+
+	at := func(h, m int) time.Time { return time.Date(2025, 12, 8, h, m, 0, 0, time.UTC) }
+	add := func(id string, pid int, started, lastSeen time.Time) {
+		rt.shells[id] = &rootShell{ID: id, PID: pid, Service: "su-l", Method: "su-l", TargetUser: "root", StartedAt: started, LastSeen: lastSeen}
+	}
+	add("gone", 1<<22+1, at(8, 0), at(8, 10))
+	add("reused", os.Getpid(), at(8, 0), at(8, 20)) // el PID es del test, no de una shell
+	add("sin_pid", 0, at(8, 0), at(8, 0))
+	add("antes_del_arranque", 0, at(5, 0), at(5, 30))
+	add("sin_last_seen", 1<<22+2, at(9, 0), time.Time{})
+
+	// Una línea del PID de la shell mueve su última vista
+	rt.Observe(Event{Ts: at(8, 15), EventType: evSuSwitch, Payload: map[string]interface{}{"pid": 1<<22 + 1}})
+
+	ended := map[string]time.Time{}
+	for _, ev := range rt.Reap(at(12, 0)) {
+		ended[payloadString(ev.Payload, "shell_id")] = ev.Ts
+	}
+
+	want := map[string]time.Time{
+		"gone":               at(8, 15),
+		"reused":             at(8, 20),
+		"antes_del_arranque": at(5, 30),
+		"sin_last_seen":      at(9, 0),
+	}
+	for id, ts := range want {
+		if got, ok := ended[id]; !ok || !got.Equal(ts) {
+			t.Errorf("%s: cerrada en %v (%v), se esperaba %v", id, got, ok, ts)
+		}
+	}
+	if _, ok := ended["sin_pid"]; ok || rt.shells["sin_pid"] == nil {
+		t.Errorf("la shell sin PID posterior al arranque no debe cerrarse")
+	}
+}
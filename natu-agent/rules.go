@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// ----------------------------
+// Reglas de parseo declarativas
+// ----------------------------
+//
+// Además de los patrones fijos de sshd/sudo/su, el agente carga reglas de un
+// fichero JSON (rules_file en la configuración, por defecto
+// /etc/natu-agent/rules.json):
+//
+//	{
+//	  "rules": [
+//	    {
+//	      "name": "vsftpd-login-fallido",
+//	      "program": "vsftpd",
+//	      "pattern": "FAIL LOGIN: Client \"(?P<ip>[0-9a-fA-F.:]+)\"",
+//	      "event_type": "ftp_failed_login",
+//	      "severity": 3,
+//	      "fields": {"remote_ip": "${ip}"},
+//	      "int_fields": []
+//	    }
+//	  ]
+//	}
+//
+// "program" es el nombre del programa de syslog ("*" para cualquiera) y
+// "pattern" una regex de Go con capturas con nombre. Si "fields" se omite se
+// copian todas las capturas al payload; si no, cada valor es una plantilla con
+// $nombre / ${nombre}. "int_fields" convierte esos campos a entero. Las reglas
+// se evalúan en orden y antes que las internas: la primera que casa gana.
+// El fichero se valida al arrancar (error fatal) y se recarga con SIGHUP
+// (si la versión nueva no es válida se mantiene la anterior).
+
+const defaultRulesPath = "/etc/natu-agent/rules.json"
+
+var reEventTypeName = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+var reTemplateRef = regexp.MustCompile(`\$\{?([A-Za-z_][A-Za-z0-9_]*)\}?`)
+
+type ParserRule struct {
+	Name      string            `json:"name"`
+	Program   string            `json:"program"`
+	Pattern   string            `json:"pattern"`
+	EventType string            `json:"event_type"`
+	Severity  int               `json:"severity"`
+	Source    string            `json:"source,omitempty"`
+	Fields    map[string]string `json:"fields,omitempty"`
+	IntFields []string          `json:"int_fields,omitempty"`
+
+	re *regexp.Regexp
+}
+
+type RulesFile struct {
+	Rules []ParserRule `json:"rules"`
+}
+
+type RuleSet struct {
+	Path  string
+	Rules []*ParserRule
+}
+
+// Reglas activas; se sustituyen enteras al recargar
+var activeRules atomic.Pointer[RuleSet]
+
+// LoadRules lee y valida el fichero. Que no exista no es un error: el agente
+// funciona sólo con las reglas internas.
+func LoadRules(path string) (*RuleSet, error) {
+	rs := &RuleSet{Path: path}
+
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return rs, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("leyendo reglas %s: %w", path, err)
+	}
+
+	var rf RulesFile
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&rf); err != nil {
+		return nil, fmt.Errorf("reglas %s: JSON inválido: %w", path, err)
+	}
+
+	var problems []string
+	names := map[string]bool{}
+	for i := range rf.Rules {
+		r := &rf.Rules[i]
+		label := fmt.Sprintf("regla #%d", i+1)
+		if r.Name != "" {
+			label = fmt.Sprintf("regla #%d (%s)", i+1, r.Name)
+		}
+		for _, p := range r.validate() {
+			problems = append(problems, label+": "+p)
+		}
+		if r.Name != "" {
+			if names[r.Name] {
+				problems = append(problems, label+": nombre repetido")
+			}
+			names[r.Name] = true
+		}
+		rs.Rules = append(rs.Rules, r)
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("reglas %s inválidas:\n  %s", path, strings.Join(problems, "\n  "))
+	}
+	return rs, nil
+}
+
+func (r *ParserRule) validate() []string {
+	var problems []string
+
+	if r.Name == "" {
+		problems = append(problems, "falta name")
+	}
+	if r.Program == "" {
+		problems = append(problems, `falta program (use "*" para cualquiera)`)
+	}
+	if !reEventTypeName.MatchString(r.EventType) {
+		problems = append(problems, fmt.Sprintf("event_type %q inválido (minúsculas, dígitos y _)", r.EventType))
+	}
+	if r.Severity < 1 || r.Severity > 5 {
+		problems = append(problems, fmt.Sprintf("severity %d fuera de rango (1-5)", r.Severity))
+	}
+	if r.Source == "" {
+		r.Source = "auth"
+	}
+
+	re, err := regexp.Compile(r.Pattern)
+	if r.Pattern == "" {
+		problems = append(problems, "falta pattern")
+	} else if err != nil {
+		problems = append(problems, fmt.Sprintf("pattern no compila: %v", err))
+	}
+	if re == nil {
+		return problems
+	}
+	r.re = re
+
+	captures := map[string]bool{}
+	for _, n := range re.SubexpNames() {
+		if n == "" {
+			continue
+		}
+		// Sin fields las capturas van tal cual al payload
+		if reservedPayloadField(n) {
+			problems = append(problems, fmt.Sprintf("captura %q reservada", n))
+		}
+		captures[n] = true
+	}
+	for field, tmpl := range r.Fields {
+		if field == "" || reservedPayloadField(field) {
+			problems = append(problems, fmt.Sprintf("campo %q reservado", field))
+		}
+		for _, m := range reTemplateRef.FindAllStringSubmatch(tmpl, -1) {
+			if !captures[m[1]] {
+				problems = append(problems, fmt.Sprintf("campo %q usa la captura inexistente %q", field, m[1]))
+			}
+		}
+	}
+	for _, f := range r.IntFields {
+		if _, ok := r.Fields[f]; !ok && !captures[f] {
+			problems = append(problems, fmt.Sprintf("int_fields: %q no es un campo de la regla", f))
+		}
+	}
+	return problems
+}
+
+// Programs devuelve los programas que usan las reglas (sin "*"), para
+// añadirlos al filtro de journald.
+func (rs *RuleSet) Programs() []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, r := range rs.Rules {
+		if r.Program != "*" && !seen[r.Program] {
+			seen[r.Program] = true
+			out = append(out, r.Program)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// applyCustomRules prueba las reglas del fichero sobre la entrada.
+func applyCustomRules(e authEntry) *Event {
+	rs := activeRules.Load()
+	if rs == nil {
+		return nil
+	}
+
+	for _, r := range rs.Rules {
+		if r.Program != "*" && r.Program != e.Program {
+			continue
+		}
+		idx := r.re.FindStringSubmatchIndex(e.Msg)
+		if idx == nil {
+			continue
+		}
+		return r.event(e, idx)
+	}
+	return nil
+}
+
+// reservedPayloadField: claves que pone el agente y una regla no puede pisar.
+func reservedPayloadField(name string) bool {
+	return name == "raw_line" || name == "rule"
+}
+
+func (r *ParserRule) event(e authEntry, idx []int) *Event {
+	payload := map[string]interface{}{
+		"raw_line": e.RawLine,
+		"rule":     r.Name,
+	}
+
+	if len(r.Fields) == 0 {
+		for i, name := range r.re.SubexpNames() {
+			if name == "" || idx[2*i] < 0 {
+				continue
+			}
+			payload[name] = e.Msg[idx[2*i]:idx[2*i+1]]
+		}
+	} else {
+		for field, tmpl := range r.Fields {
+			payload[field] = string(r.re.ExpandString(nil, tmpl, e.Msg, idx))
+		}
+	}
+
+	for _, f := range r.IntFields {
+		if s, ok := payload[f].(string); ok {
+			if n, err := strconv.Atoi(s); err == nil {
+				payload[f] = n
+			}
+		}
+	}
+	if user, ok := payload["username"].(string); ok && user != "" {
+		payload["is_root"] = user == "root"
+	}
+
+	return &Event{
+		Ts:        e.Ts,
+		Source:    r.Source,
+		EventType: r.EventType,
+		Severity:  r.Severity,
+		Payload:   payload,
+	}
+}
+
+// ReloadRules vuelve a leer el fichero; si falla se conservan las reglas
+// actuales.
+func ReloadRules(path string) {
+	rs, err := LoadRules(path)
+	if err != nil {
+		log.Printf("⚠️  %v (se mantienen las reglas anteriores)", err)
+		return
+	}
+	activeRules.Store(rs)
+	log.Printf("Reglas recargadas desde %s: %d reglas", path, len(rs.Rules))
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------------------------
+// Sesiones SSH
+// ----------------------------
+//
+// sshd no registra el fin de sesión junto al login, así que reconstruimos las
+// sesiones siguiendo el PID: "Accepted ..." abre la sesión (ssh_session_start)
+// y pam_unix(sshd:session) "session closed" o "Disconnected from user" la
+// cierran (ssh_session_end con la duración). "session opened" sólo abre
+// sesión si no vimos el Accepted (p.ej. login anterior al agente). El estado
+// se persiste en sessions.json para sobrevivir a los reinicios del agente.
+//
+// Las sesiones que empezaron antes del arranque del host (btime de
+// /proc/stat), p.ej. al releer un auth.log antiguo, no se siguen: su PID ya
+// no significa nada. Las que se cierran sin log (Reap) terminan en la última
+// línea vista de su PID, no en el momento de la limpieza.
+
+const (
+	evPamSessionOpened = "ssh_pam_session_opened"
+	evPamSessionClosed = "ssh_pam_session_closed"
+)
+
+type sshSession struct {
+	ID         string    `json:"id"`
+	PID        int       `json:"pid"`
+	Username   string    `json:"username"`
+	RemoteIP   string    `json:"remote_ip,omitempty"`
+	DstPort    int       `json:"dst_port,omitempty"`
+	AuthMethod string    `json:"auth_method,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	// Última línea de log de este PID
+	LastSeen time.Time `json:"last_seen"`
+}
+
+type SessionTracker struct {
+	hostname string
+	path     string
+	// Arranque del host; cero si no se pudo leer
+	bootTime time.Time
+
+	mu       sync.Mutex
+	sessions map[int]*sshSession
+}
+
+func OpenSessionTracker(dir, hostname string) (*SessionTracker, error) {
+	st := &SessionTracker{
+		hostname: hostname,
+		path:     filepath.Join(dir, "sessions.json"),
+		sessions: make(map[int]*sshSession),
+	}
+	if bt, err := readBootTime(); err == nil {
+		st.bootTime = bt
+	} else {
+		log.Printf("⚠️  sesiones: no se pudo leer el arranque del host: %v", err)
+	}
+
+	b, err := os.ReadFile(st.path)
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("leyendo sesiones: %w", err)
+	}
+	if err := json.Unmarshal(b, &st.sessions); err != nil {
+		log.Printf("⚠️  sesiones corruptas en %s, se descartan: %v", st.path, err)
+		st.sessions = make(map[int]*sshSession)
+	}
+	return st, nil
+}
+
+// Observe recibe cada evento parseado y devuelve los que hay que enviar: el
+// propio evento y/o los ssh_session_start/end derivados. Los eventos internos
+// de pam no se envían.
+func (st *SessionTracker) Observe(ev *Event) []Event {
+	if ev == nil {
+		return nil
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	pid := payloadInt(ev.Payload, "pid")
+	if s := st.sessions[pid]; s != nil && ev.Ts.After(s.LastSeen) {
+		s.LastSeen = ev.Ts
+	}
+
+	switch ev.EventType {
+	case "ssh_login_success":
+		out := []Event{*ev}
+		if pid <= 0 || st.beforeBoot(ev.Ts) {
+			return out
+		}
+		s := &sshSession{
+			PID:        pid,
+			Username:   payloadString(ev.Payload, "username"),
+			RemoteIP:   payloadString(ev.Payload, "remote_ip"),
+			DstPort:    payloadInt(ev.Payload, "dst_port"),
+			AuthMethod: payloadString(ev.Payload, "auth_method"),
+			StartedAt:  ev.Ts,
+			LastSeen:   ev.Ts,
+		}
+		s.ID = st.sessionID(s)
+		st.sessions[pid] = s
+		st.saveLocked()
+		return append(out, st.sessionEvent(s, "ssh_session_start", ev.Ts, payloadString(ev.Payload, "raw_line"), ""))
+
+	case evPamSessionOpened:
+		if st.sessions[pid] != nil || pid <= 0 || st.beforeBoot(ev.Ts) {
+			return nil
+		}
+		// Login anterior al arranque del agente: abrimos con lo que sabemos
+		s := &sshSession{PID: pid, Username: payloadString(ev.Payload, "username"), StartedAt: ev.Ts, LastSeen: ev.Ts}
+		s.ID = st.sessionID(s)
+		st.sessions[pid] = s
+		st.saveLocked()
+		return []Event{st.sessionEvent(s, "ssh_session_start", ev.Ts, payloadString(ev.Payload, "raw_line"), "")}
+
+	case evPamSessionClosed:
+		s := st.sessions[pid]
+		if s == nil {
+			return nil
+		}
+		delete(st.sessions, pid)
+		st.saveLocked()
+		return []Event{st.sessionEvent(s, "ssh_session_end", ev.Ts, payloadString(ev.Payload, "raw_line"), "session_closed")}
+
+	case "ssh_disconnected":
+		out := []Event{*ev}
+		if preauth, _ := ev.Payload["preauth"].(bool); preauth {
+			return out
+		}
+		s := st.findForDisconnect(pid, ev)
+		if s == nil {
+			return out
+		}
+		delete(st.sessions, s.PID)
+		st.saveLocked()
+		return append(out, st.sessionEvent(s, "ssh_session_end", ev.Ts, payloadString(ev.Payload, "raw_line"), "disconnected"))
+	}
+
+	return []Event{*ev}
+}
+
+// findForDisconnect busca la sesión por PID y, si no, por usuario/IP/puerto:
+// en versiones antiguas de OpenSSH "Disconnected" lo escribe el proceso hijo.
+func (st *SessionTracker) findForDisconnect(pid int, ev *Event) *sshSession {
+	if s := st.sessions[pid]; s != nil {
+		return s
+	}
+	user := payloadString(ev.Payload, "username")
+	ip := payloadString(ev.Payload, "remote_ip")
+	port := payloadInt(ev.Payload, "dst_port")
+	for _, s := range st.sessions {
+		if s.Username == user && s.RemoteIP == ip && s.DstPort == port {
+			return s
+		}
+	}
+	return nil
+}
+
+// ActiveFor devuelve la sesión activa más reciente del usuario, para
+// vincular las shells de root con la conexión SSH de la que vienen.
+func (st *SessionTracker) ActiveFor(username string) *sshSession {
+	if username == "" {
+		return nil
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	var last *sshSession
+	for _, s := range st.sessions {
+		if s.Username != username {
+			continue
+		}
+		if last == nil || s.StartedAt.After(last.StartedAt) {
+			last = s
+		}
+	}
+	if last == nil {
+		return nil
+	}
+	cp := *last
+	return &cp
+}
+
+// Reap cierra las sesiones cuyo proceso sshd ya no existe (reinicio del host,
+// kill -9...), para que no queden activas para siempre. Una sesión anterior
+// al arranque se cierra aunque el PID exista: lo ha reutilizado otro proceso,
+// igual que si el PID ya no es de sshd. Se cierran en su última línea vista.
+func (st *SessionTracker) Reap(now time.Time) []Event {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	var out []Event
+	for pid, s := range st.sessions {
+		if !st.beforeBoot(s.StartedAt) && sshdAlive(pid) {
+			continue
+		}
+		end := s.LastSeen
+		if end.Before(s.StartedAt) {
+			// sessions.json de versiones sin last_seen
+			end = s.StartedAt
+		}
+		delete(st.sessions, pid)
+		out = append(out, st.sessionEvent(s, "ssh_session_end", end.UTC(), "", "process_gone"))
+	}
+	if len(out) > 0 {
+		st.saveLocked()
+	}
+	return out
+}
+
+func (st *SessionTracker) beforeBoot(ts time.Time) bool {
+	return !st.bootTime.IsZero() && ts.Before(st.bootTime)
+}
+
+// sshdAlive: el PID existe y sigue siendo un sshd.
+func sshdAlive(pid int) bool {
+	comm, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/comm")
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(strings.TrimSpace(string(comm)), "sshd")
+}
+
+// readBootTime lee btime (segundos epoch del arranque) de /proc/stat.
+func readBootTime() (time.Time, error) {
+	b, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if v, ok := strings.CutPrefix(line, "btime "); ok {
+			secs, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("btime inválido: %w", err)
+			}
+			return time.Unix(secs, 0), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("btime no encontrado en /proc/stat")
+}
+
+func (st *SessionTracker) sessionID(s *sshSession) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d", st.hostname, s.PID, s.StartedAt.UnixNano())))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (st *SessionTracker) sessionEvent(s *sshSession, eventType string, ts time.Time, rawLine, endReason string) Event {
+	payload := map[string]interface{}{
+		"session_id": s.ID,
+		"pid":        s.PID,
+		"username":   s.Username,
+		"is_root":    s.Username == "root",
+		"started_at": s.StartedAt,
+	}
+	if rawLine != "" {
+		payload["raw_line"] = rawLine
+	}
+	if s.RemoteIP != "" {
+		payload["remote_ip"] = s.RemoteIP
+		payload["dst_port"] = s.DstPort
+	}
+	if s.AuthMethod != "" {
+		payload["auth_method"] = s.AuthMethod
+	}
+
+	severity := 2
+	if eventType == "ssh_session_end" {
+		severity = 1
+		payload["ended_at"] = ts
+		payload["duration_seconds"] = int64(ts.Sub(s.StartedAt).Seconds())
+		payload["end_reason"] = endReason
+	}
+
+	return Event{
+		Ts:        ts,
+		Source:    "auth",
+		EventType: eventType,
+		Severity:  severity,
+		Payload:   payload,
+	}
+}
+
+func (st *SessionTracker) saveLocked() {
+	b, err := json.Marshal(st.sessions)
+	if err != nil {
+		log.Printf("sesiones: error serializando: %v", err)
+		return
+	}
+	if err := writeFileAtomic(st.path, b); err != nil {
+		log.Printf("sesiones: error guardando %s: %v", st.path, err)
+	}
+}
+
+func payloadString(p map[string]interface{}, key string) string {
+	if v, ok := p[key].(string); ok {
+		return v
+	}
+	return ""
+}
+
+func payloadInt(p map[string]interface{}, key string) int {
+	switch v := p[key].(type) {
+	case int:
+		return v
+	case float64:
+		return int(v)
+	}
+	return 0
+}
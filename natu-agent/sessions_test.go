@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestSessionTracker crea un tracker en un directorio temporal con el
+// arranque del host fijado en boot.
+func newTestSessionTracker(t *testing.T, boot time.Time) *SessionTracker {
+	t.Helper()
+	st, err := OpenSessionTracker(t.TempDir(), "isov3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.bootTime = boot
+	return st
+}
+
+// observeLine parsea una línea de auth.log y la pasa por el tracker.
+func observeLine(t *testing.T, st *SessionTracker, line string) []Event {
+	t.Helper()
+	ev := parseAuthLine(line)
+	if ev == nil {
+		t.Fatalf("línea no reconocida: %s", line)
+	}
+	return st.Observe(ev)
+}
+
+func eventTypes(evs []Event) []string {
+	out := make([]string, len(evs))
+	for i, ev := range evs {
+		out[i] = ev.EventType
+	}
+	return out
+}
+
+func TestSessionTracker(t *testing.T) {
+	boot := time.Date(2025, 12, 8, 6, 0, 0, 0, time.UTC)
+	st := newTestSessionTracker(t, boot)
+
+	// Login completo: Accepted abre, pam opened no duplica, pam closed cierra
+	out := observeLine(t, st, "2025-12-08T08:00:00+00:00 isov3 sshd[2001]: Accepted publickey for alice from 198.51.100.4 port 50022 ssh2: ED25519 SHA256:Zm9v")
+	if got := eventTypes(out); len(got) != 2 || got[0] != "ssh_login_success" || got[1] != "ssh_session_start" {
+		t.Fatalf("Accepted: eventos %v", got)
+	}
+	sessionID := payloadString(out[1].Payload, "session_id")
+	if out[1].Payload["remote_ip"] != "198.51.100.4" || out[1].Payload["auth_method"] != "publickey" {
+		t.Errorf("ssh_session_start: payload %v", out[1].Payload)
+	}
+	if out := observeLine(t, st, "2025-12-08T08:00:00+00:00 isov3 sshd[2001]: pam_unix(sshd:session): session opened for user alice(uid=1000) by (uid=0)"); len(out) != 0 {
+		t.Errorf("pam opened tras Accepted: eventos %v", eventTypes(out))
+	}
+	if a := st.ActiveFor("alice"); a == nil || a.ID != sessionID {
+		t.Errorf("ActiveFor(alice) = %v", a)
+	}
+	out = observeLine(t, st, "2025-12-08T09:00:00+00:00 isov3 sshd[2001]: pam_unix(sshd:session): session closed for user alice")
+	if len(out) != 1 || out[0].EventType != "ssh_session_end" {
+		t.Fatalf("pam closed: eventos %v", eventTypes(out))
+	}
+	if out[0].Payload["session_id"] != sessionID || out[0].Payload["duration_seconds"] != int64(3600) || out[0].Payload["end_reason"] != "session_closed" {
+		t.Errorf("ssh_session_end: payload %v", out[0].Payload)
+	}
+	if st.ActiveFor("alice") != nil {
+		t.Errorf("la sesión de alice sigue activa")
+	}
+
+	// OpenSSH antiguo: Disconnected lo escribe otro PID, se busca por usuario/IP/puerto
+	observeLine(t, st, "2025-12-08T08:10:00+00:00 isov3 sshd[3001]: Accepted password for bob from 198.51.100.5 port 50100 ssh2")
+	out = observeLine(t, st, "2025-12-08T08:40:00+00:00 isov3 sshd[3002]: Disconnected from user bob 198.51.100.5 port 50100")
+	if got := eventTypes(out); len(got) != 2 || got[1] != "ssh_session_end" || out[1].Payload["end_reason"] != "disconnected" {
+		t.Errorf("Disconnected: eventos %v", got)
+	}
+
+	// Un Disconnected previo a la autenticación no cierra nada
+	observeLine(t, st, "2025-12-08T08:11:00+00:00 isov3 sshd[3101]: Accepted password for carol from 198.51.100.6 port 50200 ssh2")
+	out = observeLine(t, st, "2025-12-08T08:12:00+00:00 isov3 sshd[3101]: Disconnected from authenticating user carol 198.51.100.6 port 50200 [preauth]")
+	if len(out) != 1 || st.ActiveFor("carol") == nil {
+		t.Errorf("Disconnected [preauth] cerró la sesión: %v", eventTypes(out))
+	}
+
+	// Sin Accepted (login anterior al agente), pam opened abre la sesión
+	out = observeLine(t, st, "2025-12-08T08:20:00+00:00 isov3 sshd[4001]: pam_unix(sshd:session): session opened for user dave(uid=1001) by (uid=0)")
+	if len(out) != 1 || out[0].EventType != "ssh_session_start" || out[0].Payload["username"] != "dave" {
+		t.Errorf("pam opened sin Accepted: eventos %v", eventTypes(out))
+	}
+
+	// Anterior al arranque del host: no se sigue
+	out = observeLine(t, st, "2025-12-08T05:00:00+00:00 isov3 sshd[4101]: Accepted password for erin from 198.51.100.7 port 50300 ssh2")
+	if len(out) != 1 || st.ActiveFor("erin") != nil {
+		t.Errorf("sesión anterior al arranque: eventos %v", eventTypes(out))
+	}
+
+	// Reap cierra las sesiones sin proceso en su última línea vista (el PID
+	// está por encima de pid_max, así que no existe)
+	observeLine(t, st, "2025-12-08T08:30:00+00:00 isov3 sshd[4194305]: Accepted password for frank from 198.51.100.8 port 50400 ssh2")
+	observeLine(t, st, "2025-12-08T08:45:00+00:00 isov3 sshd[4194305]: Disconnected from authenticating user frank 198.51.100.8 port 50400 [preauth]")
+	ended := map[string]time.Time{}
+	for _, ev := range st.Reap(time.Date(2025, 12, 8, 12, 0, 0, 0, time.UTC)) {
+		ended[payloadString(ev.Payload, "username")] = ev.Ts
+	}
+	if ts, ok := ended["frank"]; !ok || !ts.Equal(time.Date(2025, 12, 8, 8, 45, 0, 0, time.UTC)) {
+		t.Errorf("Reap: frank cerrada en %v (%v)", ts, ok)
+	}
+}
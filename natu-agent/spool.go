@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------------------------
+// Spool en disco
+// ----------------------------
+//
+// Los eventos se escriben en segmentos JSONL dentro de spoolDir. Cada segmento
+// es un lote: se sella al llegar a batchSize eventos o cuando lleva
+// batchMaxWait abierto, y el sender lo envía entero a /api/v1/events/batch.
+// Sólo se borra del disco cuando natu-core responde 200, así que una caída del
+// core o un reinicio del agente no pierden eventos.
+//
+// Un lote puede llegar dos veces (core lo guardó pero la respuesta se perdió,
+// o el agente cayó antes de borrar el segmento): cada evento lleva un id
+// estable y natu-core ignora los que ya tiene.
+
+const (
+	segmentPrefix = "seg-"
+	openSuffix    = ".open"
+	sealedSuffix  = ".jsonl"
+	// Segmento que no se pudo leer, o que natu-core rechazó, tras
+	// spoolMaxAttempts: se aparta para revisarlo a mano, nunca se borra
+	quarantineSuffix = ".bad"
+	spoolMaxAttempts = 5
+	// Cabecera con la que natu-core marca un lote que no aceptará nunca
+	permanentRejectHeader = "X-Natu-Permanent"
+)
+
+type SpoolConfig struct {
+	Dir          string
+	BatchSize    int
+	BatchMaxWait time.Duration
+	MaxBytes     int64
+	MinBackoff   time.Duration
+	MaxBackoff   time.Duration
+}
+
+type Spool struct {
+	cfg SpoolConfig
+
+	mu       sync.Mutex
+	cur      *os.File
+	curSeq   uint64
+	curCount int
+	curSince time.Time
+	nextSeq  uint64
+
+	wake chan struct{}
+}
+
+func OpenSpool(cfg SpoolConfig) (*Spool, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creando spool %s: %w", cfg.Dir, err)
+	}
+
+	sp := &Spool{cfg: cfg, wake: make(chan struct{}, 1)}
+
+	// Los segmentos que quedaron abiertos tras un reinicio se sellan tal cual:
+	// lo que esté en disco se envía, sin esperar a completar el lote.
+	names, err := sp.listSegments(openSuffix)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		open := filepath.Join(cfg.Dir, name)
+		sealed := strings.TrimSuffix(open, openSuffix) + sealedSuffix
+		if err := os.Rename(open, sealed); err != nil {
+			return nil, fmt.Errorf("sellando segmento %s: %w", name, err)
+		}
+	}
+
+	sealed, err := sp.listSegments(sealedSuffix)
+	if err != nil {
+		return nil, err
+	}
+	bad, err := sp.listSegments(quarantineSuffix)
+	if err != nil {
+		return nil, err
+	}
+	// Los apartados también cuentan: un número reutilizado pisaría un .bad
+	for _, name := range append(sealed, bad...) {
+		if seq, ok := segmentSeq(name); ok && seq >= sp.nextSeq {
+			sp.nextSeq = seq + 1
+		}
+	}
+	if len(sealed) > 0 {
+		log.Printf("spool: %d lotes pendientes de envío en %s", len(sealed), cfg.Dir)
+	}
+	if len(bad) > 0 {
+		log.Printf("⚠️  spool: %d lotes apartados por ilegibles o rechazados (%s*%s) en %s", len(bad), segmentPrefix, quarantineSuffix, cfg.Dir)
+	}
+
+	return sp, nil
+}
+
+// Enqueue persiste el evento en el segmento abierto (con fsync) antes de
+// devolver. Si el segmento llega a BatchSize se sella y se despierta al sender.
+func (sp *Spool) Enqueue(ev Event) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	if sp.cur == nil {
+		name := fmt.Sprintf("%s%020d%s", segmentPrefix, sp.nextSeq, openSuffix)
+		f, err := os.OpenFile(filepath.Join(sp.cfg.Dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return fmt.Errorf("abriendo segmento: %w", err)
+		}
+		sp.cur = f
+		sp.curSeq = sp.nextSeq
+		sp.curCount = 0
+		sp.curSince = time.Now()
+		sp.nextSeq++
+	}
+
+	if _, err := sp.cur.Write(b); err != nil {
+		return fmt.Errorf("escribiendo segmento: %w", err)
+	}
+	if err := sp.cur.Sync(); err != nil {
+		return fmt.Errorf("sync segmento: %w", err)
+	}
+	sp.curCount++
+
+	if sp.curCount >= sp.cfg.BatchSize {
+		return sp.sealLocked()
+	}
+	return nil
+}
+
+func (sp *Spool) sealLocked() error {
+	if sp.cur == nil {
+		return nil
+	}
+	open := sp.cur.Name()
+	if err := sp.cur.Close(); err != nil {
+		log.Printf("spool: error cerrando segmento %s: %v", open, err)
+	}
+	sp.cur = nil
+
+	sealed := strings.TrimSuffix(open, openSuffix) + sealedSuffix
+	if err := os.Rename(open, sealed); err != nil {
+		return fmt.Errorf("sellando segmento: %w", err)
+	}
+
+	select {
+	case sp.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// sealIfDue sella el segmento abierto si lleva más de BatchMaxWait con eventos.
+func (sp *Spool) sealIfDue() {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	if sp.cur == nil || sp.curCount == 0 {
+		return
+	}
+	if time.Since(sp.curSince) < sp.cfg.BatchMaxWait {
+		return
+	}
+	if err := sp.sealLocked(); err != nil {
+		log.Printf("spool: %v", err)
+	}
+}
+
+func (sp *Spool) listSegments(suffix string) ([]string, error) {
+	entries, err := os.ReadDir(sp.cfg.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("leyendo spool: %w", err)
+	}
+	var names []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		names = append(names, name)
+	}
+	// El número de secuencia va con ceros a la izquierda: orden léxico == orden FIFO
+	sort.Strings(names)
+	return names, nil
+}
+
+func segmentSeq(name string) (uint64, bool) {
+	s := strings.TrimPrefix(name, segmentPrefix)
+	s = strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(s, sealedSuffix), openSuffix), quarantineSuffix)
+	seq, err := strconv.ParseUint(s, 10, 64)
+	return seq, err == nil
+}
+
+// SetLimits aplica el tamaño de lote, la espera y el límite de disco de una
+// configuración recargada. El directorio no cambia en caliente.
+func (sp *Spool) SetLimits(cfg SpoolConfig) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	sp.cfg.BatchSize = cfg.BatchSize
+	sp.cfg.BatchMaxWait = cfg.BatchMaxWait
+	sp.cfg.MaxBytes = cfg.MaxBytes
+}
+
+// enforceLimit descarta los lotes más antiguos si el spool supera MaxBytes,
+// para no llenar el disco durante una caída larga de natu-core.
+func (sp *Spool) enforceLimit(sealed []string) []string {
+	sp.mu.Lock()
+	maxBytes := sp.cfg.MaxBytes
+	sp.mu.Unlock()
+
+	if maxBytes <= 0 {
+		return sealed
+	}
+
+	var total int64
+	sizes := make([]int64, len(sealed))
+	for i, name := range sealed {
+		if fi, err := os.Stat(filepath.Join(sp.cfg.Dir, name)); err == nil {
+			sizes[i] = fi.Size()
+			total += fi.Size()
+		}
+	}
+
+	dropped := 0
+	for total > maxBytes && dropped < len(sealed)-1 {
+		if err := os.Remove(filepath.Join(sp.cfg.Dir, sealed[dropped])); err != nil {
+			log.Printf("spool: error descartando %s: %v", sealed[dropped], err)
+			break
+		}
+		total -= sizes[dropped]
+		dropped++
+	}
+	if dropped > 0 {
+		log.Printf("⚠️  spool lleno: descartados %d lotes antiguos (límite %d MB)", dropped, maxBytes>>20)
+	}
+	return sealed[dropped:]
+}
+
+func readSegment(path string) ([]Event, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []Event
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var ev Event
+		if err := json.Unmarshal(line, &ev); err != nil {
+			// Una escritura cortada por un crash deja la última línea incompleta
+			log.Printf("spool: línea corrupta en %s descartada: %v", filepath.Base(path), err)
+			continue
+		}
+		events = append(events, ev)
+	}
+	return events, scanner.Err()
+}
+
+// eventIDs da a cada evento un id estable. Los que salen de una línea (origin)
+// se identifican por la línea, el tipo y su orden entre los de ese tipo; los
+// que no tienen origen (sesiones y shells cerradas por Reap) por su
+// contenido, que incluye el id de sesión o de shell.
+func eventIDs(origin string, events []Event) {
+	seen := map[string]int{}
+	for i := range events {
+		ev := &events[i]
+		if origin == "" {
+			ev.ID = ""
+			b, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			ev.ID = lineHash(string(b))[:32]
+			continue
+		}
+		n := seen[ev.EventType]
+		seen[ev.EventType] = n + 1
+		ev.ID = lineHash(origin + "|" + ev.EventType + "|" + strconv.Itoa(n))[:32]
+	}
+}
+
+// ----------------------------
+// Sender
+// ----------------------------
+
+type batchSender struct {
+	hostname string
+}
+
+// errPermanent marca los lotes que natu-core declara inaceptables
+// (permanentRejectHeader): reintentarlos no sirve y se descartan.
+type errPermanent struct{ status int }
+
+func (e errPermanent) Error() string { return fmt.Sprintf("http %d", e.status) }
+
+// errRejected es un 400/413/422 sin esa marca: puede venir de un proxy o de
+// un cuerpo truncado, así que se reintenta y, si persiste, el lote se aparta
+// como .bad. El resto (401 por secret, 5xx...) se reintenta sin límite.
+type errRejected struct{ status int }
+
+func (e errRejected) Error() string { return fmt.Sprintf("http %d", e.status) }
+
+func (bs *batchSender) send(events []Event) error {
+	conn := activeServer.Load()
+	req := BatchRequest{
+		AgentSecret: conn.secret,
+		Hostname:    bs.hostname,
+		Events:      events,
+	}
+
+	b, err := json.Marshal(req)
+	if err != nil {
+		return errRejected{status: 0}
+	}
+
+	resp, err := conn.client.Post(conn.url+"/api/v1/events/batch", "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.Header.Get(permanentRejectHeader) != "":
+		return errPermanent{status: resp.StatusCode}
+	case resp.StatusCode == http.StatusBadRequest ||
+		resp.StatusCode == http.StatusRequestEntityTooLarge ||
+		resp.StatusCode == http.StatusUnprocessableEntity:
+		return errRejected{status: resp.StatusCode}
+	default:
+		return fmt.Errorf("http %d", resp.StatusCode)
+	}
+}
+
+// Run envía los lotes sellados en orden FIFO. Ante un error reintenta el
+// mismo lote con backoff exponencial hasta MaxBackoff; nunca avanza al
+// siguiente sin haber confirmado el anterior. Un segmento que no se puede
+// leer entero (open o scanner) tampoco se envía a medias, y uno que natu-core
+// rechaza sin marcarlo como definitivo no se borra: en ambos casos se
+// reintenta y, si sigue fallando, se renombra a .bad. Sólo se descarta un
+// lote con permanentRejectHeader.
+func (sp *Spool) Run(bs *batchSender) {
+	tick := time.NewTicker(500 * time.Millisecond)
+	defer tick.Stop()
+
+	backoff := sp.cfg.MinBackoff
+	failures, failingSeg := 0, ""
+
+	wait := func() {
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > sp.cfg.MaxBackoff {
+			backoff = sp.cfg.MaxBackoff
+		}
+	}
+
+	// fail cuenta un fallo del segmento y lo aparta al llegar a
+	// spoolMaxAttempts. Devuelve true si hay que esperar antes de seguir.
+	fail := func(seg, path, what string, err error) bool {
+		if failingSeg != seg {
+			failures, failingSeg = 0, seg
+		}
+		failures++
+		if failures < spoolMaxAttempts {
+			log.Printf("spool: %s %s: %v; reintento en %s", what, seg, err, backoff)
+			return true
+		}
+		bad := strings.TrimSuffix(path, sealedSuffix) + quarantineSuffix
+		if rerr := os.Rename(path, bad); rerr != nil {
+			log.Printf("spool: error apartando %s: %v; reintento en %s", seg, rerr, backoff)
+			return true
+		}
+		log.Printf("❌ spool: %s %s tras %d intentos (%v), apartado como %s", what, seg, failures, err, filepath.Base(bad))
+		failures = 0
+		backoff = sp.cfg.MinBackoff
+		return false
+	}
+
+	for {
+		sp.sealIfDue()
+
+		sealed, err := sp.listSegments(sealedSuffix)
+		if err != nil {
+			log.Printf("spool: %v", err)
+		}
+		sealed = sp.enforceLimit(sealed)
+
+		if len(sealed) == 0 {
+			select {
+			case <-sp.wake:
+			case <-tick.C:
+			}
+			continue
+		}
+
+		path := filepath.Join(sp.cfg.Dir, sealed[0])
+		events, err := readSegment(path)
+		if err != nil {
+			if fail(sealed[0], path, "error leyendo", err) {
+				wait()
+			}
+			continue
+		}
+
+		if len(events) > 0 {
+			err = bs.send(events)
+			var perm errPermanent
+			var rejected errRejected
+			switch {
+			case errors.As(err, &perm):
+				log.Printf("❌ lote %s rechazado por natu-core como definitivo (%v), se descarta (%d eventos)", sealed[0], perm, len(events))
+			case errors.As(err, &rejected):
+				if fail(sealed[0], path, "lote rechazado", err) {
+					wait()
+				}
+				continue
+			case err != nil:
+				log.Printf("Error enviando lote (%d eventos): %v; reintento en %s", len(events), err, backoff)
+				wait()
+				continue
+			default:
+				log.Printf("Lote enviado (%d eventos)", len(events))
+			}
+		}
+
+		failures = 0
+		backoff = sp.cfg.MinBackoff
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("spool: error borrando %s: %v", sealed[0], err)
+		}
+	}
+}
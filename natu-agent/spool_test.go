@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEventIDs(t *testing.T) {
+	ts := time.Date(2025, 12, 8, 8, 54, 37, 0, time.UTC)
+	batch := func() []Event {
+		return []Event{
+			{Ts: ts, Source: "auth", EventType: "ssh_session_end", Payload: map[string]interface{}{"session_id": "a"}},
+			{Ts: ts, Source: "auth", EventType: "root_shell_end", Payload: map[string]interface{}{"shell_id": "x"}},
+			{Ts: ts, Source: "auth", EventType: "root_shell_end", Payload: map[string]interface{}{"shell_id": "y"}},
+		}
+	}
+	origin := lineOrigin(42, 1024, "Dec  8 08:54:37 isov3 sshd[1]: Disconnected from user root")
+
+	first, again := batch(), batch()
+	eventIDs(origin, first)
+	eventIDs(origin, again)
+
+	ids := map[string]bool{}
+	for i := range first {
+		if first[i].ID == "" || first[i].ID != again[i].ID {
+			t.Errorf("evento %d: id %q no es estable (%q)", i, first[i].ID, again[i].ID)
+		}
+		ids[first[i].ID] = true
+	}
+	if len(ids) != len(first) {
+		t.Errorf("ids repetidos dentro de la misma línea: %v", ids)
+	}
+
+	// La misma línea en otro offset (fichero truncado y reescrito) es otra
+	other := batch()
+	eventIDs(lineOrigin(42, 2048, "Dec  8 08:54:37 isov3 sshd[1]: Disconnected from user root"), other)
+	if other[0].ID == first[0].ID {
+		t.Errorf("la misma línea en otro offset reutiliza el id %q", other[0].ID)
+	}
+
+	// Sin origen el id sale del contenido
+	reaped, reapedAgain := batch(), batch()
+	eventIDs("", reaped)
+	eventIDs("", reapedAgain)
+	if reaped[1].ID == "" || reaped[1].ID != reapedAgain[1].ID || reaped[1].ID == reaped[2].ID {
+		t.Errorf("ids por contenido: %q %q %q", reaped[1].ID, reapedAgain[1].ID, reaped[2].ID)
+	}
+}
+
+func TestSpoolRejectedBatch(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		permanent bool
+		wantBad   bool
+		wantCalls int32
+	}{
+		{name: "400 de un proxy se aparta", status: http.StatusBadRequest, wantBad: true, wantCalls: spoolMaxAttempts},
+		{name: "rechazo definitivo de natu-core se descarta", status: http.StatusUnprocessableEntity, permanent: true, wantCalls: 1},
+	}
+
+	for _, tt := range tests {
+		var calls atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			if tt.permanent {
+				w.Header().Set(permanentRejectHeader, "1")
+			}
+			http.Error(w, "rechazado", tt.status)
+		}))
+		activeServer.Store(&serverConn{client: srv.Client(), url: srv.URL, secret: "s"})
+
+		dir := t.TempDir()
+		sp, err := OpenSpool(SpoolConfig{
+			Dir: dir, BatchSize: 2, BatchMaxWait: time.Hour, MaxBytes: 1 << 20,
+			MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			if err := sp.Enqueue(Event{Source: "auth", EventType: "ssh_failed_login"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		go sp.Run(&batchSender{hostname: "h"})
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			pending, _ := filepath.Glob(filepath.Join(dir, "*"+sealedSuffix))
+			if len(pending) == 0 || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		srv.Close()
+
+		bad, _ := filepath.Glob(filepath.Join(dir, "*"+quarantineSuffix))
+		if (len(bad) == 1) != tt.wantBad {
+			t.Errorf("%s: segmentos apartados = %v", tt.name, bad)
+		}
+		if got := calls.Load(); got != tt.wantCalls {
+			t.Errorf("%s: %d envíos, se esperaban %d", tt.name, got, tt.wantCalls)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ----------------------------
+// Tail con reanudación
+// ----------------------------
+//
+// FileTailer sigue un fichero de log por polling llevando la cuenta exacta
+// del offset consumido. Sólo avanza el checkpoint cuando el handler acepta la
+// línea (evento ya en el spool), así que tras un reinicio o un logrotate cada
+// línea se lee una única vez. Si el agente cae entre encolar un evento y
+// guardar el checkpoint, la línea se relee, pero sus eventos llevan el mismo
+// id (lineOrigin) y natu-core descarta los repetidos.
+
+// LineHandler procesa una línea completa. origin la identifica (lineOrigin).
+// Devuelve true si generó un evento (en ese caso el checkpoint se persiste de
+// inmediato). Si devuelve error la línea se reintenta.
+type LineHandler func(text, origin string) (bool, error)
+
+type FileTailer struct {
+	path  string
+	key   string
+	store *CheckpointStore
+	poll  time.Duration
+
+	f       *os.File
+	r       *bufio.Reader
+	inode   uint64
+	offset  int64
+	partial []byte
+
+	lastHash    string
+	lastPartial bool
+	lastSave    time.Time
+	dirty       bool
+}
+
+func NewFileTailer(path string, store *CheckpointStore) *FileTailer {
+	return &FileTailer{
+		path:  path,
+		key:   "file:" + path,
+		store: store,
+		poll:  500 * time.Millisecond,
+	}
+}
+
+func fileInode(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
+
+// Run no retorna: lee lo pendiente según el checkpoint y luego sigue el fichero.
+func (ft *FileTailer) Run(handle LineHandler) {
+	ft.resume(handle)
+
+	for {
+		if ft.f == nil {
+			if err := ft.open(ft.path, 0); err != nil {
+				time.Sleep(ft.poll)
+				continue
+			}
+		}
+
+		ft.drain(handle)
+
+		fi, err := os.Stat(ft.path)
+		switch {
+		case err != nil:
+			// El fichero desapareció (rotación en curso): seguimos con el fd viejo
+		case fileInode(fi) != ft.inode:
+			// Logrotate movió el fichero: apuramos el viejo antes de cambiar,
+			// dando un ciclo extra por si el demonio aún no reabrió su log.
+			time.Sleep(ft.poll)
+			ft.drain(handle)
+			ft.flushPartial(handle)
+			log.Printf("tail: %s rotado, siguiendo el fichero nuevo", ft.path)
+			ft.close()
+			continue
+		case fi.Size() < ft.offset:
+			log.Printf("tail: %s truncado (%d < %d), releyendo desde el inicio", ft.path, fi.Size(), ft.offset)
+			ft.close()
+			if err := ft.open(ft.path, 0); err != nil {
+				log.Printf("tail: error reabriendo %s: %v", ft.path, err)
+			}
+			continue
+		}
+
+		if ft.dirty && time.Since(ft.lastSave) >= 2*time.Second {
+			ft.saveCheckpoint()
+		}
+		time.Sleep(ft.poll)
+	}
+}
+
+// resume decide desde dónde leer al arrancar.
+func (ft *FileTailer) resume(handle LineHandler) {
+	var fi os.FileInfo
+	for {
+		var err error
+		if fi, err = os.Stat(ft.path); err == nil {
+			break
+		}
+		log.Printf("tail: esperando a %s: %v", ft.path, err)
+		time.Sleep(5 * time.Second)
+	}
+
+	cp, ok := ft.store.Get(ft.key)
+	if !ok {
+		if err := ft.open(ft.path, 0); err != nil {
+			log.Printf("tail: error abriendo %s: %v", ft.path, err)
+		}
+		return
+	}
+
+	if fileInode(fi) == cp.Inode {
+		offset := cp.Offset
+		if fi.Size() < offset || !verifyLineHash(ft.path, offset, cp.LastLineHash, cp.PartialLine) {
+			log.Printf("tail: %s no coincide con el checkpoint, releyendo desde el inicio", ft.path)
+			offset = 0
+		}
+		if err := ft.open(ft.path, offset); err != nil {
+			log.Printf("tail: error abriendo %s: %v", ft.path, err)
+		}
+		return
+	}
+
+	// El fichero rotó con el agente parado: buscamos el inode del checkpoint
+	// entre los rotados (auth.log.1, auth.log-20250101...) y lo apuramos.
+	if rotated := findRotated(ft.path, cp.Inode); rotated != "" {
+		if verifyLineHash(rotated, cp.Offset, cp.LastLineHash, cp.PartialLine) {
+			log.Printf("tail: drenando %s desde offset %d antes de seguir %s", rotated, cp.Offset, ft.path)
+			if err := ft.open(rotated, cp.Offset); err == nil {
+				ft.drain(handle)
+				ft.flushPartial(handle)
+				ft.close()
+			}
+		} else {
+			log.Printf("⚠️  tail: %s no coincide con el checkpoint, se omite", rotated)
+		}
+	} else {
+		log.Printf("⚠️  tail: no se encontró el fichero rotado de %s (inode %d); pueden faltar líneas", ft.path, cp.Inode)
+	}
+
+	if err := ft.open(ft.path, 0); err != nil {
+		log.Printf("tail: error abriendo %s: %v", ft.path, err)
+	}
+}
+
+func findRotated(path string, inode uint64) string {
+	var candidates []string
+	for _, pattern := range []string{path + ".*", path + "-*"} {
+		matches, _ := filepath.Glob(pattern)
+		candidates = append(candidates, matches...)
+	}
+	sort.Strings(candidates)
+
+	for _, c := range candidates {
+		if strings.HasSuffix(c, ".gz") || strings.HasSuffix(c, ".xz") || strings.HasSuffix(c, ".bz2") {
+			continue
+		}
+		fi, err := os.Stat(c)
+		if err != nil || fi.IsDir() {
+			continue
+		}
+		if fileInode(fi) == inode {
+			return c
+		}
+	}
+	return ""
+}
+
+// verifyLineHash comprueba que la línea que termina justo en offset es la
+// misma que registramos en el checkpoint. Si se entregó sin '\n' (partial),
+// tiene que seguir siendo la última del fichero: si el escritor la completó
+// después, offset ya no cae en un final de línea.
+func verifyLineHash(path string, offset int64, hash string, partial bool) bool {
+	if offset == 0 || hash == "" {
+		return offset == 0
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	start := offset - 64*1024
+	if start < 0 {
+		start = 0
+	}
+	buf := make([]byte, offset-start+1)
+	n, err := f.ReadAt(buf, start)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false
+	}
+	if int64(n) < offset-start {
+		return false
+	}
+	next := buf[offset-start : n]
+	buf = buf[:offset-start]
+
+	if partial {
+		if len(next) > 0 && next[0] != '\n' {
+			return false
+		}
+	} else {
+		if len(buf) == 0 || buf[len(buf)-1] != '\n' {
+			return false
+		}
+		buf = buf[:len(buf)-1]
+	}
+	if i := bytes.LastIndexByte(buf, '\n'); i >= 0 {
+		buf = buf[i+1:]
+	}
+	return lineHash(strings.TrimRight(string(buf), "\r")) == hash
+}
+
+func (ft *FileTailer) open(path string, offset int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	ft.f = f
+	ft.r = bufio.NewReaderSize(f, 64*1024)
+	ft.inode = fileInode(fi)
+	ft.offset = offset
+	ft.partial = nil
+	return nil
+}
+
+func (ft *FileTailer) close() {
+	if ft.f != nil {
+		_ = ft.f.Close()
+	}
+	ft.f = nil
+	ft.r = nil
+	ft.partial = nil
+}
+
+// drain lee hasta EOF. Una línea sin '\n' final se guarda en partial hasta
+// que el escritor la complete.
+func (ft *FileTailer) drain(handle LineHandler) {
+	if ft.r == nil {
+		return
+	}
+	for {
+		chunk, err := ft.r.ReadBytes('\n')
+		if len(chunk) > 0 {
+			ft.partial = append(ft.partial, chunk...)
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Printf("tail: error leyendo %s: %v", ft.path, err)
+			}
+			return
+		}
+
+		full := ft.partial
+		ft.partial = nil
+		ft.deliver(handle, strings.TrimRight(string(full), "\r\n"), int64(len(full)), false)
+	}
+}
+
+// flushPartial entrega una última línea sin salto final (fichero rotado).
+func (ft *FileTailer) flushPartial(handle LineHandler) {
+	if len(ft.partial) == 0 {
+		return
+	}
+	full := ft.partial
+	ft.partial = nil
+	ft.deliver(handle, strings.TrimRight(string(full), "\r\n"), int64(len(full)), true)
+}
+
+// lineOrigin identifica una línea por el inode, el offset donde empieza y su
+// hash: es el mismo si se relee tras un reinicio o desde el fichero rotado,
+// y distinto si el fichero se trunca o el inode se reutiliza.
+func lineOrigin(inode uint64, offset int64, text string) string {
+	return fmt.Sprintf("file:%d:%d:%s", inode, offset, lineHash(text)[:16])
+}
+
+// deliver entrega una línea de n bytes; partial si no tenía '\n' final.
+func (ft *FileTailer) deliver(handle LineHandler, text string, n int64, partial bool) {
+	origin := lineOrigin(ft.inode, ft.offset, text)
+	var emitted bool
+	for {
+		var err error
+		emitted, err = handle(text, origin)
+		if err == nil {
+			break
+		}
+		log.Printf("tail: error procesando línea de %s, reintentando: %v", ft.path, err)
+		time.Sleep(time.Second)
+	}
+
+	ft.offset += n
+	ft.lastHash = lineHash(text)
+	ft.lastPartial = partial
+	ft.dirty = true
+
+	// Las líneas que no generan evento pueden releerse sin duplicar nada, así
+	// que para ellas basta con persistir el checkpoint de vez en cuando.
+	if emitted || time.Since(ft.lastSave) >= 2*time.Second {
+		ft.saveCheckpoint()
+	}
+}
+
+func (ft *FileTailer) saveCheckpoint() {
+	cp := Checkpoint{Inode: ft.inode, Offset: ft.offset, LastLineHash: ft.lastHash, PartialLine: ft.lastPartial}
+	if err := ft.store.Set(ft.key, cp); err != nil {
+		log.Printf("tail: error guardando checkpoint de %s: %v", ft.path, err)
+		return
+	}
+	ft.lastSave = time.Now()
+	ft.dirty = false
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyLineHash(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		offset  int
+		line    string
+		partial bool
+		want    bool
+	}{
+		{"línea completa", "uno\ndos\ntres\n", 8, "dos", false, true},
+		{"hash distinto", "uno\ndos\ntres\n", 8, "tres", false, false},
+		{"offset a mitad de línea", "uno\ndos\ntres\n", 6, "do", false, false},
+		{"offset más allá del final", "uno\n", 8, "uno", false, false},
+		{"última línea sin salto entregada al rotar", "uno\ndos", 7, "dos", true, true},
+		{"sin salto pero guardada como completa", "uno\ndos", 7, "dos", false, false},
+		{"sin salto y luego completada con salto", "uno\ndos\n", 7, "dos", true, true},
+		{"sin salto y luego continuada por el escritor", "uno\ndos más\n", 7, "dos", true, false},
+		{"sin salto con CRLF previo", "uno\r\ndos", 8, "dos", true, true},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "auth.log")
+		if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if got := verifyLineHash(path, int64(tt.offset), lineHash(tt.line), tt.partial); got != tt.want {
+			t.Errorf("%s: verifyLineHash = %v, se esperaba %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ----------------------------
+// Timestamps de syslog
+// ----------------------------
+//
+// auth.log puede venir en varios formatos según la distro y la config de
+// rsyslog/syslog-ng:
+//
+//	2025-12-08T08:54:37.490977+00:00 isov3 sshd[1]: ...   (RFC3339, rsyslog moderno)
+//	Dec  8 08:54:37 isov3 sshd[1]: ...                    (RFC3164 clásico)
+//	<38>1 2025-12-08T08:54:37Z isov3 sshd 1 - - ...       (RFC5424)
+//	2025-12-08 08:54:37 isov3 sshd[1]: ...                (ISO sin zona)
+//
+// parseSyslogPrefix detecta cuál es, devuelve el resto de la línea como
+// "host programa[pid]: mensaje" y el nombre del formato, que se guarda en el
+// payload (ts_format) para poder auditar de dónde salió la hora.
+
+const (
+	tsFormatRFC3339  = "rfc3339"
+	tsFormatRFC3164  = "rfc3164"
+	tsFormatRFC5424  = "rfc5424"
+	tsFormatISO8601  = "iso8601"
+	tsFormatJournald = "journald"
+	tsFormatUnknown  = "unknown"
+)
+
+// logLocation es la zona horaria del host, usada para los formatos sin zona.
+var logLocation = time.Local
+
+var isoLayouts = []string{
+	"2006-01-02T15:04:05.999999999Z0700",
+	"2006-01-02T15:04:05.999999999",
+}
+
+var isoSpaceLayouts = []string{
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999Z0700",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02 15:04:05,999999999",
+}
+
+func parseSyslogPrefix(line string, now time.Time) (time.Time, string, string) {
+	line = strings.TrimLeft(line, " ")
+
+	// <PRI> opcional (líneas reenviadas tal cual por la red)
+	if strings.HasPrefix(line, "<") {
+		if end := strings.IndexByte(line, '>'); end > 1 && end <= 4 {
+			if _, err := strconv.Atoi(line[1:end]); err == nil {
+				line = line[end+1:]
+			}
+		}
+	}
+
+	if strings.HasPrefix(line, "1 ") {
+		if ts, rest, ok := parseRFC5424(line[2:]); ok {
+			return ts, rest, tsFormatRFC5424
+		}
+	}
+
+	first, rest := splitToken(line)
+
+	if ts, err := time.Parse(time.RFC3339Nano, first); err == nil {
+		return ts.UTC(), rest, tsFormatRFC3339
+	}
+	for _, layout := range isoLayouts {
+		if ts, err := time.ParseInLocation(layout, first, logLocation); err == nil {
+			return ts.UTC(), rest, tsFormatISO8601
+		}
+	}
+
+	// "2025-12-08 08:54:37[.123][+01:00]" ocupa dos tokens
+	if len(first) == 10 && first[4] == '-' && first[7] == '-' {
+		second, rest2 := splitToken(rest)
+		for _, layout := range isoSpaceLayouts {
+			if ts, err := time.ParseInLocation(layout, first+" "+second, logLocation); err == nil {
+				return ts.UTC(), rest2, tsFormatISO8601
+			}
+		}
+	}
+
+	if ts, rest, ok := parseRFC3164(line, now); ok {
+		return ts, rest, tsFormatRFC3164
+	}
+
+	// Formato desconocido: como antes, primer token fuera y hora de recepción
+	return now.UTC(), rest, tsFormatUnknown
+}
+
+// parseRFC3164 interpreta "Mmm dd hh:mm:ss" (día con espacio de relleno). El
+// formato no lleva año: se asume el actual salvo que la fecha quede en el
+// futuro, caso típico de leer en enero líneas escritas en diciembre.
+func parseRFC3164(line string, now time.Time) (time.Time, string, bool) {
+	if len(line) < 15 {
+		return time.Time{}, "", false
+	}
+	stamp := line[:15]
+	rest := strings.TrimLeft(line[15:], " ")
+
+	// Algunos daemons añaden fracciones de segundo: "Dec  8 08:54:37.123"
+	layout := "Jan _2 15:04:05"
+	if len(line) > 16 && line[15] == '.' {
+		end := 16
+		for end < len(line) && line[end] >= '0' && line[end] <= '9' {
+			end++
+		}
+		stamp = line[:end]
+		rest = strings.TrimLeft(line[end:], " ")
+		layout = "Jan _2 15:04:05." + strings.Repeat("0", end-16)
+	}
+
+	t, err := time.ParseInLocation(layout, stamp, logLocation)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+
+	local := now.In(logLocation)
+	ts := time.Date(local.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), logLocation)
+	if ts.After(local.Add(24 * time.Hour)) {
+		ts = ts.AddDate(-1, 0, 0)
+	}
+	return ts.UTC(), rest, true
+}
+
+// parseRFC5424 recibe la línea sin "<PRI>1 " y reconstruye el resto como
+// "host app[procid]: mensaje" para que el parseo de cabecera sea el mismo.
+func parseRFC5424(line string) (time.Time, string, bool) {
+	tsStr, rest := splitToken(line)
+	host, rest := splitToken(rest)
+	app, rest := splitToken(rest)
+	procID, rest := splitToken(rest)
+	_, rest = splitToken(rest) // MSGID
+
+	ts, err := time.Parse(time.RFC3339Nano, tsStr)
+	if err != nil || app == "" {
+		return time.Time{}, "", false
+	}
+
+	// STRUCTURED-DATA: "-" o uno o más bloques [id k="v" ...]
+	if strings.HasPrefix(rest, "-") {
+		rest = rest[1:]
+	} else {
+		for strings.HasPrefix(rest, "[") {
+			end := structuredDataEnd(rest)
+			if end < 0 {
+				return time.Time{}, "", false
+			}
+			rest = rest[end+1:]
+		}
+	}
+	msg := strings.TrimPrefix(strings.TrimLeft(rest, " "), "\ufeff")
+
+	tag := app
+	if procID != "" && procID != "-" {
+		tag = app + "[" + procID + "]"
+	}
+	return ts.UTC(), host + " " + tag + ": " + msg, true
+}
+
+// structuredDataEnd devuelve el índice del ']' que cierra el bloque inicial,
+// respetando valores entre comillas con escapes.
+func structuredDataEnd(s string) int {
+	inQuote := false
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if inQuote {
+				i++
+			}
+		case '"':
+			inQuote = !inQuote
+		case ']':
+			if !inQuote {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func splitToken(s string) (string, string) {
+	s = strings.TrimLeft(s, " ")
+	if i := strings.IndexByte(s, ' '); i >= 0 {
+		return s[:i], strings.TrimLeft(s[i+1:], " ")
+	}
+	return s, ""
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSyslogPrefix(t *testing.T) {
+	// Zona fija con desplazamiento para que se note si un formato sin zona
+	// no se interpreta en la hora local del host.
+	saved := logLocation
+	logLocation = time.FixedZone("CET", 3600)
+	defer func() { logLocation = saved }()
+
+	at := func(s string) time.Time {
+		ts, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			t.Fatalf("hora de prueba inválida %q: %v", s, err)
+		}
+		return ts.UTC()
+	}
+
+	tests := []struct {
+		name       string
+		line       string
+		now        string
+		wantTs     string
+		wantRest   string
+		wantFormat string
+	}{
+		{
+			name:       "RFC3339 con microsegundos",
+			line:       "2025-12-08T08:54:37.490977+00:00 isov3 sshd[1]: Accepted",
+			now:        "2025-12-08T09:00:00Z",
+			wantTs:     "2025-12-08T08:54:37.490977Z",
+			wantRest:   "isov3 sshd[1]: Accepted",
+			wantFormat: tsFormatRFC3339,
+		},
+		{
+			name:       "RFC3339 con zona se pasa a UTC",
+			line:       "2025-12-08T10:54:37+02:00 isov3 sshd[1]: x",
+			now:        "2025-12-08T09:00:00Z",
+			wantTs:     "2025-12-08T08:54:37Z",
+			wantRest:   "isov3 sshd[1]: x",
+			wantFormat: tsFormatRFC3339,
+		},
+		{
+			name:       "RFC3164 en hora local",
+			line:       "Dec  8 09:54:37 isov3 sshd[1]: Failed password",
+			now:        "2025-12-08T09:00:00Z",
+			wantTs:     "2025-12-08T08:54:37Z",
+			wantRest:   "isov3 sshd[1]: Failed password",
+			wantFormat: tsFormatRFC3164,
+		},
+		{
+			name:       "RFC3164 de diciembre leído en enero es del año anterior",
+			line:       "Dec 31 23:59:59 isov3 sshd[1]: x",
+			now:        "2026-01-01T00:10:00Z",
+			wantTs:     "2025-12-31T22:59:59Z",
+			wantRest:   "isov3 sshd[1]: x",
+			wantFormat: tsFormatRFC3164,
+		},
+		{
+			name:       "RFC3164 de enero leído en Nochevieja local es del año en curso",
+			line:       "Jan  1 00:30:00 isov3 sshd[1]: x",
+			now:        "2025-12-31T23:20:00Z",
+			wantTs:     "2025-12-31T23:30:00Z",
+			wantRest:   "isov3 sshd[1]: x",
+			wantFormat: tsFormatRFC3164,
+		},
+		{
+			name:       "RFC3164 con reloj del emisor algo adelantado no cambia de año",
+			line:       "Jun 15 12:00:00 isov3 sshd[1]: x",
+			now:        "2025-06-15T08:00:00Z",
+			wantTs:     "2025-06-15T11:00:00Z",
+			wantRest:   "isov3 sshd[1]: x",
+			wantFormat: tsFormatRFC3164,
+		},
+		{
+			name:       "RFC3164 con fracciones de segundo",
+			line:       "Dec  8 09:54:37.123 isov3 sudo: x",
+			now:        "2025-12-08T09:00:00Z",
+			wantTs:     "2025-12-08T08:54:37.123Z",
+			wantRest:   "isov3 sudo: x",
+			wantFormat: tsFormatRFC3164,
+		},
+		{
+			name:       "RFC5424 con PRI y structured data",
+			line:       `<38>1 2025-12-08T08:54:37Z isov3 sshd 1234 - [meta x="a\]b"] Accepted`,
+			now:        "2025-12-08T09:00:00Z",
+			wantTs:     "2025-12-08T08:54:37Z",
+			wantRest:   "isov3 sshd[1234]: Accepted",
+			wantFormat: tsFormatRFC5424,
+		},
+		{
+			name:       "RFC5424 sin procid",
+			line:       "<38>1 2025-12-08T08:54:37Z isov3 sshd - - - Accepted",
+			now:        "2025-12-08T09:00:00Z",
+			wantTs:     "2025-12-08T08:54:37Z",
+			wantRest:   "isov3 sshd: Accepted",
+			wantFormat: tsFormatRFC5424,
+		},
+		{
+			name:       "ISO con espacio y sin zona en hora local",
+			line:       "2025-12-08 09:54:37 isov3 sshd[1]: x",
+			now:        "2025-12-08T09:00:00Z",
+			wantTs:     "2025-12-08T08:54:37Z",
+			wantRest:   "isov3 sshd[1]: x",
+			wantFormat: tsFormatISO8601,
+		},
+		{
+			name:       "ISO con espacio y zona",
+			line:       "2025-12-08 08:54:37+00:00 isov3 sshd[1]: x",
+			now:        "2025-12-08T09:00:00Z",
+			wantTs:     "2025-12-08T08:54:37Z",
+			wantRest:   "isov3 sshd[1]: x",
+			wantFormat: tsFormatISO8601,
+		},
+		{
+			name:       "formato desconocido usa la hora de recepción",
+			line:       "garbage isov3 sshd[1]: x",
+			now:        "2025-12-08T09:00:00Z",
+			wantTs:     "2025-12-08T09:00:00Z",
+			wantRest:   "isov3 sshd[1]: x",
+			wantFormat: tsFormatUnknown,
+		},
+	}
+
+	for _, tt := range tests {
+		ts, rest, format := parseSyslogPrefix(tt.line, at(tt.now))
+		if !ts.Equal(at(tt.wantTs)) || ts.Location() != time.UTC {
+			t.Errorf("%s: ts = %s, se esperaba %s", tt.name, ts.Format(time.RFC3339Nano), tt.wantTs)
+		}
+		if rest != tt.wantRest {
+			t.Errorf("%s: rest = %q, se esperaba %q", tt.name, rest, tt.wantRest)
+		}
+		if format != tt.wantFormat {
+			t.Errorf("%s: formato = %s, se esperaba %s", tt.name, format, tt.wantFormat)
+		}
+	}
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ----------------------------------------------------
+// Cambios de cuentas y grupos (account_change)
+// ----------------------------------------------------
+
+type AccountChange struct {
+	Ts          time.Time `json:"ts"`
+	Hostname    string    `json:"hostname"`
+	ChangeType  string    `json:"change_type"`
+	Target      string    `json:"target,omitempty"`
+	Group       string    `json:"group,omitempty"`
+	Actor       string    `json:"actor,omitempty"`
+	ActorSource string    `json:"actor_source,omitempty"`
+	Program     string    `json:"program"`
+	Severity    int       `json:"severity"`
+	RawLine     string    `json:"raw_line"`
+}
+
+type AccountChangesResponse struct {
+	WindowMinutes int             `json:"window_minutes"`
+	Limit         int             `json:"limit"`
+	GeneratedAt   time.Time       `json:"generated_at"`
+	Changes       []AccountChange `json:"changes"`
+}
+
+type AccountAlert struct {
+	ID         int64     `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	Hostname   string    `json:"hostname"`
+	Rule       string    `json:"rule"`
+	ChangeType string    `json:"change_type"`
+	Target     string    `json:"target"`
+	Group      string    `json:"group,omitempty"`
+	Actor      string    `json:"actor,omitempty"`
+	RawLine    string    `json:"raw_line"`
+	EventTs    time.Time `json:"event_ts"`
+	Status     string    `json:"status"`
+}
+
+type AccountAlertsResponse struct {
+	WindowMinutes int            `json:"window_minutes"`
+	Limit         int            `json:"limit"`
+	GeneratedAt   time.Time      `json:"generated_at"`
+	Alerts        []AccountAlert `json:"alerts"`
+}
+
+type AccountAlertUpdateRequest struct {
+	Status string `json:"status"`
+}
+
+const (
+	accountRuleCreated         = "account_created"
+	accountRulePrivilegedGroup = "privileged_group_member"
+	accountAlertWatermark      = "account_alerts"
+)
+
+// Grupos que dan root vía sudo/polkit según la distribución
+var privilegedGroups = []string{"sudo", "wheel", "admin", "root"}
+
+// ----------------------------------------------------
+// API account_changes
+// ----------------------------------------------------
+
+func (s *Server) handleAccountChanges(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "solo GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	host := q.Get("hostname")
+	changeType := q.Get("change_type")
+	target := q.Get("target")
+	actor := q.Get("actor")
+	group := q.Get("group")
+	minStr := q.Get("minutes")
+	limitStr := q.Get("limit")
+
+	windowMinutes := 1440
+	if minStr != "" {
+		if v, err := strconv.Atoi(minStr); err == nil && v > 0 && v <= 10080 {
+			windowMinutes = v
+		}
+	}
+
+	limit := 200
+	if limitStr != "" {
+		if v, err := strconv.Atoi(limitStr); err == nil && v > 0 && v <= 1000 {
+			limit = v
+		}
+	}
+
+	ctx := r.Context()
+	now := time.Now().UTC()
+
+	query := `
+        SELECT
+            e.ts,
+            a.hostname,
+            COALESCE(e.payload->>'change_type', '')  AS change_type,
+            COALESCE(e.payload->>'target', '')       AS target,
+            COALESCE(e.payload->>'group', '')        AS group_name,
+            COALESCE(e.payload->>'actor', '')        AS actor,
+            COALESCE(e.payload->>'actor_source', '') AS actor_source,
+            COALESCE(e.payload->>'program', '')      AS program,
+            e.severity,
+            COALESCE(e.payload->>'raw_line', '')     AS raw_line
+        FROM raw_events e
+        JOIN agents a ON e.agent_id = a.id
+        WHERE e.source = 'auth'
+          AND e.event_type = 'account_change'
+          AND e.ts >= now() - ($1::int || ' minutes')::interval
+    `
+	args := []any{windowMinutes}
+	argPos := 2
+
+	if host != "" {
+		query += " AND a.hostname = $" + strconv.Itoa(argPos)
+		args = append(args, host)
+		argPos++
+	}
+	if changeType != "" {
+		query += " AND e.payload->>'change_type' = $" + strconv.Itoa(argPos)
+		args = append(args, changeType)
+		argPos++
+	}
+	if target != "" {
+		query += " AND e.payload->>'target' = $" + strconv.Itoa(argPos)
+		args = append(args, target)
+		argPos++
+	}
+	if actor != "" {
+		query += " AND e.payload->>'actor' = $" + strconv.Itoa(argPos)
+		args = append(args, actor)
+		argPos++
+	}
+	if group != "" {
+		query += " AND e.payload->>'group' = $" + strconv.Itoa(argPos)
+		args = append(args, group)
+		argPos++
+	}
+
+	query += " ORDER BY e.ts DESC LIMIT $" + strconv.Itoa(argPos)
+	args = append(args, limit)
+
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		log.Printf("Error consultando account_changes: %v", err)
+		http.Error(w, "error consultando cambios de cuentas", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var changes []AccountChange
+	for rows.Next() {
+		var c AccountChange
+		if err := rows.Scan(
+			&c.Ts,
+			&c.Hostname,
+			&c.ChangeType,
+			&c.Target,
+			&c.Group,
+			&c.Actor,
+			&c.ActorSource,
+			&c.Program,
+			&c.Severity,
+			&c.RawLine,
+		); err != nil {
+			log.Printf("Error escaneando account_change: %v", err)
+			http.Error(w, "error leyendo cambios de cuentas", http.StatusInternalServerError)
+			return
+		}
+		changes = append(changes, c)
+	}
+	if rows.Err() != nil {
+		log.Printf("Error final en rows account_changes: %v", rows.Err())
+		http.Error(w, "error leyendo cambios de cuentas", http.StatusInternalServerError)
+		return
+	}
+
+	if changes == nil {
+		changes = []AccountChange{}
+	}
+
+	resp := AccountChangesResponse{
+		WindowMinutes: windowMinutes,
+		Limit:         limit,
+		GeneratedAt:   now,
+		Changes:       changes,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(resp); err != nil {
+		log.Printf("Error serializando respuesta account_changes: %v", err)
+	}
+}
+
+// ----------------------------------------------------
+// Worker account_alerts (cuentas nuevas y grupos privilegiados)
+// ----------------------------------------------------
+
+// El worker sigue raw_events.id (event_watermarks): una cuenta creada durante
+// una caída de core se alerta igual cuando el spool del agente la entrega.
+// window_minutes sólo marca desde dónde empieza la primera pasada.
+
+func (s *Server) startAccountAlertWorker() {
+	s.startWorker("AccountAlertWorker", func(ctx context.Context, st *Settings) error {
+		return s.runAccountAlertScan(ctx, st.AccountAlert.WindowMinutes)
+	})
+}
+
+func (s *Server) runAccountAlertScan(ctx context.Context, windowMinutes int) error {
+	from, mark, maxID, err := eventRange(ctx, s.db, accountAlertWatermark, time.Duration(windowMinutes)*time.Minute)
+	if err != nil {
+		return err
+	}
+	if maxID <= mark {
+		return nil
+	}
+
+	// Altas de usuario y entradas en sudo/wheel/admin/root. Con gpasswd -M
+	// (group_members_set) el objetivo es la lista completa de miembros.
+	rows, err := s.db.Query(ctx, `
+        SELECT
+            e.agent_id::text,
+            a.hostname,
+            e.ts,
+            e.payload->>'change_type'                AS change_type,
+            COALESCE(e.payload->>'target', e.payload->>'members', '') AS target,
+            COALESCE(e.payload->>'group', '')        AS group_name,
+            COALESCE(e.payload->>'actor', '')        AS actor,
+            COALESCE(e.payload->>'raw_line', '')     AS raw_line
+        FROM raw_events e
+        JOIN agents a ON a.id = e.agent_id
+        WHERE e.source = 'auth'
+          AND e.event_type = 'account_change'
+          AND e.id > $1
+          AND e.id <= $2
+          AND (
+                e.payload->>'change_type' = 'user_created'
+             OR (e.payload->>'change_type' IN ('group_member_added', 'group_members_set')
+                 AND e.payload->>'group' = ANY($3::text[]))
+          )
+        ORDER BY e.ts ASC;
+    `, from, maxID, privilegedGroups)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type cand struct {
+		AgentID    string
+		Hostname   string
+		Ts         time.Time
+		ChangeType string
+		Target     string
+		Group      string
+		Actor      string
+		RawLine    string
+	}
+
+	var cands []cand
+	for rows.Next() {
+		var c cand
+		if err := rows.Scan(&c.AgentID, &c.Hostname, &c.Ts, &c.ChangeType, &c.Target, &c.Group, &c.Actor, &c.RawLine); err != nil {
+			return err
+		}
+		cands = append(cands, c)
+	}
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	for _, c := range cands {
+		rule := accountRulePrivilegedGroup
+		if c.ChangeType == "user_created" {
+			rule = accountRuleCreated
+		}
+
+		var exists bool
+		err := s.db.QueryRow(ctx, `
+            SELECT EXISTS (
+                SELECT 1
+                FROM account_alerts
+                WHERE agent_id = $1
+                  AND rule = $2
+                  AND target = $3
+                  AND group_name = $4
+                  AND event_ts = $5
+            );
+        `, c.AgentID, rule, c.Target, c.Group, c.Ts).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+
+		_, err = s.db.Exec(ctx, `
+            INSERT INTO account_alerts (
+                agent_id, hostname, rule, change_type, target, group_name,
+                actor, raw_line, event_ts, status
+            )
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, 'new');
+        `, c.AgentID, c.Hostname, rule, c.ChangeType, c.Target, c.Group, c.Actor, c.RawLine, c.Ts)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("⚠️  ACCOUNT alert (%s): host=%s target=%s group=%s actor=%s",
+			rule, c.Hostname, c.Target, c.Group, c.Actor)
+	}
+
+	return saveEventWatermark(ctx, s.db, accountAlertWatermark, maxID)
+}
+
+// ----------------------------------------------------
+// API account_alerts (GET + PATCH)
+// ----------------------------------------------------
+
+func (s *Server) handleAccountAlerts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.handleAccountAlertsGET(w, r)
+	case http.MethodPatch:
+		s.handleAccountAlertsPATCH(w, r)
+	default:
+		http.Error(w, "solo GET o PATCH", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleAccountAlertsGET(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	status := q.Get("status")
+	rule := q.Get("rule")
+	target := q.Get("target")
+	host := q.Get("hostname")
+	minStr := q.Get("minutes")
+	limitStr := q.Get("limit")
+
+	windowMinutes := 1440
+	if minStr != "" {
+		if v, err := strconv.Atoi(minStr); err == nil && v > 0 && v <= 10080 {
+			windowMinutes = v
+		}
+	}
+
+	limit := 50
+	if limitStr != "" {
+		if v, err := strconv.Atoi(limitStr); err == nil && v > 0 && v <= 500 {
+			limit = v
+		}
+	}
+
+	ctx := r.Context()
+	now := time.Now().UTC()
+
+	query := `
+        SELECT
+            id,
+            created_at,
+            hostname,
+            rule,
+            change_type,
+            target,
+            group_name,
+            actor,
+            raw_line,
+            event_ts,
+            status
+        FROM account_alerts
+        WHERE created_at >= now() - ($1::int || ' minutes')::interval
+    `
+	args := []any{windowMinutes}
+	argPos := 2
+
+	if status != "" {
+		query += " AND status = $" + strconv.Itoa(argPos)
+		args = append(args, status)
+		argPos++
+	}
+	if rule != "" {
+		query += " AND rule = $" + strconv.Itoa(argPos)
+		args = append(args, rule)
+		argPos++
+	}
+	if target != "" {
+		query += " AND target = $" + strconv.Itoa(argPos)
+		args = append(args, target)
+		argPos++
+	}
+	if host != "" {
+		query += " AND hostname = $" + strconv.Itoa(argPos)
+		args = append(args, host)
+		argPos++
+	}
+
+	query += " ORDER BY created_at DESC LIMIT $" + strconv.Itoa(argPos)
+	args = append(args, limit)
+
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		log.Printf("Error consultando account_alerts: %v", err)
+		http.Error(w, "error consultando account_alerts", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var alerts []AccountAlert
+	for rows.Next() {
+		var a AccountAlert
+		if err := rows.Scan(
+			&a.ID,
+			&a.CreatedAt,
+			&a.Hostname,
+			&a.Rule,
+			&a.ChangeType,
+			&a.Target,
+			&a.Group,
+			&a.Actor,
+			&a.RawLine,
+			&a.EventTs,
+			&a.Status,
+		); err != nil {
+			log.Printf("Error escaneando account_alert: %v", err)
+			http.Error(w, "error leyendo account_alerts", http.StatusInternalServerError)
+			return
+		}
+		alerts = append(alerts, a)
+	}
+	if rows.Err() != nil {
+		log.Printf("Error final en rows account_alerts: %v", rows.Err())
+		http.Error(w, "error leyendo account_alerts", http.StatusInternalServerError)
+		return
+	}
+
+	if alerts == nil {
+		alerts = []AccountAlert{}
+	}
+
+	resp := AccountAlertsResponse{
+		WindowMinutes: windowMinutes,
+		Limit:         limit,
+		GeneratedAt:   now,
+		Alerts:        alerts,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(resp); err != nil {
+		log.Printf("Error serializando respuesta account_alerts: %v", err)
+	}
+}
+
+func (s *Server) handleAccountAlertsPATCH(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	prefix := "/api/v1/account_alerts/"
+	if !strings.HasPrefix(path, prefix) || len(path) <= len(prefix) {
+		http.Error(w, "ruta inválida, use /api/v1/account_alerts/{id}", http.StatusBadRequest)
+		return
+	}
+	idStr := strings.TrimPrefix(path, prefix)
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "id inválido", http.StatusBadRequest)
+		return
+	}
+
+	var req AccountAlertUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "JSON inválido", http.StatusBadRequest)
+		return
+	}
+
+	newStatus := strings.ToLower(strings.TrimSpace(req.Status))
+	if newStatus == "" {
+		http.Error(w, "status requerido", http.StatusBadRequest)
+		return
+	}
+	if newStatus != "new" && newStatus != "ack" && newStatus != "closed" {
+		http.Error(w, "status inválido (use new, ack o closed)", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+
+	var a AccountAlert
+	err = s.db.QueryRow(ctx, `
+        UPDATE account_alerts
+        SET status = $1
+        WHERE id = $2
+        RETURNING
+            id,
+            created_at,
+            hostname,
+            rule,
+            change_type,
+            target,
+            group_name,
+            actor,
+            raw_line,
+            event_ts,
+            status;
+    `, newStatus, id).Scan(
+		&a.ID,
+		&a.CreatedAt,
+		&a.Hostname,
+		&a.Rule,
+		&a.ChangeType,
+		&a.Target,
+		&a.Group,
+		&a.Actor,
+		&a.RawLine,
+		&a.EventTs,
+		&a.Status,
+	)
+	if err != nil {
+		log.Printf("Error actualizando account_alert id=%d: %v", id, err)
+		http.Error(w, "account_alert no encontrada o error al actualizar", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(a); err != nil {
+		log.Printf("Error serializando respuesta PATCH account_alert: %v", err)
+	}
+}
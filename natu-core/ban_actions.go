@@ -0,0 +1,976 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ----------------------------------------------------
+// Acciones de respuesta remotas (ban / unban)
+// ----------------------------------------------------
+//
+// Un analista pide desde natu-core banear o desbanear una IP en un host o en
+// toda la flota. La acción queda en ban_actions con un destino por agente
+// (ban_action_targets); cada agente la recoge al hacer poll, la ejecuta con
+// fail2ban-client o ipset y devuelve el resultado. Todo paso queda en
+// ban_action_audit.
+//
+// Estados de la acción: pending -> running -> done | partial | failed, o
+// cancelled. Estados del destino: pending -> sent -> success | failed, o
+// cancelled si se canceló antes de enviarse.
+//
+// Un ban no puede cubrir más que settings.ban_actions.min_prefix_v4 / _v6 ni
+// tocar redes reservadas o de federation_allowlist. Crear y cancelar exige
+// el api_token de la configuración; como el token es compartido, el
+// requested_by / actor que manda el cliente se guarda como "sin verificar"
+// con la IP de origen.
+
+type BanActionTarget struct {
+	Hostname    string     `json:"hostname"`
+	Status      string     `json:"status"`
+	Attempts    int        `json:"attempts"`
+	PickedAt    *time.Time `json:"picked_at,omitempty"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	Output      string     `json:"output,omitempty"`
+}
+
+type BanActionAudit struct {
+	Ts       time.Time `json:"ts"`
+	Event    string    `json:"event"`
+	Actor    string    `json:"actor,omitempty"`
+	Hostname string    `json:"hostname,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+}
+
+type BanAction struct {
+	ID          int64             `json:"id"`
+	CreatedAt   time.Time         `json:"created_at"`
+	Action      string            `json:"action"`
+	IP          string            `json:"ip"`
+	Jail        string            `json:"jail"`
+	Method      string            `json:"method"`
+	IpsetSet    string            `json:"ipset_set,omitempty"`
+	TTLSeconds  *int              `json:"ttl_seconds,omitempty"`
+	Scope       string            `json:"scope"`
+	Hostname    string            `json:"hostname,omitempty"`
+	RequestedBy string            `json:"requested_by"`
+	Reason      string            `json:"reason,omitempty"`
+	SourceAlert string            `json:"source_alert,omitempty"`
+	Status      string            `json:"status"`
+	Targets     []BanActionTarget `json:"targets"`
+	Audit       []BanActionAudit  `json:"audit,omitempty"`
+}
+
+type BanActionsResponse struct {
+	WindowMinutes int         `json:"window_minutes"`
+	Limit         int         `json:"limit"`
+	GeneratedAt   time.Time   `json:"generated_at"`
+	Actions       []BanAction `json:"actions"`
+}
+
+type BanActionCreateRequest struct {
+	Action      string `json:"action"`
+	IP          string `json:"ip"`
+	Jail        string `json:"jail"`
+	Method      string `json:"method"`
+	IpsetSet    string `json:"ipset_set"`
+	TTLSeconds  *int   `json:"ttl_seconds"`
+	Scope       string `json:"scope"`
+	Hostname    string `json:"hostname"`
+	RequestedBy string `json:"requested_by"`
+	Reason      string `json:"reason"`
+	SourceAlert string `json:"source_alert"`
+}
+
+type BanActionSettings struct {
+	// Red más grande que se puede banear (/24 en IPv4, /64 en IPv6)
+	MinPrefixV4 int `json:"min_prefix_v4"`
+	MinPrefixV6 int `json:"min_prefix_v6"`
+}
+
+type BanActionUpdateRequest struct {
+	Status string `json:"status"`
+	Actor  string `json:"actor"`
+}
+
+// Lo que ve el agente
+type AgentAction struct {
+	ID         int64  `json:"id"`
+	Action     string `json:"action"`
+	IP         string `json:"ip"`
+	Jail       string `json:"jail"`
+	Method     string `json:"method"`
+	IpsetSet   string `json:"ipset_set,omitempty"`
+	TTLSeconds *int   `json:"ttl_seconds,omitempty"`
+}
+
+type AgentActionPollRequest struct {
+	AgentSecret string `json:"agent_secret"`
+	Hostname    string `json:"hostname"`
+	// El host no quiere recibir bans federados (actions.fleet_opt_out)
+	FleetOptOut bool `json:"fleet_opt_out"`
+}
+
+type AgentActionPollResponse struct {
+	Actions []AgentAction `json:"actions"`
+}
+
+type AgentActionResultRequest struct {
+	AgentSecret string `json:"agent_secret"`
+	Hostname    string `json:"hostname"`
+	Results     []struct {
+		ActionID int64  `json:"action_id"`
+		Success  bool   `json:"success"`
+		Output   string `json:"output"`
+	} `json:"results"`
+}
+
+const (
+	// Un destino enviado sin respuesta se reenvía pasado este tiempo
+	banActionRedeliverMinutes = 10
+	banActionMaxAttempts      = 5
+	// Alcance "fleet": agentes vistos en las últimas 24 h
+	banActionFleetSeenHours = 24
+	banActionMaxTTLSeconds  = 30 * 24 * 3600
+)
+
+var reJailName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// insertBanAction guarda la acción ya validada; los destinos los añade quien
+// la crea.
+func insertBanAction(ctx context.Context, tx pgx.Tx, req BanActionCreateRequest) (int64, error) {
+	var id int64
+	err := tx.QueryRow(ctx, `
+        INSERT INTO ban_actions (action, ip, jail, method, ipset_set, ttl_seconds, scope,
+                                 target_hostname, requested_by, reason, source_alert)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+        RETURNING id
+    `, req.Action, req.IP, req.Jail, req.Method, req.IpsetSet, req.TTLSeconds, req.Scope,
+		req.Hostname, req.RequestedBy, req.Reason, req.SourceAlert).Scan(&id)
+	return id, err
+}
+
+func auditBanAction(ctx context.Context, tx pgx.Tx, actionID int64, event, actor, hostname, detail string) error {
+	_, err := tx.Exec(ctx, `
+        INSERT INTO ban_action_audit (action_id, event, actor, hostname, detail)
+        VALUES ($1, $2, $3, $4, $5)
+    `, actionID, event, actor, hostname, detail)
+	return err
+}
+
+// validIPOrCIDR acepta una IP o una red; es lo que recibirá fail2ban/ipset.
+func validIPOrCIDR(s string) bool {
+	if net.ParseIP(s) != nil {
+		return true
+	}
+	_, _, err := net.ParseCIDR(s)
+	return err == nil
+}
+
+// Redes que nunca se banean: loopback, privadas, link-local y no
+// especificadas.
+var banReservedNets = mustParseCIDRs(
+	"0.0.0.0/8", "127.0.0.0/8", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "169.254.0.0/16",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	out := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		out = append(out, n)
+	}
+	return out
+}
+
+// netsOverlap: una de las dos redes contiene a la otra (en CIDR no hay
+// solapes parciales).
+func netsOverlap(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// banTargetProblem explica por qué no se puede banear ip (IP o red), o ""
+// si se puede: red más grande que el mínimo configurado, rango reservado o
+// solape con federation_allowlist.
+func banTargetProblem(ip string, bs BanActionSettings, allow []*net.IPNet) string {
+	var n *net.IPNet
+	if addr := net.ParseIP(ip); addr != nil {
+		bits := 128
+		if addr.To4() != nil {
+			addr, bits = addr.To4(), 32
+		}
+		n = &net.IPNet{IP: addr, Mask: net.CIDRMask(bits, bits)}
+	} else {
+		var err error
+		if _, n, err = net.ParseCIDR(ip); err != nil {
+			return "ip inválida"
+		}
+		ones, bits := n.Mask.Size()
+		min := bs.MinPrefixV6
+		if bits == 32 {
+			min = bs.MinPrefixV4
+		}
+		if ones < min {
+			return fmt.Sprintf("red demasiado grande: el prefijo mínimo es /%d", min)
+		}
+	}
+
+	for _, r := range banReservedNets {
+		if netsOverlap(n, r) {
+			return "ip en rango reservado (" + r.String() + ")"
+		}
+	}
+	for _, a := range allow {
+		if netsOverlap(n, a) {
+			return "ip en federation_allowlist (" + a.String() + ")"
+		}
+	}
+	return ""
+}
+
+// unverifiedActor marca un nombre que declara el cliente: el token no
+// identifica a nadie, así que queda como dato sin verificar junto a la IP de
+// origen (y no puede hacerse pasar por "federation").
+func unverifiedActor(r *http.Request, claimed string) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return claimed + " (sin verificar, " + host + ")"
+}
+
+// requireAPIToken comprueba "Authorization: Bearer <api_token>". Sin
+// api_token configurado no se permite ninguna escritura.
+func (s *Server) requireAPIToken(w http.ResponseWriter, r *http.Request) bool {
+	if s.apiToken == "" {
+		http.Error(w, "escrituras deshabilitadas: configure api_token en natu-core", http.StatusForbidden)
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(s.apiToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="natu-core"`)
+		http.Error(w, "token inválido o ausente", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// ----------------------------------------------------
+// API ban_actions (analistas)
+// ----------------------------------------------------
+
+func (s *Server) handleBanActions(w http.ResponseWriter, r *http.Request) {
+	hasID := strings.HasPrefix(r.URL.Path, "/api/v1/ban_actions/") && len(r.URL.Path) > len("/api/v1/ban_actions/")
+
+	if (r.Method == http.MethodPost || r.Method == http.MethodPatch) && !s.requireAPIToken(w, r) {
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && !hasID:
+		s.handleBanActionsPOST(w, r)
+	case r.Method == http.MethodGet && !hasID:
+		s.handleBanActionsGET(w, r)
+	case r.Method == http.MethodGet && hasID:
+		s.handleBanActionGET(w, r)
+	case r.Method == http.MethodPatch && hasID:
+		s.handleBanActionPATCH(w, r)
+	default:
+		http.Error(w, "use GET/POST en /api/v1/ban_actions o GET/PATCH en /api/v1/ban_actions/{id}", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleBanActionsPOST(w http.ResponseWriter, r *http.Request) {
+	var req BanActionCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "JSON inválido", http.StatusBadRequest)
+		return
+	}
+
+	req.Action = strings.ToLower(strings.TrimSpace(req.Action))
+	req.IP = strings.TrimSpace(req.IP)
+	req.Method = strings.ToLower(strings.TrimSpace(req.Method))
+	req.Scope = strings.ToLower(strings.TrimSpace(req.Scope))
+	req.RequestedBy = strings.TrimSpace(req.RequestedBy)
+	if req.Jail == "" {
+		req.Jail = "sshd"
+	}
+	if req.Method == "" {
+		req.Method = "fail2ban"
+	}
+	if req.Method == "ipset" && req.IpsetSet == "" {
+		req.IpsetSet = "ssh-banned"
+	}
+
+	if req.Action != "ban" && req.Action != "unban" {
+		http.Error(w, "action inválida (use ban o unban)", http.StatusBadRequest)
+		return
+	}
+	if !validIPOrCIDR(req.IP) {
+		http.Error(w, "ip inválida", http.StatusBadRequest)
+		return
+	}
+	if !reJailName.MatchString(req.Jail) {
+		http.Error(w, "jail inválida", http.StatusBadRequest)
+		return
+	}
+	switch req.Method {
+	case "fail2ban":
+		if req.TTLSeconds != nil {
+			http.Error(w, "ttl_seconds sólo se admite con method ipset (fail2ban usa el bantime de la jail)", http.StatusBadRequest)
+			return
+		}
+	case "ipset":
+		if !reJailName.MatchString(req.IpsetSet) {
+			http.Error(w, "ipset_set inválido", http.StatusBadRequest)
+			return
+		}
+		if req.TTLSeconds != nil && (*req.TTLSeconds < 1 || *req.TTLSeconds > banActionMaxTTLSeconds) {
+			http.Error(w, "ttl_seconds fuera de rango", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "method inválido (use fail2ban o ipset)", http.StatusBadRequest)
+		return
+	}
+	if req.Scope != "host" && req.Scope != "fleet" {
+		http.Error(w, "scope inválido (use host o fleet)", http.StatusBadRequest)
+		return
+	}
+	if req.Scope == "host" && req.Hostname == "" {
+		http.Error(w, "hostname requerido con scope host", http.StatusBadRequest)
+		return
+	}
+	if req.Scope == "fleet" {
+		req.Hostname = ""
+	}
+	if req.RequestedBy == "" {
+		http.Error(w, "requested_by requerido", http.StatusBadRequest)
+		return
+	}
+	req.RequestedBy = unverifiedActor(r, req.RequestedBy)
+
+	ctx := r.Context()
+
+	// Unban de cualquier red se permite; ban sólo de redes acotadas y fuera
+	// de rangos propios
+	if req.Action == "ban" {
+		allow, err := s.loadFederationAllowlist(ctx)
+		if err != nil {
+			log.Printf("Error consultando federation_allowlist: %v", err)
+			http.Error(w, "error consultando allowlist", http.StatusInternalServerError)
+			return
+		}
+		if problem := banTargetProblem(req.IP, s.settings.Load().BanActions, allow); problem != "" {
+			http.Error(w, problem, http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		http.Error(w, "error iniciando transacción", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	id, err := insertBanAction(ctx, tx, req)
+	if err != nil {
+		log.Printf("Error creando ban_action: %v", err)
+		http.Error(w, "error creando acción", http.StatusInternalServerError)
+		return
+	}
+
+	targetQuery := `
+        INSERT INTO ban_action_targets (action_id, agent_id, hostname)
+        SELECT $1, a.id, a.hostname
+        FROM agents a
+    `
+	args := []any{id}
+	if req.Scope == "host" {
+		targetQuery += " WHERE a.hostname = $2"
+		args = append(args, req.Hostname)
+	} else {
+		targetQuery += " WHERE a.last_seen >= now() - ($2::int || ' hours')::interval"
+		args = append(args, banActionFleetSeenHours)
+	}
+	tag, err := tx.Exec(ctx, targetQuery, args...)
+	if err != nil {
+		log.Printf("Error creando destinos de ban_action: %v", err)
+		http.Error(w, "error creando acción", http.StatusInternalServerError)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, "ningún agente coincide con el destino", http.StatusNotFound)
+		return
+	}
+
+	detail := req.Action + " " + req.IP + " (" + req.Method + ", " + strconv.FormatInt(tag.RowsAffected(), 10) + " agentes)"
+	if req.Reason != "" {
+		detail += ": " + req.Reason
+	}
+	if err := auditBanAction(ctx, tx, id, "created", req.RequestedBy, req.Hostname, detail); err != nil {
+		http.Error(w, "error guardando auditoría", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, "error commit acción", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Acción remota #%d: %s por %s", id, detail, req.RequestedBy)
+
+	a, err := s.loadBanAction(ctx, id, true)
+	if err != nil {
+		http.Error(w, "error leyendo acción creada", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(a); err != nil {
+		log.Printf("Error serializando respuesta POST ban_action: %v", err)
+	}
+}
+
+func (s *Server) handleBanActionsGET(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	status := q.Get("status")
+	ip := q.Get("ip")
+	host := q.Get("hostname")
+	minStr := q.Get("minutes")
+	limitStr := q.Get("limit")
+
+	windowMinutes := 1440
+	if minStr != "" {
+		if v, err := strconv.Atoi(minStr); err == nil && v > 0 && v <= 43200 {
+			windowMinutes = v
+		}
+	}
+
+	limit := 100
+	if limitStr != "" {
+		if v, err := strconv.Atoi(limitStr); err == nil && v > 0 && v <= 500 {
+			limit = v
+		}
+	}
+
+	ctx := r.Context()
+	now := time.Now().UTC()
+
+	query := `
+        SELECT ba.id
+        FROM ban_actions ba
+        WHERE ba.created_at >= now() - ($1::int || ' minutes')::interval
+    `
+	args := []any{windowMinutes}
+	argPos := 2
+
+	if status != "" {
+		query += " AND ba.status = $" + strconv.Itoa(argPos)
+		args = append(args, status)
+		argPos++
+	}
+	if ip != "" {
+		query += " AND ba.ip = $" + strconv.Itoa(argPos)
+		args = append(args, ip)
+		argPos++
+	}
+	if host != "" {
+		query += " AND EXISTS (SELECT 1 FROM ban_action_targets t WHERE t.action_id = ba.id AND t.hostname = $" + strconv.Itoa(argPos) + ")"
+		args = append(args, host)
+		argPos++
+	}
+
+	query += " ORDER BY ba.created_at DESC LIMIT $" + strconv.Itoa(argPos)
+	args = append(args, limit)
+
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		log.Printf("Error consultando ban_actions: %v", err)
+		http.Error(w, "error consultando acciones", http.StatusInternalServerError)
+		return
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			http.Error(w, "error leyendo acciones", http.StatusInternalServerError)
+			return
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		http.Error(w, "error leyendo acciones", http.StatusInternalServerError)
+		return
+	}
+
+	actions := []BanAction{}
+	for _, id := range ids {
+		a, err := s.loadBanAction(ctx, id, false)
+		if err != nil {
+			log.Printf("Error leyendo ban_action id=%d: %v", id, err)
+			http.Error(w, "error leyendo acciones", http.StatusInternalServerError)
+			return
+		}
+		actions = append(actions, *a)
+	}
+
+	resp := BanActionsResponse{
+		WindowMinutes: windowMinutes,
+		Limit:         limit,
+		GeneratedAt:   now,
+		Actions:       actions,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(resp); err != nil {
+		log.Printf("Error serializando respuesta ban_actions: %v", err)
+	}
+}
+
+func banActionIDFromPath(path string) (int64, bool) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(path, "/api/v1/ban_actions/"), 10, 64)
+	return id, err == nil && id > 0
+}
+
+func (s *Server) handleBanActionGET(w http.ResponseWriter, r *http.Request) {
+	id, ok := banActionIDFromPath(r.URL.Path)
+	if !ok {
+		http.Error(w, "id inválido", http.StatusBadRequest)
+		return
+	}
+
+	a, err := s.loadBanAction(r.Context(), id, true)
+	if err != nil {
+		http.Error(w, "acción no encontrada", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(a); err != nil {
+		log.Printf("Error serializando respuesta ban_action: %v", err)
+	}
+}
+
+// handleBanActionPATCH sólo permite cancelar. Los destinos ya enviados al
+// agente siguen su curso y su resultado se registra igualmente.
+func (s *Server) handleBanActionPATCH(w http.ResponseWriter, r *http.Request) {
+	id, ok := banActionIDFromPath(r.URL.Path)
+	if !ok {
+		http.Error(w, "id inválido", http.StatusBadRequest)
+		return
+	}
+
+	var req BanActionUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "JSON inválido", http.StatusBadRequest)
+		return
+	}
+	if strings.ToLower(strings.TrimSpace(req.Status)) != "cancelled" {
+		http.Error(w, "status inválido (sólo cancelled)", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Actor) == "" {
+		http.Error(w, "actor requerido", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		http.Error(w, "error iniciando transacción", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, `
+        UPDATE ban_actions
+        SET status = 'cancelled'
+        WHERE id = $1
+          AND status IN ('pending', 'running')
+    `, id)
+	if err != nil {
+		http.Error(w, "error cancelando acción", http.StatusInternalServerError)
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		http.Error(w, "acción no encontrada o ya finalizada", http.StatusConflict)
+		return
+	}
+
+	tag, err = tx.Exec(ctx, `
+        UPDATE ban_action_targets
+        SET status = 'cancelled', completed_at = now()
+        WHERE action_id = $1
+          AND status = 'pending'
+    `, id)
+	if err != nil {
+		http.Error(w, "error cancelando acción", http.StatusInternalServerError)
+		return
+	}
+
+	detail := strconv.FormatInt(tag.RowsAffected(), 10) + " destinos pendientes cancelados"
+	if err := auditBanAction(ctx, tx, id, "cancelled", unverifiedActor(r, strings.TrimSpace(req.Actor)), "", detail); err != nil {
+		http.Error(w, "error guardando auditoría", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, "error commit cancelación", http.StatusInternalServerError)
+		return
+	}
+
+	a, err := s.loadBanAction(ctx, id, true)
+	if err != nil {
+		http.Error(w, "error leyendo acción", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(a); err != nil {
+		log.Printf("Error serializando respuesta PATCH ban_action: %v", err)
+	}
+}
+
+func (s *Server) loadBanAction(ctx context.Context, id int64, withAudit bool) (*BanAction, error) {
+	var a BanAction
+	err := s.db.QueryRow(ctx, `
+        SELECT id, created_at, action, ip, jail, method, ipset_set, ttl_seconds, scope,
+               target_hostname, requested_by, reason, source_alert, status
+        FROM ban_actions
+        WHERE id = $1
+    `, id).Scan(&a.ID, &a.CreatedAt, &a.Action, &a.IP, &a.Jail, &a.Method, &a.IpsetSet, &a.TTLSeconds, &a.Scope,
+		&a.Hostname, &a.RequestedBy, &a.Reason, &a.SourceAlert, &a.Status)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(ctx, `
+        SELECT hostname, status, attempts, picked_at, completed_at, output
+        FROM ban_action_targets
+        WHERE action_id = $1
+        ORDER BY hostname
+    `, id)
+	if err != nil {
+		return nil, err
+	}
+	a.Targets = []BanActionTarget{}
+	for rows.Next() {
+		var t BanActionTarget
+		if err := rows.Scan(&t.Hostname, &t.Status, &t.Attempts, &t.PickedAt, &t.CompletedAt, &t.Output); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		a.Targets = append(a.Targets, t)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	if !withAudit {
+		return &a, nil
+	}
+
+	rows, err = s.db.Query(ctx, `
+        SELECT ts, event, actor, hostname, detail
+        FROM ban_action_audit
+        WHERE action_id = $1
+        ORDER BY ts, id
+    `, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var au BanActionAudit
+		if err := rows.Scan(&au.Ts, &au.Event, &au.Actor, &au.Hostname, &au.Detail); err != nil {
+			return nil, err
+		}
+		a.Audit = append(a.Audit, au)
+	}
+	return &a, rows.Err()
+}
+
+// ----------------------------------------------------
+// API para agentes (poll y resultados)
+// ----------------------------------------------------
+
+func (s *Server) handleAgentActionsPoll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "solo POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req AgentActionPollRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "JSON inválido", http.StatusBadRequest)
+		return
+	}
+	if req.AgentSecret == "" {
+		http.Error(w, "agent_secret requerido", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+
+	agentID, err := s.ensureAgent(ctx, req.AgentSecret, req.Hostname)
+	if err != nil {
+		http.Error(w, "agente no encontrado o secret inválido", http.StatusUnauthorized)
+		return
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		http.Error(w, "error iniciando transacción", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	if err := syncFederationOptOut(ctx, tx, agentID, req.FleetOptOut); err != nil {
+		log.Printf("Error actualizando opt-out de federación: %v", err)
+		http.Error(w, "error actualizando agente", http.StatusInternalServerError)
+		return
+	}
+
+	// Destinos que agotaron los reintentos sin respuesta
+	expired, err := tx.Query(ctx, `
+        UPDATE ban_action_targets
+        SET status = 'failed', completed_at = now(), output = 'sin respuesta del agente'
+        WHERE agent_id = $1
+          AND status = 'sent'
+          AND attempts >= $2
+          AND picked_at < now() - ($3::int || ' minutes')::interval
+        RETURNING action_id, hostname
+    `, agentID, banActionMaxAttempts, banActionRedeliverMinutes)
+	if err != nil {
+		http.Error(w, "error consultando acciones", http.StatusInternalServerError)
+		return
+	}
+	type expiredTarget struct {
+		ActionID int64
+		Hostname string
+	}
+	var expiredTargets []expiredTarget
+	for expired.Next() {
+		var e expiredTarget
+		if err := expired.Scan(&e.ActionID, &e.Hostname); err != nil {
+			expired.Close()
+			http.Error(w, "error consultando acciones", http.StatusInternalServerError)
+			return
+		}
+		expiredTargets = append(expiredTargets, e)
+	}
+	expired.Close()
+	for _, e := range expiredTargets {
+		if err := auditBanAction(ctx, tx, e.ActionID, "failed", "", e.Hostname, "sin respuesta del agente"); err != nil {
+			http.Error(w, "error guardando auditoría", http.StatusInternalServerError)
+			return
+		}
+		if err := refreshBanActionStatus(ctx, tx, e.ActionID); err != nil {
+			http.Error(w, "error actualizando acción", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	rows, err := tx.Query(ctx, `
+        UPDATE ban_action_targets t
+        SET status = 'sent', picked_at = now(), attempts = t.attempts + 1
+        FROM ban_actions a
+        WHERE t.action_id = a.id
+          AND t.agent_id = $1
+          AND a.status IN ('pending', 'running')
+          AND (t.status = 'pending'
+               OR (t.status = 'sent' AND t.picked_at < now() - ($2::int || ' minutes')::interval))
+        RETURNING a.id, a.action, a.ip, a.jail, a.method, a.ipset_set, a.ttl_seconds, t.hostname, t.attempts
+    `, agentID, banActionRedeliverMinutes)
+	if err != nil {
+		log.Printf("Error en poll de acciones: %v", err)
+		http.Error(w, "error consultando acciones", http.StatusInternalServerError)
+		return
+	}
+
+	type picked struct {
+		AgentAction
+		Hostname string
+		Attempts int
+	}
+	var list []picked
+	for rows.Next() {
+		var p picked
+		if err := rows.Scan(&p.ID, &p.Action, &p.IP, &p.Jail, &p.Method, &p.IpsetSet, &p.TTLSeconds, &p.Hostname, &p.Attempts); err != nil {
+			rows.Close()
+			http.Error(w, "error leyendo acciones", http.StatusInternalServerError)
+			return
+		}
+		list = append(list, p)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		http.Error(w, "error leyendo acciones", http.StatusInternalServerError)
+		return
+	}
+
+	// Un ban y su unban posterior deben ejecutarse en ese orden
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	actions := []AgentAction{}
+	for _, p := range list {
+		detail := "intento " + strconv.Itoa(p.Attempts)
+		if err := auditBanAction(ctx, tx, p.ID, "sent", "", p.Hostname, detail); err != nil {
+			http.Error(w, "error guardando auditoría", http.StatusInternalServerError)
+			return
+		}
+		if _, err := tx.Exec(ctx, `UPDATE ban_actions SET status = 'running' WHERE id = $1 AND status = 'pending'`, p.ID); err != nil {
+			http.Error(w, "error actualizando acción", http.StatusInternalServerError)
+			return
+		}
+		actions = append(actions, p.AgentAction)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, "error commit poll", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(AgentActionPollResponse{Actions: actions}); err != nil {
+		log.Printf("Error serializando respuesta poll de acciones: %v", err)
+	}
+}
+
+func (s *Server) handleAgentActionsResult(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "solo POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req AgentActionResultRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "JSON inválido", http.StatusBadRequest)
+		return
+	}
+	if req.AgentSecret == "" {
+		http.Error(w, "agent_secret requerido", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+
+	agentID, err := s.ensureAgent(ctx, req.AgentSecret, req.Hostname)
+	if err != nil {
+		http.Error(w, "agente no encontrado o secret inválido", http.StatusUnauthorized)
+		return
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		http.Error(w, "error iniciando transacción", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	for _, res := range req.Results {
+		status := "failed"
+		if res.Success {
+			status = "success"
+		}
+		output := res.Output
+		if len(output) > 4000 {
+			output = output[:4000]
+		}
+
+		var hostname string
+		err := tx.QueryRow(ctx, `
+            UPDATE ban_action_targets
+            SET status = $3, completed_at = now(), output = $4
+            WHERE action_id = $1
+              AND agent_id = $2
+              AND status = 'sent'
+            RETURNING hostname
+        `, res.ActionID, agentID, status, output).Scan(&hostname)
+		if err == pgx.ErrNoRows {
+			// Resultado repetido o de una acción que no es de este agente
+			continue
+		}
+		if err != nil {
+			log.Printf("Error guardando resultado de acción %d: %v", res.ActionID, err)
+			http.Error(w, "error guardando resultados", http.StatusInternalServerError)
+			return
+		}
+
+		if err := auditBanAction(ctx, tx, res.ActionID, status, "", hostname, output); err != nil {
+			http.Error(w, "error guardando auditoría", http.StatusInternalServerError)
+			return
+		}
+		if err := refreshBanActionStatus(ctx, tx, res.ActionID); err != nil {
+			http.Error(w, "error actualizando acción", http.StatusInternalServerError)
+			return
+		}
+		if !res.Success {
+			log.Printf("⚠️  Acción remota #%d falló en %s: %s", res.ActionID, hostname, output)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		http.Error(w, "error commit resultados", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(`{"status":"ok"}`))
+}
+
+// refreshBanActionStatus recalcula el estado global a partir de los destinos.
+// Una acción cancelada sigue como cancelled.
+func refreshBanActionStatus(ctx context.Context, tx pgx.Tx, actionID int64) error {
+	_, err := tx.Exec(ctx, `
+        UPDATE ban_actions ba
+        SET status = CASE
+                WHEN t.open > 0   THEN 'running'
+                WHEN t.failed = 0 THEN 'done'
+                WHEN t.ok = 0     THEN 'failed'
+                ELSE 'partial'
+            END
+        FROM (
+            SELECT
+                count(*) FILTER (WHERE status IN ('pending', 'sent')) AS open,
+                count(*) FILTER (WHERE status = 'failed')             AS failed,
+                count(*) FILTER (WHERE status = 'success')            AS ok
+            FROM ban_action_targets
+            WHERE action_id = $1
+        ) t
+        WHERE ba.id = $1
+          AND ba.status <> 'cancelled'
+    `, actionID)
+	return err
+}
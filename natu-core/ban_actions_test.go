@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireAPIToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		want   int
+	}{
+		{"sin token configurado", "", "Bearer x", http.StatusForbidden},
+		{"sin cabecera", "s3cret", "", http.StatusUnauthorized},
+		{"token distinto", "s3cret", "Bearer otro", http.StatusUnauthorized},
+		{"sin Bearer", "s3cret", "s3cret", http.StatusUnauthorized},
+		{"token correcto", "s3cret", "Bearer s3cret", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		s := &Server{apiToken: tt.token}
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/ban_actions", nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		w := httptest.NewRecorder()
+		if ok := s.requireAPIToken(w, r); ok != (tt.want == http.StatusOK) || w.Code != tt.want {
+			t.Errorf("%s: ok=%v código=%d, se esperaba %d", tt.name, ok, w.Code, tt.want)
+		}
+	}
+}
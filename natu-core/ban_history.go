@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ----------------------------------------------------
+// Historial de bans (fail2ban.log)
+// ----------------------------------------------------
+//
+// El agente envía f2b_found / f2b_ban / f2b_restore / f2b_unban leídos de
+// fail2ban.log. El worker los convierte en intervalos en ssh_ban_history:
+// un ban abre un intervalo, el unban lo cierra con su duración y un restore
+// (fail2ban reiniciado) se anota en el intervalo abierto o abre uno nuevo si
+// el ban original es anterior al historial. Sigue raw_events.id
+// (event_watermarks), así que un unban que llega tarde cierra igual su
+// intervalo; window_minutes sólo marca desde dónde empieza la primera pasada.
+
+type SSHBanInterval struct {
+	ID         int64      `json:"id"`
+	Hostname   string     `json:"hostname"`
+	Jail       string     `json:"jail"`
+	IP         string     `json:"ip"`
+	BannedAt   time.Time  `json:"banned_at"`
+	UnbannedAt *time.Time `json:"unbanned_at,omitempty"`
+	// Para los bans activos, lo que llevan baneados hasta ahora
+	DurationSeconds int64  `json:"duration_seconds"`
+	FoundCount      int    `json:"found_count"`
+	Restored        bool   `json:"restored"`
+	Status          string `json:"status"`
+}
+
+type SSHBanHistoryResponse struct {
+	WindowMinutes int              `json:"window_minutes"`
+	Limit         int              `json:"limit"`
+	GeneratedAt   time.Time        `json:"generated_at"`
+	Bans          []SSHBanInterval `json:"bans"`
+}
+
+// Ventana hacia atrás para contar los Found que precedieron a un ban
+const banHistoryFoundLookbackMinutes = 60
+
+const banHistoryWatermark = "ssh_ban_history"
+
+// ----------------------------------------------------
+// Worker ssh_ban_history
+// ----------------------------------------------------
+
+func (s *Server) startBanHistoryWorker() {
+	s.startWorker("BanHistoryWorker", func(ctx context.Context, st *Settings) error {
+		return s.runBanHistoryScan(ctx, st.BanHistory.WindowMinutes)
+	})
+}
+
+func (s *Server) runBanHistoryScan(ctx context.Context, windowMinutes int) error {
+	from, mark, maxID, err := eventRange(ctx, s.db, banHistoryWatermark, time.Duration(windowMinutes)*time.Minute)
+	if err != nil {
+		return err
+	}
+	if maxID <= mark {
+		return nil
+	}
+
+	rows, err := s.db.Query(ctx, `
+        SELECT
+            e.agent_id::text,
+            a.hostname,
+            e.ts,
+            e.event_type,
+            e.payload->>'jail'                     AS jail,
+            e.payload->>'ip'                       AS ip,
+            (e.payload->>'banned_at')::timestamptz AS payload_banned_at
+        FROM raw_events e
+        JOIN agents a ON a.id = e.agent_id
+        WHERE e.source = 'fail2ban'
+          AND e.event_type IN ('f2b_ban', 'f2b_restore', 'f2b_unban')
+          AND e.id > $1
+          AND e.id <= $2
+          AND e.payload ? 'jail'
+          AND e.payload ? 'ip'
+        ORDER BY e.ts ASC, e.id ASC;
+    `, from, maxID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type cand struct {
+		AgentID         string
+		Hostname        string
+		Ts              time.Time
+		EventType       string
+		Jail            string
+		IP              string
+		PayloadBannedAt *time.Time
+	}
+
+	var cands []cand
+	for rows.Next() {
+		var c cand
+		if err := rows.Scan(&c.AgentID, &c.Hostname, &c.Ts, &c.EventType, &c.Jail, &c.IP, &c.PayloadBannedAt); err != nil {
+			return err
+		}
+		cands = append(cands, c)
+	}
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	// Los eventos se aplican en orden; cada paso es idempotente para que
+	// releer los últimos ids no duplique intervalos.
+	for _, c := range cands {
+		switch c.EventType {
+		case "f2b_ban", "f2b_restore":
+			// ¿Hay ya un intervalo que cubra este instante?
+			var coveringID int64
+			err := s.db.QueryRow(ctx, `
+                SELECT COALESCE(MAX(id), 0)
+                FROM ssh_ban_history
+                WHERE agent_id = $1
+                  AND jail = $2
+                  AND ip = $3
+                  AND banned_at <= $4
+                  AND (unbanned_at IS NULL OR unbanned_at >= $4);
+            `, c.AgentID, c.Jail, c.IP, c.Ts).Scan(&coveringID)
+			if err != nil {
+				return err
+			}
+			if coveringID != 0 {
+				if c.EventType == "f2b_restore" {
+					if _, err := s.db.Exec(ctx, `UPDATE ssh_ban_history SET restored = true WHERE id = $1`, coveringID); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+
+			tag, err := s.db.Exec(ctx, `
+                INSERT INTO ssh_ban_history (agent_id, hostname, jail, ip, banned_at, found_count, restored)
+                SELECT $1::uuid, $2::text, $3::text, $4::text, $5::timestamptz, count(*), $6::boolean
+                FROM raw_events e
+                WHERE e.agent_id = $1
+                  AND e.source = 'fail2ban'
+                  AND e.event_type = 'f2b_found'
+                  AND e.payload->>'jail' = $3
+                  AND e.payload->>'ip' = $4
+                  AND e.ts <= $5
+                  AND e.ts >= $5 - ($7::int || ' minutes')::interval
+                ON CONFLICT (agent_id, jail, ip, banned_at) DO NOTHING;
+            `, c.AgentID, c.Hostname, c.Jail, c.IP, c.Ts, c.EventType == "f2b_restore", banHistoryFoundLookbackMinutes)
+			if err != nil {
+				return err
+			}
+			if tag.RowsAffected() > 0 && c.EventType == "f2b_ban" {
+				log.Printf("Ban registrado: host=%s jail=%s ip=%s", c.Hostname, c.Jail, c.IP)
+			}
+
+		case "f2b_unban":
+			tag, err := s.db.Exec(ctx, `
+                UPDATE ssh_ban_history
+                SET unbanned_at = $4,
+                    duration_seconds = EXTRACT(EPOCH FROM $4::timestamptz - banned_at)::bigint
+                WHERE id = (
+                    SELECT id
+                    FROM ssh_ban_history
+                    WHERE agent_id = $1
+                      AND jail = $2
+                      AND ip = $3
+                      AND unbanned_at IS NULL
+                      AND banned_at <= $4
+                    ORDER BY banned_at DESC
+                    LIMIT 1
+                );
+            `, c.AgentID, c.Jail, c.IP, c.Ts)
+			if err != nil {
+				return err
+			}
+			if tag.RowsAffected() > 0 || c.PayloadBannedAt == nil {
+				continue
+			}
+
+			// El ban es anterior al historial: el agente nos dice cuándo fue
+			_, err = s.db.Exec(ctx, `
+                INSERT INTO ssh_ban_history (agent_id, hostname, jail, ip, banned_at, unbanned_at, duration_seconds)
+                VALUES ($1, $2, $3, $4, $5, $6, EXTRACT(EPOCH FROM $6::timestamptz - $5::timestamptz)::bigint)
+                ON CONFLICT (agent_id, jail, ip, banned_at) DO NOTHING;
+            `, c.AgentID, c.Hostname, c.Jail, c.IP, *c.PayloadBannedAt, c.Ts)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return saveEventWatermark(ctx, s.db, banHistoryWatermark, maxID)
+}
+
+// ----------------------------------------------------
+// API ssh_ban_history
+// ----------------------------------------------------
+
+func (s *Server) handleSSHBanHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "solo GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	host := q.Get("hostname")
+	jail := q.Get("jail")
+	ip := q.Get("ip")
+	status := q.Get("status")
+	minStr := q.Get("minutes")
+	limitStr := q.Get("limit")
+
+	windowMinutes := 1440
+	if minStr != "" {
+		if v, err := strconv.Atoi(minStr); err == nil && v > 0 && v <= 43200 {
+			windowMinutes = v
+		}
+	}
+
+	limit := 200
+	if limitStr != "" {
+		if v, err := strconv.Atoi(limitStr); err == nil && v > 0 && v <= 1000 {
+			limit = v
+		}
+	}
+
+	if status != "" && status != "active" && status != "ended" {
+		http.Error(w, "status inválido (use active o ended)", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	now := time.Now().UTC()
+
+	// Intervalos que se solapan con la ventana (los activos siempre)
+	query := `
+        SELECT id, hostname, jail, ip, banned_at, unbanned_at,
+               COALESCE(duration_seconds, EXTRACT(EPOCH FROM now() - banned_at)::bigint),
+               found_count, restored
+        FROM ssh_ban_history
+        WHERE COALESCE(unbanned_at, now()) >= now() - ($1::int || ' minutes')::interval
+    `
+	args := []any{windowMinutes}
+	argPos := 2
+
+	if host != "" {
+		query += " AND hostname = $" + strconv.Itoa(argPos)
+		args = append(args, host)
+		argPos++
+	}
+	if jail != "" {
+		query += " AND jail = $" + strconv.Itoa(argPos)
+		args = append(args, jail)
+		argPos++
+	}
+	if ip != "" {
+		query += " AND ip = $" + strconv.Itoa(argPos)
+		args = append(args, ip)
+		argPos++
+	}
+	switch status {
+	case "active":
+		query += " AND unbanned_at IS NULL"
+	case "ended":
+		query += " AND unbanned_at IS NOT NULL"
+	}
+
+	query += " ORDER BY banned_at DESC LIMIT $" + strconv.Itoa(argPos)
+	args = append(args, limit)
+
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		log.Printf("Error consultando ssh_ban_history: %v", err)
+		http.Error(w, "error consultando historial de bans", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var bans []SSHBanInterval
+	for rows.Next() {
+		var b SSHBanInterval
+		if err := rows.Scan(&b.ID, &b.Hostname, &b.Jail, &b.IP, &b.BannedAt, &b.UnbannedAt,
+			&b.DurationSeconds, &b.FoundCount, &b.Restored); err != nil {
+			log.Printf("Error escaneando ssh_ban_history: %v", err)
+			http.Error(w, "error leyendo historial de bans", http.StatusInternalServerError)
+			return
+		}
+		b.Status = "active"
+		if b.UnbannedAt != nil {
+			b.Status = "ended"
+		}
+		bans = append(bans, b)
+	}
+	if rows.Err() != nil {
+		log.Printf("Error final en rows ssh_ban_history: %v", rows.Err())
+		http.Error(w, "error leyendo historial de bans", http.StatusInternalServerError)
+		return
+	}
+
+	if bans == nil {
+		bans = []SSHBanInterval{}
+	}
+
+	resp := SSHBanHistoryResponse{
+		WindowMinutes: windowMinutes,
+		Limit:         limit,
+		GeneratedAt:   now,
+		Bans:          bans,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(resp); err != nil {
+		log.Printf("Error serializando respuesta ssh_ban_history: %v", err)
+	}
+}
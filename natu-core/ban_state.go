@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ----------------------------------------------------
+// Estado de bans por diferencias
+// ----------------------------------------------------
+//
+// Cada sincronización del agente se compara con lo que ya había en
+// ssh_bans_state: los bans que siguen se actualizan (last_seen), los nuevos
+// entran con first_seen y los que ya no aparecen pasan a ssh_bans_intervals
+// como intervalo cerrado. Así se sabe cuándo apareció y desapareció cada ban
+// y cuántas veces ha vuelto una IP.
+
+type SSHBanStateInterval struct {
+	ID       int64      `json:"id"`
+	Hostname string     `json:"hostname"`
+	IP       string     `json:"ip"`
+	Jail     string     `json:"jail"`
+	Source   string     `json:"source,omitempty"`
+	Origin   string     `json:"origin"`
+	Sets     []string   `json:"sets"`
+	BannedAt *time.Time `json:"banned_at,omitempty"`
+	// Primera y última sincronización en la que apareció el ban
+	FirstSeen time.Time  `json:"first_seen"`
+	LastSeen  time.Time  `json:"last_seen"`
+	ClosedAt  *time.Time `json:"closed_at,omitempty"`
+	// Para los abiertos, lo que llevan hasta ahora
+	DurationSeconds int64  `json:"duration_seconds"`
+	Status          string `json:"status"`
+}
+
+// SSHBanRecurrence resume cuántas veces aparece una IP en la ventana.
+type SSHBanRecurrence struct {
+	IP        string    `json:"ip"`
+	Intervals int       `json:"intervals"`
+	Hosts     int       `json:"hosts"`
+	Open      bool      `json:"open"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+type SSHBanStateHistoryResponse struct {
+	WindowMinutes int                   `json:"window_minutes"`
+	Limit         int                   `json:"limit"`
+	GeneratedAt   time.Time             `json:"generated_at"`
+	Intervals     []SSHBanStateInterval `json:"intervals"`
+	Recurrence    []SSHBanRecurrence    `json:"recurrence"`
+}
+
+// syncBanState aplica la lista actual del agente sobre ssh_bans_state dentro
+// de tx. Devuelve cuántos bans son nuevos y cuántos se han cerrado.
+func syncBanState(ctx context.Context, tx pgx.Tx, agentID string, bans []SSHBanSyncItem) (opened, closed int64, err error) {
+	ips := []string{}
+	jails := []string{}
+
+	for _, ban := range bans {
+		if ban.IP == "" {
+			continue
+		}
+
+		jail := ban.Jail
+		if jail == "" {
+			jail = "sshd"
+		}
+		sets := ban.Sets
+		if sets == nil {
+			sets = []string{}
+		}
+
+		var inserted bool
+		err := tx.QueryRow(ctx, `
+            INSERT INTO ssh_bans_state (agent_id, ip, jail, banned_at, reason, source, synced_at,
+                                        timeout_seconds, expires_at, sets, origin, first_seen, last_seen)
+            VALUES ($1, $2, $3, $4, $5, $6, now(), $7, $8, $9, $10, now(), now())
+            ON CONFLICT (agent_id, ip, jail) DO UPDATE
+            SET banned_at = EXCLUDED.banned_at,
+                reason = EXCLUDED.reason,
+                source = EXCLUDED.source,
+                synced_at = now(),
+                timeout_seconds = EXCLUDED.timeout_seconds,
+                expires_at = EXCLUDED.expires_at,
+                sets = EXCLUDED.sets,
+                origin = EXCLUDED.origin,
+                last_seen = now()
+            RETURNING (xmax = 0)
+        `, agentID, ban.IP, jail, ban.BannedAt, ban.Reason, ban.Source, ban.TimeoutSeconds, ban.ExpiresAt, sets,
+			banOrigin(ban.Source, jail, sets)).Scan(&inserted)
+		if err != nil {
+			return 0, 0, err
+		}
+		if inserted {
+			opened++
+		}
+
+		ips = append(ips, ban.IP)
+		jails = append(jails, jail)
+	}
+
+	// Lo que ya no está en la lista se cierra y sale del estado actual
+	tag, err := tx.Exec(ctx, `
+        WITH gone AS (
+            DELETE FROM ssh_bans_state b
+            WHERE b.agent_id = $1
+              AND NOT EXISTS (
+                  SELECT 1
+                  FROM unnest($2::text[], $3::text[]) AS cur(ip, jail)
+                  WHERE cur.ip = b.ip AND cur.jail = b.jail
+              )
+            RETURNING b.agent_id, b.ip, b.jail, b.source, b.origin, b.sets, b.banned_at, b.first_seen, b.last_seen
+        )
+        INSERT INTO ssh_bans_intervals (agent_id, hostname, ip, jail, source, origin, sets,
+                                        banned_at, first_seen, last_seen, closed_at)
+        SELECT g.agent_id, a.hostname, g.ip, g.jail, g.source, g.origin, g.sets,
+               g.banned_at, g.first_seen, g.last_seen, now()
+        FROM gone g
+        JOIN agents a ON a.id = g.agent_id
+    `, agentID, ips, jails)
+	if err != nil {
+		return 0, 0, err
+	}
+	return opened, tag.RowsAffected(), nil
+}
+
+// ----------------------------------------------------
+// API ssh_bans/history
+// ----------------------------------------------------
+
+func (s *Server) handleSSHBanStateHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "solo GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	host := q.Get("hostname")
+	jail := q.Get("jail")
+	ip := q.Get("ip")
+	status := q.Get("status")
+	minStr := q.Get("minutes")
+	limitStr := q.Get("limit")
+
+	windowMinutes := 1440
+	if minStr != "" {
+		if v, err := strconv.Atoi(minStr); err == nil && v > 0 && v <= 43200 {
+			windowMinutes = v
+		}
+	}
+
+	limit := 200
+	if limitStr != "" {
+		if v, err := strconv.Atoi(limitStr); err == nil && v > 0 && v <= 1000 {
+			limit = v
+		}
+	}
+
+	if status != "" && status != "open" && status != "closed" {
+		http.Error(w, "status inválido (use open o closed)", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	now := time.Now().UTC()
+
+	// Abiertos (ssh_bans_state) y cerrados que se solapan con la ventana
+	query := `
+        WITH h AS (
+            SELECT 0::bigint AS id, a.hostname, b.ip, b.jail, b.source, b.origin, b.sets,
+                   b.banned_at, b.first_seen, b.last_seen, NULL::timestamptz AS closed_at, b.agent_id
+            FROM ssh_bans_state b
+            JOIN agents a ON a.id = b.agent_id
+            UNION ALL
+            SELECT i.id, i.hostname, i.ip, i.jail, i.source, i.origin, i.sets,
+                   i.banned_at, i.first_seen, i.last_seen, i.closed_at, i.agent_id
+            FROM ssh_bans_intervals i
+            WHERE i.closed_at >= now() - ($1::int || ' minutes')::interval
+        )
+        SELECT id, hostname, ip, jail, COALESCE(source, ''), origin, sets, banned_at,
+               first_seen, last_seen, closed_at, agent_id::text
+        FROM h
+        WHERE true
+    `
+	args := []any{windowMinutes}
+	argPos := 2
+
+	if host != "" {
+		query += " AND hostname = $" + strconv.Itoa(argPos)
+		args = append(args, host)
+		argPos++
+	}
+	if jail != "" {
+		query += " AND jail = $" + strconv.Itoa(argPos)
+		args = append(args, jail)
+		argPos++
+	}
+	if ip != "" {
+		query += " AND ip = $" + strconv.Itoa(argPos)
+		args = append(args, ip)
+		argPos++
+	}
+	switch status {
+	case "open":
+		query += " AND closed_at IS NULL"
+	case "closed":
+		query += " AND closed_at IS NOT NULL"
+	}
+
+	query += " ORDER BY first_seen DESC LIMIT $" + strconv.Itoa(argPos)
+	args = append(args, limit)
+
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		log.Printf("Error consultando historial de ssh_bans_state: %v", err)
+		http.Error(w, "error consultando historial de bans", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var intervals []SSHBanStateInterval
+	recurrence := map[string]*SSHBanRecurrence{}
+	recurrenceHosts := map[string]map[string]bool{}
+	var order []string
+
+	for rows.Next() {
+		var it SSHBanStateInterval
+		var agentID string
+		if err := rows.Scan(&it.ID, &it.Hostname, &it.IP, &it.Jail, &it.Source, &it.Origin, &it.Sets,
+			&it.BannedAt, &it.FirstSeen, &it.LastSeen, &it.ClosedAt, &agentID); err != nil {
+			log.Printf("Error escaneando historial de ssh_bans_state: %v", err)
+			http.Error(w, "error leyendo historial de bans", http.StatusInternalServerError)
+			return
+		}
+
+		end := now
+		it.Status = "open"
+		if it.ClosedAt != nil {
+			end = *it.ClosedAt
+			it.Status = "closed"
+		}
+		it.DurationSeconds = int64(end.Sub(it.FirstSeen).Seconds())
+		if it.Sets == nil {
+			it.Sets = []string{}
+		}
+		intervals = append(intervals, it)
+
+		rec, ok := recurrence[it.IP]
+		if !ok {
+			rec = &SSHBanRecurrence{IP: it.IP, FirstSeen: it.FirstSeen, LastSeen: it.LastSeen}
+			recurrence[it.IP] = rec
+			recurrenceHosts[it.IP] = map[string]bool{}
+			order = append(order, it.IP)
+		}
+		rec.Intervals++
+		recurrenceHosts[it.IP][agentID] = true
+		rec.Hosts = len(recurrenceHosts[it.IP])
+		if it.ClosedAt == nil {
+			rec.Open = true
+		}
+		if it.FirstSeen.Before(rec.FirstSeen) {
+			rec.FirstSeen = it.FirstSeen
+		}
+		if it.LastSeen.After(rec.LastSeen) {
+			rec.LastSeen = it.LastSeen
+		}
+	}
+	if rows.Err() != nil {
+		log.Printf("Error final en rows historial de ssh_bans_state: %v", rows.Err())
+		http.Error(w, "error leyendo historial de bans", http.StatusInternalServerError)
+		return
+	}
+
+	if intervals == nil {
+		intervals = []SSHBanStateInterval{}
+	}
+	recs := make([]SSHBanRecurrence, 0, len(order))
+	for _, ip := range order {
+		recs = append(recs, *recurrence[ip])
+	}
+	// Las IPs que más vuelven, primero
+	sort.SliceStable(recs, func(i, j int) bool {
+		return recs[i].Intervals > recs[j].Intervals
+	})
+
+	resp := SSHBanStateHistoryResponse{
+		WindowMinutes: windowMinutes,
+		Limit:         limit,
+		GeneratedAt:   now,
+		Intervals:     intervals,
+		Recurrence:    recs,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(resp); err != nil {
+		log.Printf("Error serializando respuesta historial de ssh_bans_state: %v", err)
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ----------------------------------------------------
+// Feeds de blocklist para firewalls externos
+// ----------------------------------------------------
+//
+// GET /api/v1/blocklist/{plain|ipset|nft|cidr} publica las IPs baneadas en
+// la flota (ssh_bans_state sincronizado hace poco) más los bans manuales
+// vigentes de ban_actions. Filtros: jail, hostname, min_hosts (hosts
+// distintos que banean la IP; los manuales no lo necesitan), manual=0 para
+// omitir los manuales y max_age_minutes. Las IPs de federation_allowlist no
+// se publican nunca.
+//
+//   - plain: una IP o red por línea.
+//   - ipset: script para "ipset restore" (set hash:net, IPv4 y -v6). Se
+//     llena un set temporal y se intercambia con swap: el set en uso nunca
+//     queda vacío y, si el restore falla, se queda como estaba.
+//   - nft:   script para "nft -f" con un set de intervalos por familia.
+//   - cidr:  la lista agregada en el menor número de redes exactas.
+//
+// El cuerpo no lleva fecha, así que el ETag sólo cambia cuando cambia la
+// lista y los pullers pueden sondear con If-None-Match.
+
+const (
+	blocklistDefaultSet     = "natu-blocklist"
+	blocklistDefaultMaxAge  = 60
+	blocklistMaxAgeLimit    = 10080
+	blocklistDefaultNftFam  = "inet"
+	blocklistDefaultNftTab  = "filter"
+	blocklistMaxHostsFilter = 1000
+	// Set temporal de ipset durante el restore
+	blocklistIpsetTmpSuffix = "-tmp"
+)
+
+var reBlocklistName = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,31}$`)
+
+type blocklistFilter struct {
+	Jail          string
+	Hostname      string
+	MinHosts      int
+	Manual        bool
+	MaxAgeMinutes int
+}
+
+func (s *Server) handleBlocklist(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "solo GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	format := strings.TrimPrefix(r.URL.Path, "/api/v1/blocklist/")
+	switch format {
+	case "plain", "ipset", "nft", "cidr":
+	default:
+		http.Error(w, "formato inválido (use plain, ipset, nft o cidr)", http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+	f := blocklistFilter{
+		Jail:          q.Get("jail"),
+		Hostname:      q.Get("hostname"),
+		MinHosts:      1,
+		Manual:        q.Get("manual") != "0" && q.Get("manual") != "false",
+		MaxAgeMinutes: blocklistDefaultMaxAge,
+	}
+	if v, err := strconv.Atoi(q.Get("min_hosts")); err == nil && v >= 1 && v <= blocklistMaxHostsFilter {
+		f.MinHosts = v
+	}
+	if v, err := strconv.Atoi(q.Get("max_age_minutes")); err == nil && v > 0 && v <= blocklistMaxAgeLimit {
+		f.MaxAgeMinutes = v
+	}
+
+	setName := blocklistDefaultSet
+	if v := q.Get("set"); v != "" {
+		setName = v
+	}
+	nftFamily := blocklistDefaultNftFam
+	if v := q.Get("family"); v != "" {
+		nftFamily = v
+	}
+	nftTable := blocklistDefaultNftTab
+	if v := q.Get("table"); v != "" {
+		nftTable = v
+	}
+	// El set IPv6 lleva el sufijo -v6 y el temporal de ipset -tmp: el nombre
+	// base tiene que dejar sitio (ipset admite 31 caracteres)
+	if !reBlocklistName.MatchString(setName) || len(setName) > 31-len("-v6"+blocklistIpsetTmpSuffix) || !reBlocklistName.MatchString(nftTable) {
+		http.Error(w, "set o table inválidos", http.StatusBadRequest)
+		return
+	}
+	switch nftFamily {
+	case "ip", "ip6", "inet", "bridge", "netdev":
+	default:
+		http.Error(w, "family inválida", http.StatusBadRequest)
+		return
+	}
+
+	prefixes, err := s.collectBlocklist(r.Context(), f)
+	if err != nil {
+		log.Printf("Error generando blocklist: %v", err)
+		http.Error(w, "error generando blocklist", http.StatusInternalServerError)
+		return
+	}
+
+	var body string
+	switch format {
+	case "plain":
+		body = renderPlainBlocklist(prefixes)
+	case "cidr":
+		body = renderPlainBlocklist(aggregatePrefixes(prefixes))
+	case "ipset":
+		body = renderIpsetBlocklist(prefixes, setName)
+	case "nft":
+		body = renderNftBlocklist(prefixes, nftFamily, nftTable, setName)
+	}
+
+	sum := sha256.Sum256([]byte(body))
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Blocklist-Entries", strconv.Itoa(len(prefixes)))
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, _ = w.Write([]byte(body))
+}
+
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		candidate = strings.TrimPrefix(candidate, "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// collectBlocklist devuelve las IPs/redes ordenadas y sin repetir.
+func (s *Server) collectBlocklist(ctx context.Context, f blocklistFilter) ([]netip.Prefix, error) {
+	query := `
+        SELECT b.ip
+        FROM ssh_bans_state b
+        JOIN agents a ON a.id = b.agent_id
+        WHERE b.synced_at >= now() - ($1::int || ' minutes')::interval
+    `
+	args := []any{f.MaxAgeMinutes}
+	argPos := 2
+
+	if f.Jail != "" {
+		query += " AND b.jail = $" + strconv.Itoa(argPos)
+		args = append(args, f.Jail)
+		argPos++
+	}
+	if f.Hostname != "" {
+		query += " AND a.hostname = $" + strconv.Itoa(argPos)
+		args = append(args, f.Hostname)
+		argPos++
+	}
+	query += " GROUP BY b.ip HAVING count(DISTINCT b.agent_id) >= $" + strconv.Itoa(argPos)
+	args = append(args, f.MinHosts)
+
+	ips, err := s.queryStrings(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Manual {
+		// Bans manuales vigentes: no cancelados, sin TTL vencido y sin un
+		// unban posterior de la misma IP
+		query := `
+            SELECT ba.ip
+            FROM ban_actions ba
+            WHERE ba.action = 'ban'
+              AND ba.requested_by <> $1
+              AND ba.status IN ('pending', 'running', 'done', 'partial')
+              AND (ba.ttl_seconds IS NULL
+                   OR ba.created_at + (ba.ttl_seconds || ' seconds')::interval > now())
+              AND NOT EXISTS (
+                  SELECT 1
+                  FROM ban_actions u
+                  WHERE u.action = 'unban'
+                    AND u.ip = ba.ip
+                    AND u.created_at > ba.created_at
+                    AND u.status <> 'cancelled'
+              )
+        `
+		args := []any{federationRequestedBy}
+		argPos := 2
+		if f.Jail != "" {
+			query += " AND ba.jail = $" + strconv.Itoa(argPos)
+			args = append(args, f.Jail)
+			argPos++
+		}
+		if f.Hostname != "" {
+			query += " AND (ba.scope = 'fleet' OR ba.target_hostname = $" + strconv.Itoa(argPos) + ")"
+			args = append(args, f.Hostname)
+		}
+
+		manual, err := s.queryStrings(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		ips = append(ips, manual...)
+	}
+
+	allow, err := s.loadFederationAllowlist(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[netip.Prefix]bool{}
+	var out []netip.Prefix
+	for _, ip := range ips {
+		p, ok := parseBlocklistEntry(ip)
+		if !ok || seen[p] || blocklistOverlapsAllow(p, allow) {
+			continue
+		}
+		seen[p] = true
+		out = append(out, p)
+	}
+	sortPrefixes(out)
+	return out, nil
+}
+
+func (s *Server) queryStrings(ctx context.Context, query string, args ...any) ([]string, error) {
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []string
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, rows.Err()
+}
+
+// parseBlocklistEntry acepta IP o CIDR y lo normaliza a prefijo.
+func parseBlocklistEntry(s string) (netip.Prefix, bool) {
+	if a, err := netip.ParseAddr(s); err == nil {
+		a = a.Unmap()
+		return netip.PrefixFrom(a, a.BitLen()), true
+	}
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	return p.Masked(), true
+}
+
+// blocklistOverlapsAllow evita publicar una red que contenga una IP
+// permitida (la allowlist manda sobre una red baneada más grande).
+func blocklistOverlapsAllow(p netip.Prefix, allow []*net.IPNet) bool {
+	for _, n := range allow {
+		a, ok := netip.AddrFromSlice(n.IP)
+		if !ok {
+			continue
+		}
+		ones, _ := n.Mask.Size()
+		if p.Overlaps(netip.PrefixFrom(a.Unmap(), ones)) {
+			return true
+		}
+	}
+	return false
+}
+
+func sortPrefixes(ps []netip.Prefix) {
+	sort.Slice(ps, func(i, j int) bool {
+		if c := ps[i].Addr().Compare(ps[j].Addr()); c != 0 {
+			return c < 0
+		}
+		return ps[i].Bits() < ps[j].Bits()
+	})
+}
+
+// aggregatePrefixes quita las redes contenidas en otras y junta parejas de
+// hermanas en su red padre, sin añadir nunca direcciones nuevas.
+func aggregatePrefixes(in []netip.Prefix) []netip.Prefix {
+	set := map[netip.Prefix]bool{}
+	for _, p := range in {
+		set[p] = true
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for p := range set {
+			if p.Bits() == 0 {
+				continue
+			}
+			parent, _ := p.Addr().Prefix(p.Bits() - 1)
+
+			// Contenida en otra red del conjunto
+			for bits := p.Bits() - 1; bits >= 0; bits-- {
+				up, _ := p.Addr().Prefix(bits)
+				if set[up] {
+					delete(set, p)
+					changed = true
+					break
+				}
+			}
+			if !set[p] {
+				continue
+			}
+
+			sibling := siblingPrefix(p, parent)
+			if set[sibling] {
+				delete(set, p)
+				delete(set, sibling)
+				set[parent] = true
+				changed = true
+			}
+		}
+	}
+
+	out := make([]netip.Prefix, 0, len(set))
+	for p := range set {
+		out = append(out, p)
+	}
+	sortPrefixes(out)
+	return out
+}
+
+// siblingPrefix es la otra mitad de parent.
+func siblingPrefix(p, parent netip.Prefix) netip.Prefix {
+	b := p.Addr().AsSlice()
+	bit := p.Bits() - 1
+	b[bit/8] ^= 1 << (7 - uint(bit%8))
+	a, _ := netip.AddrFromSlice(b)
+	return netip.PrefixFrom(a, p.Bits())
+}
+
+func prefixText(p netip.Prefix) string {
+	if p.IsSingleIP() {
+		return p.Addr().String()
+	}
+	return p.String()
+}
+
+func splitFamilies(ps []netip.Prefix) (v4, v6 []netip.Prefix) {
+	for _, p := range ps {
+		if p.Addr().Is4() {
+			v4 = append(v4, p)
+		} else {
+			v6 = append(v6, p)
+		}
+	}
+	return v4, v6
+}
+
+func renderPlainBlocklist(ps []netip.Prefix) string {
+	var b strings.Builder
+	for _, p := range ps {
+		b.WriteString(prefixText(p))
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+func renderIpsetBlocklist(ps []netip.Prefix, setName string) string {
+	v4, v6 := splitFamilies(ps)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# natu blocklist: %d entradas\n", len(ps))
+	for _, fam := range []struct {
+		name   string
+		family string
+		list   []netip.Prefix
+	}{
+		{setName, "inet", v4},
+		{setName + "-v6", "inet6", v6},
+	} {
+		tmp := fam.name + blocklistIpsetTmpSuffix
+		fmt.Fprintf(&b, "create %s hash:net family %s -exist\n", fam.name, fam.family)
+		// Puede quedar de un restore anterior que falló
+		fmt.Fprintf(&b, "create %s hash:net family %s -exist\n", tmp, fam.family)
+		fmt.Fprintf(&b, "flush %s\n", tmp)
+		for _, p := range fam.list {
+			fmt.Fprintf(&b, "add %s %s -exist\n", tmp, prefixText(p))
+		}
+		fmt.Fprintf(&b, "swap %s %s\n", tmp, fam.name)
+		fmt.Fprintf(&b, "destroy %s\n", tmp)
+	}
+	return b.String()
+}
+
+func renderNftBlocklist(ps []netip.Prefix, family, table, setName string) string {
+	v4, v6 := splitFamilies(ps)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# natu blocklist: %d entradas (nft -f)\n", len(ps))
+	fmt.Fprintf(&b, "add table %s %s\n", family, table)
+	for _, fam := range []struct {
+		name string
+		typ  string
+		list []netip.Prefix
+	}{
+		{setName, "ipv4_addr", v4},
+		{setName + "-v6", "ipv6_addr", v6},
+	} {
+		fmt.Fprintf(&b, "add set %s %s %s { type %s; flags interval; }\n", family, table, fam.name, fam.typ)
+		fmt.Fprintf(&b, "flush set %s %s %s\n", family, table, fam.name)
+		if len(fam.list) == 0 {
+			continue
+		}
+		elems := make([]string, 0, len(fam.list))
+		for _, p := range aggregatePrefixes(fam.list) {
+			elems = append(elems, prefixText(p))
+		}
+		fmt.Fprintf(&b, "add element %s %s %s { %s }\n", family, table, fam.name, strings.Join(elems, ", "))
+	}
+	return b.String()
+}
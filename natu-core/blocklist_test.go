@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestAggregatePrefixes(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"vacío", "", ""},
+		{"una red", "203.0.113.7/32", "203.0.113.7/32"},
+		{"duplicados", "203.0.113.7/32 203.0.113.7/32", "203.0.113.7/32"},
+		{"hermanas /32 -> /31", "203.0.113.6/32 203.0.113.7/32", "203.0.113.6/31"},
+		{"no hermanas aunque contiguas", "203.0.113.7/32 203.0.113.8/32", "203.0.113.7/32 203.0.113.8/32"},
+		{"fusión en cascada", "10.0.0.0/26 10.0.0.64/26 10.0.0.128/25", "10.0.0.0/24"},
+		{"cuatro /32 -> /30", "198.51.100.3/32 198.51.100.1/32 198.51.100.0/32 198.51.100.2/32", "198.51.100.0/30"},
+		{"contenida en otra", "10.1.0.0/16 10.1.2.3/32 10.1.200.0/24", "10.1.0.0/16"},
+		{"contenida y hermana de la contenedora", "10.0.0.0/25 10.0.0.5/32 10.0.0.128/25", "10.0.0.0/24"},
+		{"tres cuartos no se amplían", "10.0.0.0/26 10.0.0.64/26 10.0.0.128/26", "10.0.0.0/25 10.0.0.128/26"},
+		{"ordenado por dirección", "192.0.2.0/24 10.0.0.0/8 172.16.0.0/12", "10.0.0.0/8 172.16.0.0/12 192.0.2.0/24"},
+		{"v6 hermanas", "2001:db8::/64 2001:db8:0:1::/64", "2001:db8::/63"},
+		{"v6 contenida", "2001:db8::/48 2001:db8:0:42::1/128", "2001:db8::/48"},
+		{"v4 y v6 no se mezclan", "0.0.0.0/1 128.0.0.0/1 ::/1 8000::/1", "0.0.0.0/0 ::/0"},
+	}
+
+	for _, tt := range tests {
+		var in []netip.Prefix
+		for _, s := range strings.Fields(tt.in) {
+			in = append(in, netip.MustParsePrefix(s))
+		}
+		out := aggregatePrefixes(in)
+
+		got := make([]string, len(out))
+		for i, p := range out {
+			got[i] = p.String()
+		}
+		if strings.Join(got, " ") != tt.want {
+			t.Errorf("%s: aggregatePrefixes(%s) = %v, se esperaba %s", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ----------------------------
+// Configuración de natu-core
+// ----------------------------
+//
+// La configuración sale de un fichero JSON (-config, NATU_CORE_CONFIG o
+// /etc/natu-core/core.json) sobre los valores por defecto, y las variables de
+// entorno pisan al fichero. listen_addr, database_url y api_token requieren reiniciar;
+// rules_file y sigma_dir se releen con SIGHUP; el bloque settings (umbrales,
+// ventanas e intervalo de los workers) se puede cambiar en caliente con
+// /api/v1/settings.
+
+const defaultCoreConfigPath = "/etc/natu-core/core.json"
+
+type CoreConfig struct {
+	ListenAddr  string `json:"listen_addr"`
+	DatabaseURL string `json:"database_url,omitempty"`
+	// Token compartido que exigen las escrituras de /api/v1/ban_actions;
+	// vacío las deja deshabilitadas
+	APIToken  string   `json:"api_token,omitempty"`
+	RulesFile string   `json:"rules_file"`
+	SigmaDir  string   `json:"sigma_dir"`
+	Settings  Settings `json:"settings"`
+}
+
+// Settings son los parámetros de detección que leen los workers en cada
+// vuelta.
+type Settings struct {
+	WorkerIntervalSeconds int                 `json:"worker_interval_seconds"`
+	SSHAlert              SSHAlertSettings    `json:"ssh_alert"`
+	Suspicious            SuspiciousSettings  `json:"suspicious_login"`
+	PasswordSpray         SpraySettings       `json:"password_spray"`
+	Distributed           DistributedSettings `json:"distributed_bruteforce"`
+	LowSlow               LowSlowSettings     `json:"low_and_slow"`
+	SudoAlert             WindowSettings      `json:"sudo_alert"`
+	SudoFailure           ThresholdSettings   `json:"sudo_failure"`
+	AccountAlert          WindowSettings      `json:"account_alert"`
+	RootShell             WindowSettings      `json:"root_shell"`
+	BanHistory            WindowSettings      `json:"ban_history"`
+	Federation            FederationSettings  `json:"federation"`
+	BanActions            BanActionSettings   `json:"ban_actions"`
+}
+
+type SpraySettings struct {
+	WindowMinutes int `json:"window_minutes"`
+	// Usuarios distintos desde una misma IP
+	UsernamesPerIP int `json:"usernames_per_ip"`
+	// IPs distintas contra un mismo usuario
+	IPsPerUsername int `json:"ips_per_username"`
+}
+
+type DistributedSettings struct {
+	WindowMinutes int `json:"window_minutes"`
+	// Fallos en toda la flota desde una IP o una subred
+	FailedThreshold int `json:"failed_threshold"`
+	// Hosts distintos atacados
+	MinHosts int `json:"min_hosts"`
+	// IPs distintas de la misma subred
+	SubnetMinIPs int `json:"subnet_min_ips"`
+}
+
+type LowSlowSettings struct {
+	// Máximo de fallos en una hora (por encima ya es fuerza bruta normal)
+	MaxPerHour int `json:"max_per_hour"`
+	// Coeficiente de variación máximo del intervalo entre intentos
+	MaxIntervalCV float64       `json:"max_interval_cv"`
+	Day           LowSlowWindow `json:"day"`
+	Week          LowSlowWindow `json:"week"`
+}
+
+type LowSlowWindow struct {
+	MinAttempts    int `json:"min_attempts"`
+	MinActiveHours int `json:"min_active_hours"`
+}
+
+type WindowSettings struct {
+	WindowMinutes int `json:"window_minutes"`
+}
+
+type ThresholdSettings struct {
+	WindowMinutes int `json:"window_minutes"`
+	Threshold     int `json:"threshold"`
+}
+
+type SSHAlertSettings struct {
+	WindowMinutes   int `json:"window_minutes"`
+	FailedThreshold int `json:"failed_threshold"`
+}
+
+type SuspiciousSettings struct {
+	WindowMinutes       int `json:"window_minutes"`
+	FailedBeforeSuccess int `json:"failed_before_success"`
+}
+
+func defaultCoreConfig() *CoreConfig {
+	return &CoreConfig{
+		ListenAddr: ":5010",
+		RulesFile:  defaultCoreRulesPath,
+		SigmaDir:   defaultSigmaDir,
+		Settings: Settings{
+			WorkerIntervalSeconds: 60,
+			SSHAlert:              SSHAlertSettings{WindowMinutes: 60, FailedThreshold: 5},
+			Suspicious:            SuspiciousSettings{WindowMinutes: 15, FailedBeforeSuccess: 3},
+			PasswordSpray:         SpraySettings{WindowMinutes: 60, UsernamesPerIP: 10, IPsPerUsername: 10},
+			Distributed:           DistributedSettings{WindowMinutes: 60, FailedThreshold: 20, MinHosts: 3, SubnetMinIPs: 3},
+			LowSlow: LowSlowSettings{
+				MaxPerHour:    4,
+				MaxIntervalCV: 0.5,
+				Day:           LowSlowWindow{MinAttempts: 10, MinActiveHours: 6},
+				Week:          LowSlowWindow{MinAttempts: 30, MinActiveHours: 24},
+			},
+			SudoAlert:    WindowSettings{WindowMinutes: 60},
+			SudoFailure:  ThresholdSettings{WindowMinutes: 60, Threshold: 3},
+			AccountAlert: WindowSettings{WindowMinutes: 60},
+			RootShell:    WindowSettings{WindowMinutes: 60},
+			BanHistory:   WindowSettings{WindowMinutes: 60},
+			Federation: FederationSettings{
+				MinHosts:   FederationMinHosts,
+				TTLSeconds: FederationTTLSeconds,
+			},
+			BanActions: BanActionSettings{MinPrefixV4: 24, MinPrefixV6: 64},
+		},
+	}
+}
+
+// coreConfigPathFromEnv es la ruta por defecto cuando no se pasa -config.
+func coreConfigPathFromEnv() string {
+	if v := os.Getenv("NATU_CORE_CONFIG"); v != "" {
+		return v
+	}
+	return defaultCoreConfigPath
+}
+
+// LoadCoreConfig lee el fichero, aplica las variables de entorno y valida.
+// Si el fichero no existe y no se pidió explícitamente se usan sólo los
+// defaults y el entorno.
+func LoadCoreConfig(path string, explicit bool) (*CoreConfig, error) {
+	cfg := defaultCoreConfig()
+
+	b, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err) && !explicit:
+	case err != nil:
+		return nil, fmt.Errorf("leyendo configuración %s: %w", path, err)
+	default:
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(cfg); err != nil {
+			return nil, fmt.Errorf("configuración %s: JSON inválido: %w", path, err)
+		}
+	}
+
+	cfg.applyEnv()
+
+	var problems []string
+	if cfg.ListenAddr == "" {
+		problems = append(problems, "listen_addr vacío")
+	}
+	if cfg.DatabaseURL == "" {
+		problems = append(problems, "database_url vacío (o DATABASE_URL no definido)")
+	}
+	problems = append(problems, cfg.Settings.validate()...)
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("configuración %s inválida:\n  %s", path, strings.Join(problems, "\n  "))
+	}
+	return cfg, nil
+}
+
+func (cfg *CoreConfig) applyEnv() {
+	envString := func(name string, dst *string) {
+		if v := os.Getenv(name); v != "" {
+			*dst = v
+		}
+	}
+	envInt := func(name string, dst *int) {
+		if v := os.Getenv(name); v != "" {
+			if iv, err := strconv.Atoi(v); err == nil {
+				*dst = iv
+			}
+		}
+	}
+	envFloat := func(name string, dst *float64) {
+		if v := os.Getenv(name); v != "" {
+			if fv, err := strconv.ParseFloat(v, 64); err == nil {
+				*dst = fv
+			}
+		}
+	}
+
+	st := &cfg.Settings
+	envString("NATU_CORE_LISTEN_ADDR", &cfg.ListenAddr)
+	envString("DATABASE_URL", &cfg.DatabaseURL)
+	envString("NATU_CORE_API_TOKEN", &cfg.APIToken)
+	envString("NATU_CORE_RULES_FILE", &cfg.RulesFile)
+	envString("NATU_CORE_SIGMA_DIR", &cfg.SigmaDir)
+	envInt("NATU_WORKER_INTERVAL_SECONDS", &st.WorkerIntervalSeconds)
+	envInt("NATU_SSH_ALERT_WINDOW_MINUTES", &st.SSHAlert.WindowMinutes)
+	envInt("NATU_SSH_ALERT_FAILED_THRESHOLD", &st.SSHAlert.FailedThreshold)
+	envInt("NATU_SUSPICIOUS_WINDOW_MINUTES", &st.Suspicious.WindowMinutes)
+	envInt("NATU_SUSPICIOUS_FAILED_BEFORE_SUCCESS", &st.Suspicious.FailedBeforeSuccess)
+	envInt("NATU_SPRAY_WINDOW_MINUTES", &st.PasswordSpray.WindowMinutes)
+	envInt("NATU_SPRAY_USERNAMES_PER_IP", &st.PasswordSpray.UsernamesPerIP)
+	envInt("NATU_SPRAY_IPS_PER_USERNAME", &st.PasswordSpray.IPsPerUsername)
+	envInt("NATU_DISTRIBUTED_WINDOW_MINUTES", &st.Distributed.WindowMinutes)
+	envInt("NATU_DISTRIBUTED_FAILED_THRESHOLD", &st.Distributed.FailedThreshold)
+	envInt("NATU_DISTRIBUTED_MIN_HOSTS", &st.Distributed.MinHosts)
+	envInt("NATU_DISTRIBUTED_SUBNET_MIN_IPS", &st.Distributed.SubnetMinIPs)
+	envInt("NATU_LOW_SLOW_MAX_PER_HOUR", &st.LowSlow.MaxPerHour)
+	envFloat("NATU_LOW_SLOW_MAX_INTERVAL_CV", &st.LowSlow.MaxIntervalCV)
+	envInt("NATU_LOW_SLOW_DAY_MIN_ATTEMPTS", &st.LowSlow.Day.MinAttempts)
+	envInt("NATU_LOW_SLOW_DAY_MIN_ACTIVE_HOURS", &st.LowSlow.Day.MinActiveHours)
+	envInt("NATU_LOW_SLOW_WEEK_MIN_ATTEMPTS", &st.LowSlow.Week.MinAttempts)
+	envInt("NATU_LOW_SLOW_WEEK_MIN_ACTIVE_HOURS", &st.LowSlow.Week.MinActiveHours)
+	envInt("NATU_SUDO_ALERT_WINDOW_MINUTES", &st.SudoAlert.WindowMinutes)
+	envInt("NATU_SUDO_FAILURE_WINDOW_MINUTES", &st.SudoFailure.WindowMinutes)
+	envInt("NATU_SUDO_FAILURE_THRESHOLD", &st.SudoFailure.Threshold)
+	envInt("NATU_ACCOUNT_ALERT_WINDOW_MINUTES", &st.AccountAlert.WindowMinutes)
+	envInt("NATU_ROOT_SHELL_WINDOW_MINUTES", &st.RootShell.WindowMinutes)
+	envInt("NATU_BAN_HISTORY_WINDOW_MINUTES", &st.BanHistory.WindowMinutes)
+	envInt("NATU_FEDERATION_MIN_HOSTS", &st.Federation.MinHosts)
+	envInt("NATU_FEDERATION_TTL_SECONDS", &st.Federation.TTLSeconds)
+	envInt("NATU_BAN_MIN_PREFIX_V4", &st.BanActions.MinPrefixV4)
+	envInt("NATU_BAN_MIN_PREFIX_V6", &st.BanActions.MinPrefixV6)
+	switch strings.ToLower(os.Getenv("NATU_FEDERATION")) {
+	case "1", "on", "true", "yes":
+		st.Federation.Enabled = true
+	case "0", "off", "false", "no":
+		st.Federation.Enabled = false
+	}
+}
+
+func (st Settings) validate() []string {
+	var problems []string
+
+	window := func(name string, v int) {
+		if v < 1 || v > 1440 {
+			problems = append(problems, name+" fuera de rango (1-1440)")
+		}
+	}
+	atLeast := func(name string, v, min int) {
+		if v < min {
+			problems = append(problems, fmt.Sprintf("%s debe ser >= %d", name, min))
+		}
+	}
+
+	if st.WorkerIntervalSeconds < 10 || st.WorkerIntervalSeconds > 3600 {
+		problems = append(problems, "settings.worker_interval_seconds fuera de rango (10-3600)")
+	}
+	window("settings.ssh_alert.window_minutes", st.SSHAlert.WindowMinutes)
+	atLeast("settings.ssh_alert.failed_threshold", st.SSHAlert.FailedThreshold, 1)
+	window("settings.suspicious_login.window_minutes", st.Suspicious.WindowMinutes)
+	atLeast("settings.suspicious_login.failed_before_success", st.Suspicious.FailedBeforeSuccess, 1)
+	window("settings.password_spray.window_minutes", st.PasswordSpray.WindowMinutes)
+	atLeast("settings.password_spray.usernames_per_ip", st.PasswordSpray.UsernamesPerIP, 2)
+	atLeast("settings.password_spray.ips_per_username", st.PasswordSpray.IPsPerUsername, 2)
+	window("settings.distributed_bruteforce.window_minutes", st.Distributed.WindowMinutes)
+	atLeast("settings.distributed_bruteforce.failed_threshold", st.Distributed.FailedThreshold, 1)
+	atLeast("settings.distributed_bruteforce.min_hosts", st.Distributed.MinHosts, 2)
+	atLeast("settings.distributed_bruteforce.subnet_min_ips", st.Distributed.SubnetMinIPs, 2)
+	atLeast("settings.low_and_slow.max_per_hour", st.LowSlow.MaxPerHour, 1)
+	if st.LowSlow.MaxIntervalCV <= 0 || st.LowSlow.MaxIntervalCV > 5 {
+		problems = append(problems, "settings.low_and_slow.max_interval_cv fuera de rango (0-5]")
+	}
+	atLeast("settings.low_and_slow.day.min_attempts", st.LowSlow.Day.MinAttempts, 3)
+	if v := st.LowSlow.Day.MinActiveHours; v < 2 || v > 24 {
+		problems = append(problems, "settings.low_and_slow.day.min_active_hours fuera de rango (2-24)")
+	}
+	atLeast("settings.low_and_slow.week.min_attempts", st.LowSlow.Week.MinAttempts, 3)
+	if v := st.LowSlow.Week.MinActiveHours; v < 2 || v > 168 {
+		problems = append(problems, "settings.low_and_slow.week.min_active_hours fuera de rango (2-168)")
+	}
+	window("settings.sudo_alert.window_minutes", st.SudoAlert.WindowMinutes)
+	window("settings.sudo_failure.window_minutes", st.SudoFailure.WindowMinutes)
+	atLeast("settings.sudo_failure.threshold", st.SudoFailure.Threshold, 1)
+	window("settings.account_alert.window_minutes", st.AccountAlert.WindowMinutes)
+	window("settings.root_shell.window_minutes", st.RootShell.WindowMinutes)
+	window("settings.ban_history.window_minutes", st.BanHistory.WindowMinutes)
+	atLeast("settings.federation.min_hosts", st.Federation.MinHosts, 2)
+	if st.Federation.TTLSeconds < 60 || st.Federation.TTLSeconds > banActionMaxTTLSeconds {
+		problems = append(problems, fmt.Sprintf("settings.federation.ttl_seconds fuera de rango (60-%d)", banActionMaxTTLSeconds))
+	}
+	if v := st.BanActions.MinPrefixV4; v < 8 || v > 32 {
+		problems = append(problems, "settings.ban_actions.min_prefix_v4 fuera de rango (8-32)")
+	}
+	if v := st.BanActions.MinPrefixV6; v < 16 || v > 128 {
+		problems = append(problems, "settings.ban_actions.min_prefix_v6 fuera de rango (16-128)")
+	}
+	return problems
+}
@@ -0,0 +1,57 @@
+package main
+
+// ----------------------------------------------------
+// Fuerza bruta distribuida (reglas internas)
+// ----------------------------------------------------
+//
+// Repartiendo intentos entre hosts y entre IPs de la misma /24 (o /64) cada
+// par (host, IP) se queda por debajo de ssh_bruteforce. Estas reglas agregan
+// los fallos de toda la flota (settings.distributed_bruteforce) y levantan
+// una alerta de campaña con todos los hosts atacados en hosts:
+//
+//   - ssh_campaign_ip: failed_threshold fallos desde una IP contra al menos
+//     min_hosts hosts.
+//   - ssh_campaign_subnet: subnet_min_ips IPs distintas de la misma subred
+//     contra al menos min_hosts hosts, con failed_threshold fallos en total.
+//     Las IPs quedan en payload.distinct_values.
+
+func distributedBruteforceRules(st *Settings) []*Rule {
+	d := st.Distributed
+	// Sólo ssh_failed_login: un "Failed password for invalid user" también
+	// genera ssh_invalid_user y contaría doble. Es lo mismo que cuenta
+	// top_subnets en ssh_summary.
+	failures := &Condition{All: []*Condition{fieldEq("source", "auth"), fieldEq("event_type", "ssh_failed_login")}}
+
+	return []*Rule{
+		{
+			Name:          "ssh_campaign_ip",
+			Description:   "Fallos SSH desde una IP repartidos entre varios hosts",
+			Type:          ruleTypeThreshold,
+			Severity:      "alto",
+			Escalation:    []SeverityStep{{MinCount: d.FailedThreshold * 5, Severity: "crítico"}},
+			WindowMinutes: d.WindowMinutes,
+			GroupBy:       []string{"payload.remote_ip"},
+			Where:         failures,
+			Threshold:     d.FailedThreshold,
+			MinHosts:      d.MinHosts,
+			Message:       "Campaña SSH desde ${remote_ip}: ${count} fallos en ${window_minutes} min contra ${hosts}",
+			Origin:        ruleOriginBuiltin,
+		},
+		{
+			Name:          "ssh_campaign_subnet",
+			Description:   "Fallos SSH desde varias IPs de una subred contra varios hosts",
+			Type:          ruleTypeDistinct,
+			Severity:      "alto",
+			Escalation:    []SeverityStep{{MinCount: d.SubnetMinIPs * 3, Severity: "crítico"}},
+			WindowMinutes: d.WindowMinutes,
+			GroupBy:       []string{"remote_subnet"},
+			Where:         failures,
+			DistinctField: "payload.remote_ip",
+			Threshold:     d.SubnetMinIPs,
+			MinHosts:      d.MinHosts,
+			MinCount:      d.FailedThreshold,
+			Message:       "Campaña SSH desde ${remote_subnet}: ${distinct_count} IPs, ${count} fallos en ${window_minutes} min contra ${hosts}",
+			Origin:        ruleOriginBuiltin,
+		},
+	}
+}
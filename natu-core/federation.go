@@ -0,0 +1,759 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ----------------------------------------------------
+// Federación de bans en la flota
+// ----------------------------------------------------
+//
+// Con settings.federation.enabled (o NATU_FEDERATION=on), cuando fail2ban
+// banea la misma IP en al menos min_hosts hosts (por defecto
+// FederationMinHosts, según ssh_bans_state), natu-core crea una acción
+// remota de alcance fleet que la añade con TTL al set ipset FederationIpsetSet
+// del resto de agentes. Quedan fuera las IPs de federation_allowlist y los
+// agentes con actions.fleet_opt_out, y las que no pasan los mismos límites que
+// un ban manual (banTargetProblem: rangos reservados y redes más grandes que
+// ban_actions.min_prefix_v4/v6), que se registran en el log. Al añadir una red a la allowlist (y en
+// cada pasada del worker) los bans federados vigentes que caen en ella se
+// retiran: se cancelan los envíos pendientes y se manda un unban a los
+// agentes que ya lo tenían. Cada propagación queda en federated_bans
+// y, en ssh_bans_state, los bans que vienen de ese set llevan
+// origin = 'federated' en lugar de 'local'.
+//
+// El set tiene que existir en los hosts con soporte de timeout:
+//
+//	ipset create natu-fleet hash:ip timeout 0 -exist
+
+const (
+	FederationMinHosts   = 3
+	FederationTTLSeconds = 24 * 3600
+	FederationIpsetSet   = "natu-fleet"
+	// Sólo cuentan los bans sincronizados hace poco
+	federationSyncFreshMinutes = 10
+	federationRequestedBy      = "federation"
+)
+
+type FederationSettings struct {
+	Enabled    bool `json:"enabled"`
+	MinHosts   int  `json:"min_hosts"`
+	TTLSeconds int  `json:"ttl_seconds"`
+}
+
+type FederationAllowEntry struct {
+	ID        int64     `json:"id"`
+	CIDR      string    `json:"cidr"`
+	Note      string    `json:"note,omitempty"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type FederationAllowCreateRequest struct {
+	CIDR      string `json:"cidr"`
+	Note      string `json:"note"`
+	CreatedBy string `json:"created_by"`
+}
+
+type FederatedBan struct {
+	ID           int64     `json:"id"`
+	IP           string    `json:"ip"`
+	ActionID     int64     `json:"action_id"`
+	ActionStatus string    `json:"action_status"`
+	HostCount    int       `json:"host_count"`
+	SourceHosts  []string  `json:"source_hosts"`
+	TargetCount  int       `json:"target_count"`
+	AppliedCount int       `json:"applied_count"`
+	TTLSeconds   int       `json:"ttl_seconds"`
+	CreatedAt    time.Time `json:"created_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	Active       bool      `json:"active"`
+}
+
+type FederationResponse struct {
+	Enabled       bool                   `json:"enabled"`
+	MinHosts      int                    `json:"min_hosts"`
+	TTLSeconds    int                    `json:"ttl_seconds"`
+	IpsetSet      string                 `json:"ipset_set"`
+	OptedOutHosts []string               `json:"opted_out_hosts"`
+	Allowlist     []FederationAllowEntry `json:"allowlist"`
+	WindowMinutes int                    `json:"window_minutes"`
+	GeneratedAt   time.Time              `json:"generated_at"`
+	Bans          []FederatedBan         `json:"bans"`
+}
+
+// federationSetLabel es como el agente etiqueta los bans del set federado.
+func federationSetLabel() string {
+	return "ipset:" + FederationIpsetSet
+}
+
+// banOrigin decide si un ban sincronizado viene de la federación.
+func banOrigin(source, jail string, sets []string) string {
+	if source == "fail2ban" {
+		return "local"
+	}
+	if jail == federationSetLabel() {
+		return "federated"
+	}
+	for _, s := range sets {
+		if s == federationSetLabel() {
+			return "federated"
+		}
+	}
+	return "local"
+}
+
+// syncFederationOptOut guarda el opt-out que declara el agente en cada poll y,
+// si lo activó, cancela los bans federados que aún no se le enviaron.
+func syncFederationOptOut(ctx context.Context, tx pgx.Tx, agentID string, optOut bool) error {
+	if _, err := tx.Exec(ctx, `UPDATE agents SET federation_opt_out = $2 WHERE id = $1`, agentID, optOut); err != nil {
+		return err
+	}
+	if !optOut {
+		return nil
+	}
+
+	rows, err := tx.Query(ctx, `
+        UPDATE ban_action_targets t
+        SET status = 'cancelled', completed_at = now(), output = 'fleet_opt_out'
+        FROM ban_actions a
+        WHERE t.action_id = a.id
+          AND t.agent_id = $1
+          AND t.status = 'pending'
+          AND a.requested_by = $2
+        RETURNING t.action_id, t.hostname
+    `, agentID, federationRequestedBy)
+	if err != nil {
+		return err
+	}
+	type cancelled struct {
+		ActionID int64
+		Hostname string
+	}
+	var list []cancelled
+	for rows.Next() {
+		var c cancelled
+		if err := rows.Scan(&c.ActionID, &c.Hostname); err != nil {
+			rows.Close()
+			return err
+		}
+		list = append(list, c)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	for _, c := range list {
+		if err := auditBanAction(ctx, tx, c.ActionID, "cancelled", federationRequestedBy, c.Hostname, "host con fleet_opt_out"); err != nil {
+			return err
+		}
+		if err := refreshBanActionStatus(ctx, tx, c.ActionID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ----------------------------------------------------
+// Worker de federación
+// ----------------------------------------------------
+
+func (s *Server) startFederationWorker() {
+	if fs := s.settings.Load().Federation; fs.Enabled {
+		log.Printf("Federación de bans activa: %d hosts, TTL %ds, set %s", fs.MinHosts, fs.TTLSeconds, FederationIpsetSet)
+	}
+
+	// Siempre en marcha: se puede activar desde /api/v1/settings
+	s.startWorker("FederationWorker", func(ctx context.Context, st *Settings) error {
+		if !st.Federation.Enabled {
+			return nil
+		}
+		return s.runFederationScan(ctx, st)
+	})
+}
+
+func (s *Server) loadFederationAllowlist(ctx context.Context) ([]*net.IPNet, error) {
+	rows, err := s.db.Query(ctx, `SELECT cidr FROM federation_allowlist`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var nets []*net.IPNet
+	for rows.Next() {
+		var c string
+		if err := rows.Scan(&c); err != nil {
+			return nil, err
+		}
+		if _, n, err := net.ParseCIDR(c); err == nil {
+			nets = append(nets, n)
+		}
+	}
+	return nets, rows.Err()
+}
+
+// federationAllowed: false si la IP (o red) cae en la allowlist.
+func federationAllowed(ip string, allow []*net.IPNet) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		var n *net.IPNet
+		var err error
+		if addr, n, err = net.ParseCIDR(ip); err != nil {
+			return false
+		}
+		addr = n.IP
+	}
+	for _, n := range allow {
+		if n.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) runFederationScan(ctx context.Context, st *Settings) error {
+	fs := st.Federation
+	allow, err := s.loadFederationAllowlist(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := s.withdrawAllowlistedBans(ctx, allow); err != nil {
+		return err
+	}
+
+	// Bans locales de fail2ban; los que ya vienen de la federación no cuentan
+	rows, err := s.db.Query(ctx, `
+        SELECT b.ip,
+               count(DISTINCT b.agent_id)                  AS hosts,
+               array_agg(DISTINCT a.hostname ORDER BY a.hostname) AS hostnames
+        FROM ssh_bans_state b
+        JOIN agents a ON a.id = b.agent_id
+        WHERE b.source = 'fail2ban'
+          AND b.synced_at >= now() - ($1::int || ' minutes')::interval
+        GROUP BY b.ip
+        HAVING count(DISTINCT b.agent_id) >= $2;
+    `, federationSyncFreshMinutes, fs.MinHosts)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type cand struct {
+		IP        string
+		Hosts     int
+		Hostnames []string
+	}
+
+	var cands []cand
+	for rows.Next() {
+		var c cand
+		if err := rows.Scan(&c.IP, &c.Hosts, &c.Hostnames); err != nil {
+			return err
+		}
+		cands = append(cands, c)
+	}
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	rejected := map[string]string{}
+	for _, c := range cands {
+		if !federationAllowed(c.IP, allow) {
+			continue
+		}
+		if problem := banTargetProblem(c.IP, st.BanActions, allow); problem != "" {
+			rejected[c.IP] = problem
+			if s.federationRejected[c.IP] != problem {
+				log.Printf("Ban federado descartado: ip=%s hosts=%d (%s): %s",
+					c.IP, c.Hosts, strings.Join(c.Hostnames, ","), problem)
+			}
+			continue
+		}
+
+		var active bool
+		err := s.db.QueryRow(ctx, `
+            SELECT EXISTS (
+                SELECT 1
+                FROM federated_bans
+                WHERE ip = $1
+                  AND expires_at > now()
+            );
+        `, c.IP).Scan(&active)
+		if err != nil {
+			return err
+		}
+		if active {
+			continue
+		}
+
+		if err := s.propagateBan(ctx, fs, c.IP, c.Hosts, c.Hostnames); err != nil {
+			return err
+		}
+	}
+	s.federationRejected = rejected
+	return nil
+}
+
+// propagateBan crea la acción fleet hacia los agentes que no tienen ya el ban
+// local ni han pedido opt-out.
+func (s *Server) propagateBan(ctx context.Context, fs FederationSettings, ip string, hosts int, hostnames []string) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	ttl := fs.TTLSeconds
+	req := BanActionCreateRequest{
+		Action:      "ban",
+		IP:          ip,
+		Jail:        "sshd",
+		Method:      "ipset",
+		IpsetSet:    FederationIpsetSet,
+		TTLSeconds:  &ttl,
+		Scope:       "fleet",
+		RequestedBy: federationRequestedBy,
+		Reason:      "baneada por " + strconv.Itoa(hosts) + " hosts: " + strings.Join(hostnames, ", "),
+		SourceAlert: "federation",
+	}
+	actionID, err := insertBanAction(ctx, tx, req)
+	if err != nil {
+		return err
+	}
+
+	tag, err := tx.Exec(ctx, `
+        INSERT INTO ban_action_targets (action_id, agent_id, hostname)
+        SELECT $1, a.id, a.hostname
+        FROM agents a
+        WHERE a.last_seen >= now() - ($2::int || ' hours')::interval
+          AND NOT a.federation_opt_out
+          AND NOT EXISTS (
+              SELECT 1
+              FROM ssh_bans_state b
+              WHERE b.agent_id = a.id
+                AND b.ip = $3
+          )
+    `, actionID, banActionFleetSeenHours, ip)
+	if err != nil {
+		return err
+	}
+	targets := tag.RowsAffected()
+	if targets == 0 {
+		// Nadie más a quien avisar: se vuelve a mirar en la siguiente pasada
+		return nil
+	}
+
+	detail := "ban " + ip + " (ipset " + FederationIpsetSet + ", " + strconv.FormatInt(targets, 10) + " agentes): " + req.Reason
+	if err := auditBanAction(ctx, tx, actionID, "created", federationRequestedBy, "", detail); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `
+        INSERT INTO federated_bans (ip, action_id, host_count, source_hosts, ttl_seconds, expires_at)
+        VALUES ($1, $2, $3, $4, $5, now() + ($5::int || ' seconds')::interval)
+    `, ip, actionID, hosts, hostnames, ttl)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	log.Printf("⚠️  Ban federado: ip=%s hosts=%d (%s) -> %d agentes, TTL %ds",
+		ip, hosts, strings.Join(hostnames, ","), targets, ttl)
+	return nil
+}
+
+// withdrawAllowlistedBans retira los bans federados vigentes cuya IP está en
+// la allowlist y devuelve cuántos retiró.
+func (s *Server) withdrawAllowlistedBans(ctx context.Context, allow []*net.IPNet) (int, error) {
+	if len(allow) == 0 {
+		return 0, nil
+	}
+
+	rows, err := s.db.Query(ctx, `
+        SELECT id, ip, COALESCE(action_id, 0)
+        FROM federated_bans
+        WHERE expires_at > now()
+    `)
+	if err != nil {
+		return 0, err
+	}
+	type activeBan struct {
+		ID       int64
+		IP       string
+		ActionID int64
+	}
+	var bans []activeBan
+	for rows.Next() {
+		var b activeBan
+		if err := rows.Scan(&b.ID, &b.IP, &b.ActionID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if !federationAllowed(b.IP, allow) {
+			bans = append(bans, b)
+		}
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return 0, rows.Err()
+	}
+
+	for _, b := range bans {
+		if err := s.withdrawFederatedBan(ctx, b.ID, b.IP, b.ActionID); err != nil {
+			return 0, fmt.Errorf("retirando ban federado %s: %w", b.IP, err)
+		}
+	}
+	return len(bans), nil
+}
+
+// withdrawFederatedBan cancela los destinos aún no enviados del ban, crea un
+// unban para los que ya lo recibieron y da el ban por vencido.
+func (s *Server) withdrawFederatedBan(ctx context.Context, banID int64, ip string, actionID int64) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var delivered []string
+	if actionID > 0 {
+		tag, err := tx.Exec(ctx, `
+            UPDATE ban_action_targets
+            SET status = 'cancelled', completed_at = now(), output = 'federation_allowlist'
+            WHERE action_id = $1
+              AND status = 'pending'
+        `, actionID)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() > 0 {
+			detail := strconv.FormatInt(tag.RowsAffected(), 10) + " destinos pendientes cancelados: ip en federation_allowlist"
+			if err := auditBanAction(ctx, tx, actionID, "cancelled", federationRequestedBy, "", detail); err != nil {
+				return err
+			}
+			// Si no llegó a enviarse a nadie la acción entera queda cancelada
+			_, err = tx.Exec(ctx, `
+                UPDATE ban_actions
+                SET status = 'cancelled'
+                WHERE id = $1
+                  AND status IN ('pending', 'running')
+                  AND NOT EXISTS (
+                      SELECT 1
+                      FROM ban_action_targets
+                      WHERE action_id = $1
+                        AND status <> 'cancelled'
+                  )
+            `, actionID)
+			if err != nil {
+				return err
+			}
+			if err := refreshBanActionStatus(ctx, tx, actionID); err != nil {
+				return err
+			}
+		}
+
+		// sent también: puede haberlo aplicado sin haber respondido aún
+		rows, err := tx.Query(ctx, `
+            SELECT agent_id::text
+            FROM ban_action_targets
+            WHERE action_id = $1
+              AND status IN ('sent', 'success')
+        `, actionID)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var agentID string
+			if err := rows.Scan(&agentID); err != nil {
+				rows.Close()
+				return err
+			}
+			delivered = append(delivered, agentID)
+		}
+		rows.Close()
+		if rows.Err() != nil {
+			return rows.Err()
+		}
+	}
+
+	if len(delivered) > 0 {
+		req := BanActionCreateRequest{
+			Action:      "unban",
+			IP:          ip,
+			Jail:        "sshd",
+			Method:      "ipset",
+			IpsetSet:    FederationIpsetSet,
+			Scope:       "fleet",
+			RequestedBy: federationRequestedBy,
+			Reason:      "ip en federation_allowlist",
+			SourceAlert: "federation",
+		}
+		unbanID, err := insertBanAction(ctx, tx, req)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `
+            INSERT INTO ban_action_targets (action_id, agent_id, hostname)
+            SELECT $1, a.id, a.hostname
+            FROM agents a
+            WHERE a.id = ANY($2::uuid[])
+        `, unbanID, delivered)
+		if err != nil {
+			return err
+		}
+		detail := "unban " + ip + " (ipset " + FederationIpsetSet + ", " + strconv.Itoa(len(delivered)) + " agentes): " + req.Reason
+		if err := auditBanAction(ctx, tx, unbanID, "created", federationRequestedBy, "", detail); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE federated_bans SET expires_at = now() WHERE id = $1`, banID); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	log.Printf("Ban federado retirado: ip=%s en federation_allowlist (unban a %d agentes)", ip, len(delivered))
+	return nil
+}
+
+// ----------------------------------------------------
+// API federation
+// ----------------------------------------------------
+
+func (s *Server) handleFederation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "solo GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	minStr := q.Get("minutes")
+	windowMinutes := 1440
+	if minStr != "" {
+		if v, err := strconv.Atoi(minStr); err == nil && v > 0 && v <= 43200 {
+			windowMinutes = v
+		}
+	}
+
+	ctx := r.Context()
+	now := time.Now().UTC()
+	fs := s.settings.Load().Federation
+
+	resp := FederationResponse{
+		Enabled:       fs.Enabled,
+		MinHosts:      fs.MinHosts,
+		TTLSeconds:    fs.TTLSeconds,
+		IpsetSet:      FederationIpsetSet,
+		OptedOutHosts: []string{},
+		WindowMinutes: windowMinutes,
+		GeneratedAt:   now,
+		Bans:          []FederatedBan{},
+	}
+
+	rows, err := s.db.Query(ctx, `SELECT hostname FROM agents WHERE federation_opt_out ORDER BY hostname`)
+	if err != nil {
+		log.Printf("Error consultando opt-out de federación: %v", err)
+		http.Error(w, "error consultando federación", http.StatusInternalServerError)
+		return
+	}
+	for rows.Next() {
+		var h string
+		if err := rows.Scan(&h); err != nil {
+			rows.Close()
+			http.Error(w, "error leyendo federación", http.StatusInternalServerError)
+			return
+		}
+		resp.OptedOutHosts = append(resp.OptedOutHosts, h)
+	}
+	rows.Close()
+
+	allow, err := s.listFederationAllowlist(ctx)
+	if err != nil {
+		log.Printf("Error consultando federation_allowlist: %v", err)
+		http.Error(w, "error consultando federación", http.StatusInternalServerError)
+		return
+	}
+	resp.Allowlist = allow
+
+	rows, err = s.db.Query(ctx, `
+        SELECT f.id, f.ip, COALESCE(f.action_id, 0), COALESCE(ba.status, ''),
+               f.host_count, f.source_hosts,
+               (SELECT count(*) FROM ban_action_targets t WHERE t.action_id = f.action_id),
+               (SELECT count(*) FROM ban_action_targets t WHERE t.action_id = f.action_id AND t.status = 'success'),
+               f.ttl_seconds, f.created_at, f.expires_at
+        FROM federated_bans f
+        LEFT JOIN ban_actions ba ON ba.id = f.action_id
+        WHERE f.created_at >= now() - ($1::int || ' minutes')::interval
+           OR f.expires_at > now()
+        ORDER BY f.created_at DESC
+    `, windowMinutes)
+	if err != nil {
+		log.Printf("Error consultando federated_bans: %v", err)
+		http.Error(w, "error consultando federación", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b FederatedBan
+		if err := rows.Scan(&b.ID, &b.IP, &b.ActionID, &b.ActionStatus, &b.HostCount, &b.SourceHosts,
+			&b.TargetCount, &b.AppliedCount, &b.TTLSeconds, &b.CreatedAt, &b.ExpiresAt); err != nil {
+			log.Printf("Error escaneando federated_bans: %v", err)
+			http.Error(w, "error leyendo federación", http.StatusInternalServerError)
+			return
+		}
+		b.Active = b.ExpiresAt.After(now)
+		resp.Bans = append(resp.Bans, b)
+	}
+	if rows.Err() != nil {
+		http.Error(w, "error leyendo federación", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(resp); err != nil {
+		log.Printf("Error serializando respuesta federation: %v", err)
+	}
+}
+
+func (s *Server) listFederationAllowlist(ctx context.Context) ([]FederationAllowEntry, error) {
+	rows, err := s.db.Query(ctx, `
+        SELECT id, cidr, note, created_by, created_at
+        FROM federation_allowlist
+        ORDER BY cidr
+    `)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []FederationAllowEntry{}
+	for rows.Next() {
+		var e FederationAllowEntry
+		if err := rows.Scan(&e.ID, &e.CIDR, &e.Note, &e.CreatedBy, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, e)
+	}
+	return list, rows.Err()
+}
+
+// handleFederationAllowlist: GET lista, POST añade una IP o red, DELETE
+// /api/v1/federation/allowlist/{id} la quita.
+func (s *Server) handleFederationAllowlist(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	prefix := "/api/v1/federation/allowlist/"
+
+	switch r.Method {
+	case http.MethodGet:
+		list, err := s.listFederationAllowlist(ctx)
+		if err != nil {
+			log.Printf("Error consultando federation_allowlist: %v", err)
+			http.Error(w, "error consultando allowlist", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(list); err != nil {
+			log.Printf("Error serializando allowlist: %v", err)
+		}
+
+	case http.MethodPost:
+		var req FederationAllowCreateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "JSON inválido", http.StatusBadRequest)
+			return
+		}
+		cidr := strings.TrimSpace(req.CIDR)
+		if ip := net.ParseIP(cidr); ip != nil {
+			if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			http.Error(w, "cidr inválido", http.StatusBadRequest)
+			return
+		}
+		if strings.TrimSpace(req.CreatedBy) == "" {
+			http.Error(w, "created_by requerido", http.StatusBadRequest)
+			return
+		}
+
+		var e FederationAllowEntry
+		err = s.db.QueryRow(ctx, `
+            INSERT INTO federation_allowlist (cidr, note, created_by)
+            VALUES ($1, $2, $3)
+            ON CONFLICT (cidr) DO UPDATE SET note = EXCLUDED.note
+            RETURNING id, cidr, note, created_by, created_at
+        `, n.String(), req.Note, req.CreatedBy).Scan(&e.ID, &e.CIDR, &e.Note, &e.CreatedBy, &e.CreatedAt)
+		if err != nil {
+			log.Printf("Error guardando federation_allowlist: %v", err)
+			http.Error(w, "error guardando allowlist", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Allowlist de federación: añadida %s por %s", e.CIDR, e.CreatedBy)
+
+		allow, err := s.loadFederationAllowlist(ctx)
+		if err == nil {
+			_, err = s.withdrawAllowlistedBans(ctx, allow)
+		}
+		if err != nil {
+			// La entrada ya está guardada; el worker lo reintenta
+			log.Printf("Error retirando bans federados de %s: %v", e.CIDR, err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(e); err != nil {
+			log.Printf("Error serializando allowlist: %v", err)
+		}
+
+	case http.MethodDelete:
+		if !strings.HasPrefix(r.URL.Path, prefix) {
+			http.Error(w, "ruta inválida, use /api/v1/federation/allowlist/{id}", http.StatusBadRequest)
+			return
+		}
+		id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, prefix), 10, 64)
+		if err != nil || id <= 0 {
+			http.Error(w, "id inválido", http.StatusBadRequest)
+			return
+		}
+		tag, err := s.db.Exec(ctx, `DELETE FROM federation_allowlist WHERE id = $1`, id)
+		if err != nil {
+			http.Error(w, "error borrando allowlist", http.StatusInternalServerError)
+			return
+		}
+		if tag.RowsAffected() == 0 {
+			http.Error(w, "entrada no encontrada", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"ok"}`))
+
+	default:
+		http.Error(w, "solo GET, POST o DELETE", http.StatusMethodNotAllowed)
+	}
+}
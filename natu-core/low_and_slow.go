@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+)
+
+// ----------------------------------------------------
+// Fuerza bruta lenta (low-and-slow)
+// ----------------------------------------------------
+//
+// ssh_bruteforce solo mira la última ventana (60 min) con un umbral fijo: un
+// intento cada 15 minutos no llega nunca. Este worker mantiene
+// ssh_failures_hourly (fallos SSH por hora e IP en toda la flota) y sobre
+// ella busca, en 24 h y en 7 días, IPs con actividad persistente y de ritmo
+// bajo:
+//
+//   - al menos min_attempts fallos repartidos en min_active_hours horas,
+//   - ninguna hora por encima de max_per_hour,
+//   - intervalo entre intentos regular: coeficiente de variación (desviación
+//     / media) <= max_interval_cv.
+//
+// La agregación sigue raw_events.id (event_watermarks), no la hora: un
+// evento que llega con días de retraso recalcula su hora.
+//
+// La tabla guarda por hora la suma y la suma de cuadrados de los intervalos,
+// así que la media y la desviación de toda la ventana salen de las filas
+// horarias sin volver a leer raw_events. Las alertas van a alerts como
+// ssh_low_and_slow_24h (medio) y ssh_low_and_slow_7d (alto), una al día por IP
+// como mucho; disable_builtin también las desactiva.
+
+const (
+	lowSlowRuleDay   = "ssh_low_and_slow_24h"
+	lowSlowRuleWeek  = "ssh_low_and_slow_7d"
+	lowSlowRetention = 8 * 24 * time.Hour
+	lowSlowWatermark = "ssh_failures_hourly"
+)
+
+var lowSlowRuleNames = []string{lowSlowRuleDay, lowSlowRuleWeek}
+
+type lowSlowScan struct {
+	Rule     string
+	Hours    int
+	Severity string
+	Window   LowSlowWindow
+}
+
+type lowSlowCandidate struct {
+	RemoteIP    string
+	Attempts    int
+	ActiveHours int
+	PeakPerHour int
+	FirstSeen   time.Time
+	LastSeen    time.Time
+	Gaps        int
+	GapSum      float64
+	GapSqSum    float64
+	AgentIDs    []string
+	Hosts       []string
+}
+
+func (s *Server) startLowSlowWorker() {
+	s.startWorker("LowSlowWorker", func(ctx context.Context, st *Settings) error {
+		if err := s.rollupSSHFailuresHourly(ctx); err != nil {
+			return fmt.Errorf("agregando ssh_failures_hourly: %w", err)
+		}
+
+		rs := s.coreRules.Load()
+		scans := []lowSlowScan{
+			{Rule: lowSlowRuleDay, Hours: 24, Severity: "medio", Window: st.LowSlow.Day},
+			{Rule: lowSlowRuleWeek, Hours: 7 * 24, Severity: "alto", Window: st.LowSlow.Week},
+		}
+		for _, sc := range scans {
+			if rs != nil && rs.DisableBuiltin[sc.Rule] {
+				continue
+			}
+			if err := s.runLowSlowScan(ctx, st.LowSlow, sc); err != nil {
+				return fmt.Errorf("%s: %w", sc.Rule, err)
+			}
+		}
+		return nil
+	})
+}
+
+// rollupSSHFailuresHourly recalcula entera cada hora que tenga algún fallo
+// SSH con id posterior a la marca de event_watermarks, así que los
+// eventos que llegan tarde (spool del agente tras una caída) también entran.
+// La primera vez agrega los últimos 7 días. Borra las horas caducadas.
+func (s *Server) rollupSSHFailuresHourly(ctx context.Context) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	retentionHours := int(lowSlowRetention / time.Hour)
+
+	// Releer los últimos ids (eventRange) sólo recalcula horas recientes
+	from, mark, maxID, err := eventRange(ctx, tx, lowSlowWatermark, 7*24*time.Hour+time.Hour)
+	if err != nil {
+		return err
+	}
+	if maxID <= mark {
+		return nil
+	}
+
+	var hours []time.Time
+	err = tx.QueryRow(ctx, `
+        SELECT COALESCE(array_agg(DISTINCT date_trunc('hour', ts)), '{}')
+        FROM raw_events
+        WHERE id > $1
+          AND id <= $2
+          AND source = 'auth'
+          AND event_type = 'ssh_failed_login'
+          AND ts >= now() - ($3::int || ' hours')::interval;
+    `, from, maxID, retentionHours).Scan(&hours)
+	if err != nil {
+		return err
+	}
+
+	if len(hours) > 0 {
+		if _, err := tx.Exec(ctx, `DELETE FROM ssh_failures_hourly WHERE hour = ANY($1)`, hours); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, `
+            WITH ev AS (
+                SELECT
+                    h.hour,
+                    e.payload->>'remote_ip'   AS remote_ip,
+                    e.agent_id::text          AS agent_id,
+                    a.hostname,
+                    e.ts,
+                    extract(epoch FROM e.ts - lag(e.ts) OVER (
+                        PARTITION BY h.hour, e.payload->>'remote_ip'
+                        ORDER BY e.ts
+                    )) AS gap
+                FROM unnest($1::timestamptz[]) AS h(hour)
+                JOIN raw_events e
+                  ON e.ts >= h.hour
+                 AND e.ts < h.hour + interval '1 hour'
+                JOIN agents a ON a.id = e.agent_id
+                WHERE e.source = 'auth'
+                  AND e.event_type = 'ssh_failed_login'
+                  AND e.payload ? 'remote_ip'
+            )
+            INSERT INTO ssh_failures_hourly (
+                hour, remote_ip, failed, agent_ids, hosts,
+                first_seen, last_seen, gap_sum, gap_sq_sum
+            )
+            SELECT
+                hour,
+                remote_ip,
+                count(*),
+                array_agg(DISTINCT agent_id),
+                array_agg(DISTINCT hostname),
+                min(ts),
+                max(ts),
+                COALESCE(sum(gap), 0),
+                COALESCE(sum(gap * gap), 0)
+            FROM ev
+            GROUP BY hour, remote_ip;
+        `, hours)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := saveEventWatermark(ctx, tx, lowSlowWatermark, maxID); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `
+        DELETE FROM ssh_failures_hourly
+        WHERE hour < now() - ($1::int || ' hours')::interval;
+    `, retentionHours)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (s *Server) runLowSlowScan(ctx context.Context, ls LowSlowSettings, sc lowSlowScan) error {
+	// cross_gap: intervalo entre el último intento de la hora anterior con
+	// actividad y el primero de esta.
+	rows, err := s.db.Query(ctx, `
+        WITH b AS (
+            SELECT
+                remote_ip, failed, agent_ids, hosts, first_seen, last_seen,
+                gap_sum, gap_sq_sum,
+                extract(epoch FROM first_seen - lag(last_seen) OVER (
+                    PARTITION BY remote_ip ORDER BY hour
+                )) AS cross_gap
+            FROM ssh_failures_hourly
+            WHERE hour >= date_trunc('hour', now()) - ($1::int || ' hours')::interval
+        ),
+        agg AS (
+            SELECT
+                remote_ip,
+                sum(failed)::int                                   AS attempts,
+                count(*)::int                                      AS active_hours,
+                max(failed)                                        AS peak,
+                min(first_seen)                                    AS first_seen,
+                max(last_seen)                                     AS last_seen,
+                (sum(failed - 1) + count(cross_gap))::int          AS gaps,
+                sum(gap_sum) + COALESCE(sum(cross_gap), 0)         AS gap_sum,
+                sum(gap_sq_sum) + COALESCE(sum(cross_gap ^ 2), 0)  AS gap_sq_sum
+            FROM b
+            GROUP BY remote_ip
+        )
+        SELECT
+            g.remote_ip, g.attempts, g.active_hours, g.peak,
+            g.first_seen, g.last_seen, g.gaps, g.gap_sum, g.gap_sq_sum,
+            ARRAY(SELECT DISTINCT x FROM b, unnest(b.agent_ids) x WHERE b.remote_ip = g.remote_ip ORDER BY x),
+            ARRAY(SELECT DISTINCT x FROM b, unnest(b.hosts) x WHERE b.remote_ip = g.remote_ip ORDER BY x)
+        FROM agg g
+        WHERE g.attempts >= $2
+          AND g.active_hours >= $3
+          AND g.peak <= $4
+        ORDER BY g.attempts DESC
+        LIMIT 500;
+    `, sc.Hours, sc.Window.MinAttempts, sc.Window.MinActiveHours, ls.MaxPerHour)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var cands []lowSlowCandidate
+	for rows.Next() {
+		var c lowSlowCandidate
+		if err := rows.Scan(&c.RemoteIP, &c.Attempts, &c.ActiveHours, &c.PeakPerHour,
+			&c.FirstSeen, &c.LastSeen, &c.Gaps, &c.GapSum, &c.GapSqSum, &c.AgentIDs, &c.Hosts); err != nil {
+			return err
+		}
+		cands = append(cands, c)
+	}
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	rule := &Rule{
+		Name:          sc.Rule,
+		Description:   "Fallos SSH persistentes, de ritmo bajo y regular, desde una IP",
+		Type:          ruleTypeThreshold,
+		Severity:      sc.Severity,
+		WindowMinutes: sc.Hours * 60,
+		DedupeMinutes: 24 * 60,
+		GroupBy:       []string{"payload.remote_ip"},
+		Threshold:     sc.Window.MinAttempts,
+		Message:       "Fuerza bruta lenta desde ${remote_ip}: ${count} fallos en ${active_hours} horas, uno cada ~${mean_interval_minutes} min (cv ${interval_cv}) contra ${hosts}",
+		Origin:        ruleOriginBuiltin,
+	}
+
+	for _, c := range cands {
+		mean, cv, ok := c.intervalStats()
+		if !ok || cv > ls.MaxIntervalCV {
+			continue
+		}
+		m := ruleMatch{
+			AgentIDs:  c.AgentIDs,
+			Hosts:     c.Hosts,
+			Count:     c.Attempts,
+			FirstSeen: c.FirstSeen,
+			LastSeen:  c.LastSeen,
+			Group:     []string{c.RemoteIP},
+			Payload: map[string]any{
+				"active_hours":          c.ActiveHours,
+				"peak_per_hour":         c.PeakPerHour,
+				"mean_interval_seconds": math.Round(mean),
+				"mean_interval_minutes": math.Round(mean/6) / 10,
+				"interval_cv":           math.Round(cv*100) / 100,
+			},
+		}
+		if err := s.raiseAlert(ctx, rule, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// intervalStats devuelve la media (segundos) y el coeficiente de variación
+// de los intervalos entre intentos. ok = false si hay menos de 2 intervalos.
+func (c lowSlowCandidate) intervalStats() (mean, cv float64, ok bool) {
+	if c.Gaps < 2 || c.GapSum <= 0 {
+		return 0, 0, false
+	}
+	n := float64(c.Gaps)
+	mean = c.GapSum / n
+	variance := c.GapSqSum/n - mean*mean
+	if variance < 0 {
+		variance = 0
+	}
+	return mean, math.Sqrt(variance) / mean, true
+}
@@ -3,12 +3,17 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -19,6 +24,8 @@ import (
 // ----------------------------
 
 type Event struct {
+	// Id estable del agente; los repetidos se ignoran
+	ID        string                 `json:"id,omitempty"`
 	Ts        time.Time              `json:"ts"`
 	Source    string                 `json:"source"`
 	EventType string                 `json:"event_type"`
@@ -34,6 +41,17 @@ type BatchRequest struct {
 
 type Server struct {
 	db *pgxpool.Pool
+	// Fichero + entorno; settings es lo efectivo (puede venir de la API)
+	baseSettings Settings
+	settings     atomic.Pointer[Settings]
+	settingsMu   sync.Mutex
+	// Reglas de rules_file y sigma_dir (se recargan con SIGHUP)
+	coreRules atomic.Pointer[CoreRuleSet]
+	// Candidatos a ban federado rechazados (ip -> motivo); sólo lo toca el
+	// worker de federación, para avisar una vez por IP
+	federationRejected map[string]string
+	// api_token de la configuración (ver requireAPIToken)
+	apiToken string
 }
 
 // ----------------------------
@@ -51,6 +69,14 @@ type SSHTopIP struct {
 	Failed   int    `json:"failed"`
 }
 
+// SSHTopSubnet agrupa los fallos por /24 (IPv4) o /64 (IPv6).
+type SSHTopSubnet struct {
+	Subnet string `json:"subnet"`
+	Failed int    `json:"failed"`
+	IPs    int    `json:"ips"`
+	Hosts  int    `json:"hosts"`
+}
+
 type SSHTopUser struct {
 	Username string `json:"username"`
 	Failed   int    `json:"failed"`
@@ -62,6 +88,7 @@ type SSHSummaryResponse struct {
 	GeneratedAt   time.Time        `json:"generated_at"`
 	Hosts         []SSHHostSummary `json:"hosts"`
 	TopIPs        []SSHTopIP       `json:"top_ips"`
+	TopSubnets    []SSHTopSubnet   `json:"top_subnets,omitempty"`
 	TopUsers      []SSHTopUser     `json:"top_users"`
 }
 
@@ -155,6 +182,7 @@ type SSHTimelineResponse struct {
 
 type SudoTimelineEvent struct {
 	Ts           time.Time `json:"ts"`
+	EventType    string    `json:"event_type"`
 	Hostname     string    `json:"hostname"`
 	SudoUser     string    `json:"sudo_user"`
 	TargetUser   string    `json:"target_user"`
@@ -164,6 +192,10 @@ type SudoTimelineEvent struct {
 	RemoteIP     string    `json:"remote_ip,omitempty"`
 	IsSudoRoot   bool      `json:"is_sudo_root"`
 	IsTargetRoot bool      `json:"is_target_root"`
+	Reason       string    `json:"reason,omitempty"`
+	ShellID      string    `json:"shell_id,omitempty"`
+	SSHSessionID string    `json:"ssh_session_id,omitempty"`
+	Duration     *int64    `json:"duration_seconds,omitempty"`
 	RawLine      string    `json:"raw_line"`
 }
 
@@ -177,22 +209,28 @@ type SudoTimelineResponse struct {
 }
 
 // ----------------------------
-// Sudo alerts (comandos peligrosos)
+// Sudo alerts (comandos peligrosos y fallos repetidos)
 // ----------------------------
 
 type SudoAlert struct {
-	ID            int64     `json:"id"`
-	CreatedAt     time.Time `json:"created_at"`
-	Hostname      string    `json:"hostname"`
-	SudoUser      string    `json:"sudo_user"`
-	TargetUser    string    `json:"target_user"`
-	RemoteIP      string    `json:"remote_ip"`
-	TTY           string    `json:"tty"`
-	Pwd           string    `json:"pwd"`
-	Command       string    `json:"command"`
-	WindowMinutes int       `json:"window_minutes"`
-	SudoTs        time.Time `json:"sudo_ts"`
-	Status        string    `json:"status"`
+	ID            int64      `json:"id"`
+	CreatedAt     time.Time  `json:"created_at"`
+	Hostname      string     `json:"hostname"`
+	SudoUser      string     `json:"sudo_user"`
+	TargetUser    string     `json:"target_user"`
+	RemoteIP      string     `json:"remote_ip"`
+	TTY           string     `json:"tty"`
+	Pwd           string     `json:"pwd"`
+	Command       string     `json:"command"`
+	WindowMinutes int        `json:"window_minutes"`
+	SudoTs        time.Time  `json:"sudo_ts"`
+	Status        string     `json:"status"`
+	Rule          string     `json:"rule"`
+	FailedCount   int        `json:"failed_count,omitempty"`
+	ShellID       string     `json:"shell_id,omitempty"`
+	SSHSessionID  string     `json:"ssh_session_id,omitempty"`
+	EndedAt       *time.Time `json:"ended_at,omitempty"`
+	Duration      int64      `json:"duration_seconds,omitempty"`
 }
 
 type SudoAlertsResponse struct {
@@ -218,18 +256,33 @@ type SSHBan struct {
 	Reason   string     `json:"reason,omitempty"`
 	Source   string     `json:"source,omitempty"`
 	SyncedAt time.Time  `json:"synced_at"`
+	// Segundos que quedan según el set del firewall (recalculado al consultar)
+	TimeoutSeconds *int64     `json:"timeout_seconds,omitempty"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	Sets           []string   `json:"sets"`
+	// local | federated (llegó por la federación de bans)
+	Origin string `json:"origin"`
+	// Primera y última sincronización en la que se vio el ban
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
 }
 
 type SSHBanSyncRequest struct {
-	AgentSecret string `json:"agent_secret"`
-	Hostname    string `json:"hostname"`
-	Bans        []struct {
-		IP       string     `json:"ip"`
-		Jail     string     `json:"jail"`
-		BannedAt *time.Time `json:"banned_at,omitempty"`
-		Reason   string     `json:"reason,omitempty"`
-		Source   string     `json:"source,omitempty"`
-	} `json:"bans"`
+	AgentSecret string           `json:"agent_secret"`
+	Hostname    string           `json:"hostname"`
+	Bans        []SSHBanSyncItem `json:"bans"`
+}
+
+// SSHBanSyncItem es un ban tal como lo envía el agente.
+type SSHBanSyncItem struct {
+	IP             string     `json:"ip"`
+	Jail           string     `json:"jail"`
+	BannedAt       *time.Time `json:"banned_at,omitempty"`
+	Reason         string     `json:"reason,omitempty"`
+	Source         string     `json:"source,omitempty"`
+	TimeoutSeconds *int64     `json:"timeout_seconds,omitempty"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	Sets           []string   `json:"sets,omitempty"`
 }
 
 type SSHBanResponse struct {
@@ -238,20 +291,7 @@ type SSHBanResponse struct {
 	Bans          []SSHBan  `json:"bans"`
 }
 
-// ----------------------------
-// Constantes de reglas
-// ----------------------------
-
-const (
-	SSHAlertWindowMinutes         = 60
-	SSHAlertFailedThreshold       = 5
-	SuspiciousWindowMinutes       = 15
-	SuspiciousFailedBeforeSuccess = 3
-
-	SudoAlertWindowMinutes = 60
-)
-
-// lista naive de comandos sudo "peligrosos"
+// lista naive de comandos sudo "peligrosos" (regla sudo_dangerous_command)
 var sudoDangerousSubstrings = []string{
 	"bash -c",
 	"sh -c",
@@ -275,29 +315,81 @@ var sudoDangerousSubstrings = []string{
 // ----------------------------
 
 func main() {
-	dsn := os.Getenv("DATABASE_URL")
-	if dsn == "" {
-		log.Fatal("DATABASE_URL no está definido")
+	configPath := flag.String("config", coreConfigPathFromEnv(), "fichero de configuración JSON")
+	flag.Parse()
+	explicitConfig := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			explicitConfig = true
+		}
+	})
+	if os.Getenv("NATU_CORE_CONFIG") != "" {
+		explicitConfig = true
+	}
+
+	cfg, err := LoadCoreConfig(*configPath, explicitConfig)
+	if err != nil {
+		log.Fatalf("%v", err)
 	}
 
 	ctx := context.Background()
 
-	pool, err := pgxpool.New(ctx, dsn)
+	pool, err := pgxpool.New(ctx, cfg.DatabaseURL)
 	if err != nil {
 		log.Fatalf("Error creando pool: %v", err)
 	}
 	defer pool.Close()
 
-	if err := ensureBanTable(ctx, pool); err != nil {
-		log.Fatalf("Error asegurando tabla ssh_bans_state: %v", err)
+	if args := flag.Args(); len(args) > 0 && args[0] == "migrate" {
+		if err := runMigrateCommand(ctx, pool, args[1:]); err != nil {
+			log.Fatalf("Error en migrate: %v", err)
+		}
+		return
+	}
+
+	if n, err := migrateUp(ctx, pool); err != nil {
+		log.Fatalf("Error aplicando migraciones: %v", err)
+	} else if n > 0 {
+		log.Printf("Esquema actualizado: %d migraciones aplicadas", n)
+	}
+
+	srv := &Server{db: pool, baseSettings: cfg.Settings, apiToken: cfg.APIToken}
+	if cfg.APIToken == "" {
+		log.Printf("⚠️  api_token vacío: POST/PATCH de /api/v1/ban_actions deshabilitados")
+	}
+	settings := cfg.Settings
+	stored, err := srv.loadStoredSettings(ctx, cfg.Settings)
+	switch {
+	case err != nil:
+		log.Printf("⚠️  Settings guardados por la API ignorados: %v", err)
+	case stored != nil:
+		settings = stored.Settings
+		log.Printf("Settings guardados por %s el %s aplicados", stored.UpdatedBy, stored.UpdatedAt.Format(time.RFC3339))
+	}
+	srv.settings.Store(&settings)
+
+	rules, err := loadRuleSet(cfg)
+	if err != nil {
+		log.Fatalf("%v", err)
 	}
+	srv.coreRules.Store(rules)
+	log.Printf("Reglas: %d del fichero %s, %d Sigma de %s (%d descartadas), %d internas deshabilitadas",
+		len(rules.Rules)-rules.SigmaRules, cfg.RulesFile, rules.SigmaRules, cfg.SigmaDir, len(rules.SigmaSkipped), len(rules.DisableBuiltin))
 
-	srv := &Server{db: pool}
+	// SIGHUP recarga las reglas (fichero y Sigma) sin reiniciar
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			srv.reloadCoreRules(cfg)
+		}
+	}()
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/v1/events/batch", srv.handleBatchEvents)
 	mux.HandleFunc("/api/v1/ssh_summary", srv.handleSSHSummary)
 	mux.HandleFunc("/api/v1/ssh_activity", srv.handleSSHActivity)
+	mux.HandleFunc("/api/v1/ssh_sessions", srv.handleSSHSessions)
 	mux.HandleFunc("/api/v1/ssh_alerts", srv.handleSSHAlerts)
 	mux.HandleFunc("/api/v1/ssh_alerts/", srv.handleSSHAlerts)
 	mux.HandleFunc("/api/v1/ssh_suspicious_logins", srv.handleSSHSuspiciousLogins)
@@ -307,13 +399,34 @@ func main() {
 	mux.HandleFunc("/api/v1/sudo_alerts", srv.handleSudoAlerts)
 	mux.HandleFunc("/api/v1/sudo_alerts/", srv.handleSudoAlerts)
 	mux.HandleFunc("/api/v1/ssh_bans", srv.handleSSHBans)
+	mux.HandleFunc("/api/v1/ssh_bans/history", srv.handleSSHBanStateHistory)
+	mux.HandleFunc("/api/v1/ssh_ban_history", srv.handleSSHBanHistory)
+	mux.HandleFunc("/api/v1/ban_actions", srv.handleBanActions)
+	mux.HandleFunc("/api/v1/ban_actions/", srv.handleBanActions)
+	mux.HandleFunc("/api/v1/agent/actions/poll", srv.handleAgentActionsPoll)
+	mux.HandleFunc("/api/v1/agent/actions/result", srv.handleAgentActionsResult)
+	mux.HandleFunc("/api/v1/federation", srv.handleFederation)
+	mux.HandleFunc("/api/v1/federation/allowlist", srv.handleFederationAllowlist)
+	mux.HandleFunc("/api/v1/federation/allowlist/", srv.handleFederationAllowlist)
+	mux.HandleFunc("/api/v1/blocklist/", srv.handleBlocklist)
+	mux.HandleFunc("/api/v1/account_changes", srv.handleAccountChanges)
+	mux.HandleFunc("/api/v1/account_alerts", srv.handleAccountAlerts)
+	mux.HandleFunc("/api/v1/account_alerts/", srv.handleAccountAlerts)
+	mux.HandleFunc("/api/v1/settings", srv.handleSettings)
+	mux.HandleFunc("/api/v1/alerts", srv.handleAlerts)
+	mux.HandleFunc("/api/v1/alerts/", srv.handleAlerts)
+	mux.HandleFunc("/api/v1/rules", srv.handleRules)
 
 	// Workers
-	srv.startSSHAlertWorker(SSHAlertWindowMinutes, SSHAlertFailedThreshold)
-	srv.startSSHSuspiciousLoginWorker(SuspiciousWindowMinutes, SuspiciousFailedBeforeSuccess)
-	srv.startSudoAlertWorker(SudoAlertWindowMinutes)
+	srv.startRuleEngineWorker()
+	srv.startLowSlowWorker()
+	srv.startSudoFailureAlertWorker()
+	srv.startAccountAlertWorker()
+	srv.startRootShellAlertWorker()
+	srv.startBanHistoryWorker()
+	srv.startFederationWorker()
 
-	addr := ":5010"
+	addr := cfg.ListenAddr
 
 	log.Printf("natu-core escuchando en %s", addr)
 	if err := http.ListenAndServe(addr, mux); err != nil {
@@ -321,22 +434,6 @@ func main() {
 	}
 }
 
-func ensureBanTable(ctx context.Context, pool *pgxpool.Pool) error {
-	_, err := pool.Exec(ctx, `
-        CREATE TABLE IF NOT EXISTS ssh_bans_state (
-            agent_id uuid REFERENCES agents(id) ON DELETE CASCADE,
-            ip text NOT NULL,
-            jail text NOT NULL DEFAULT 'sshd',
-            banned_at timestamptz,
-            reason text,
-            source text,
-            synced_at timestamptz NOT NULL DEFAULT now(),
-            PRIMARY KEY (agent_id, ip, jail)
-        );
-    `)
-	return err
-}
-
 func (s *Server) ensureAgent(ctx context.Context, secret, hostname string) (string, error) {
 	var agentID string
 	err := s.db.QueryRow(ctx, `
@@ -372,6 +469,17 @@ func (s *Server) ensureAgent(ctx context.Context, secret, hostname string) (stri
 // ----------------------------------------------------
 // Ingesta de eventos (batch)
 // ----------------------------------------------------
+//
+// El agente reintenta cualquier rechazo y, si persiste, aparta el lote sin
+// borrarlo. Sólo descarta los lotes marcados con permanentRejectHeader, que
+// son los que no se aceptarán nunca por mucho que se reenvíen.
+
+const permanentRejectHeader = "X-Natu-Permanent"
+
+func rejectBatch(w http.ResponseWriter, msg string) {
+	w.Header().Set(permanentRejectHeader, "1")
+	http.Error(w, msg, http.StatusUnprocessableEntity)
+}
 
 func (s *Server) handleBatchEvents(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -384,8 +492,12 @@ func (s *Server) handleBatchEvents(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "JSON inválido", http.StatusBadRequest)
 		return
 	}
-	if req.AgentSecret == "" || len(req.Events) == 0 {
-		http.Error(w, "agent_secret y events requeridos", http.StatusBadRequest)
+	if req.AgentSecret == "" {
+		http.Error(w, "agent_secret requerido", http.StatusBadRequest)
+		return
+	}
+	if len(req.Events) == 0 {
+		rejectBatch(w, "events requerido")
 		return
 	}
 
@@ -405,6 +517,7 @@ func (s *Server) handleBatchEvents(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback(ctx)
 
+	duplicated := 0
 	for _, ev := range req.Events {
 		if ev.Ts.IsZero() {
 			ev.Ts = time.Now().UTC()
@@ -414,24 +527,32 @@ func (s *Server) handleBatchEvents(w http.ResponseWriter, r *http.Request) {
 		}
 		payloadBytes, err := json.Marshal(ev.Payload)
 		if err != nil {
-			http.Error(w, "payload inválido", http.StatusBadRequest)
+			rejectBatch(w, "payload inválido")
 			return
 		}
 
-		_, err = tx.Exec(ctx, `
-            INSERT INTO raw_events (agent_id, ts, source, event_type, severity, payload)
-            VALUES ($1, $2, $3, $4, $5, $6::jsonb)
-        `, agentID, ev.Ts, ev.Source, ev.EventType, ev.Severity, string(payloadBytes))
+		// Un lote reenviado trae los mismos ids: lo ya guardado se ignora
+		tag, err := tx.Exec(ctx, `
+            INSERT INTO raw_events (agent_id, ts, source, event_type, severity, payload, event_uid)
+            VALUES ($1, $2, $3, $4, $5, $6::jsonb, NULLIF($7, ''))
+            ON CONFLICT (agent_id, event_uid) WHERE event_uid IS NOT NULL DO NOTHING
+        `, agentID, ev.Ts, ev.Source, ev.EventType, ev.Severity, string(payloadBytes), ev.ID)
 		if err != nil {
 			http.Error(w, "error insertando eventos", http.StatusInternalServerError)
 			return
 		}
+		if tag.RowsAffected() == 0 {
+			duplicated++
+		}
 	}
 
 	if err := tx.Commit(ctx); err != nil {
 		http.Error(w, "error commit", http.StatusInternalServerError)
 		return
 	}
+	if duplicated > 0 {
+		log.Printf("Lote de %s: %d de %d eventos ya estaban guardados (reenvío)", req.Hostname, duplicated, len(req.Events))
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -480,35 +601,20 @@ func (s *Server) handlePostSSHBans(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback(ctx)
 
-	if _, err := tx.Exec(ctx, `DELETE FROM ssh_bans_state WHERE agent_id = $1`, agentID); err != nil {
-		http.Error(w, "error limpiando bans previos", http.StatusInternalServerError)
+	opened, closed, err := syncBanState(ctx, tx, agentID, req.Bans)
+	if err != nil {
+		log.Printf("Error sincronizando bans de %s: %v", req.Hostname, err)
+		http.Error(w, "error guardando bans", http.StatusInternalServerError)
 		return
 	}
 
-	for _, ban := range req.Bans {
-		if ban.IP == "" {
-			continue
-		}
-
-		jail := ban.Jail
-		if jail == "" {
-			jail = "sshd"
-		}
-
-		_, err := tx.Exec(ctx, `
-            INSERT INTO ssh_bans_state (agent_id, ip, jail, banned_at, reason, source, synced_at)
-            VALUES ($1, $2, $3, $4, $5, $6, now())
-        `, agentID, ban.IP, jail, ban.BannedAt, ban.Reason, ban.Source)
-		if err != nil {
-			http.Error(w, "error guardando bans", http.StatusInternalServerError)
-			return
-		}
-	}
-
 	if err := tx.Commit(ctx); err != nil {
 		http.Error(w, "error commit bans", http.StatusInternalServerError)
 		return
 	}
+	if opened > 0 || closed > 0 {
+		log.Printf("Bans de %s: %d nuevos, %d cerrados", req.Hostname, opened, closed)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -518,6 +624,10 @@ func (s *Server) handlePostSSHBans(w http.ResponseWriter, r *http.Request) {
 func (s *Server) handleGetSSHBans(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query()
 	minStr := q.Get("minutes")
+	jail := q.Get("jail")
+	host := q.Get("hostname")
+	source := q.Get("source")
+	origin := q.Get("origin")
 	windowMinutes := 1440
 	if minStr != "" {
 		if v, err := strconv.Atoi(minStr); err == nil && v > 0 && v <= 10080 {
@@ -528,13 +638,40 @@ func (s *Server) handleGetSSHBans(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	now := time.Now().UTC()
 
-	rows, err := s.db.Query(ctx, `
-        SELECT b.ip, b.jail, b.banned_at, b.reason, b.source, b.synced_at, a.hostname
+	query := `
+        SELECT b.ip, b.jail, b.banned_at, b.reason, b.source, b.synced_at, a.hostname,
+               b.expires_at, b.sets, b.origin, b.first_seen, b.last_seen
         FROM ssh_bans_state b
         JOIN agents a ON b.agent_id = a.id
         WHERE b.synced_at >= now() - ($1::int || ' minutes')::interval
-        ORDER BY COALESCE(b.banned_at, b.synced_at) DESC;
-    `, windowMinutes)
+    `
+	args := []any{windowMinutes}
+	argPos := 2
+
+	if jail != "" {
+		query += " AND b.jail = $" + strconv.Itoa(argPos)
+		args = append(args, jail)
+		argPos++
+	}
+	if host != "" {
+		query += " AND a.hostname = $" + strconv.Itoa(argPos)
+		args = append(args, host)
+		argPos++
+	}
+	if source != "" {
+		query += " AND (b.source = $" + strconv.Itoa(argPos) + " OR EXISTS (SELECT 1 FROM unnest(b.sets) s WHERE split_part(s, ':', 1) = $" + strconv.Itoa(argPos) + "))"
+		args = append(args, source)
+		argPos++
+	}
+	if origin != "" {
+		query += " AND b.origin = $" + strconv.Itoa(argPos)
+		args = append(args, origin)
+		argPos++
+	}
+
+	query += " ORDER BY COALESCE(b.banned_at, b.synced_at) DESC"
+
+	rows, err := s.db.Query(ctx, query, args...)
 	if err != nil {
 		http.Error(w, "error consultando bans", http.StatusInternalServerError)
 		return
@@ -544,10 +681,18 @@ func (s *Server) handleGetSSHBans(w http.ResponseWriter, r *http.Request) {
 	var bans []SSHBan
 	for rows.Next() {
 		var b SSHBan
-		if err := rows.Scan(&b.IP, &b.Jail, &b.BannedAt, &b.Reason, &b.Source, &b.SyncedAt, &b.Hostname); err != nil {
+		if err := rows.Scan(&b.IP, &b.Jail, &b.BannedAt, &b.Reason, &b.Source, &b.SyncedAt, &b.Hostname,
+			&b.ExpiresAt, &b.Sets, &b.Origin, &b.FirstSeen, &b.LastSeen); err != nil {
 			http.Error(w, "error leyendo bans", http.StatusInternalServerError)
 			return
 		}
+		if b.ExpiresAt != nil {
+			remaining := int64(b.ExpiresAt.Sub(now).Seconds())
+			if remaining < 0 {
+				remaining = 0
+			}
+			b.TimeoutSeconds = &remaining
+		}
 		bans = append(bans, b)
 	}
 
@@ -596,6 +741,13 @@ func (s *Server) handleSSHSummary(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// group_by=subnet añade top_subnets
+	groupBy := q.Get("group_by")
+	if groupBy != "" && groupBy != "ip" && groupBy != "subnet" {
+		http.Error(w, "group_by inválido (use ip o subnet)", http.StatusBadRequest)
+		return
+	}
+
 	ctx := r.Context()
 	now := time.Now().UTC()
 
@@ -718,6 +870,54 @@ LIMIT 10;
 		topIPs = []SSHTopIP{}
 	}
 
+	var topSubnets []SSHTopSubnet
+	if groupBy == "subnet" {
+		subnetQuery := commonCTE + `
+SELECT natu_subnet(remote_ip) AS subnet,
+       COUNT(*)                  AS failed_count,
+       COUNT(DISTINCT remote_ip) AS ip_count,
+       COUNT(DISTINCT hostname)  AS host_count
+FROM dedup
+WHERE event_type = 'ssh_failed_login'
+  AND natu_subnet(remote_ip) IS NOT NULL
+GROUP BY subnet
+ORDER BY failed_count DESC
+LIMIT 10;
+`
+
+		subnetArgs := []any{}
+		if useWindow {
+			subnetArgs = append(subnetArgs, windowMinutes)
+		}
+
+		rows, err = s.db.Query(ctx, subnetQuery, subnetArgs...)
+		if err != nil {
+			log.Printf("Error consultando top subredes: %v", err)
+			http.Error(w, "error consultando top subredes", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var sn SSHTopSubnet
+			if err := rows.Scan(&sn.Subnet, &sn.Failed, &sn.IPs, &sn.Hosts); err != nil {
+				log.Printf("Error escaneando top subred: %v", err)
+				http.Error(w, "error leyendo top subredes", http.StatusInternalServerError)
+				return
+			}
+			topSubnets = append(topSubnets, sn)
+		}
+		if rows.Err() != nil {
+			log.Printf("Error final en rows subredes: %v", rows.Err())
+			http.Error(w, "error leyendo top subredes", http.StatusInternalServerError)
+			return
+		}
+
+		if topSubnets == nil {
+			topSubnets = []SSHTopSubnet{}
+		}
+	}
+
 	userQuery := commonCTE + `
 SELECT username,
        COUNT(*) FILTER (WHERE event_type = 'ssh_failed_login')  AS failed_count,
@@ -767,6 +967,7 @@ LIMIT 10;
 		GeneratedAt:   now,
 		Hosts:         hosts,
 		TopIPs:        topIPs,
+		TopSubnets:    topSubnets,
 		TopUsers:      topUsers,
 	}
 
@@ -778,342 +979,6 @@ LIMIT 10;
 	}
 }
 
-// ----------------------------------------------------
-// Worker de alertas SSH (fuerza bruta)
-// ----------------------------------------------------
-
-func (s *Server) startSSHAlertWorker(windowMinutes int, threshold int) {
-	go func() {
-		ticker := time.NewTicker(1 * time.Minute)
-		defer ticker.Stop()
-
-		for range ticker.C {
-			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-			if err := s.runSSHAlertScan(ctx, windowMinutes, threshold); err != nil {
-				log.Printf("Error en SSHAlertWorker: %v", err)
-			}
-			cancel()
-		}
-	}()
-}
-
-func (s *Server) runSSHAlertScan(ctx context.Context, windowMinutes int, threshold int) error {
-	rows, err := s.db.Query(ctx, `
-        SELECT
-            a.id::text       AS agent_id,
-            a.hostname       AS hostname,
-            e.payload->>'remote_ip' AS remote_ip,
-            COUNT(*)         AS failed_count,
-            MIN(e.ts)        AS first_seen,
-            MAX(e.ts)        AS last_seen
-        FROM raw_events e
-        JOIN agents a ON e.agent_id = a.id
-        WHERE e.source = 'auth'
-          AND e.event_type = 'ssh_failed_login'
-          AND e.ts >= now() - ($1::int || ' minutes')::interval
-          AND e.payload ? 'remote_ip'
-        GROUP BY a.id, a.hostname, remote_ip
-        HAVING COUNT(*) >= $2
-        ORDER BY failed_count DESC;
-    `, windowMinutes, threshold)
-	if err != nil {
-		return err
-	}
-	defer rows.Close()
-
-	type candidate struct {
-		AgentID     string
-		Hostname    string
-		RemoteIP    string
-		FailedCount int
-		FirstSeen   time.Time
-		LastSeen    time.Time
-	}
-
-	var cands []candidate
-	for rows.Next() {
-		var c candidate
-		if err := rows.Scan(&c.AgentID, &c.Hostname, &c.RemoteIP, &c.FailedCount, &c.FirstSeen, &c.LastSeen); err != nil {
-			return err
-		}
-		cands = append(cands, c)
-	}
-	if rows.Err() != nil {
-		return rows.Err()
-	}
-
-	for _, c := range cands {
-		var exists bool
-		err := s.db.QueryRow(ctx, `
-            SELECT EXISTS (
-                SELECT 1
-                FROM ssh_alerts
-                WHERE agent_id = $1
-                  AND remote_ip = $2
-                  AND created_at >= now() - ($3::int || ' minutes')::interval
-            );
-        `, c.AgentID, c.RemoteIP, windowMinutes).Scan(&exists)
-		if err != nil {
-			return err
-		}
-
-		if exists {
-			continue
-		}
-
-		_, err = s.db.Exec(ctx, `
-            INSERT INTO ssh_alerts (agent_id, hostname, remote_ip, failed_count, window_minutes, first_seen, last_seen, status)
-            VALUES ($1, $2, $3, $4, $5, $6, $7, 'new');
-        `, c.AgentID, c.Hostname, c.RemoteIP, c.FailedCount, windowMinutes, c.FirstSeen, c.LastSeen)
-		if err != nil {
-			return err
-		}
-
-		log.Printf("⚠️  SSH alert creada: host=%s ip=%s failed=%d window=%dmin",
-			c.Hostname, c.RemoteIP, c.FailedCount, windowMinutes)
-	}
-
-	return nil
-}
-
-// ----------------------------------------------------
-// Worker brute-force exitoso (ssh_suspicious_logins)
-// ----------------------------------------------------
-
-func (s *Server) startSSHSuspiciousLoginWorker(windowMinutes int, threshold int) {
-	go func() {
-		ticker := time.NewTicker(1 * time.Minute)
-		defer ticker.Stop()
-
-		for range ticker.C {
-			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-			if err := s.runSSHSuspiciousLoginScan(ctx, windowMinutes, threshold); err != nil {
-				log.Printf("Error en SSH Suspicious Worker: %v", err)
-			}
-			cancel()
-		}
-	}()
-}
-
-func (s *Server) runSSHSuspiciousLoginScan(ctx context.Context, windowMinutes int, threshold int) error {
-	rows, err := s.db.Query(ctx, `
-        SELECT
-            a.id::text                        AS agent_id,
-            a.hostname                        AS hostname,
-            se.payload->>'username'           AS username,
-            se.payload->>'remote_ip'          AS remote_ip,
-            se.ts                             AS success_ts,
-            COUNT(fe.*)                       AS failed_count,
-            MIN(fe.ts)                        AS first_failed_at
-        FROM raw_events se
-        JOIN agents a ON se.agent_id = a.id
-        JOIN raw_events fe ON fe.agent_id = se.agent_id
-            AND fe.source = 'auth'
-            AND fe.event_type = 'ssh_failed_login'
-            AND fe.payload->>'remote_ip' = se.payload->>'remote_ip'
-            AND fe.ts BETWEEN se.ts - ($1::int || ' minutes')::interval AND se.ts
-        WHERE se.source = 'auth'
-          AND se.event_type = 'ssh_login_success'
-          AND se.ts >= now() - ($1::int || ' minutes')::interval
-        GROUP BY a.id, a.hostname, username, remote_ip, success_ts
-        HAVING COUNT(fe.*) >= $2
-        ORDER BY success_ts DESC;
-    `, windowMinutes, threshold)
-	if err != nil {
-		return err
-	}
-	defer rows.Close()
-
-	type cand struct {
-		AgentID     string
-		Hostname    string
-		Username    string
-		RemoteIP    string
-		SuccessTs   time.Time
-		FailedCount int
-		FirstFailed time.Time
-	}
-
-	var cands []cand
-	for rows.Next() {
-		var c cand
-		if err := rows.Scan(&c.AgentID, &c.Hostname, &c.Username, &c.RemoteIP, &c.SuccessTs, &c.FailedCount, &c.FirstFailed); err != nil {
-			return err
-		}
-		cands = append(cands, c)
-	}
-	if rows.Err() != nil {
-		return rows.Err()
-	}
-
-	for _, c := range cands {
-		var exists bool
-		err := s.db.QueryRow(ctx, `
-            SELECT EXISTS (
-                SELECT 1
-                FROM ssh_suspicious_logins
-                WHERE agent_id = $1
-                  AND remote_ip = $2
-                  AND username = $3
-                  AND success_at = $4
-            );
-        `, c.AgentID, c.RemoteIP, c.Username, c.SuccessTs).Scan(&exists)
-		if err != nil {
-			return err
-		}
-
-		if exists {
-			continue
-		}
-
-		_, err = s.db.Exec(ctx, `
-            INSERT INTO ssh_suspicious_logins (
-                agent_id, hostname, username, remote_ip,
-                failed_count_before_success, window_minutes,
-                first_failed_at, success_at, status
-            )
-            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, 'new');
-        `, c.AgentID, c.Hostname, c.Username, c.RemoteIP, c.FailedCount, windowMinutes, c.FirstFailed, c.SuccessTs)
-		if err != nil {
-			return err
-		}
-
-		log.Printf("⚠️  SSH suspicious login: host=%s ip=%s user=%s failed_before=%d window=%dmin",
-			c.Hostname, c.RemoteIP, c.Username, c.FailedCount, windowMinutes)
-	}
-
-	return nil
-}
-
-// ----------------------------------------------------
-// Worker sudo_alerts (comandos peligrosos)
-// ----------------------------------------------------
-
-func isDangerousSudoCommand(cmd string) bool {
-	lower := strings.ToLower(cmd)
-	for _, sub := range sudoDangerousSubstrings {
-		if strings.Contains(lower, strings.ToLower(sub)) {
-			return true
-		}
-	}
-	return false
-}
-
-func (s *Server) startSudoAlertWorker(windowMinutes int) {
-	go func() {
-		ticker := time.NewTicker(1 * time.Minute)
-		defer ticker.Stop()
-
-		for range ticker.C {
-			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-			if err := s.runSudoAlertScan(ctx, windowMinutes); err != nil {
-				log.Printf("Error en SudoAlertWorker: %v", err)
-			}
-			cancel()
-		}
-	}()
-}
-
-func (s *Server) runSudoAlertScan(ctx context.Context, windowMinutes int) error {
-	rows, err := s.db.Query(ctx, `
-        SELECT
-            e.agent_id::text                 AS agent_id,
-            a.hostname                       AS hostname,
-            e.ts                             AS sudo_ts,
-            e.payload->>'sudo_user'          AS sudo_user,
-            e.payload->>'target_user'        AS target_user,
-            COALESCE(e.payload->>'tty', '')  AS tty,
-            COALESCE(e.payload->>'pwd', '')  AS pwd,
-            COALESCE(e.payload->>'command', '') AS command,
-            COALESCE(se.remote_ip, '')       AS remote_ip
-        FROM raw_events e
-        JOIN agents a ON e.agent_id = a.id
-        LEFT JOIN LATERAL (
-            SELECT se.payload->>'remote_ip' AS remote_ip
-            FROM raw_events se
-            WHERE se.agent_id = e.agent_id
-              AND se.source = 'auth'
-              AND se.event_type = 'ssh_login_success'
-              AND se.ts <= e.ts
-              AND se.payload ? 'remote_ip'
-            ORDER BY se.ts DESC
-            LIMIT 1
-        ) se ON TRUE
-        WHERE e.source = 'auth'
-          AND e.event_type = 'sudo_command'
-          AND e.ts >= now() - ($1::int || ' minutes')::interval;
-    `, windowMinutes)
-	if err != nil {
-		return err
-	}
-	defer rows.Close()
-
-	type cand struct {
-		AgentID  string
-		Hostname string
-		SudoTs   time.Time
-		SudoUser string
-		Target   string
-		TTY      string
-		Pwd      string
-		Command  string
-		RemoteIP string
-	}
-
-	var cands []cand
-	for rows.Next() {
-		var c cand
-		if err := rows.Scan(&c.AgentID, &c.Hostname, &c.SudoTs, &c.SudoUser, &c.Target, &c.TTY, &c.Pwd, &c.Command, &c.RemoteIP); err != nil {
-			return err
-		}
-		cands = append(cands, c)
-	}
-	if rows.Err() != nil {
-		return rows.Err()
-	}
-
-	for _, c := range cands {
-		if !isDangerousSudoCommand(c.Command) {
-			continue
-		}
-
-		var exists bool
-		err := s.db.QueryRow(ctx, `
-            SELECT EXISTS (
-                SELECT 1
-                FROM sudo_alerts
-                WHERE agent_id = $1
-                  AND sudo_user = $2
-                  AND target_user = $3
-                  AND command = $4
-                  AND sudo_ts = $5
-            );
-        `, c.AgentID, c.SudoUser, c.Target, c.Command, c.SudoTs).Scan(&exists)
-		if err != nil {
-			return err
-		}
-		if exists {
-			continue
-		}
-
-		_, err = s.db.Exec(ctx, `
-            INSERT INTO sudo_alerts (
-                agent_id, hostname, sudo_user, target_user, remote_ip,
-                tty, pwd, command, window_minutes, sudo_ts, status
-            )
-            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, 'new');
-        `, c.AgentID, c.Hostname, c.SudoUser, c.Target, c.RemoteIP, c.TTY, c.Pwd, c.Command, windowMinutes, c.SudoTs)
-		if err != nil {
-			return err
-		}
-
-		log.Printf("⚠️  SUDO alert creada: host=%s user=%s target=%s ip=%s cmd=%q",
-			c.Hostname, c.SudoUser, c.Target, c.RemoteIP, c.Command)
-	}
-
-	return nil
-}
-
 // ----------------------------------------------------
 // API ssh_alerts (GET + PATCH)
 // ----------------------------------------------------
@@ -1633,7 +1498,7 @@ WITH base AS (
         e.ts,
         a.hostname,
         e.event_type,
-        e.payload->>'username'  AS username,
+        COALESCE(e.payload->>'username', '')    AS username,
         e.payload->>'remote_ip' AS remote_ip,
         COALESCE(e.payload->>'auth_method', '') AS auth_method,
         COALESCE(e.payload->>'is_root', '')      AS is_root_str,
@@ -1642,7 +1507,7 @@ WITH base AS (
     FROM raw_events e
     JOIN agents a ON e.agent_id = a.id
     WHERE e.source = 'auth'
-      AND e.event_type IN ('ssh_failed_login', 'ssh_login_success')
+      AND e.event_type IN (` + sshActivityEventTypesSQL + `)
       AND e.payload->>'remote_ip' = $1
 )
 SELECT DISTINCT ON (ts, remote_ip, username, event_type, raw_line)
@@ -1784,6 +1649,7 @@ func (s *Server) handleSudoTimeline(w http.ResponseWriter, r *http.Request) {
 	query := `
         SELECT DISTINCT
             e.ts,
+            e.event_type,
             a.hostname,
             e.payload->>'sudo_user'         AS sudo_user,
             e.payload->>'target_user'       AS target_user,
@@ -1792,8 +1658,12 @@ func (s *Server) handleSudoTimeline(w http.ResponseWriter, r *http.Request) {
             COALESCE(e.payload->>'command', '') AS command,
             COALESCE(e.payload->>'is_sudo_root', '')   AS is_sudo_root_str,
             COALESCE(e.payload->>'is_target_root', '') AS is_target_root_str,
-            e.payload->>'raw_line'          AS raw_line,
-            COALESCE(se.remote_ip, '')      AS remote_ip
+            COALESCE(e.payload->>'reason', '') AS reason,
+            COALESCE(e.payload->>'shell_id', '') AS shell_id,
+            COALESCE(e.payload->>'ssh_session_id', '') AS ssh_session_id,
+            (e.payload->>'duration_seconds')::bigint AS duration_seconds,
+            COALESCE(e.payload->>'raw_line', '') AS raw_line,
+            COALESCE(e.payload->>'remote_ip', se.remote_ip, '') AS remote_ip
         FROM raw_events e
         JOIN agents a ON e.agent_id = a.id
         LEFT JOIN LATERAL (
@@ -1808,7 +1678,7 @@ func (s *Server) handleSudoTimeline(w http.ResponseWriter, r *http.Request) {
             LIMIT 1
         ) se ON TRUE
         WHERE e.source = 'auth'
-          AND e.event_type = 'sudo_command'
+          AND e.event_type IN ('sudo_command', 'sudo_auth_failure', 'sudo_denied', 'root_shell_start', 'root_shell_end')
           AND e.ts >= now() - ($1::int || ' minutes')::interval
     `
 	args := []any{windowMinutes}
@@ -1843,6 +1713,7 @@ func (s *Server) handleSudoTimeline(w http.ResponseWriter, r *http.Request) {
 
 		if err := rows.Scan(
 			&ev.Ts,
+			&ev.EventType,
 			&ev.Hostname,
 			&ev.SudoUser,
 			&ev.TargetUser,
@@ -1851,6 +1722,10 @@ func (s *Server) handleSudoTimeline(w http.ResponseWriter, r *http.Request) {
 			&ev.Command,
 			&isSudoRootStr,
 			&isTargetRootStr,
+			&ev.Reason,
+			&ev.ShellID,
+			&ev.SSHSessionID,
+			&ev.Duration,
 			&ev.RawLine,
 			&ev.RemoteIP,
 		); err != nil {
@@ -1913,6 +1788,7 @@ func (s *Server) handleSudoAlertsGET(w http.ResponseWriter, r *http.Request) {
 	targetUser := q.Get("target_user")
 	ip := q.Get("ip")
 	host := q.Get("hostname")
+	rule := q.Get("rule")
 	minStr := q.Get("minutes")
 	limitStr := q.Get("limit")
 
@@ -1946,7 +1822,13 @@ func (s *Server) handleSudoAlertsGET(w http.ResponseWriter, r *http.Request) {
             command,
             window_minutes,
             sudo_ts,
-            status
+            status,
+            rule,
+            failed_count,
+            shell_id,
+            ssh_session_id,
+            ended_at,
+            COALESCE(duration_seconds, 0)
         FROM sudo_alerts
         WHERE created_at >= now() - ($1::int || ' minutes')::interval
     `
@@ -1978,6 +1860,11 @@ func (s *Server) handleSudoAlertsGET(w http.ResponseWriter, r *http.Request) {
 		args = append(args, host)
 		argPos++
 	}
+	if rule != "" {
+		query += " AND rule = $" + strconv.Itoa(argPos)
+		args = append(args, rule)
+		argPos++
+	}
 
 	query += " ORDER BY created_at DESC LIMIT $" + strconv.Itoa(argPos)
 	args = append(args, limit)
@@ -2006,11 +1893,20 @@ func (s *Server) handleSudoAlertsGET(w http.ResponseWriter, r *http.Request) {
 			&a.WindowMinutes,
 			&a.SudoTs,
 			&a.Status,
+			&a.Rule,
+			&a.FailedCount,
+			&a.ShellID,
+			&a.SSHSessionID,
+			&a.EndedAt,
+			&a.Duration,
 		); err != nil {
 			log.Printf("Error escaneando sudo_alert: %v", err)
 			http.Error(w, "error leyendo sudo_alerts", http.StatusInternalServerError)
 			return
 		}
+		if a.Rule == sudoRuleRootShell && a.EndedAt == nil {
+			a.Duration = int64(now.Sub(a.SudoTs).Seconds())
+		}
 		alerts = append(alerts, a)
 	}
 	if rows.Err() != nil {
@@ -2087,7 +1983,13 @@ func (s *Server) handleSudoAlertsPATCH(w http.ResponseWriter, r *http.Request) {
             command,
             window_minutes,
             sudo_ts,
-            status;
+            status,
+            rule,
+            failed_count,
+            shell_id,
+            ssh_session_id,
+            ended_at,
+            COALESCE(duration_seconds, 0);
     `, newStatus, id).Scan(
 		&a.ID,
 		&a.CreatedAt,
@@ -2101,6 +2003,12 @@ func (s *Server) handleSudoAlertsPATCH(w http.ResponseWriter, r *http.Request) {
 		&a.WindowMinutes,
 		&a.SudoTs,
 		&a.Status,
+		&a.Rule,
+		&a.FailedCount,
+		&a.ShellID,
+		&a.SSHSessionID,
+		&a.EndedAt,
+		&a.Duration,
 	)
 	if err != nil {
 		log.Printf("Error actualizando sudo_alert id=%d: %v", id, err)
@@ -2108,6 +2016,10 @@ func (s *Server) handleSudoAlertsPATCH(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if a.Rule == sudoRuleRootShell && a.EndedAt == nil {
+		a.Duration = int64(time.Since(a.SudoTs).Seconds())
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	enc := json.NewEncoder(w)
 	enc.SetIndent("", "  ")
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ----------------------------------------------------
+// Migraciones de esquema
+// ----------------------------------------------------
+//
+// Los ficheros de migrations/ van embebidos en el binario con el formato
+// NNNN_nombre.up.sql / NNNN_nombre.down.sql y se aplican en orden. La versión
+// aplicada se guarda en schema_version; cada migración corre en su propia
+// transacción y un advisory lock evita que dos natu-core migren a la vez.
+// Al arrancar el servidor se aplican las pendientes, así que una base vacía
+// se inicializa sola. A mano:
+//
+//	natu-core migrate up
+//	natu-core migrate down [N] [--force]   (por defecto deshace 1)
+//	natu-core migrate status
+//
+// 0001_base adopta las tablas que ya existían en producción (agents,
+// raw_events...): deshacerla borra todo el histórico, así que migrate down
+// se niega a llegar a ella sin --force.
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Clave del advisory lock de migraciones ("natu")
+const migrationLockKey int64 = 0x6e617475
+
+// Versión de 0001_base: sólo se revierte con --force
+const baseMigrationVersion = 1
+
+var reMigrationFile = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type migrationState struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+	// Aplicada en la base pero sin fichero en este binario
+	Unknown bool
+}
+
+func loadMigrations() ([]migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*migration{}
+	for _, e := range entries {
+		m := reMigrationFile.FindStringSubmatch(e.Name())
+		if m == nil {
+			return nil, fmt.Errorf("nombre de migración inválido: %s", e.Name())
+		}
+		version, _ := strconv.Atoi(m[1])
+
+		body, err := migrationFiles.ReadFile(path.Join("migrations", e.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		}
+		if mig.Name != m[2] {
+			return nil, fmt.Errorf("migración %d con nombres distintos: %s y %s", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(body)
+		} else {
+			mig.Down = string(body)
+		}
+	}
+
+	out := make([]migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.Up == "" || mig.Down == "" {
+			return nil, fmt.Errorf("migración %04d_%s sin fichero up o down", mig.Version, mig.Name)
+		}
+		out = append(out, *mig)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+// withMigrationLock ejecuta fn con el advisory lock tomado en una conexión
+// propia (el lock es de sesión).
+func withMigrationLock(ctx context.Context, pool *pgxpool.Pool, fn func(conn *pgxpool.Conn) error) error {
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey); err != nil {
+		return fmt.Errorf("tomando lock de migraciones: %w", err)
+	}
+	defer func() {
+		_, _ = conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockKey)
+	}()
+
+	if _, err := conn.Exec(ctx, `
+        CREATE TABLE IF NOT EXISTS schema_version (
+            version int PRIMARY KEY,
+            name text NOT NULL,
+            applied_at timestamptz NOT NULL DEFAULT now()
+        );
+    `); err != nil {
+		return fmt.Errorf("creando schema_version: %w", err)
+	}
+
+	return fn(conn)
+}
+
+func appliedVersions(ctx context.Context, conn *pgxpool.Conn) (map[int]time.Time, error) {
+	rows, err := conn.Query(ctx, `SELECT version, applied_at FROM schema_version`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := map[int]time.Time{}
+	for rows.Next() {
+		var v int
+		var at time.Time
+		if err := rows.Scan(&v, &at); err != nil {
+			return nil, err
+		}
+		out[v] = at
+	}
+	return out, rows.Err()
+}
+
+func runMigrationStep(ctx context.Context, conn *pgxpool.Conn, sql string, record func(tx pgx.Tx) error) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, sql); err != nil {
+		return err
+	}
+	if err := record(tx); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// migrateUp aplica las migraciones pendientes y devuelve cuántas aplicó.
+func migrateUp(ctx context.Context, pool *pgxpool.Pool) (int, error) {
+	migs, err := loadMigrations()
+	if err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	err = withMigrationLock(ctx, pool, func(conn *pgxpool.Conn) error {
+		done, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migs {
+			if _, ok := done[m.Version]; ok {
+				continue
+			}
+			err := runMigrationStep(ctx, conn, m.Up, func(tx pgx.Tx) error {
+				_, err := tx.Exec(ctx, `INSERT INTO schema_version (version, name) VALUES ($1, $2)`, m.Version, m.Name)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migración %04d_%s: %w", m.Version, m.Name, err)
+			}
+			applied++
+			logMigration("aplicada", m)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// migrateDown deshace las últimas steps migraciones aplicadas. Si entre ellas
+// está 0001_base y no se pasa force no deshace ninguna.
+func migrateDown(ctx context.Context, pool *pgxpool.Pool, steps int, force bool) (int, error) {
+	migs, err := loadMigrations()
+	if err != nil {
+		return 0, err
+	}
+	byVersion := map[int]migration{}
+	for _, m := range migs {
+		byVersion[m.Version] = m
+	}
+
+	reverted := 0
+	err = withMigrationLock(ctx, pool, func(conn *pgxpool.Conn) error {
+		done, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		versions := make([]int, 0, len(done))
+		for v := range done {
+			versions = append(versions, v)
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+		if len(versions) > steps {
+			versions = versions[:steps]
+		}
+		for _, v := range versions {
+			if v == baseMigrationVersion && !force {
+				return fmt.Errorf("revertir %04d_base borra agents y raw_events (todo el histórico); use --force si es lo que quiere", v)
+			}
+		}
+
+		for _, v := range versions {
+			m, ok := byVersion[v]
+			if !ok {
+				return fmt.Errorf("la versión %d está aplicada pero este binario no tiene su migración", v)
+			}
+			err := runMigrationStep(ctx, conn, m.Down, func(tx pgx.Tx) error {
+				_, err := tx.Exec(ctx, `DELETE FROM schema_version WHERE version = $1`, m.Version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("revirtiendo %04d_%s: %w", m.Version, m.Name, err)
+			}
+			reverted++
+			logMigration("revertida", m)
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+func migrationStatus(ctx context.Context, pool *pgxpool.Pool) ([]migrationState, error) {
+	migs, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []migrationState
+	err = withMigrationLock(ctx, pool, func(conn *pgxpool.Conn) error {
+		done, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migs {
+			st := migrationState{Version: m.Version, Name: m.Name}
+			if at, ok := done[m.Version]; ok {
+				at := at
+				st.AppliedAt = &at
+				delete(done, m.Version)
+			}
+			out = append(out, st)
+		}
+		for v, at := range done {
+			at := at
+			out = append(out, migrationState{Version: v, AppliedAt: &at, Unknown: true})
+		}
+		return nil
+	})
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, err
+}
+
+func logMigration(what string, m migration) {
+	log.Printf("Migración %04d_%s %s", m.Version, m.Name, what)
+}
+
+// runMigrateCommand implementa "natu-core migrate up|down [N]|status".
+func runMigrateCommand(ctx context.Context, pool *pgxpool.Pool, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("uso: natu-core migrate up|down [N] [--force]|status")
+	}
+
+	switch args[0] {
+	case "up":
+		n, err := migrateUp(ctx, pool)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d migraciones aplicadas\n", n)
+
+	case "down":
+		steps, force := 1, false
+		for _, arg := range args[1:] {
+			if arg == "--force" {
+				force = true
+				continue
+			}
+			v, err := strconv.Atoi(arg)
+			if err != nil || v < 1 {
+				return fmt.Errorf("N inválido: %q", arg)
+			}
+			steps = v
+		}
+		n, err := migrateDown(ctx, pool, steps, force)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d migraciones revertidas\n", n)
+
+	case "status":
+		states, err := migrationStatus(ctx, pool)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSIÓN\tNOMBRE\tESTADO\tAPLICADA")
+		for _, st := range states {
+			state, at := "pendiente", "-"
+			if st.AppliedAt != nil {
+				state = "aplicada"
+				at = st.AppliedAt.UTC().Format(time.RFC3339)
+			}
+			if st.Unknown {
+				state = "desconocida"
+			}
+			fmt.Fprintf(tw, "%04d\t%s\t%s\t%s\n", st.Version, st.Name, state, at)
+		}
+		return tw.Flush()
+
+	default:
+		return fmt.Errorf("subcomando %q desconocido (use up, down o status)", args[0])
+	}
+	return nil
+}
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS sudo_alerts;
+DROP TABLE IF EXISTS ssh_suspicious_logins;
+DROP TABLE IF EXISTS ssh_alerts;
+DROP TABLE IF EXISTS raw_events;
+DROP TABLE IF EXISTS agents;
@@ -0,0 +1,75 @@
+-- Esquema base: agentes, eventos crudos y alertas clásicas.
+-- Todo con IF NOT EXISTS para adoptar bases creadas antes de las migraciones.
+
+CREATE TABLE IF NOT EXISTS agents (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    hostname text NOT NULL,
+    secret text NOT NULL UNIQUE,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    last_seen timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS raw_events (
+    id bigserial PRIMARY KEY,
+    agent_id uuid REFERENCES agents(id) ON DELETE CASCADE,
+    ts timestamptz NOT NULL,
+    source text NOT NULL,
+    event_type text NOT NULL,
+    severity int NOT NULL DEFAULT 1,
+    payload jsonb NOT NULL DEFAULT '{}'
+);
+
+CREATE INDEX IF NOT EXISTS raw_events_ts_idx ON raw_events (ts);
+CREATE INDEX IF NOT EXISTS raw_events_event_type_ts_idx ON raw_events (event_type, ts);
+CREATE INDEX IF NOT EXISTS raw_events_agent_ts_idx ON raw_events (agent_id, ts);
+CREATE INDEX IF NOT EXISTS raw_events_remote_ip_idx ON raw_events ((payload->>'remote_ip'));
+
+CREATE TABLE IF NOT EXISTS ssh_alerts (
+    id bigserial PRIMARY KEY,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    agent_id uuid REFERENCES agents(id) ON DELETE CASCADE,
+    hostname text NOT NULL,
+    remote_ip text NOT NULL,
+    failed_count int NOT NULL,
+    window_minutes int NOT NULL,
+    first_seen timestamptz NOT NULL,
+    last_seen timestamptz NOT NULL,
+    status text NOT NULL DEFAULT 'new'
+);
+
+CREATE INDEX IF NOT EXISTS ssh_alerts_created_idx ON ssh_alerts (created_at);
+CREATE INDEX IF NOT EXISTS ssh_alerts_agent_ip_idx ON ssh_alerts (agent_id, remote_ip);
+
+CREATE TABLE IF NOT EXISTS ssh_suspicious_logins (
+    id bigserial PRIMARY KEY,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    agent_id uuid REFERENCES agents(id) ON DELETE CASCADE,
+    hostname text NOT NULL,
+    username text NOT NULL,
+    remote_ip text NOT NULL,
+    failed_count_before_success int NOT NULL,
+    window_minutes int NOT NULL,
+    first_failed_at timestamptz NOT NULL,
+    success_at timestamptz NOT NULL,
+    status text NOT NULL DEFAULT 'new'
+);
+
+CREATE INDEX IF NOT EXISTS ssh_suspicious_logins_created_idx ON ssh_suspicious_logins (created_at);
+
+CREATE TABLE IF NOT EXISTS sudo_alerts (
+    id bigserial PRIMARY KEY,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    agent_id uuid REFERENCES agents(id) ON DELETE CASCADE,
+    hostname text NOT NULL,
+    sudo_user text NOT NULL,
+    target_user text NOT NULL DEFAULT '',
+    remote_ip text NOT NULL DEFAULT '',
+    tty text NOT NULL DEFAULT '',
+    pwd text NOT NULL DEFAULT '',
+    command text NOT NULL DEFAULT '',
+    window_minutes int NOT NULL,
+    sudo_ts timestamptz NOT NULL,
+    status text NOT NULL DEFAULT 'new'
+);
+
+CREATE INDEX IF NOT EXISTS sudo_alerts_created_idx ON sudo_alerts (created_at);
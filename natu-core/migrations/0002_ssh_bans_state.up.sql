@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS ssh_bans_state (
+    agent_id uuid REFERENCES agents(id) ON DELETE CASCADE,
+    ip text NOT NULL,
+    jail text NOT NULL DEFAULT 'sshd',
+    banned_at timestamptz,
+    reason text,
+    source text,
+    synced_at timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (agent_id, ip, jail)
+);
+
+-- Fuentes ipset/nft: tiempo restante y sets donde está la IP
+ALTER TABLE ssh_bans_state ADD COLUMN IF NOT EXISTS timeout_seconds bigint;
+ALTER TABLE ssh_bans_state ADD COLUMN IF NOT EXISTS expires_at timestamptz;
+ALTER TABLE ssh_bans_state ADD COLUMN IF NOT EXISTS sets text[] NOT NULL DEFAULT '{}';
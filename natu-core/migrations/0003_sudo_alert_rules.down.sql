@@ -0,0 +1,7 @@
+ALTER TABLE sudo_alerts
+    DROP COLUMN IF EXISTS rule,
+    DROP COLUMN IF EXISTS failed_count,
+    DROP COLUMN IF EXISTS shell_id,
+    DROP COLUMN IF EXISTS ssh_session_id,
+    DROP COLUMN IF EXISTS ended_at,
+    DROP COLUMN IF EXISTS duration_seconds;
@@ -0,0 +1,9 @@
+-- Columnas que distinguen el tipo de alerta sudo. Las filas existentes
+-- quedan como comando peligroso.
+ALTER TABLE sudo_alerts
+    ADD COLUMN IF NOT EXISTS rule text NOT NULL DEFAULT 'sudo_dangerous_command',
+    ADD COLUMN IF NOT EXISTS failed_count int NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS shell_id text NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS ssh_session_id text NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS ended_at timestamptz,
+    ADD COLUMN IF NOT EXISTS duration_seconds bigint;
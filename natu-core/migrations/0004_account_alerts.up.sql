@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS account_alerts (
+    id bigserial PRIMARY KEY,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    agent_id uuid REFERENCES agents(id) ON DELETE CASCADE,
+    hostname text NOT NULL,
+    rule text NOT NULL,
+    change_type text NOT NULL,
+    target text NOT NULL DEFAULT '',
+    group_name text NOT NULL DEFAULT '',
+    actor text NOT NULL DEFAULT '',
+    raw_line text NOT NULL DEFAULT '',
+    event_ts timestamptz NOT NULL,
+    status text NOT NULL DEFAULT 'new'
+);
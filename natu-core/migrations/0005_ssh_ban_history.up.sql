@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS ssh_ban_history (
+    id bigserial PRIMARY KEY,
+    agent_id uuid REFERENCES agents(id) ON DELETE CASCADE,
+    hostname text NOT NULL,
+    jail text NOT NULL,
+    ip text NOT NULL,
+    banned_at timestamptz NOT NULL,
+    unbanned_at timestamptz,
+    duration_seconds bigint,
+    found_count int NOT NULL DEFAULT 0,
+    restored boolean NOT NULL DEFAULT false,
+    UNIQUE (agent_id, jail, ip, banned_at)
+);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS ban_action_audit;
+DROP TABLE IF EXISTS ban_action_targets;
+DROP TABLE IF EXISTS ban_actions;
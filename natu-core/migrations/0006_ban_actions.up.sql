@@ -0,0 +1,38 @@
+CREATE TABLE IF NOT EXISTS ban_actions (
+    id bigserial PRIMARY KEY,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    action text NOT NULL,
+    ip text NOT NULL,
+    jail text NOT NULL DEFAULT 'sshd',
+    method text NOT NULL DEFAULT 'fail2ban',
+    ipset_set text NOT NULL DEFAULT '',
+    ttl_seconds int,
+    scope text NOT NULL,
+    target_hostname text NOT NULL DEFAULT '',
+    requested_by text NOT NULL,
+    reason text NOT NULL DEFAULT '',
+    source_alert text NOT NULL DEFAULT '',
+    status text NOT NULL DEFAULT 'pending'
+);
+
+CREATE TABLE IF NOT EXISTS ban_action_targets (
+    action_id bigint REFERENCES ban_actions(id) ON DELETE CASCADE,
+    agent_id uuid REFERENCES agents(id) ON DELETE CASCADE,
+    hostname text NOT NULL,
+    status text NOT NULL DEFAULT 'pending',
+    attempts int NOT NULL DEFAULT 0,
+    picked_at timestamptz,
+    completed_at timestamptz,
+    output text NOT NULL DEFAULT '',
+    PRIMARY KEY (action_id, agent_id)
+);
+
+CREATE TABLE IF NOT EXISTS ban_action_audit (
+    id bigserial PRIMARY KEY,
+    action_id bigint REFERENCES ban_actions(id) ON DELETE CASCADE,
+    ts timestamptz NOT NULL DEFAULT now(),
+    event text NOT NULL,
+    actor text NOT NULL DEFAULT '',
+    hostname text NOT NULL DEFAULT '',
+    detail text NOT NULL DEFAULT ''
+);
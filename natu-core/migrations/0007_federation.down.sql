@@ -0,0 +1,4 @@
+ALTER TABLE ssh_bans_state DROP COLUMN IF EXISTS origin;
+DROP TABLE IF EXISTS federated_bans;
+DROP TABLE IF EXISTS federation_allowlist;
+ALTER TABLE agents DROP COLUMN IF EXISTS federation_opt_out;
@@ -0,0 +1,22 @@
+ALTER TABLE agents ADD COLUMN IF NOT EXISTS federation_opt_out boolean NOT NULL DEFAULT false;
+
+CREATE TABLE IF NOT EXISTS federation_allowlist (
+    id bigserial PRIMARY KEY,
+    cidr text NOT NULL UNIQUE,
+    note text NOT NULL DEFAULT '',
+    created_by text NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS federated_bans (
+    id bigserial PRIMARY KEY,
+    ip text NOT NULL,
+    action_id bigint REFERENCES ban_actions(id) ON DELETE SET NULL,
+    host_count int NOT NULL,
+    source_hosts text[] NOT NULL DEFAULT '{}',
+    ttl_seconds int NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    expires_at timestamptz NOT NULL
+);
+
+ALTER TABLE ssh_bans_state ADD COLUMN IF NOT EXISTS origin text NOT NULL DEFAULT 'local';
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS ssh_bans_intervals;
+ALTER TABLE ssh_bans_state DROP COLUMN IF EXISTS first_seen;
+ALTER TABLE ssh_bans_state DROP COLUMN IF EXISTS last_seen;
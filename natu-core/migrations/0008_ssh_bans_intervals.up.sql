@@ -0,0 +1,20 @@
+ALTER TABLE ssh_bans_state ADD COLUMN IF NOT EXISTS first_seen timestamptz NOT NULL DEFAULT now();
+ALTER TABLE ssh_bans_state ADD COLUMN IF NOT EXISTS last_seen timestamptz NOT NULL DEFAULT now();
+
+CREATE TABLE IF NOT EXISTS ssh_bans_intervals (
+    id bigserial PRIMARY KEY,
+    agent_id uuid REFERENCES agents(id) ON DELETE CASCADE,
+    hostname text NOT NULL,
+    ip text NOT NULL,
+    jail text NOT NULL,
+    source text,
+    origin text NOT NULL DEFAULT 'local',
+    sets text[] NOT NULL DEFAULT '{}',
+    banned_at timestamptz,
+    first_seen timestamptz NOT NULL,
+    last_seen timestamptz NOT NULL,
+    closed_at timestamptz NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS ssh_bans_intervals_closed_idx ON ssh_bans_intervals (closed_at);
+CREATE INDEX IF NOT EXISTS ssh_bans_intervals_ip_idx ON ssh_bans_intervals (ip);
@@ -0,0 +1,7 @@
+-- Settings guardados con PUT /api/v1/settings (una sola fila)
+CREATE TABLE IF NOT EXISTS core_settings (
+    id int PRIMARY KEY CHECK (id = 1),
+    settings jsonb NOT NULL,
+    updated_by text NOT NULL,
+    updated_at timestamptz NOT NULL DEFAULT now()
+);
@@ -0,0 +1,25 @@
+-- Alertas genéricas del motor de reglas
+CREATE TABLE IF NOT EXISTS alerts (
+    id bigserial PRIMARY KEY,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    rule text NOT NULL,
+    rule_type text NOT NULL,
+    origin text NOT NULL,
+    severity text NOT NULL,
+    agent_id uuid REFERENCES agents(id) ON DELETE CASCADE,
+    hostname text NOT NULL DEFAULT '',
+    hosts text[] NOT NULL DEFAULT '{}',
+    group_key text NOT NULL,
+    group_values jsonb NOT NULL DEFAULT '{}',
+    count int NOT NULL,
+    distinct_count int NOT NULL DEFAULT 0,
+    first_seen timestamptz NOT NULL,
+    last_seen timestamptz NOT NULL,
+    window_minutes int NOT NULL,
+    message text NOT NULL,
+    payload jsonb NOT NULL DEFAULT '{}',
+    status text NOT NULL DEFAULT 'new'
+);
+
+CREATE INDEX IF NOT EXISTS alerts_rule_group_idx ON alerts (rule, group_key, created_at);
+CREATE INDEX IF NOT EXISTS alerts_created_idx ON alerts (created_at);
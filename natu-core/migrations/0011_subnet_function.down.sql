@@ -0,0 +1 @@
+DROP FUNCTION IF EXISTS natu_subnet(text);
@@ -0,0 +1,19 @@
+-- Subred normalizada de una IP (/24 en IPv4, /64 en IPv6); NULL si el texto
+-- no es una IP. La usan las reglas (campo remote_subnet) y ssh_summary.
+CREATE OR REPLACE FUNCTION natu_subnet(ip text) RETURNS text
+LANGUAGE plpgsql IMMUTABLE AS $$
+DECLARE
+    addr inet;
+BEGIN
+    IF ip IS NULL OR ip = '' THEN
+        RETURN NULL;
+    END IF;
+    addr := ip::inet;
+    IF family(addr) = 4 THEN
+        RETURN network(set_masklen(addr, 24))::text;
+    END IF;
+    RETURN network(set_masklen(addr, 64))::text;
+EXCEPTION WHEN invalid_text_representation THEN
+    RETURN NULL;
+END
+$$;
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS ssh_failures_hourly;
@@ -0,0 +1,17 @@
+-- Fallos SSH agregados por hora e IP en toda la flota (detección lenta).
+-- gap_sum / gap_sq_sum: suma y suma de cuadrados (segundos) de los
+-- intervalos entre intentos consecutivos dentro de la hora.
+CREATE TABLE IF NOT EXISTS ssh_failures_hourly (
+    hour timestamptz NOT NULL,
+    remote_ip text NOT NULL,
+    failed int NOT NULL,
+    agent_ids text[] NOT NULL DEFAULT '{}',
+    hosts text[] NOT NULL DEFAULT '{}',
+    first_seen timestamptz NOT NULL,
+    last_seen timestamptz NOT NULL,
+    gap_sum double precision NOT NULL DEFAULT 0,
+    gap_sq_sum double precision NOT NULL DEFAULT 0,
+    PRIMARY KEY (hour, remote_ip)
+);
+
+CREATE INDEX IF NOT EXISTS ssh_failures_hourly_ip_idx ON ssh_failures_hourly (remote_ip, hour);
@@ -0,0 +1,8 @@
+-- Último raw_events.id procesado por cada worker que convierte eventos en
+-- alertas o intervalos. Siguen el id y no la hora del evento para que lo que
+-- llega tarde (spool del agente) también se procese.
+CREATE TABLE IF NOT EXISTS event_watermarks (
+    name text PRIMARY KEY,
+    last_event_id bigint NOT NULL,
+    updated_at timestamptz NOT NULL DEFAULT now()
+);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS raw_events_agent_event_uid_idx;
+ALTER TABLE raw_events DROP COLUMN IF EXISTS event_uid;
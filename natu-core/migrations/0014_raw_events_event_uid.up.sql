@@ -0,0 +1,8 @@
+-- Id estable que pone el agente a cada evento: un lote reenviado (respuesta
+-- perdida, agente reiniciado antes de borrar el segmento) no se duplica.
+-- Los agentes antiguos no lo envían y sus eventos quedan con NULL.
+ALTER TABLE raw_events ADD COLUMN IF NOT EXISTS event_uid text;
+
+CREATE UNIQUE INDEX IF NOT EXISTS raw_events_agent_event_uid_idx
+    ON raw_events (agent_id, event_uid)
+    WHERE event_uid IS NOT NULL;
@@ -0,0 +1,59 @@
+package main
+
+// ----------------------------------------------------
+// Password spraying (reglas internas)
+// ----------------------------------------------------
+//
+// ssh_bruteforce cuenta fallos por (host, IP): una IP que prueba 40 usuarios
+// distintos, un intento cada uno y repartidos por la flota, no llega al
+// umbral. Estas dos reglas miran toda la flota en settings.password_spray:
+//
+//   - ssh_password_spray: usuarios distintos probados desde una misma IP.
+//   - ssh_user_targeted: IPs distintas que atacan a un mismo usuario.
+//
+// Los valores distintos salen de ssh_failed_login y ssh_invalid_user
+// (sondeos sin contraseña), pero ${count} sólo cuenta ssh_failed_login: un
+// usuario inexistente deja los dos eventos en el mismo intento. La severidad
+// sube con el número de valores distintos.
+
+func passwordSprayRules(st *Settings) []*Rule {
+	sp := st.PasswordSpray
+	failures := &Condition{All: []*Condition{
+		fieldEq("source", "auth"),
+		{Field: "event_type", Op: "in", Values: []string{"ssh_failed_login", "ssh_invalid_user"}},
+	}}
+	attempts := fieldEq("event_type", "ssh_failed_login")
+
+	return []*Rule{
+		{
+			Name:          "ssh_password_spray",
+			Description:   "Una IP prueba muchos usuarios distintos en la flota",
+			Type:          ruleTypeDistinct,
+			Severity:      "alto",
+			Escalation:    []SeverityStep{{MinCount: sp.UsernamesPerIP * 3, Severity: "crítico"}},
+			WindowMinutes: sp.WindowMinutes,
+			GroupBy:       []string{"payload.remote_ip"},
+			Where:         failures,
+			CountWhere:    attempts,
+			DistinctField: "payload.username",
+			Threshold:     sp.UsernamesPerIP,
+			Message:       "Password spraying desde ${remote_ip}: ${distinct_count} usuarios distintos (${count} fallos en ${window_minutes} min) contra ${hosts}",
+			Origin:        ruleOriginBuiltin,
+		},
+		{
+			Name:          "ssh_user_targeted",
+			Description:   "Un usuario atacado desde muchas IPs distintas",
+			Type:          ruleTypeDistinct,
+			Severity:      "medio",
+			Escalation:    []SeverityStep{{MinCount: sp.IPsPerUsername * 2, Severity: "alto"}, {MinCount: sp.IPsPerUsername * 5, Severity: "crítico"}},
+			WindowMinutes: sp.WindowMinutes,
+			GroupBy:       []string{"payload.username"},
+			Where:         failures,
+			CountWhere:    attempts,
+			DistinctField: "payload.remote_ip",
+			Threshold:     sp.IPsPerUsername,
+			Message:       "Usuario ${username} atacado desde ${distinct_count} IPs distintas (${count} fallos en ${window_minutes} min) en ${hosts}",
+			Origin:        ruleOriginBuiltin,
+		},
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// ----------------------------------------------------
+// Worker sudo_alerts (shells de root)
+// ----------------------------------------------------
+//
+// Cada root_shell_start del agente (su, sudo -i, sudo su -, sudo bash) abre
+// una alerta rule = 'root_shell' con el usuario real y la sesión SSH de
+// origen. Cuando llega el root_shell_end se completan ended_at y la duración.
+// Los inicios se leen por raw_events.id (event_watermarks), así que una
+// shell que el spool entrega tarde también abre su alerta.
+
+const (
+	sudoRuleRootShell  = "root_shell"
+	rootShellWatermark = "root_shell_alerts"
+)
+
+func (s *Server) startRootShellAlertWorker() {
+	s.startWorker("RootShellAlertWorker", func(ctx context.Context, st *Settings) error {
+		return s.runRootShellAlertScan(ctx, st.RootShell.WindowMinutes)
+	})
+}
+
+func (s *Server) runRootShellAlertScan(ctx context.Context, windowMinutes int) error {
+	from, mark, maxID, err := eventRange(ctx, s.db, rootShellWatermark, time.Duration(windowMinutes)*time.Minute)
+	if err != nil {
+		return err
+	}
+	if maxID <= mark {
+		return nil
+	}
+
+	rows, err := s.db.Query(ctx, `
+        SELECT
+            e.agent_id::text,
+            a.hostname,
+            e.ts,
+            e.payload->>'shell_id'                     AS shell_id,
+            COALESCE(e.payload->>'sudo_user', '')      AS sudo_user,
+            COALESCE(e.payload->>'target_user', '')    AS target_user,
+            COALESCE(e.payload->>'remote_ip', '')      AS remote_ip,
+            COALESCE(e.payload->>'tty', '')            AS tty,
+            COALESCE(e.payload->>'method', '')         AS method,
+            COALESCE(e.payload->>'ssh_session_id', '') AS ssh_session_id
+        FROM raw_events e
+        JOIN agents a ON a.id = e.agent_id
+        WHERE e.source = 'auth'
+          AND e.event_type = 'root_shell_start'
+          AND e.id > $1
+          AND e.id <= $2
+          AND e.payload ? 'shell_id'
+        ORDER BY e.ts ASC;
+    `, from, maxID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type cand struct {
+		AgentID      string
+		Hostname     string
+		Ts           time.Time
+		ShellID      string
+		SudoUser     string
+		Target       string
+		RemoteIP     string
+		TTY          string
+		Method       string
+		SSHSessionID string
+	}
+
+	var cands []cand
+	for rows.Next() {
+		var c cand
+		if err := rows.Scan(&c.AgentID, &c.Hostname, &c.Ts, &c.ShellID, &c.SudoUser, &c.Target, &c.RemoteIP, &c.TTY, &c.Method, &c.SSHSessionID); err != nil {
+			return err
+		}
+		cands = append(cands, c)
+	}
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	for _, c := range cands {
+		var exists bool
+		err := s.db.QueryRow(ctx, `
+            SELECT EXISTS (
+                SELECT 1
+                FROM sudo_alerts
+                WHERE agent_id = $1
+                  AND rule = $2
+                  AND shell_id = $3
+            );
+        `, c.AgentID, sudoRuleRootShell, c.ShellID).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+
+		_, err = s.db.Exec(ctx, `
+            INSERT INTO sudo_alerts (
+                agent_id, hostname, sudo_user, target_user, remote_ip,
+                tty, pwd, command, window_minutes, sudo_ts, status,
+                rule, shell_id, ssh_session_id
+            )
+            VALUES ($1, $2, $3, $4, $5, $6, '', $7, $8, $9, 'new', $10, $11, $12);
+        `, c.AgentID, c.Hostname, c.SudoUser, c.Target, c.RemoteIP, c.TTY, c.Method, windowMinutes, c.Ts,
+			sudoRuleRootShell, c.ShellID, c.SSHSessionID)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("⚠️  SUDO alert (shell de root): host=%s user=%s método=%s ip=%s sesión=%s",
+			c.Hostname, c.SudoUser, c.Method, c.RemoteIP, c.SSHSessionID)
+	}
+
+	// Cierre de las shells que ya tienen alerta abierta
+	_, err = s.db.Exec(ctx, `
+        UPDATE sudo_alerts sa
+        SET ended_at = e.ts,
+            duration_seconds = COALESCE((e.payload->>'duration_seconds')::bigint,
+                                        EXTRACT(EPOCH FROM e.ts - sa.sudo_ts)::bigint)
+        FROM raw_events e
+        WHERE sa.rule = $1
+          AND sa.ended_at IS NULL
+          AND e.agent_id = sa.agent_id
+          AND e.source = 'auth'
+          AND e.event_type = 'root_shell_end'
+          AND e.payload->>'shell_id' = sa.shell_id
+          AND e.ts >= sa.sudo_ts;
+    `, sudoRuleRootShell)
+	if err != nil {
+		return err
+	}
+
+	return saveEventWatermark(ctx, s.db, rootShellWatermark, maxID)
+}
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ----------------------------------------------------
+// Motor de reglas (worker + API alerts)
+// ----------------------------------------------------
+//
+// Un único worker evalúa en cada vuelta las reglas activas (internas no
+// deshabilitadas + fichero) y guarda las coincidencias nuevas en alerts. Las
+// reglas internas además replican en su tabla de siempre (ssh_alerts,
+// ssh_suspicious_logins, sudo_alerts) para que sus endpoints sigan igual.
+
+type Alert struct {
+	ID            int64             `json:"id"`
+	CreatedAt     time.Time         `json:"created_at"`
+	Rule          string            `json:"rule"`
+	RuleType      string            `json:"rule_type"`
+	Origin        string            `json:"origin"`
+	Severity      string            `json:"severity"`
+	Hostname      string            `json:"hostname"`
+	Hosts         []string          `json:"hosts"`
+	GroupValues   map[string]string `json:"group_values"`
+	Count         int               `json:"count"`
+	DistinctCount int               `json:"distinct_count,omitempty"`
+	FirstSeen     time.Time         `json:"first_seen"`
+	LastSeen      time.Time         `json:"last_seen"`
+	WindowMinutes int               `json:"window_minutes"`
+	Message       string            `json:"message"`
+	Payload       map[string]any    `json:"payload,omitempty"`
+	Status        string            `json:"status"`
+}
+
+type AlertsResponse struct {
+	WindowMinutes int       `json:"window_minutes"`
+	Limit         int       `json:"limit"`
+	GeneratedAt   time.Time `json:"generated_at"`
+	Alerts        []Alert   `json:"alerts"`
+}
+
+type AlertUpdateRequest struct {
+	Status string `json:"status"`
+}
+
+type RulesResponse struct {
+	RulesFile      string      `json:"rules_file"`
+	SigmaDir       string      `json:"sigma_dir"`
+	DisableBuiltin []string    `json:"disable_builtin"`
+	GeneratedAt    time.Time   `json:"generated_at"`
+	Rules          []*Rule     `json:"rules"`
+	SigmaSkipped   []SigmaSkip `json:"sigma_skipped"`
+}
+
+// ruleMatch es una fila de la consulta de una regla.
+type ruleMatch struct {
+	AgentIDs      []string
+	Hosts         []string
+	Count         int
+	DistinctCount int
+	FirstSeen     time.Time
+	LastSeen      time.Time
+	Payload       map[string]any
+	Group         []string
+}
+
+// activeRules son las reglas internas (con los settings vigentes) menos las
+// deshabilitadas, más las del fichero.
+func (s *Server) activeRules(st *Settings) []*Rule {
+	rs := s.coreRules.Load()
+	var out []*Rule
+	for _, r := range builtinRules(st) {
+		if rs != nil && rs.DisableBuiltin[r.Name] {
+			continue
+		}
+		out = append(out, r)
+	}
+	if rs != nil {
+		out = append(out, rs.Rules...)
+	}
+	return out
+}
+
+// reloadCoreRules vuelve a leer el fichero de reglas y sigma_dir; si el
+// fichero no es válido se mantienen las anteriores.
+func (s *Server) reloadCoreRules(cfg *CoreConfig) {
+	rs, err := loadRuleSet(cfg)
+	if err != nil {
+		log.Printf("⚠️  Reglas no recargadas, se mantienen las anteriores: %v", err)
+		return
+	}
+	s.coreRules.Store(rs)
+	log.Printf("Reglas recargadas: %d del fichero, %d Sigma (%d descartadas), %d internas deshabilitadas",
+		len(rs.Rules)-rs.SigmaRules, rs.SigmaRules, len(rs.SigmaSkipped), len(rs.DisableBuiltin))
+}
+
+func (s *Server) startRuleEngineWorker() {
+	s.startWorker("RuleEngine", func(ctx context.Context, st *Settings) error {
+		failed := 0
+		for _, rule := range s.activeRules(st) {
+			if err := s.runRule(ctx, rule); err != nil {
+				log.Printf("Error en regla %s: %v", rule.Name, err)
+				failed++
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d reglas con error", failed)
+		}
+		return nil
+	})
+}
+
+func (s *Server) runRule(ctx context.Context, rule *Rule) error {
+	query, args, err := rule.buildQuery()
+	if err != nil {
+		return err
+	}
+
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var matches []ruleMatch
+	for rows.Next() {
+		var m ruleMatch
+		var payload []byte
+		m.Group = make([]string, len(rule.GroupBy))
+		dest := []any{&m.AgentIDs, &m.Hosts, &m.Count, &m.DistinctCount, &m.FirstSeen, &m.LastSeen, &payload}
+		for i := range m.Group {
+			dest = append(dest, &m.Group[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(payload, &m.Payload); err != nil {
+			return err
+		}
+		matches = append(matches, m)
+	}
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	for _, m := range matches {
+		if err := s.raiseAlert(ctx, rule, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// raiseAlert guarda la coincidencia si no está ya alertada (y la replica en
+// la tabla antigua en la misma transacción).
+func (s *Server) raiseAlert(ctx context.Context, rule *Rule, m ruleMatch) error {
+	groupValues := map[string]string{}
+	for i, g := range rule.GroupBy {
+		groupValues[g] = m.Group[i]
+	}
+	keyBytes, err := json.Marshal(m.Group)
+	if err != nil {
+		return err
+	}
+	groupKey := string(keyBytes)
+
+	var exists bool
+	switch rule.Type {
+	case ruleTypeThreshold, ruleTypeDistinct:
+		err = s.db.QueryRow(ctx, `
+            SELECT EXISTS (
+                SELECT 1
+                FROM alerts
+                WHERE rule = $1
+                  AND group_key = $2
+                  AND created_at >= now() - ($3::int || ' minutes')::interval
+            );
+        `, rule.Name, groupKey, rule.dedupeMinutes()).Scan(&exists)
+	default:
+		err = s.db.QueryRow(ctx, `
+            SELECT EXISTS (
+                SELECT 1
+                FROM alerts
+                WHERE rule = $1
+                  AND group_key = $2
+                  AND last_seen = $3
+            );
+        `, rule.Name, groupKey, m.LastSeen).Scan(&exists)
+	}
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	var agentID *string
+	if len(m.AgentIDs) == 1 {
+		agentID = &m.AgentIDs[0]
+	}
+	hostname := strings.Join(m.Hosts, ",")
+	severity := rule.severityFor(m)
+	message := rule.renderMessage(m)
+
+	groupJSON, err := json.Marshal(groupValues)
+	if err != nil {
+		return err
+	}
+	payloadJSON, err := json.Marshal(m.Payload)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `
+        INSERT INTO alerts (
+            rule, rule_type, origin, severity, agent_id, hostname, hosts,
+            group_key, group_values, count, distinct_count,
+            first_seen, last_seen, window_minutes, message, payload, status
+        )
+        VALUES ($1, $2, $3, $4, $5::uuid, $6, $7, $8, $9::jsonb, $10, $11, $12, $13, $14, $15, $16::jsonb, 'new');
+    `, rule.Name, rule.Type, rule.Origin, severity, agentID, hostname, m.Hosts,
+		groupKey, string(groupJSON), m.Count, m.DistinctCount,
+		m.FirstSeen, m.LastSeen, rule.WindowMinutes, message, string(payloadJSON))
+	if err != nil {
+		return err
+	}
+
+	if rule.legacy != "" && agentID != nil {
+		if err := mirrorLegacyAlert(ctx, tx, rule, *agentID, hostname, groupValues, m); err != nil {
+			return fmt.Errorf("replicando en %s: %w", rule.legacy, err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	log.Printf("⚠️  Alerta %s [%s]: %s", rule.Name, severity, message)
+	return nil
+}
+
+// mirrorLegacyAlert escribe la alerta de una regla interna en su tabla de
+// siempre, con la misma deduplicación que tenían los workers antiguos.
+func mirrorLegacyAlert(ctx context.Context, tx pgx.Tx, rule *Rule, agentID, hostname string, g map[string]string, m ruleMatch) error {
+	var exists bool
+	var err error
+
+	switch rule.legacy {
+	case "ssh_alerts":
+		err = tx.QueryRow(ctx, `
+            SELECT EXISTS (
+                SELECT 1
+                FROM ssh_alerts
+                WHERE agent_id = $1
+                  AND remote_ip = $2
+                  AND created_at >= now() - ($3::int || ' minutes')::interval
+            );
+        `, agentID, g["payload.remote_ip"], rule.WindowMinutes).Scan(&exists)
+		if err != nil || exists {
+			return err
+		}
+		_, err = tx.Exec(ctx, `
+            INSERT INTO ssh_alerts (agent_id, hostname, remote_ip, failed_count, window_minutes, first_seen, last_seen, status)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, 'new');
+        `, agentID, hostname, g["payload.remote_ip"], m.Count, rule.WindowMinutes, m.FirstSeen, m.LastSeen)
+		return err
+
+	case "ssh_suspicious_logins":
+		err = tx.QueryRow(ctx, `
+            SELECT EXISTS (
+                SELECT 1
+                FROM ssh_suspicious_logins
+                WHERE agent_id = $1
+                  AND remote_ip = $2
+                  AND username = $3
+                  AND success_at = $4
+            );
+        `, agentID, g["payload.remote_ip"], g["payload.username"], m.LastSeen).Scan(&exists)
+		if err != nil || exists {
+			return err
+		}
+		_, err = tx.Exec(ctx, `
+            INSERT INTO ssh_suspicious_logins (
+                agent_id, hostname, username, remote_ip,
+                failed_count_before_success, window_minutes,
+                first_failed_at, success_at, status
+            )
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, 'new');
+        `, agentID, hostname, g["payload.username"], g["payload.remote_ip"], m.Count, rule.WindowMinutes, m.FirstSeen, m.LastSeen)
+		return err
+
+	case "sudo_alerts":
+		err = tx.QueryRow(ctx, `
+            SELECT EXISTS (
+                SELECT 1
+                FROM sudo_alerts
+                WHERE agent_id = $1
+                  AND sudo_user = $2
+                  AND target_user = $3
+                  AND command = $4
+                  AND sudo_ts = $5
+            );
+        `, agentID, g["payload.sudo_user"], g["payload.target_user"], g["payload.command"], m.LastSeen).Scan(&exists)
+		if err != nil || exists {
+			return err
+		}
+
+		// IP del último login SSH correcto en el host antes del sudo
+		var remoteIP string
+		err = tx.QueryRow(ctx, `
+            SELECT COALESCE((
+                SELECT payload->>'remote_ip'
+                FROM raw_events
+                WHERE agent_id = $1
+                  AND source = 'auth'
+                  AND event_type = 'ssh_login_success'
+                  AND ts <= $2
+                  AND payload ? 'remote_ip'
+                ORDER BY ts DESC
+                LIMIT 1
+            ), '');
+        `, agentID, m.LastSeen).Scan(&remoteIP)
+		if err != nil {
+			return err
+		}
+
+		tty, _ := m.Payload["tty"].(string)
+		pwd, _ := m.Payload["pwd"].(string)
+		_, err = tx.Exec(ctx, `
+            INSERT INTO sudo_alerts (
+                agent_id, hostname, sudo_user, target_user, remote_ip,
+                tty, pwd, command, window_minutes, sudo_ts, status
+            )
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, 'new');
+        `, agentID, hostname, g["payload.sudo_user"], g["payload.target_user"], remoteIP,
+			tty, pwd, g["payload.command"], rule.WindowMinutes, m.LastSeen)
+		return err
+	}
+	return fmt.Errorf("tabla %q desconocida", rule.legacy)
+}
+
+// renderMessage sustituye ${campo} en el mensaje de la regla.
+func (r *Rule) renderMessage(m ruleMatch) string {
+	values := map[string]string{}
+	for k, v := range m.Payload {
+		if v != nil {
+			values[k] = fmt.Sprint(v)
+		}
+	}
+	for i, g := range r.GroupBy {
+		values[fieldShortName(g)] = m.Group[i]
+	}
+	values["count"] = strconv.Itoa(m.Count)
+	values["distinct_count"] = strconv.Itoa(m.DistinctCount)
+	values["window_minutes"] = strconv.Itoa(r.WindowMinutes)
+	values["hostname"] = strings.Join(m.Hosts, ",")
+	values["hosts"] = strings.Join(m.Hosts, ", ")
+	values["rule"] = r.Name
+
+	return reMessageRef.ReplaceAllStringFunc(r.Message, func(ref string) string {
+		name := reMessageRef.FindStringSubmatch(ref)[1]
+		return values[name]
+	})
+}
+
+// ----------------------------------------------------
+// API alerts (GET + PATCH) y rules (GET)
+// ----------------------------------------------------
+
+func (s *Server) handleAlerts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.handleAlertsGET(w, r)
+	case http.MethodPatch:
+		s.handleAlertsPATCH(w, r)
+	default:
+		http.Error(w, "solo GET o PATCH", http.StatusMethodNotAllowed)
+	}
+}
+
+const alertColumns = `
+    id, created_at, rule, rule_type, origin, severity, hostname, hosts,
+    group_values, count, distinct_count, first_seen, last_seen,
+    window_minutes, message, payload, status`
+
+func scanAlert(row pgx.Row) (Alert, error) {
+	var a Alert
+	var groupValues, payload []byte
+	err := row.Scan(
+		&a.ID,
+		&a.CreatedAt,
+		&a.Rule,
+		&a.RuleType,
+		&a.Origin,
+		&a.Severity,
+		&a.Hostname,
+		&a.Hosts,
+		&groupValues,
+		&a.Count,
+		&a.DistinctCount,
+		&a.FirstSeen,
+		&a.LastSeen,
+		&a.WindowMinutes,
+		&a.Message,
+		&payload,
+		&a.Status,
+	)
+	if err != nil {
+		return a, err
+	}
+	if err := json.Unmarshal(groupValues, &a.GroupValues); err != nil {
+		return a, err
+	}
+	if err := json.Unmarshal(payload, &a.Payload); err != nil {
+		return a, err
+	}
+	if len(a.Payload) == 0 {
+		a.Payload = nil
+	}
+	return a, nil
+}
+
+func (s *Server) handleAlertsGET(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	minStr := q.Get("minutes")
+	limitStr := q.Get("limit")
+
+	windowMinutes := 60
+	if minStr != "" {
+		if v, err := strconv.Atoi(minStr); err == nil && v > 0 && v <= 10080 {
+			windowMinutes = v
+		}
+	}
+
+	limit := 50
+	if limitStr != "" {
+		if v, err := strconv.Atoi(limitStr); err == nil && v > 0 && v <= 500 {
+			limit = v
+		}
+	}
+
+	ctx := r.Context()
+	now := time.Now().UTC()
+
+	query := `SELECT` + alertColumns + `
+FROM alerts
+WHERE created_at >= now() - ($1::int || ' minutes')::interval
+`
+	args := []any{windowMinutes}
+	argPos := 2
+
+	for _, f := range []string{"rule", "status", "severity"} {
+		if v := q.Get(f); v != "" {
+			query += " AND " + f + " = $" + strconv.Itoa(argPos)
+			args = append(args, v)
+			argPos++
+		}
+	}
+	if host := q.Get("hostname"); host != "" {
+		query += " AND $" + strconv.Itoa(argPos) + " = ANY(hosts)"
+		args = append(args, host)
+		argPos++
+	}
+
+	query += " ORDER BY created_at DESC LIMIT $" + strconv.Itoa(argPos)
+	args = append(args, limit)
+
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		log.Printf("Error consultando alerts: %v", err)
+		http.Error(w, "error consultando alertas", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var alerts []Alert
+	for rows.Next() {
+		a, err := scanAlert(rows)
+		if err != nil {
+			log.Printf("Error escaneando alerta: %v", err)
+			http.Error(w, "error leyendo alertas", http.StatusInternalServerError)
+			return
+		}
+		alerts = append(alerts, a)
+	}
+	if rows.Err() != nil {
+		log.Printf("Error final en rows alerts: %v", rows.Err())
+		http.Error(w, "error leyendo alertas", http.StatusInternalServerError)
+		return
+	}
+
+	if alerts == nil {
+		alerts = []Alert{}
+	}
+
+	resp := AlertsResponse{
+		WindowMinutes: windowMinutes,
+		Limit:         limit,
+		GeneratedAt:   now,
+		Alerts:        alerts,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(resp); err != nil {
+		log.Printf("Error serializando respuesta alerts: %v", err)
+	}
+}
+
+func (s *Server) handleAlertsPATCH(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	prefix := "/api/v1/alerts/"
+	if !strings.HasPrefix(path, prefix) || len(path) <= len(prefix) {
+		http.Error(w, "ruta inválida, use /api/v1/alerts/{id}", http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(path, prefix), 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "id inválido", http.StatusBadRequest)
+		return
+	}
+
+	var req AlertUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "JSON inválido", http.StatusBadRequest)
+		return
+	}
+
+	newStatus := strings.ToLower(strings.TrimSpace(req.Status))
+	if newStatus == "" {
+		http.Error(w, "status requerido", http.StatusBadRequest)
+		return
+	}
+	if newStatus != "new" && newStatus != "ack" && newStatus != "closed" {
+		http.Error(w, "status inválido (use new, ack o closed)", http.StatusBadRequest)
+		return
+	}
+
+	a, err := scanAlert(s.db.QueryRow(r.Context(), `
+        UPDATE alerts
+        SET status = $1
+        WHERE id = $2
+        RETURNING`+alertColumns, newStatus, id))
+	if err != nil {
+		log.Printf("Error actualizando alert id=%d: %v", id, err)
+		http.Error(w, "alerta no encontrada o error al actualizar", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(a); err != nil {
+		log.Printf("Error serializando respuesta PATCH alert: %v", err)
+	}
+}
+
+func (s *Server) handleRules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "solo GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp := RulesResponse{
+		DisableBuiltin: []string{},
+		SigmaSkipped:   []SigmaSkip{},
+		GeneratedAt:    time.Now().UTC(),
+		Rules:          s.activeRules(s.settings.Load()),
+	}
+	if rs := s.coreRules.Load(); rs != nil {
+		resp.RulesFile = rs.Path
+		resp.SigmaDir = rs.SigmaDir
+		if rs.SigmaSkipped != nil {
+			resp.SigmaSkipped = rs.SigmaSkipped
+		}
+		for name := range rs.DisableBuiltin {
+			resp.DisableBuiltin = append(resp.DisableBuiltin, name)
+		}
+		sort.Strings(resp.DisableBuiltin)
+	}
+	if resp.Rules == nil {
+		resp.Rules = []*Rule{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(resp); err != nil {
+		log.Printf("Error serializando respuesta rules: %v", err)
+	}
+}
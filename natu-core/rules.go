@@ -0,0 +1,781 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ----------------------------------------------------
+// Reglas de detección declarativas
+// ----------------------------------------------------
+//
+// Cada regla se compila a una consulta SQL sobre raw_events. Tipos:
+//
+//   - match:          cada evento que cumple where es una alerta.
+//   - threshold:      count(*) >= threshold por grupo dentro de la ventana.
+//   - distinct_count: count(DISTINCT distinct_field) >= threshold por grupo
+//     (los primeros 100 valores quedan en payload.distinct_values).
+//   - sequence:       un evento "then" precedido de al menos min_count
+//     eventos "first" en within_minutes, con los campos de correlate iguales.
+//
+// threshold y distinct_count admiten min_hosts: el grupo tiene que venir de
+// al menos ese número de hosts distintos. distinct_count admite además
+// min_count (mínimo de eventos del grupo) y count_where, que limita qué
+// eventos de where cuentan en count y min_count (los demás sólo aportan
+// valores distintos).
+//
+// Los campos son source, event_type, agent_id, hostname, payload.<campo> y
+// remote_subnet (payload.remote_ip normalizada a /24 o /64).
+// Las condiciones se anidan con all / any / not; las hojas llevan field, op
+// (eq, ne, in, contains, startswith, endswith, regex, exists, gt, gte, lt,
+// lte) y value o values (cualquiera de ellos). Los valores de group_by no
+// pueden ser nulos.
+//
+// Además de las reglas internas (ssh_bruteforce, ssh_suspicious_login y
+// sudo_dangerous_command, con los umbrales de /api/v1/settings) se cargan las
+// del fichero rules_file de la configuración:
+//
+//	{
+//	  "disable_builtin": [],
+//	  "rules": [
+//	    {
+//	      "name": "ssh_user_enum",
+//	      "type": "distinct_count",
+//	      "severity": "alto",
+//	      "window_minutes": 30,
+//	      "group_by": ["payload.remote_ip"],
+//	      "distinct_field": "payload.username",
+//	      "threshold": 10,
+//	      "where": {"all": [
+//	        {"field": "source", "op": "eq", "value": "auth"},
+//	        {"field": "event_type", "op": "in", "values": ["ssh_invalid_user", "ssh_failed_login"]}
+//	      ]},
+//	      "message": "${remote_ip} probó ${distinct_count} usuarios en ${window_minutes} min"
+//	    }
+//	  ]
+//	}
+//
+// El mensaje admite ${count}, ${distinct_count}, ${window_minutes},
+// ${hostname}, ${hosts} y los campos de group_by por su último nombre
+// (payload.remote_ip -> ${remote_ip}). El fichero se valida al arrancar
+// (error fatal) y se recarga con SIGHUP (si no es válido se mantiene el
+// anterior).
+
+const defaultCoreRulesPath = "/etc/natu-core/rules.json"
+
+const (
+	ruleTypeMatch     = "match"
+	ruleTypeThreshold = "threshold"
+	ruleTypeDistinct  = "distinct_count"
+	ruleTypeSequence  = "sequence"
+
+	ruleOriginBuiltin = "builtin"
+	ruleOriginFile    = "file"
+)
+
+// Máximo de coincidencias (las más recientes) que se procesan por regla y
+// pasada
+const ruleMaxMatches = 500
+
+var reRuleName = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+var rePayloadField = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)*$`)
+var reMessageRef = regexp.MustCompile(`\$\{?([A-Za-z_][A-Za-z0-9_]*)\}?`)
+
+var ruleSeverities = []string{"bajo", "medio", "alto", "crítico"}
+
+type Rule struct {
+	Name          string         `json:"name"`
+	Description   string         `json:"description,omitempty"`
+	Type          string         `json:"type"`
+	Severity      string         `json:"severity"`
+	Escalation    []SeverityStep `json:"escalation,omitempty"`
+	WindowMinutes int            `json:"window_minutes"`
+	// Sin alertas repetidas del mismo grupo en este tiempo (por defecto la
+	// ventana); match y sequence deduplican por evento
+	DedupeMinutes int        `json:"dedupe_minutes,omitempty"`
+	GroupBy       []string   `json:"group_by,omitempty"`
+	Where         *Condition `json:"where,omitempty"`
+	Threshold     int        `json:"threshold,omitempty"`
+	MinHosts      int        `json:"min_hosts,omitempty"`
+	// Mínimo de eventos en distinct_count
+	MinCount int `json:"min_count,omitempty"`
+	// Eventos que cuentan en count en distinct_count (por defecto todos)
+	CountWhere    *Condition    `json:"count_where,omitempty"`
+	DistinctField string        `json:"distinct_field,omitempty"`
+	Sequence      *SequenceSpec `json:"sequence,omitempty"`
+	Message       string        `json:"message"`
+	Tags          []string      `json:"tags,omitempty"`
+
+	// builtin | file | sigma
+	Origin string `json:"origin"`
+	// Tabla antigua donde se replica la alerta (sólo reglas internas)
+	legacy string
+}
+
+// SeverityStep sube la severidad cuando el recuento (valores distintos en
+// distinct_count) llega a MinCount.
+type SeverityStep struct {
+	MinCount int    `json:"min_count"`
+	Severity string `json:"severity"`
+}
+
+type SequenceSpec struct {
+	First         *Condition `json:"first"`
+	Then          *Condition `json:"then"`
+	WithinMinutes int        `json:"within_minutes"`
+	MinCount      int        `json:"min_count"`
+	Correlate     []string   `json:"correlate"`
+}
+
+type Condition struct {
+	All []*Condition `json:"all,omitempty"`
+	Any []*Condition `json:"any,omitempty"`
+	Not *Condition   `json:"not,omitempty"`
+
+	Field      string   `json:"field,omitempty"`
+	Op         string   `json:"op,omitempty"`
+	Value      string   `json:"value,omitempty"`
+	Values     []string `json:"values,omitempty"`
+	IgnoreCase bool     `json:"ignore_case,omitempty"`
+}
+
+type CoreRulesFile struct {
+	DisableBuiltin []string `json:"disable_builtin"`
+	Rules          []*Rule  `json:"rules"`
+}
+
+// CoreRuleSet son las reglas cargadas del fichero y de sigma_dir.
+type CoreRuleSet struct {
+	Path           string
+	DisableBuiltin map[string]bool
+	Rules          []*Rule
+	SigmaDir       string
+	SigmaRules     int
+	SigmaSkipped   []SigmaSkip
+}
+
+// loadRuleSet carga el fichero de reglas (cualquier error es fatal) y añade
+// las reglas Sigma que se pueden traducir.
+func loadRuleSet(cfg *CoreConfig) (*CoreRuleSet, error) {
+	rs, err := LoadCoreRules(cfg.RulesFile)
+	if err != nil {
+		return nil, err
+	}
+
+	taken := builtinRuleNames()
+	for _, r := range rs.Rules {
+		taken[r.Name] = true
+	}
+
+	sigma, skipped, err := LoadSigmaRules(cfg.SigmaDir, taken)
+	if err != nil {
+		return nil, err
+	}
+	for _, sk := range skipped {
+		log.Printf("⚠️  Regla Sigma %s descartada: %s", sk.File, strings.Join(sk.Problems, "; "))
+	}
+	rs.SigmaDir = cfg.SigmaDir
+	rs.SigmaRules = len(sigma)
+	rs.SigmaSkipped = skipped
+	rs.Rules = append(rs.Rules, sigma...)
+	return rs, nil
+}
+
+// LoadCoreRules lee y valida el fichero de reglas. Que no exista no es un
+// error: quedan sólo las reglas internas.
+func LoadCoreRules(path string) (*CoreRuleSet, error) {
+	rs := &CoreRuleSet{Path: path, DisableBuiltin: map[string]bool{}}
+	if path == "" {
+		return rs, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return rs, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("leyendo reglas %s: %w", path, err)
+	}
+
+	var rf CoreRulesFile
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&rf); err != nil {
+		return nil, fmt.Errorf("reglas %s: JSON inválido: %w", path, err)
+	}
+
+	builtin := builtinRuleNames()
+
+	var problems []string
+	for _, name := range rf.DisableBuiltin {
+		if !builtin[name] {
+			problems = append(problems, fmt.Sprintf("disable_builtin: %q no es una regla interna", name))
+		}
+		rs.DisableBuiltin[name] = true
+	}
+
+	names := map[string]bool{}
+	for i, r := range rf.Rules {
+		if r == nil {
+			problems = append(problems, fmt.Sprintf("regla #%d vacía", i+1))
+			continue
+		}
+		label := fmt.Sprintf("regla #%d", i+1)
+		if r.Name != "" {
+			label = fmt.Sprintf("regla #%d (%s)", i+1, r.Name)
+		}
+		r.Origin = ruleOriginFile
+		for _, p := range r.validate() {
+			problems = append(problems, label+": "+p)
+		}
+		if builtin[r.Name] {
+			problems = append(problems, label+": el nombre coincide con una regla interna (use disable_builtin)")
+		}
+		if names[r.Name] {
+			problems = append(problems, label+": nombre repetido")
+		}
+		names[r.Name] = true
+		rs.Rules = append(rs.Rules, r)
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("reglas %s inválidas:\n  %s", path, strings.Join(problems, "\n  "))
+	}
+	return rs, nil
+}
+
+func (r *Rule) validate() []string {
+	var problems []string
+
+	if !reRuleName.MatchString(r.Name) {
+		problems = append(problems, fmt.Sprintf("name %q inválido (minúsculas, dígitos y _)", r.Name))
+	}
+	if !validSeverity(r.Severity) {
+		problems = append(problems, fmt.Sprintf("severity %q inválida (use %s)", r.Severity, strings.Join(ruleSeverities, ", ")))
+	}
+	for _, st := range r.Escalation {
+		if st.MinCount < 1 || !validSeverity(st.Severity) {
+			problems = append(problems, fmt.Sprintf("escalation: paso {%d, %q} inválido", st.MinCount, st.Severity))
+		}
+	}
+	if r.WindowMinutes < 1 || r.WindowMinutes > 10080 {
+		problems = append(problems, "window_minutes fuera de rango (1-10080)")
+	}
+	if r.MinHosts < 0 || (r.MinHosts > 0 && r.Type != ruleTypeThreshold && r.Type != ruleTypeDistinct) {
+		problems = append(problems, "min_hosts sólo vale en threshold y distinct_count (>= 0)")
+	}
+	if r.MinCount < 0 || (r.MinCount > 0 && r.Type != ruleTypeDistinct) {
+		problems = append(problems, "min_count sólo vale en distinct_count (>= 0)")
+	}
+	if r.CountWhere != nil && r.Type != ruleTypeDistinct {
+		problems = append(problems, "count_where sólo vale en distinct_count")
+	}
+	if r.DedupeMinutes < 0 || r.DedupeMinutes > 10080 {
+		problems = append(problems, "dedupe_minutes fuera de rango (0-10080)")
+	}
+	if strings.TrimSpace(r.Message) == "" {
+		problems = append(problems, "falta message")
+	}
+
+	switch r.Type {
+	case ruleTypeMatch:
+		if r.Where == nil {
+			problems = append(problems, "match necesita where")
+		}
+	case ruleTypeThreshold, ruleTypeDistinct:
+		if r.Where == nil {
+			problems = append(problems, r.Type+" necesita where")
+		}
+		if r.Threshold < 1 {
+			problems = append(problems, "threshold debe ser >= 1")
+		}
+		if r.Type == ruleTypeDistinct && r.DistinctField == "" {
+			problems = append(problems, "distinct_count necesita distinct_field")
+		}
+	case ruleTypeSequence:
+		if r.Where != nil {
+			problems = append(problems, "sequence no usa where (use sequence.first y sequence.then)")
+		}
+		if r.Sequence == nil || r.Sequence.First == nil || r.Sequence.Then == nil {
+			problems = append(problems, "sequence necesita sequence.first y sequence.then")
+		} else {
+			if r.Sequence.WithinMinutes < 1 || r.Sequence.WithinMinutes > 10080 {
+				problems = append(problems, "sequence.within_minutes fuera de rango (1-10080)")
+			}
+			if r.Sequence.MinCount < 1 {
+				problems = append(problems, "sequence.min_count debe ser >= 1")
+			}
+			for _, f := range r.Sequence.Correlate {
+				if f == "hostname" {
+					problems = append(problems, "sequence.correlate: use agent_id en lugar de hostname")
+				}
+			}
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("type %q inválido (use match, threshold, distinct_count o sequence)", r.Type))
+	}
+
+	for _, m := range reMessageRef.FindAllStringSubmatch(r.Message, -1) {
+		if !r.knowsMessageField(m[1]) {
+			problems = append(problems, fmt.Sprintf("message: ${%s} no es un campo de la regla", m[1]))
+		}
+	}
+
+	// Si la regla está bien formada, que compile
+	if len(problems) == 0 {
+		if _, _, err := r.buildQuery(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	return problems
+}
+
+func validSeverity(s string) bool {
+	for _, v := range ruleSeverities {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) knowsMessageField(name string) bool {
+	switch name {
+	case "count", "distinct_count", "window_minutes", "hostname", "hosts", "rule":
+		return true
+	}
+	for _, g := range r.GroupBy {
+		if fieldShortName(g) == name {
+			return true
+		}
+	}
+	// match y sequence tienen el payload del evento
+	return r.Type == ruleTypeMatch || r.Type == ruleTypeSequence
+}
+
+// fieldShortName: payload.remote_ip -> remote_ip
+func fieldShortName(f string) string {
+	if i := strings.LastIndex(f, "."); i >= 0 {
+		return f[i+1:]
+	}
+	return f
+}
+
+// severityFor aplica la escalada a la coincidencia.
+func (r *Rule) severityFor(m ruleMatch) string {
+	count := m.Count
+	if r.Type == ruleTypeDistinct {
+		count = m.DistinctCount
+	}
+	sev := r.Severity
+	best := 0
+	for _, st := range r.Escalation {
+		if count >= st.MinCount && st.MinCount > best {
+			sev = st.Severity
+			best = st.MinCount
+		}
+	}
+	return sev
+}
+
+func (r *Rule) dedupeMinutes() int {
+	if r.DedupeMinutes > 0 {
+		return r.DedupeMinutes
+	}
+	return r.WindowMinutes
+}
+
+// ----------------------------------------------------
+// Compilación a SQL
+// ----------------------------------------------------
+
+type sqlArgs struct {
+	args []any
+}
+
+func (a *sqlArgs) add(v any) string {
+	a.args = append(a.args, v)
+	return "$" + strconv.Itoa(len(a.args))
+}
+
+// fieldSQL traduce un campo a su expresión (texto) sobre el alias de
+// raw_events. hostname sale de agents: "a" para el evento principal.
+func fieldSQL(alias, field string) (string, error) {
+	switch field {
+	case "source", "event_type":
+		return alias + "." + field, nil
+	case "agent_id":
+		return alias + ".agent_id::text", nil
+	case "remote_subnet":
+		return "natu_subnet(" + alias + ".payload->>'remote_ip')", nil
+	case "hostname":
+		if alias == "e" || alias == "b" {
+			return "a.hostname", nil
+		}
+		return "(SELECT hostname FROM agents WHERE id = " + alias + ".agent_id)", nil
+	}
+
+	path, ok := strings.CutPrefix(field, "payload.")
+	if !ok || !rePayloadField.MatchString(path) {
+		return "", fmt.Errorf("campo %q inválido (use source, event_type, agent_id, hostname o payload.<campo>)", field)
+	}
+	parts := strings.Split(path, ".")
+	if len(parts) == 1 {
+		return alias + ".payload->>'" + path + "'", nil
+	}
+	return alias + ".payload#>>'{" + strings.Join(parts, ",") + "}'", nil
+}
+
+const numericGuard = `'^-?[0-9]+(\.[0-9]+)?$'`
+
+func (c *Condition) sql(alias string, a *sqlArgs) (string, error) {
+	if c == nil {
+		return "", fmt.Errorf("condición vacía")
+	}
+
+	branches := 0
+	for _, set := range []bool{len(c.All) > 0, len(c.Any) > 0, c.Not != nil, c.Field != ""} {
+		if set {
+			branches++
+		}
+	}
+	if branches != 1 {
+		return "", fmt.Errorf("cada condición lleva exactamente uno de all, any, not o field")
+	}
+
+	join := func(list []*Condition, sep string) (string, error) {
+		parts := make([]string, 0, len(list))
+		for _, sub := range list {
+			s, err := sub.sql(alias, a)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, s)
+		}
+		return "(" + strings.Join(parts, sep) + ")", nil
+	}
+
+	switch {
+	case len(c.All) > 0:
+		return join(c.All, " AND ")
+	case len(c.Any) > 0:
+		return join(c.Any, " OR ")
+	case c.Not != nil:
+		s, err := c.Not.sql(alias, a)
+		if err != nil {
+			return "", err
+		}
+		return "(NOT COALESCE(" + s + ", false))", nil
+	}
+
+	x, err := fieldSQL(alias, c.Field)
+	if err != nil {
+		return "", err
+	}
+
+	values := c.Values
+	if c.Value != "" {
+		values = append([]string{c.Value}, values...)
+	}
+
+	if c.Op == "exists" {
+		if len(values) > 0 {
+			return "", fmt.Errorf("%s: exists no lleva valores", c.Field)
+		}
+		return "(" + x + " IS NOT NULL)", nil
+	}
+	if len(values) == 0 {
+		return "", fmt.Errorf("%s: %s necesita value o values", c.Field, c.Op)
+	}
+
+	lower := func(s string) string {
+		if c.IgnoreCase {
+			return "lower(" + s + ")"
+		}
+		return s
+	}
+
+	var parts []string
+	switch c.Op {
+	case "eq", "ne", "in":
+		arr := a.add(values)
+		expr := lower(x) + " = ANY(" + arr + "::text[])"
+		if c.IgnoreCase {
+			expr = lower(x) + " = ANY(SELECT lower(v) FROM unnest(" + arr + "::text[]) v)"
+		}
+		if c.Op == "ne" {
+			return "(" + x + " IS NULL OR NOT (" + expr + "))", nil
+		}
+		return "(" + expr + ")", nil
+
+	case "contains", "startswith", "endswith":
+		for _, v := range values {
+			p := lower(a.add(v) + "::text")
+			switch c.Op {
+			case "contains":
+				parts = append(parts, "strpos("+lower(x)+", "+p+") > 0")
+			case "startswith":
+				parts = append(parts, "starts_with("+lower(x)+", "+p+")")
+			case "endswith":
+				parts = append(parts, "right("+lower(x)+", char_length("+p+")) = "+p)
+			}
+		}
+
+	case "regex":
+		op := " ~ "
+		if c.IgnoreCase {
+			op = " ~* "
+		}
+		for _, v := range values {
+			if _, err := regexp.Compile(v); err != nil {
+				return "", fmt.Errorf("%s: regex %q inválida: %v", c.Field, v, err)
+			}
+			parts = append(parts, x+op+a.add(v)+"::text")
+		}
+
+	case "gt", "gte", "lt", "lte":
+		cmp := map[string]string{"gt": ">", "gte": ">=", "lt": "<", "lte": "<="}[c.Op]
+		for _, v := range values {
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return "", fmt.Errorf("%s: %s necesita un número, no %q", c.Field, c.Op, v)
+			}
+			parts = append(parts, "(CASE WHEN "+x+" ~ "+numericGuard+" THEN ("+x+")::numeric END) "+cmp+" "+a.add(n)+"::numeric")
+		}
+
+	default:
+		return "", fmt.Errorf("%s: op %q desconocido", c.Field, c.Op)
+	}
+
+	return "(" + strings.Join(parts, " OR ") + ")", nil
+}
+
+// buildQuery compila la regla. Columnas: agent_ids, hosts, count,
+// distinct_count, first_seen, last_seen, payload y un valor por group_by.
+func (r *Rule) buildQuery() (string, []any, error) {
+	a := &sqlArgs{}
+	window := a.add(r.WindowMinutes)
+
+	main := "e"
+	if r.Type == ruleTypeSequence {
+		main = "b"
+	}
+
+	var groupCols, notNull []string
+	for _, g := range r.GroupBy {
+		x, err := fieldSQL(main, g)
+		if err != nil {
+			return "", nil, fmt.Errorf("group_by: %w", err)
+		}
+		groupCols = append(groupCols, x)
+		notNull = append(notNull, x+" IS NOT NULL")
+	}
+
+	groupSelect := ""
+	for _, g := range groupCols {
+		groupSelect += ",\n            " + g
+	}
+	notNullSQL := ""
+	for _, n := range notNull {
+		notNullSQL += "\n          AND " + n
+	}
+
+	switch r.Type {
+	case ruleTypeMatch:
+		where, err := r.Where.sql("e", a)
+		if err != nil {
+			return "", nil, fmt.Errorf("where: %w", err)
+		}
+		q := `
+        SELECT ARRAY[e.agent_id::text], ARRAY[a.hostname], 1, 0, e.ts, e.ts, e.payload` + groupSelect + `
+        FROM raw_events e
+        JOIN agents a ON a.id = e.agent_id
+        WHERE e.ts >= now() - (` + window + `::int || ' minutes')::interval
+          AND ` + where + notNullSQL + `
+        ORDER BY e.ts DESC
+        LIMIT ` + strconv.Itoa(ruleMaxMatches)
+		return q, a.args, nil
+
+	case ruleTypeThreshold, ruleTypeDistinct:
+		where, err := r.Where.sql("e", a)
+		if err != nil {
+			return "", nil, fmt.Errorf("where: %w", err)
+		}
+		distinct := "0"
+		count := "count(*)"
+		if r.CountWhere != nil {
+			cw, err := r.CountWhere.sql("e", a)
+			if err != nil {
+				return "", nil, fmt.Errorf("count_where: %w", err)
+			}
+			count = "count(*) FILTER (WHERE " + cw + ")"
+		}
+		having := count
+		payload := "'{}'::jsonb"
+		if r.Type == ruleTypeDistinct {
+			df, err := fieldSQL("e", r.DistinctField)
+			if err != nil {
+				return "", nil, fmt.Errorf("distinct_field: %w", err)
+			}
+			distinct = "count(DISTINCT " + df + ")::int"
+			having = "count(DISTINCT " + df + ")"
+			payload = "jsonb_build_object('distinct_values', (array_agg(DISTINCT " + df + "))[1:100])"
+		}
+		groupBy := ""
+		if len(groupCols) > 0 {
+			pos := make([]string, len(groupCols))
+			for i := range groupCols {
+				pos[i] = strconv.Itoa(8 + i)
+			}
+			groupBy = "\n        GROUP BY " + strings.Join(pos, ", ")
+		}
+		extraHaving := ""
+		if r.MinHosts > 0 {
+			extraHaving = "\n           AND count(DISTINCT e.agent_id) >= " + a.add(r.MinHosts)
+		}
+		if r.MinCount > 0 {
+			extraHaving += "\n           AND " + count + " >= " + a.add(r.MinCount)
+		}
+		q := `
+        SELECT array_agg(DISTINCT e.agent_id::text), array_agg(DISTINCT a.hostname),
+               ` + count + `::int, ` + distinct + `, min(e.ts), max(e.ts), ` + payload + groupSelect + `
+        FROM raw_events e
+        JOIN agents a ON a.id = e.agent_id
+        WHERE e.ts >= now() - (` + window + `::int || ' minutes')::interval
+          AND ` + where + notNullSQL + groupBy + `
+        HAVING ` + having + ` >= ` + a.add(r.Threshold) + extraHaving + `
+        ORDER BY 3 DESC
+        LIMIT ` + strconv.Itoa(ruleMaxMatches)
+		return q, a.args, nil
+
+	case ruleTypeSequence:
+		seq := r.Sequence
+		then, err := seq.Then.sql("b", a)
+		if err != nil {
+			return "", nil, fmt.Errorf("sequence.then: %w", err)
+		}
+		first, err := seq.First.sql("f", a)
+		if err != nil {
+			return "", nil, fmt.Errorf("sequence.first: %w", err)
+		}
+		within := a.add(seq.WithinMinutes)
+
+		correlate := ""
+		for _, c := range seq.Correlate {
+			if c == "agent_id" {
+				correlate += "\n            AND f.agent_id = b.agent_id"
+				continue
+			}
+			fx, err := fieldSQL("f", c)
+			if err != nil {
+				return "", nil, fmt.Errorf("sequence.correlate: %w", err)
+			}
+			bx, _ := fieldSQL("b", c)
+			correlate += "\n            AND " + fx + " = " + bx
+		}
+
+		q := `
+        SELECT ARRAY[b.agent_id::text], ARRAY[a.hostname], count(*)::int, 0, min(f.ts), b.ts, b.payload` + groupSelect + `
+        FROM raw_events b
+        JOIN agents a ON a.id = b.agent_id
+        JOIN raw_events f ON f.ts BETWEEN b.ts - (` + within + `::int || ' minutes')::interval AND b.ts` + correlate + `
+            AND ` + first + `
+        WHERE b.ts >= now() - (` + window + `::int || ' minutes')::interval
+          AND ` + then + notNullSQL + `
+        GROUP BY b.id, a.hostname
+        HAVING count(*) >= ` + a.add(seq.MinCount) + `
+        ORDER BY b.ts DESC
+        LIMIT ` + strconv.Itoa(ruleMaxMatches)
+		return q, a.args, nil
+	}
+	return "", nil, fmt.Errorf("type %q inválido", r.Type)
+}
+
+// ----------------------------------------------------
+// Reglas internas
+// ----------------------------------------------------
+
+func fieldEq(field, value string) *Condition {
+	return &Condition{Field: field, Op: "eq", Value: value}
+}
+
+// builtinRuleNames son los nombres reservados: las reglas internas y las
+// alertas de los detectores propios (low-and-slow), que también se pueden
+// desactivar con disable_builtin.
+func builtinRuleNames() map[string]bool {
+	names := map[string]bool{}
+	for _, r := range builtinRules(&defaultCoreConfig().Settings) {
+		names[r.Name] = true
+	}
+	for _, name := range lowSlowRuleNames {
+		names[name] = true
+	}
+	return names
+}
+
+// builtinRules son las detecciones de siempre, con los umbrales vigentes.
+// Sus alertas se replican en ssh_alerts, ssh_suspicious_logins y sudo_alerts.
+func builtinRules(st *Settings) []*Rule {
+	failed := &Condition{All: []*Condition{fieldEq("source", "auth"), fieldEq("event_type", "ssh_failed_login")}}
+
+	rules := []*Rule{
+		{
+			Name:        "ssh_bruteforce",
+			Description: "Muchos fallos SSH desde la misma IP contra un host",
+			Type:        ruleTypeThreshold,
+			Severity:    "medio",
+			Escalation: []SeverityStep{
+				{MinCount: 10, Severity: "alto"},
+				{MinCount: 20, Severity: "crítico"},
+			},
+			WindowMinutes: st.SSHAlert.WindowMinutes,
+			GroupBy:       []string{"agent_id", "payload.remote_ip"},
+			Where:         failed,
+			Threshold:     st.SSHAlert.FailedThreshold,
+			Message:       "Multiples fallos SSH (${count} intentos en ${window_minutes} min) desde ${remote_ip}",
+			Origin:        ruleOriginBuiltin,
+			legacy:        "ssh_alerts",
+		},
+		{
+			Name:          "ssh_suspicious_login",
+			Description:   "Login SSH correcto tras varios fallos desde la misma IP",
+			Type:          ruleTypeSequence,
+			Severity:      "alto",
+			WindowMinutes: st.Suspicious.WindowMinutes,
+			GroupBy:       []string{"agent_id", "payload.username", "payload.remote_ip"},
+			Sequence: &SequenceSpec{
+				First:         failed,
+				Then:          &Condition{All: []*Condition{fieldEq("source", "auth"), fieldEq("event_type", "ssh_login_success")}},
+				WithinMinutes: st.Suspicious.WindowMinutes,
+				MinCount:      st.Suspicious.FailedBeforeSuccess,
+				Correlate:     []string{"agent_id", "payload.remote_ip"},
+			},
+			Message: "Login SSH de ${username} desde ${remote_ip} tras ${count} fallos",
+			Origin:  ruleOriginBuiltin,
+			legacy:  "ssh_suspicious_logins",
+		},
+		{
+			Name:          "sudo_dangerous_command",
+			Description:   "sudo con un comando de la lista de peligrosos",
+			Type:          ruleTypeMatch,
+			Severity:      "alto",
+			WindowMinutes: st.SudoAlert.WindowMinutes,
+			GroupBy:       []string{"agent_id", "payload.sudo_user", "payload.target_user", "payload.command"},
+			Where: &Condition{All: []*Condition{
+				fieldEq("source", "auth"),
+				fieldEq("event_type", "sudo_command"),
+				{Field: "payload.command", Op: "contains", Values: sudoDangerousSubstrings, IgnoreCase: true},
+			}},
+			Message: "sudo peligroso de ${sudo_user} como ${target_user}: ${command}",
+			Origin:  ruleOriginBuiltin,
+			legacy:  "sudo_alerts",
+		},
+	}
+	rules = append(rules, passwordSprayRules(st)...)
+	return append(rules, distributedBruteforceRules(st)...)
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestConditionSQL(t *testing.T) {
+	tests := []struct {
+		name  string
+		alias string
+		cond  *Condition
+		want  string
+		args  []any
+		err   string
+	}{
+		{
+			name: "eq",
+			cond: fieldEq("event_type", "ssh_failed_login"),
+			want: `(e.event_type = ANY($1::text[]))`,
+			args: []any{[]string{"ssh_failed_login"}},
+		},
+		{
+			name: "in con value y values",
+			cond: &Condition{Field: "payload.username", Op: "in", Value: "root", Values: []string{"admin"}},
+			want: `(e.payload->>'username' = ANY($1::text[]))`,
+			args: []any{[]string{"root", "admin"}},
+		},
+		{
+			name: "eq sin mayúsculas",
+			cond: &Condition{Field: "payload.username", Op: "eq", Value: "Root", IgnoreCase: true},
+			want: `(lower(e.payload->>'username') = ANY(SELECT lower(v) FROM unnest($1::text[]) v))`,
+			args: []any{[]string{"Root"}},
+		},
+		{
+			name: "ne acepta el campo ausente",
+			cond: &Condition{Field: "payload.tty", Op: "ne", Value: "unknown"},
+			want: `(e.payload->>'tty' IS NULL OR NOT (e.payload->>'tty' = ANY($1::text[])))`,
+			args: []any{[]string{"unknown"}},
+		},
+		{
+			name: "contains con varios valores es OR",
+			cond: &Condition{Field: "payload.command", Op: "contains", Values: []string{"curl", "wget"}},
+			want: `(strpos(e.payload->>'command', $1::text) > 0 OR strpos(e.payload->>'command', $2::text) > 0)`,
+			args: []any{"curl", "wget"},
+		},
+		{
+			name: "startswith sin mayúsculas",
+			cond: &Condition{Field: "payload.command", Op: "startswith", Value: "/tmp/", IgnoreCase: true},
+			want: `(starts_with(lower(e.payload->>'command'), lower($1::text)))`,
+			args: []any{"/tmp/"},
+		},
+		{
+			name: "endswith",
+			cond: &Condition{Field: "payload.command", Op: "endswith", Value: ".sh"},
+			want: `(right(e.payload->>'command', char_length($1::text)) = $1::text)`,
+			args: []any{".sh"},
+		},
+		{
+			name: "regex sin mayúsculas",
+			cond: &Condition{Field: "payload.username", Op: "regex", Value: "^adm", IgnoreCase: true},
+			want: `(e.payload->>'username' ~* $1::text)`,
+			args: []any{"^adm"},
+		},
+		{
+			name: "gte numérico",
+			cond: &Condition{Field: "payload.attempts", Op: "gte", Value: "3"},
+			want: `((CASE WHEN e.payload->>'attempts' ~ ` + numericGuard + ` THEN (e.payload->>'attempts')::numeric END) >= $1::numeric)`,
+			args: []any{3.0},
+		},
+		{
+			name: "exists en un campo anidado",
+			cond: &Condition{Field: "payload.geo.country", Op: "exists"},
+			want: `(e.payload#>>'{geo,country}' IS NOT NULL)`,
+		},
+		{
+			name: "remote_subnet",
+			cond: fieldEq("remote_subnet", "203.0.113.0/24"),
+			want: `(natu_subnet(e.payload->>'remote_ip') = ANY($1::text[]))`,
+			args: []any{[]string{"203.0.113.0/24"}},
+		},
+		{
+			name:  "hostname fuera del evento principal",
+			alias: "f",
+			cond:  fieldEq("hostname", "isov3"),
+			want:  `((SELECT hostname FROM agents WHERE id = f.agent_id) = ANY($1::text[]))`,
+			args:  []any{[]string{"isov3"}},
+		},
+		{
+			name: "all, any y not",
+			cond: &Condition{All: []*Condition{
+				fieldEq("source", "auth"),
+				{Any: []*Condition{fieldEq("hostname", "a"), fieldEq("hostname", "b")}},
+				{Not: &Condition{Field: "payload.tty", Op: "exists"}},
+			}},
+			want: `((e.source = ANY($1::text[])) AND ((a.hostname = ANY($2::text[])) OR (a.hostname = ANY($3::text[]))) AND (NOT COALESCE((e.payload->>'tty' IS NOT NULL), false)))`,
+			args: []any{[]string{"auth"}, []string{"a"}, []string{"b"}},
+		},
+		{name: "campo sin payload.", cond: fieldEq("username", "root"), err: `campo "username" inválido`},
+		{name: "campo con caracteres raros", cond: fieldEq("payload.user'name", "x"), err: "inválido"},
+		{name: "regex inválida", cond: &Condition{Field: "payload.username", Op: "regex", Value: "("}, err: "regex"},
+		{name: "comparación no numérica", cond: &Condition{Field: "payload.attempts", Op: "gt", Value: "tres"}, err: "necesita un número"},
+		{name: "op desconocido", cond: &Condition{Field: "payload.username", Op: "like", Value: "x"}, err: `op "like" desconocido`},
+		{name: "exists con valor", cond: &Condition{Field: "payload.tty", Op: "exists", Value: "x"}, err: "no lleva valores"},
+		{name: "eq sin valor", cond: &Condition{Field: "payload.tty", Op: "eq"}, err: "necesita value"},
+		{name: "dos ramas a la vez", cond: &Condition{Field: "source", Op: "eq", Value: "auth", Not: fieldEq("source", "x")}, err: "exactamente uno"},
+		{name: "all con hijo vacío", cond: &Condition{All: []*Condition{{}}}, err: "exactamente uno"},
+	}
+
+	for _, tt := range tests {
+		alias := tt.alias
+		if alias == "" {
+			alias = "e"
+		}
+		a := &sqlArgs{}
+		got, err := tt.cond.sql(alias, a)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error = %v, se esperaba %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: error inesperado: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s:\n got  %s\n want %s", tt.name, got, tt.want)
+		}
+		if !reflect.DeepEqual(a.args, tt.args) {
+			t.Errorf("%s: args = %#v, se esperaba %#v", tt.name, a.args, tt.args)
+		}
+	}
+}
+
+var rePlaceholder = regexp.MustCompile(`\$(\d+)`)
+
+// checkPlaceholders comprueba que la consulta usa exactamente los args.
+func checkPlaceholders(t *testing.T, name, q string, args []any) {
+	t.Helper()
+	used := map[int]bool{}
+	for _, m := range rePlaceholder.FindAllStringSubmatch(q, -1) {
+		n, _ := strconv.Atoi(m[1])
+		used[n] = true
+	}
+	for i := 1; i <= len(args); i++ {
+		if !used[i] {
+			t.Errorf("%s: $%d no se usa en la consulta", name, i)
+		}
+	}
+	if len(used) != len(args) {
+		t.Errorf("%s: %d placeholders distintos para %d args", name, len(used), len(args))
+	}
+}
+
+func TestBuiltinRulesCompile(t *testing.T) {
+	rules := builtinRules(&defaultCoreConfig().Settings)
+	for _, r := range rules {
+		if problems := r.validate(); len(problems) > 0 {
+			t.Errorf("%s: %v", r.Name, problems)
+			continue
+		}
+		q, args, err := r.buildQuery()
+		if err != nil {
+			t.Errorf("%s: %v", r.Name, err)
+			continue
+		}
+		checkPlaceholders(t, r.Name, q, args)
+	}
+
+	// El recuento del password spray sólo mira ssh_failed_login
+	for _, r := range rules {
+		if r.Name != "ssh_password_spray" {
+			continue
+		}
+		q, _, _ := r.buildQuery()
+		if !strings.Contains(q, "count(*) FILTER (WHERE (e.event_type = ANY(") || !strings.Contains(q, "count(DISTINCT e.payload->>'username')") {
+			t.Errorf("ssh_password_spray:\n%s", q)
+		}
+	}
+}
+
+func TestRuleValidate(t *testing.T) {
+	base := func() *Rule {
+		return &Rule{
+			Name:          "test_rule",
+			Type:          ruleTypeThreshold,
+			Severity:      "alto",
+			WindowMinutes: 10,
+			GroupBy:       []string{"agent_id", "payload.remote_ip"},
+			Where:         fieldEq("event_type", "ssh_failed_login"),
+			Threshold:     5,
+			Message:       "${count} fallos desde ${remote_ip} en ${hostname}",
+		}
+	}
+
+	tests := []struct {
+		name   string
+		modify func(r *Rule)
+		want   string
+		err    string
+	}{
+		{
+			name:   "threshold",
+			modify: func(r *Rule) {},
+			want:   "HAVING count(*) >= $",
+		},
+		{
+			name: "distinct_count con min_hosts, min_count y count_where",
+			modify: func(r *Rule) {
+				r.Type = ruleTypeDistinct
+				r.DistinctField = "payload.username"
+				r.MinHosts = 2
+				r.MinCount = 10
+				r.CountWhere = fieldEq("payload.auth_method", "password")
+				r.Message = "${distinct_count} usuarios"
+			},
+			want: "AND count(*) FILTER (WHERE (e.payload->>'auth_method' = ANY(",
+		},
+		{
+			name: "sequence",
+			modify: func(r *Rule) {
+				r.Type = ruleTypeSequence
+				r.Where = nil
+				r.Sequence = &SequenceSpec{
+					First:         fieldEq("event_type", "ssh_failed_login"),
+					Then:          fieldEq("event_type", "ssh_login_success"),
+					WithinMinutes: 15,
+					MinCount:      3,
+					Correlate:     []string{"agent_id", "payload.remote_ip"},
+				}
+			},
+			want: "AND f.payload->>'remote_ip' = b.payload->>'remote_ip'",
+		},
+		{name: "nombre inválido", modify: func(r *Rule) { r.Name = "Test-Rule" }, err: "inválido"},
+		{name: "severidad inválida", modify: func(r *Rule) { r.Severity = "high" }, err: "severity"},
+		{name: "campo de message desconocido", modify: func(r *Rule) { r.Message = "${foo}" }, err: "${foo} no es un campo"},
+		{name: "group_by inválido", modify: func(r *Rule) { r.GroupBy = []string{"ip"}; r.Message = "${count} fallos" }, err: "group_by:"},
+		{name: "where que no compila", modify: func(r *Rule) { r.Where = &Condition{Field: "payload.x", Op: "regex", Value: "["} }, err: "where:"},
+		{name: "min_count fuera de distinct_count", modify: func(r *Rule) { r.MinCount = 3 }, err: "min_count sólo vale"},
+		{name: "count_where fuera de distinct_count", modify: func(r *Rule) { r.CountWhere = fieldEq("source", "auth") }, err: "count_where sólo vale"},
+		{
+			name: "count_where que no compila",
+			modify: func(r *Rule) {
+				r.Type = ruleTypeDistinct
+				r.DistinctField = "payload.username"
+				r.CountWhere = fieldEq("user", "x")
+			},
+			err: "count_where:",
+		},
+		{name: "distinct_count sin distinct_field", modify: func(r *Rule) { r.Type = ruleTypeDistinct }, err: "necesita distinct_field"},
+		{name: "sequence con where", modify: func(r *Rule) { r.Type = ruleTypeSequence }, err: "sequence no usa where"},
+		{name: "tipo desconocido", modify: func(r *Rule) { r.Type = "count" }, err: `type "count" inválido`},
+	}
+
+	for _, tt := range tests {
+		r := base()
+		tt.modify(r)
+		problems := r.validate()
+		if tt.err != "" {
+			if !strings.Contains(strings.Join(problems, "; "), tt.err) {
+				t.Errorf("%s: problemas = %v, se esperaba %q", tt.name, problems, tt.err)
+			}
+			continue
+		}
+		if len(problems) > 0 {
+			t.Errorf("%s: problemas inesperados: %v", tt.name, problems)
+			continue
+		}
+		q, args, err := r.buildQuery()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !strings.Contains(q, tt.want) {
+			t.Errorf("%s: la consulta no contiene %q:\n%s", tt.name, tt.want, q)
+		}
+		checkPlaceholders(t, tt.name, q, args)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ----------------------------------------------------
+// Settings en caliente
+// ----------------------------------------------------
+//
+// Los settings efectivos son los del fichero + entorno con, encima, lo que se
+// haya guardado con PUT /api/v1/settings (tabla core_settings, una sola
+// fila). Los workers leen s.settings en cada vuelta, así que un cambio se
+// aplica en la siguiente pasada sin reiniciar. Sólo se guardan los campos
+// que se han cambiado por la API (un JSON parcial que se va acumulando entre
+// PUTs): el resto sigue saliendo del fichero y del entorno. Un DELETE borra
+// los cambios y se vuelve a los valores del fichero.
+
+type SettingsResponse struct {
+	Settings Settings `json:"settings"`
+	// file: fichero + entorno; api: con cambios guardados por la API
+	Source string   `json:"source"`
+	Base   Settings `json:"base"`
+	// Campos cambiados por la API, tal como se guardan en core_settings
+	Overrides json.RawMessage `json:"overrides,omitempty"`
+	UpdatedBy string          `json:"updated_by,omitempty"`
+	UpdatedAt *time.Time      `json:"updated_at,omitempty"`
+}
+
+type SettingsUpdateRequest struct {
+	UpdatedBy string `json:"updated_by"`
+	// Sólo hace falta mandar los campos que cambian
+	Settings json.RawMessage `json:"settings"`
+}
+
+// Timeout de cada pasada de un worker
+const workerScanTimeout = 30 * time.Second
+
+// startWorker lanza un worker periódico que toma los settings vigentes en
+// cada vuelta.
+func (s *Server) startWorker(name string, scan func(ctx context.Context, st *Settings) error) {
+	go func() {
+		for {
+			time.Sleep(time.Duration(s.settings.Load().WorkerIntervalSeconds) * time.Second)
+
+			ctx, cancel := context.WithTimeout(context.Background(), workerScanTimeout)
+			if err := scan(ctx, s.settings.Load()); err != nil {
+				log.Printf("Error en %s: %v", name, err)
+			}
+			cancel()
+		}
+	}()
+}
+
+// loadStoredSettings aplica sobre base los settings guardados por la API.
+// Devuelve nil si no hay nada guardado.
+func (s *Server) loadStoredSettings(ctx context.Context, base Settings) (*SettingsResponse, error) {
+	var raw []byte
+	var resp SettingsResponse
+	var updatedAt time.Time
+	err := s.db.QueryRow(ctx, `
+        SELECT settings, updated_by, updated_at
+        FROM core_settings
+        WHERE id = 1
+    `).Scan(&raw, &resp.UpdatedBy, &updatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := mergeSettings(base, raw)
+	if err != nil {
+		return nil, err
+	}
+	if problems := st.validate(); len(problems) > 0 {
+		return nil, errors.New(strings.Join(problems, "; "))
+	}
+
+	resp.Settings = st
+	resp.Source = "api"
+	resp.Base = base
+	resp.Overrides = raw
+	resp.UpdatedAt = &updatedAt
+	return &resp, nil
+}
+
+// mergeOverrides acumula un PUT sobre los cambios ya guardados: los objetos
+// se mezclan campo a campo y el resto de valores se sustituye.
+func mergeOverrides(stored, update []byte) ([]byte, error) {
+	dst := map[string]any{}
+	if len(stored) > 0 {
+		if err := decodeJSONObject(stored, &dst); err != nil {
+			return nil, err
+		}
+	}
+	var src map[string]any
+	if err := decodeJSONObject(update, &src); err != nil {
+		return nil, err
+	}
+	mergeJSONObjects(dst, src)
+	return json.Marshal(dst)
+}
+
+func decodeJSONObject(raw []byte, dst *map[string]any) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(dst); err != nil {
+		return err
+	}
+	if *dst == nil {
+		return errors.New("se esperaba un objeto JSON")
+	}
+	return nil
+}
+
+func mergeJSONObjects(dst, src map[string]any) {
+	for k, v := range src {
+		sub, ok := v.(map[string]any)
+		if cur, isObj := dst[k].(map[string]any); ok && isObj {
+			mergeJSONObjects(cur, sub)
+			continue
+		}
+		dst[k] = v
+	}
+}
+
+func mergeSettings(base Settings, raw []byte) (Settings, error) {
+	st := base
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&st); err != nil {
+		return base, err
+	}
+	return st, nil
+}
+
+// ----------------------------------------------------
+// API settings (GET + PUT + DELETE)
+// ----------------------------------------------------
+
+func (s *Server) handleSettings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		s.handlePutSettings(w, r)
+		return
+	case http.MethodDelete:
+		s.handleDeleteSettings(w, r)
+		return
+	default:
+		http.Error(w, "solo GET/PUT/DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stored, err := s.loadStoredSettings(r.Context(), s.baseSettings)
+	if err != nil {
+		log.Printf("Error leyendo core_settings: %v", err)
+		http.Error(w, "error leyendo settings", http.StatusInternalServerError)
+		return
+	}
+	resp := SettingsResponse{Settings: *s.settings.Load(), Source: "file", Base: s.baseSettings}
+	if stored != nil {
+		resp.Source = stored.Source
+		resp.Overrides = stored.Overrides
+		resp.UpdatedBy = stored.UpdatedBy
+		resp.UpdatedAt = stored.UpdatedAt
+	}
+	writeSettingsResponse(w, resp)
+}
+
+func (s *Server) handlePutSettings(w http.ResponseWriter, r *http.Request) {
+	var req SettingsUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "JSON inválido", http.StatusBadRequest)
+		return
+	}
+	req.UpdatedBy = strings.TrimSpace(req.UpdatedBy)
+	if req.UpdatedBy == "" || len(req.Settings) == 0 {
+		http.Error(w, "updated_by y settings requeridos", http.StatusBadRequest)
+		return
+	}
+
+	s.settingsMu.Lock()
+	defer s.settingsMu.Unlock()
+
+	ctx := r.Context()
+
+	var stored []byte
+	err := s.db.QueryRow(ctx, `SELECT settings FROM core_settings WHERE id = 1`).Scan(&stored)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		log.Printf("Error leyendo core_settings: %v", err)
+		http.Error(w, "error leyendo settings", http.StatusInternalServerError)
+		return
+	}
+
+	raw, err := mergeOverrides(stored, req.Settings)
+	if err != nil {
+		http.Error(w, "settings inválidos: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	st, err := mergeSettings(s.baseSettings, raw)
+	if err != nil {
+		http.Error(w, "settings inválidos: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if problems := st.validate(); len(problems) > 0 {
+		http.Error(w, "settings inválidos: "+strings.Join(problems, "; "), http.StatusBadRequest)
+		return
+	}
+
+	var updatedAt time.Time
+	err = s.db.QueryRow(ctx, `
+        INSERT INTO core_settings (id, settings, updated_by, updated_at)
+        VALUES (1, $1::jsonb, $2, now())
+        ON CONFLICT (id) DO UPDATE
+        SET settings = EXCLUDED.settings,
+            updated_by = EXCLUDED.updated_by,
+            updated_at = EXCLUDED.updated_at
+        RETURNING updated_at
+    `, string(raw), req.UpdatedBy).Scan(&updatedAt)
+	if err != nil {
+		log.Printf("Error guardando core_settings: %v", err)
+		http.Error(w, "error guardando settings", http.StatusInternalServerError)
+		return
+	}
+
+	s.applySettings(st, req.UpdatedBy)
+	writeSettingsResponse(w, SettingsResponse{
+		Settings:  st,
+		Source:    "api",
+		Base:      s.baseSettings,
+		Overrides: raw,
+		UpdatedBy: req.UpdatedBy,
+		UpdatedAt: &updatedAt,
+	})
+}
+
+func (s *Server) handleDeleteSettings(w http.ResponseWriter, r *http.Request) {
+	s.settingsMu.Lock()
+	defer s.settingsMu.Unlock()
+
+	if _, err := s.db.Exec(r.Context(), `DELETE FROM core_settings WHERE id = 1`); err != nil {
+		log.Printf("Error borrando core_settings: %v", err)
+		http.Error(w, "error borrando settings", http.StatusInternalServerError)
+		return
+	}
+
+	s.applySettings(s.baseSettings, "reset")
+	writeSettingsResponse(w, SettingsResponse{Settings: s.baseSettings, Source: "file", Base: s.baseSettings})
+}
+
+// applySettings publica st para los workers y deja constancia del cambio.
+func (s *Server) applySettings(st Settings, by string) {
+	prev := s.settings.Swap(&st)
+	if prev != nil && prev.Federation.Enabled != st.Federation.Enabled {
+		state := "desactivada"
+		if st.Federation.Enabled {
+			state = "activada"
+		}
+		log.Printf("Federación de bans %s (%s)", state, by)
+	}
+	log.Printf("Settings actualizados por %s", by)
+}
+
+func writeSettingsResponse(w http.ResponseWriter, resp SettingsResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(resp); err != nil {
+		log.Printf("Error serializando respuesta settings: %v", err)
+	}
+}
@@ -0,0 +1,736 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ----------------------------------------------------
+// Importación de reglas Sigma
+// ----------------------------------------------------
+//
+// Los .yml/.yaml de sigma_dir (recursivo) se compilan a reglas del motor:
+// una regla Sigma sin agregación es una regla match y "| count() by campo > N"
+// (con timeframe) es threshold, o distinct_count con count(campo).
+//
+// Sólo se aceptan logsource product linux con service auth, sshd o sudo. Los
+// campos se traducen con sigmaFieldMap (COMMAND, USER, src_ip...); el resto se
+// busca tal cual en el payload. Como en Sigma, las comparaciones de texto
+// ignoran mayúsculas salvo con |cased.
+//
+// Las keywords (listas sin campo, o "|contains" sin campo) no se admiten: el
+// agente sólo envía las líneas que ya sabe interpretar, así que buscar texto
+// libre ("unexpected internal error"...) no encontraría nunca nada.
+//
+// Lo que no se sabe traducir (keywords, otros logsource, modificadores como
+// base64 o cidr, "near", agregaciones distintas de count...) se informa al
+// cargar y la regla se descarta sin parar el arranque; GET /api/v1/rules
+// lista los descartes.
+
+const defaultSigmaDir = "/etc/natu-core/sigma"
+
+// Ventana de las reglas Sigma sin timeframe
+const sigmaDefaultWindowMinutes = 60
+
+const ruleOriginSigma = "sigma"
+
+// SigmaSkip es una regla Sigma descartada al cargar.
+type SigmaSkip struct {
+	File     string   `json:"file"`
+	Title    string   `json:"title,omitempty"`
+	Problems []string `json:"problems"`
+}
+
+type sigmaDoc struct {
+	Title       string   `yaml:"title"`
+	ID          string   `yaml:"id"`
+	Status      string   `yaml:"status"`
+	Description string   `yaml:"description"`
+	Level       string   `yaml:"level"`
+	Tags        []string `yaml:"tags"`
+	Action      string   `yaml:"action"`
+	LogSource   struct {
+		Product  string `yaml:"product"`
+		Service  string `yaml:"service"`
+		Category string `yaml:"category"`
+	} `yaml:"logsource"`
+	Detection yaml.Node `yaml:"detection"`
+}
+
+var sigmaLevels = map[string]string{
+	"informational": "bajo",
+	"low":           "bajo",
+	"medium":        "medio",
+	"high":          "alto",
+	"critical":      "crítico",
+}
+
+// Campos Sigma habituales en reglas de auth/sshd/sudo -> campos de natu
+var sigmaFieldMap = map[string]string{
+	"COMMAND":        "payload.command",
+	"USER":           "payload.target_user",
+	"TTY":            "payload.tty",
+	"PWD":            "payload.pwd",
+	"User":           "payload.username",
+	"user":           "payload.username",
+	"TargetUserName": "payload.username",
+	"src_ip":         "payload.remote_ip",
+	"SourceIp":       "payload.remote_ip",
+	"IpAddress":      "payload.remote_ip",
+	"dst_port":       "payload.dst_port",
+	"Hostname":       "hostname",
+	"hostname":       "hostname",
+	"ComputerName":   "hostname",
+	"event_type":     "event_type",
+	"source":         "source",
+}
+
+var reSigmaTimeframe = regexp.MustCompile(`^(\d+)([smhd])$`)
+var reSigmaCount = regexp.MustCompile(`^count\(\s*([A-Za-z0-9_.]*)\s*\)(?:\s+by\s+([A-Za-z0-9_.]+))?\s*(>=|>)\s*(\d+)$`)
+var reSigmaNameChars = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// LoadSigmaRules compila las reglas Sigma de dir. taken son los nombres ya
+// usados (internas y fichero). Que el directorio no exista no es un error.
+func LoadSigmaRules(dir string, taken map[string]bool) ([]*Rule, []SigmaSkip, error) {
+	if dir == "" {
+		return nil, nil, nil
+	}
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+
+	var rules []*Rule
+	var skipped []SigmaSkip
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		ext := strings.ToLower(filepath.Ext(p))
+		if d.IsDir() || (ext != ".yml" && ext != ".yaml") {
+			return nil
+		}
+
+		rel, _ := filepath.Rel(dir, p)
+		r, title, problems := loadSigmaFile(p)
+		if r != nil {
+			if taken[r.Name] {
+				problems = append(problems, fmt.Sprintf("nombre %s ya usado por otra regla", r.Name))
+			}
+			problems = append(problems, r.validate()...)
+		}
+		if len(problems) > 0 {
+			skipped = append(skipped, SigmaSkip{File: rel, Title: title, Problems: problems})
+			return nil
+		}
+		taken[r.Name] = true
+		rules = append(rules, r)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("leyendo reglas Sigma de %s: %w", dir, err)
+	}
+	return rules, skipped, nil
+}
+
+func loadSigmaFile(p string) (*Rule, string, []string) {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, "", []string{err.Error()}
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	var doc sigmaDoc
+	if err := dec.Decode(&doc); err != nil {
+		return nil, "", []string{"YAML inválido: " + err.Error()}
+	}
+	var extra yaml.Node
+	if err := dec.Decode(&extra); !errors.Is(err, io.EOF) {
+		return nil, doc.Title, []string{"colecciones de reglas (varios documentos YAML) no soportadas"}
+	}
+
+	base := strings.TrimSuffix(filepath.Base(p), filepath.Ext(p))
+	r, problems := compileSigma(&doc, base)
+	return r, doc.Title, problems
+}
+
+// compileSigma traduce un documento Sigma a una regla del motor.
+func compileSigma(doc *sigmaDoc, baseName string) (*Rule, []string) {
+	var problems []string
+	fail := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if doc.Title == "" {
+		fail("falta title")
+	}
+	if doc.Action != "" {
+		fail("action %q no soportado", doc.Action)
+	}
+	switch doc.Status {
+	case "deprecated", "unsupported":
+		fail("status %s", doc.Status)
+	}
+
+	severity := "medio"
+	if doc.Level != "" {
+		sev, ok := sigmaLevels[doc.Level]
+		if !ok {
+			fail("level %q desconocido", doc.Level)
+		}
+		severity = sev
+	}
+
+	ls := doc.LogSource
+	if ls.Product != "linux" {
+		fail("logsource product %q no soportado (sólo linux)", ls.Product)
+	}
+	if ls.Category != "" {
+		fail("logsource category %q no soportada", ls.Category)
+	}
+	scope := []*Condition{fieldEq("source", "auth")}
+	switch ls.Service {
+	case "auth":
+	case "sshd":
+		scope = append(scope, &Condition{Field: "event_type", Op: "startswith", Value: "ssh_"})
+	case "sudo":
+		scope = append(scope, &Condition{Field: "event_type", Op: "startswith", Value: "sudo_"})
+	default:
+		fail("logsource service %q no soportado (use auth, sshd o sudo)", ls.Service)
+	}
+
+	det := &doc.Detection
+	if det.Kind != yaml.MappingNode {
+		fail("detection debe ser un mapa")
+		return nil, problems
+	}
+
+	searches := map[string]*Condition{}
+	var order []string
+	var condNodes []string
+	timeframe := ""
+	for i := 0; i+1 < len(det.Content); i += 2 {
+		key, val := det.Content[i].Value, det.Content[i+1]
+		switch key {
+		case "condition":
+			switch val.Kind {
+			case yaml.ScalarNode:
+				condNodes = append(condNodes, val.Value)
+			case yaml.SequenceNode:
+				for _, c := range val.Content {
+					condNodes = append(condNodes, c.Value)
+				}
+			}
+		case "timeframe":
+			timeframe = val.Value
+		default:
+			c, err := compileSigmaSearch(val)
+			if err != nil {
+				fail("%s: %v", key, err)
+				continue
+			}
+			searches[key] = c
+			order = append(order, key)
+		}
+	}
+	if len(condNodes) == 0 {
+		fail("falta detection.condition")
+	}
+	if len(problems) > 0 {
+		return nil, problems
+	}
+
+	var agg string
+	var conds []*Condition
+	for _, cond := range condNodes {
+		expr, aggPart, _ := strings.Cut(cond, "|")
+		aggPart = strings.TrimSpace(aggPart)
+		if aggPart != "" {
+			if len(condNodes) > 1 {
+				return nil, []string{"agregación en una lista de condiciones no soportada"}
+			}
+			agg = aggPart
+		}
+		c, err := parseSigmaCondition(expr, searches, order)
+		if err != nil {
+			return nil, []string{fmt.Sprintf("condition %q: %v", cond, err)}
+		}
+		conds = append(conds, c)
+	}
+	match := conds[0]
+	if len(conds) > 1 {
+		match = &Condition{Any: conds}
+	}
+
+	window := sigmaDefaultWindowMinutes
+	if timeframe != "" {
+		w, err := sigmaTimeframeMinutes(timeframe)
+		if err != nil {
+			return nil, []string{err.Error()}
+		}
+		window = w
+	}
+
+	title := strings.ReplaceAll(doc.Title, "$", "")
+	r := &Rule{
+		Name:          sigmaRuleName(baseName),
+		Description:   strings.TrimSpace(doc.Description),
+		Type:          ruleTypeMatch,
+		Severity:      severity,
+		WindowMinutes: window,
+		GroupBy:       []string{"agent_id"},
+		Where:         &Condition{All: append(scope, match)},
+		Message:       "Sigma: " + title + " en ${hostname}",
+		Tags:          append([]string{}, doc.Tags...),
+		Origin:        ruleOriginSigma,
+	}
+	if doc.ID != "" {
+		r.Tags = append(r.Tags, "sigma:"+doc.ID)
+	}
+
+	if agg != "" {
+		m := reSigmaCount.FindStringSubmatch(agg)
+		if m == nil {
+			return nil, []string{fmt.Sprintf("agregación %q no soportada (sólo count() [by campo] > N)", agg)}
+		}
+		if timeframe == "" {
+			return nil, []string{"la agregación necesita timeframe"}
+		}
+		n, _ := strconv.Atoi(m[4])
+		if m[3] == ">" {
+			n++
+		}
+		r.Type = ruleTypeThreshold
+		r.Threshold = n
+		r.Message = "Sigma: " + title + " en ${hostname} (${count} eventos en ${window_minutes} min)"
+		if m[2] != "" {
+			by, err := sigmaField(m[2])
+			if err != nil {
+				return nil, []string{err.Error()}
+			}
+			r.GroupBy = append(r.GroupBy, by)
+			if short := fieldShortName(by); short != "hostname" {
+				r.Message = "Sigma: " + title + " en ${hostname}, " + m[2] + "=${" + short + "} (${count} eventos en ${window_minutes} min)"
+			}
+		}
+		if m[1] != "" {
+			df, err := sigmaField(m[1])
+			if err != nil {
+				return nil, []string{err.Error()}
+			}
+			r.Type = ruleTypeDistinct
+			r.DistinctField = df
+			r.Message = strings.Replace(r.Message, "${count} eventos", "${distinct_count} valores de "+m[1], 1)
+		}
+	}
+	return r, nil
+}
+
+// sigmaRuleName: lnx_sshd_susp_ssh.yml -> sigma_lnx_sshd_susp_ssh
+func sigmaRuleName(base string) string {
+	name := reSigmaNameChars.ReplaceAllString(strings.ToLower(base), "_")
+	return "sigma_" + strings.Trim(name, "_")
+}
+
+func sigmaTimeframeMinutes(tf string) (int, error) {
+	m := reSigmaTimeframe.FindStringSubmatch(tf)
+	if m == nil {
+		return 0, fmt.Errorf("timeframe %q inválido (use Ns, Nm, Nh o Nd)", tf)
+	}
+	n, _ := strconv.Atoi(m[1])
+	minutes := n
+	switch m[2] {
+	case "s":
+		minutes = (n + 59) / 60
+	case "h":
+		minutes = n * 60
+	case "d":
+		minutes = n * 1440
+	}
+	if minutes < 1 || minutes > 10080 {
+		return 0, fmt.Errorf("timeframe %q fuera de rango (1m-7d)", tf)
+	}
+	return minutes, nil
+}
+
+func sigmaField(name string) (string, error) {
+	if f, ok := sigmaFieldMap[name]; ok {
+		return f, nil
+	}
+	if !rePayloadField.MatchString(name) {
+		return "", fmt.Errorf("campo %q no soportado", name)
+	}
+	return "payload." + name, nil
+}
+
+var errSigmaKeywords = errors.New("búsqueda de texto libre no soportada (el agente sólo envía líneas ya interpretadas; use campos)")
+
+// compileSigmaSearch traduce un identificador de búsqueda: un mapa es AND de
+// campos y una lista de mapas es OR. Las listas de valores (keywords) se
+// rechazan.
+func compileSigmaSearch(n *yaml.Node) (*Condition, error) {
+	switch n.Kind {
+	case yaml.MappingNode:
+		return compileSigmaMap(n)
+	case yaml.ScalarNode:
+		return nil, errSigmaKeywords
+	case yaml.SequenceNode:
+		if len(n.Content) == 0 {
+			return nil, fmt.Errorf("lista vacía")
+		}
+		var list []*Condition
+		for _, item := range n.Content {
+			var c *Condition
+			var err error
+			switch item.Kind {
+			case yaml.MappingNode:
+				c, err = compileSigmaMap(item)
+			case yaml.ScalarNode:
+				err = errSigmaKeywords
+			default:
+				err = fmt.Errorf("elemento de lista no soportado")
+			}
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, c)
+		}
+		if len(list) == 1 {
+			return list[0], nil
+		}
+		return &Condition{Any: list}, nil
+	}
+	return nil, fmt.Errorf("búsqueda no soportada")
+}
+
+type sigmaModifiers struct {
+	// contains | startswith | endswith
+	position   string
+	all        bool
+	re         bool
+	cased      bool
+	ignoreCase bool
+	exists     bool
+	compare    string
+}
+
+func compileSigmaMap(n *yaml.Node) (*Condition, error) {
+	var all []*Condition
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, val := n.Content[i].Value, n.Content[i+1]
+
+		parts := strings.Split(key, "|")
+		if parts[0] == "" {
+			// "|contains": keywords con modificadores
+			return nil, errSigmaKeywords
+		}
+		var mods sigmaModifiers
+		field, err := sigmaField(parts[0])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, mod := range parts[1:] {
+			switch mod {
+			case "contains", "startswith", "endswith":
+				if mods.position != "" {
+					return nil, fmt.Errorf("%s: modificadores de posición repetidos", key)
+				}
+				mods.position = mod
+			case "all":
+				mods.all = true
+			case "re":
+				mods.re = true
+			case "i":
+				mods.ignoreCase = true
+			case "cased":
+				mods.cased = true
+			case "exists":
+				mods.exists = true
+			case "gt", "gte", "lt", "lte":
+				mods.compare = mod
+			default:
+				return nil, fmt.Errorf("%s: modificador %q no soportado", key, mod)
+			}
+		}
+
+		var values []*yaml.Node
+		switch val.Kind {
+		case yaml.ScalarNode:
+			values = []*yaml.Node{val}
+		case yaml.SequenceNode:
+			values = val.Content
+		default:
+			return nil, fmt.Errorf("%s: valor no soportado", key)
+		}
+		if len(values) == 0 {
+			return nil, fmt.Errorf("%s: lista vacía", key)
+		}
+
+		var leaves []*Condition
+		for _, v := range values {
+			if v.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("%s: valor anidado no soportado", key)
+			}
+			c, err := sigmaValue(field, mods, v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			}
+			leaves = append(leaves, c)
+		}
+		switch {
+		case len(leaves) == 1:
+			all = append(all, leaves[0])
+		case mods.all:
+			all = append(all, &Condition{All: leaves})
+		default:
+			all = append(all, &Condition{Any: leaves})
+		}
+	}
+	if len(all) == 0 {
+		return nil, fmt.Errorf("mapa vacío")
+	}
+	if len(all) == 1 {
+		return all[0], nil
+	}
+	return &Condition{All: all}, nil
+}
+
+// sigmaValue compila la comparación de field con un valor Sigma.
+func sigmaValue(field string, mods sigmaModifiers, v *yaml.Node) (*Condition, error) {
+	if mods.exists {
+		c := &Condition{Field: field, Op: "exists"}
+		switch v.Value {
+		case "true":
+			return c, nil
+		case "false":
+			return &Condition{Not: c}, nil
+		}
+		return nil, fmt.Errorf("exists necesita true o false")
+	}
+	if v.Tag == "!!null" {
+		return &Condition{Not: &Condition{Field: field, Op: "exists"}}, nil
+	}
+	if mods.compare != "" {
+		return &Condition{Field: field, Op: mods.compare, Value: v.Value}, nil
+	}
+	if mods.re {
+		if mods.position != "" {
+			return nil, fmt.Errorf("re no se combina con %s", mods.position)
+		}
+		return &Condition{Field: field, Op: "regex", Value: v.Value, IgnoreCase: mods.ignoreCase}, nil
+	}
+
+	ignoreCase := !mods.cased
+	if pattern, ok := sigmaWildcardRegex(v.Value, mods.position); ok {
+		return &Condition{Field: field, Op: "regex", Value: pattern, IgnoreCase: ignoreCase}, nil
+	}
+	value := sigmaUnescape(v.Value)
+	if value == "" && mods.position != "" {
+		return &Condition{Field: field, Op: "exists"}, nil
+	}
+
+	op := "eq"
+	if mods.position != "" {
+		op = mods.position
+	}
+	return &Condition{Field: field, Op: op, Value: value, IgnoreCase: ignoreCase}, nil
+}
+
+// sigmaWildcardRegex convierte un valor con * o ? sin escapar en regex.
+func sigmaWildcardRegex(v, position string) (string, bool) {
+	var b strings.Builder
+	wild := false
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		switch {
+		case c == '\\' && i+1 < len(v) && strings.IndexByte(`*?\`, v[i+1]) >= 0:
+			b.WriteString(regexp.QuoteMeta(string(v[i+1])))
+			i++
+		case c == '*':
+			b.WriteString(".*")
+			wild = true
+		case c == '?':
+			b.WriteString(".")
+			wild = true
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	if !wild {
+		return "", false
+	}
+
+	pattern := b.String()
+	if position != "contains" && position != "endswith" {
+		pattern = "^" + pattern
+	}
+	if position != "contains" && position != "startswith" {
+		pattern += "$"
+	}
+	return pattern, true
+}
+
+func sigmaUnescape(v string) string {
+	r := strings.NewReplacer(`\*`, `*`, `\?`, `?`, `\\`, `\`)
+	return r.Replace(v)
+}
+
+// ----------------------------------------------------
+// Condiciones Sigma
+// ----------------------------------------------------
+//
+// Gramática soportada: identificadores, and, or, not, paréntesis y
+// "1 of x*" / "all of x*" / "1 of them" / "all of them".
+
+type sigmaParser struct {
+	tokens   []string
+	pos      int
+	searches map[string]*Condition
+	order    []string
+}
+
+func parseSigmaCondition(expr string, searches map[string]*Condition, order []string) (*Condition, error) {
+	expr = strings.ReplaceAll(strings.ReplaceAll(expr, "(", " ( "), ")", " ) ")
+	p := &sigmaParser{tokens: strings.Fields(expr), searches: searches, order: order}
+	if len(p.tokens) == 0 {
+		return nil, fmt.Errorf("condición vacía")
+	}
+	c, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("sobra %q", p.tokens[p.pos])
+	}
+	return c, nil
+}
+
+func (p *sigmaParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return strings.ToLower(p.tokens[p.pos])
+	}
+	return ""
+}
+
+func (p *sigmaParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *sigmaParser) or() (*Condition, error) {
+	return p.binary("or", p.and)
+}
+
+func (p *sigmaParser) and() (*Condition, error) {
+	return p.binary("and", p.not)
+}
+
+func (p *sigmaParser) binary(op string, sub func() (*Condition, error)) (*Condition, error) {
+	first, err := sub()
+	if err != nil {
+		return nil, err
+	}
+	list := []*Condition{first}
+	for p.peek() == op {
+		p.next()
+		c, err := sub()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, c)
+	}
+	if len(list) == 1 {
+		return first, nil
+	}
+	if op == "and" {
+		return &Condition{All: list}, nil
+	}
+	return &Condition{Any: list}, nil
+}
+
+func (p *sigmaParser) not() (*Condition, error) {
+	if p.peek() == "not" {
+		p.next()
+		c, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return &Condition{Not: c}, nil
+	}
+	return p.primary()
+}
+
+func (p *sigmaParser) primary() (*Condition, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("condición incompleta")
+	}
+	raw := p.tokens[p.pos]
+	t := p.next()
+
+	switch t {
+	case "(":
+		c, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("falta )")
+		}
+		return c, nil
+	case ")", "and", "or":
+		return nil, fmt.Errorf("%q inesperado", raw)
+	case "near":
+		return nil, fmt.Errorf("near no soportado")
+	}
+
+	if p.peek() == "of" {
+		p.next()
+		if t != "1" && t != "all" && t != "any" {
+			return nil, fmt.Errorf("%q of no soportado (use 1 of o all of)", raw)
+		}
+		if p.pos >= len(p.tokens) {
+			return nil, fmt.Errorf("falta el patrón de %s of", raw)
+		}
+		pattern := p.tokens[p.pos]
+		p.pos++
+
+		var list []*Condition
+		for _, name := range p.order {
+			ok := pattern == "them"
+			if !ok {
+				ok, _ = path.Match(pattern, name)
+			}
+			if ok {
+				list = append(list, p.searches[name])
+			}
+		}
+		if len(list) == 0 {
+			return nil, fmt.Errorf("%s no coincide con ninguna búsqueda", pattern)
+		}
+		if len(list) == 1 {
+			return list[0], nil
+		}
+		if t == "all" {
+			return &Condition{All: list}, nil
+		}
+		return &Condition{Any: list}, nil
+	}
+
+	c, ok := p.searches[raw]
+	if !ok {
+		return nil, fmt.Errorf("búsqueda %q no definida", raw)
+	}
+	return c, nil
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// condString da una forma compacta de una condición para comparar en tests.
+func condString(c *Condition) string {
+	list := func(name string, cs []*Condition) string {
+		parts := make([]string, len(cs))
+		for i, sub := range cs {
+			parts[i] = condString(sub)
+		}
+		return name + "(" + strings.Join(parts, ", ") + ")"
+	}
+	switch {
+	case c == nil:
+		return "<nil>"
+	case len(c.All) > 0:
+		return list("all", c.All)
+	case len(c.Any) > 0:
+		return list("any", c.Any)
+	case c.Not != nil:
+		return "not(" + condString(c.Not) + ")"
+	}
+	s := c.Field + " " + c.Op
+	if c.Value != "" {
+		s += " " + c.Value
+	}
+	if c.IgnoreCase {
+		s += " /i"
+	}
+	return s
+}
+
+func TestParseSigmaCondition(t *testing.T) {
+	searches := map[string]*Condition{
+		"selection":      fieldEq("a", "1"),
+		"selection_user": fieldEq("b", "2"),
+		"filter":         fieldEq("c", "3"),
+	}
+	order := []string{"selection", "selection_user", "filter"}
+
+	tests := []struct {
+		expr string
+		want string
+		err  string
+	}{
+		{expr: "selection", want: "a eq 1"},
+		{expr: "selection and not filter", want: "all(a eq 1, not(c eq 3))"},
+		{expr: "selection or filter and selection_user", want: "any(a eq 1, all(c eq 3, b eq 2))"},
+		{expr: "(selection or filter) and selection_user", want: "all(any(a eq 1, c eq 3), b eq 2)"},
+		{expr: "not not selection", want: "not(not(a eq 1))"},
+		{expr: "selection AND NOT filter", want: "all(a eq 1, not(c eq 3))"},
+		{expr: "1 of selection*", want: "any(a eq 1, b eq 2)"},
+		{expr: "any of selection*", want: "any(a eq 1, b eq 2)"},
+		{expr: "all of selection*", want: "all(a eq 1, b eq 2)"},
+		{expr: "1 of selection_u*", want: "b eq 2"},
+		{expr: "1 of them", want: "any(a eq 1, b eq 2, c eq 3)"},
+		{expr: "all of them and not filter", want: "all(all(a eq 1, b eq 2, c eq 3), not(c eq 3))"},
+		{expr: "1 of selection_? or filter", err: "no coincide"},
+		{expr: "", err: "condición vacía"},
+		{expr: "selection and", err: "condición incompleta"},
+		{expr: "(selection", err: "falta )"},
+		{expr: "selection )", err: "sobra"},
+		{expr: "missing", err: "no definida"},
+		{expr: "2 of selection*", err: "no soportado"},
+		{expr: "1 of nope*", err: "no coincide"},
+		{expr: "all of", err: "falta el patrón"},
+		{expr: "selection near filter", err: "sobra"},
+		{expr: "near filter", err: "near no soportado"},
+	}
+
+	for _, tt := range tests {
+		c, err := parseSigmaCondition(tt.expr, searches, order)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%q: error = %v, se esperaba %q", tt.expr, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: error inesperado: %v", tt.expr, err)
+			continue
+		}
+		if got := condString(c); got != tt.want {
+			t.Errorf("%q:\n got  %s\n want %s", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func compileSigmaYAML(t *testing.T, src string) (*Rule, []string) {
+	t.Helper()
+	var doc sigmaDoc
+	if err := yaml.Unmarshal([]byte(src), &doc); err != nil {
+		t.Fatalf("YAML de prueba inválido: %v", err)
+	}
+	return compileSigma(&doc, "test_rule")
+}
+
+const sigmaTestHeader = `title: Prueba
+level: high
+logsource:
+  product: linux
+  service: sshd
+`
+
+func TestCompileSigmaDetection(t *testing.T) {
+	tests := []struct {
+		name      string
+		detection string
+		want      string
+		err       string
+	}{
+		{
+			name: "wildcard al final",
+			detection: `
+  selection:
+    User: 'adm*'
+  condition: selection`,
+			want: `payload.username regex ^adm.*$ /i`,
+		},
+		{
+			name: "wildcard con contains",
+			detection: `
+  selection:
+    COMMAND|contains: '/tmp/*.sh'
+  condition: selection`,
+			want: `payload.command regex /tmp/.*\.sh /i`,
+		},
+		{
+			name: "interrogación con startswith",
+			detection: `
+  selection:
+    User|startswith: 'us?r'
+  condition: selection`,
+			want: `payload.username regex ^us.r /i`,
+		},
+		{
+			name: "asterisco escapado",
+			detection: `
+  selection:
+    COMMAND: 'rm \*'
+  condition: selection`,
+			want: `payload.command eq rm * /i`,
+		},
+		{
+			name: "lista de valores es OR, |all es AND y |cased respeta mayúsculas",
+			detection: `
+  selection:
+    User|cased:
+      - root
+      - admin
+    COMMAND|contains|all:
+      - curl
+      - '| sh'
+  condition: selection`,
+			want: `all(any(payload.username eq root, payload.username eq admin), all(payload.command contains curl /i, payload.command contains | sh /i))`,
+		},
+		{
+			name: "lista de mapas es OR y 1 of combina búsquedas",
+			detection: `
+  selection_root:
+    - User: root
+    - USER: root
+  selection_ip:
+    src_ip|re: '^10\.'
+  filter:
+    Hostname: bastion
+  condition: 1 of selection_* and not filter`,
+			want: `all(any(any(payload.username eq root /i, payload.target_user eq root /i), payload.remote_ip regex ^10\.), not(hostname eq bastion /i))`,
+		},
+		{
+			name: "lista de condiciones es OR",
+			detection: `
+  selection:
+    User: root
+  other:
+    User: admin
+  condition:
+    - selection
+    - other`,
+			want: `any(payload.username eq root /i, payload.username eq admin /i)`,
+		},
+		{
+			name: "null y exists",
+			detection: `
+  selection:
+    TTY: null
+    src_ip|exists: true
+  condition: selection`,
+			want: `all(not(payload.tty exists), payload.remote_ip exists)`,
+		},
+		{
+			name: "keywords escalares",
+			detection: `
+  keywords:
+    - 'Accepted publickey'
+  condition: keywords`,
+			err: errSigmaKeywords.Error(),
+		},
+		{
+			name: "keywords con |contains",
+			detection: `
+  selection:
+    '|contains': 'Accepted'
+  condition: selection`,
+			err: errSigmaKeywords.Error(),
+		},
+		{
+			name: "modificador desconocido",
+			detection: `
+  selection:
+    User|base64: root
+  condition: selection`,
+			err: `modificador "base64" no soportado`,
+		},
+		{
+			name: "re con contains",
+			detection: `
+  selection:
+    User|contains|re: 'ro+t'
+  condition: selection`,
+			err: "re no se combina con contains",
+		},
+		{
+			name: "agregación sin timeframe",
+			detection: `
+  selection:
+    User: root
+  condition: selection | count() > 5`,
+			err: "necesita timeframe",
+		},
+		{
+			name: "agregación no soportada",
+			detection: `
+  selection:
+    User: root
+  timeframe: 5m
+  condition: selection | sum(x) > 5`,
+			err: "no soportada",
+		},
+	}
+
+	for _, tt := range tests {
+		r, problems := compileSigmaYAML(t, sigmaTestHeader+"detection:"+tt.detection)
+		if tt.err != "" {
+			if len(problems) == 0 || !strings.Contains(strings.Join(problems, "; "), tt.err) {
+				t.Errorf("%s: problemas = %v, se esperaba %q", tt.name, problems, tt.err)
+			}
+			continue
+		}
+		if len(problems) > 0 {
+			t.Errorf("%s: problemas inesperados: %v", tt.name, problems)
+			continue
+		}
+		if r.Type != ruleTypeMatch || r.Severity != "alto" || r.Name != "sigma_test_rule" {
+			t.Errorf("%s: regla = %s/%s/%s", tt.name, r.Name, r.Type, r.Severity)
+		}
+		// Where = all(source=auth, event_type startswith ssh_, búsqueda)
+		if got := condString(r.Where); !strings.HasPrefix(got, "all(source eq auth, event_type startswith ssh_, ") {
+			t.Errorf("%s: ámbito de logsource = %s", tt.name, got)
+			continue
+		}
+		if got := condString(r.Where.All[2]); got != tt.want {
+			t.Errorf("%s:\n got  %s\n want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCompileSigmaAggregation(t *testing.T) {
+	tests := []struct {
+		condition     string
+		timeframe     string
+		wantType      string
+		wantThreshold int
+		wantWindow    int
+		wantGroupBy   string
+		wantDistinct  string
+	}{
+		{"selection | count() > 5", "10m", ruleTypeThreshold, 6, 10, "agent_id", ""},
+		{"selection | count() >= 5", "2h", ruleTypeThreshold, 5, 120, "agent_id", ""},
+		{"selection | count() by src_ip > 9", "90s", ruleTypeThreshold, 10, 2, "agent_id,payload.remote_ip", ""},
+		{"selection | count(User) by src_ip >= 3", "1d", ruleTypeDistinct, 3, 1440, "agent_id,payload.remote_ip", "payload.username"},
+	}
+
+	for _, tt := range tests {
+		src := sigmaTestHeader + "detection:\n  selection:\n    event_type: ssh_failed_login\n" +
+			"  timeframe: " + tt.timeframe + "\n  condition: " + tt.condition + "\n"
+		r, problems := compileSigmaYAML(t, src)
+		if len(problems) > 0 {
+			t.Errorf("%q: problemas inesperados: %v", tt.condition, problems)
+			continue
+		}
+		if r.Type != tt.wantType || r.Threshold != tt.wantThreshold || r.WindowMinutes != tt.wantWindow {
+			t.Errorf("%q: type=%s threshold=%d window=%d, se esperaba %s/%d/%d",
+				tt.condition, r.Type, r.Threshold, r.WindowMinutes, tt.wantType, tt.wantThreshold, tt.wantWindow)
+		}
+		if got := strings.Join(r.GroupBy, ","); got != tt.wantGroupBy {
+			t.Errorf("%q: group_by = %s, se esperaba %s", tt.condition, got, tt.wantGroupBy)
+		}
+		if r.DistinctField != tt.wantDistinct {
+			t.Errorf("%q: distinct_field = %q, se esperaba %q", tt.condition, r.DistinctField, tt.wantDistinct)
+		}
+		if problems := r.validate(); len(problems) > 0 {
+			t.Errorf("%q: la regla compilada no valida: %v", tt.condition, problems)
+		}
+	}
+}
@@ -7,10 +7,21 @@ import (
 	"time"
 )
 
+// Eventos SSH que se listan en actividad y timeline. Además de failed/success
+// incluye los mensajes pre-auth de sshd, que es donde aparecen los escáneres.
+const sshActivityEventTypesSQL = `'ssh_failed_login', 'ssh_login_success', 'ssh_invalid_user',
+            'ssh_preauth_closed', 'ssh_max_auth_exceeded', 'ssh_no_identification',
+            'ssh_banner_exchange_failed', 'ssh_disconnected'`
+
+// Eventos pre-auth que cuentan como sondeo en el agregado por IP
+const sshProbeEventTypesSQL = `'ssh_invalid_user', 'ssh_preauth_closed', 'ssh_max_auth_exceeded',
+            'ssh_no_identification', 'ssh_banner_exchange_failed'`
+
 type SSHActivityIP struct {
 	RemoteIP string    `json:"remote_ip"`
 	Failed   int       `json:"failed"`
 	Success  int       `json:"success"`
+	Probes   int       `json:"probes"`
 	LastSeen time.Time `json:"last_seen"`
 }
 
@@ -53,10 +64,11 @@ func (s *Server) handleSSHActivity(w http.ResponseWriter, r *http.Request) {
             e.payload->>'remote_ip' AS remote_ip,
             COUNT(*) FILTER (WHERE e.event_type = 'ssh_failed_login')  AS failed_count,
             COUNT(*) FILTER (WHERE e.event_type = 'ssh_login_success') AS success_count,
+            COUNT(*) FILTER (WHERE e.event_type IN (`+sshProbeEventTypesSQL+`)) AS probe_count,
             MAX(e.ts) AS last_seen
         FROM raw_events e
         WHERE e.source = 'auth'
-          AND e.event_type IN ('ssh_failed_login', 'ssh_login_success')
+          AND e.event_type IN (`+sshActivityEventTypesSQL+`)
           AND e.ts >= now() - ($1::int || ' minutes')::interval
           AND e.payload ? 'remote_ip'
         GROUP BY remote_ip
@@ -71,7 +83,7 @@ func (s *Server) handleSSHActivity(w http.ResponseWriter, r *http.Request) {
 	var ips []SSHActivityIP
 	for rows.Next() {
 		var item SSHActivityIP
-		if err := rows.Scan(&item.RemoteIP, &item.Failed, &item.Success, &item.LastSeen); err != nil {
+		if err := rows.Scan(&item.RemoteIP, &item.Failed, &item.Success, &item.Probes, &item.LastSeen); err != nil {
 			http.Error(w, "error leyendo IPs SSH", http.StatusInternalServerError)
 			return
 		}
@@ -100,7 +112,7 @@ func (s *Server) handleSSHActivity(w http.ResponseWriter, r *http.Request) {
         FROM raw_events e
         JOIN agents a ON e.agent_id = a.id
         WHERE e.source = 'auth'
-          AND e.event_type IN ('ssh_failed_login', 'ssh_login_success')
+          AND e.event_type IN (`+sshActivityEventTypesSQL+`)
           AND e.ts >= now() - ($1::int || ' minutes')::interval
         ORDER BY e.ts DESC
         LIMIT $2;
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ----------------------------------------------------
+// Sesiones SSH (ssh_session_start / ssh_session_end)
+// ----------------------------------------------------
+
+type SSHSession struct {
+	SessionID       string     `json:"session_id"`
+	Hostname        string     `json:"hostname"`
+	Username        string     `json:"username"`
+	RemoteIP        string     `json:"remote_ip,omitempty"`
+	AuthMethod      string     `json:"auth_method,omitempty"`
+	PID             int        `json:"pid,omitempty"`
+	StartedAt       time.Time  `json:"started_at"`
+	EndedAt         *time.Time `json:"ended_at,omitempty"`
+	DurationSeconds int64      `json:"duration_seconds"`
+	EndReason       string     `json:"end_reason,omitempty"`
+	Active          bool       `json:"active"`
+}
+
+type SSHSessionHostSummary struct {
+	Hostname string `json:"hostname"`
+	Active   int    `json:"active"`
+	Closed   int    `json:"closed"`
+}
+
+type SSHSessionsResponse struct {
+	WindowMinutes int                     `json:"window_minutes"`
+	Limit         int                     `json:"limit"`
+	GeneratedAt   time.Time               `json:"generated_at"`
+	Hosts         []SSHSessionHostSummary `json:"hosts"`
+	Sessions      []SSHSession            `json:"sessions"`
+}
+
+func (s *Server) handleSSHSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "solo GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	host := q.Get("hostname")
+	username := q.Get("username")
+	ip := q.Get("ip")
+	status := q.Get("status")
+	minStr := q.Get("minutes")
+	limitStr := q.Get("limit")
+
+	if status != "" && status != "active" && status != "closed" {
+		http.Error(w, "status inválido (use active o closed)", http.StatusBadRequest)
+		return
+	}
+
+	windowMinutes := 1440
+	if minStr != "" {
+		if v, err := strconv.Atoi(minStr); err == nil && v > 0 && v <= 10080 {
+			windowMinutes = v
+		}
+	}
+
+	limit := 200
+	if limitStr != "" {
+		if v, err := strconv.Atoi(limitStr); err == nil && v > 0 && v <= 1000 {
+			limit = v
+		}
+	}
+
+	ctx := r.Context()
+	now := time.Now().UTC()
+
+	// Las sesiones activas se listan aunque empezaran antes de la ventana; el
+	// límite de 30 días sólo acota el escaneo de raw_events.
+	query := `
+WITH starts AS (
+    SELECT DISTINCT ON (e.agent_id, e.payload->>'session_id')
+        e.agent_id,
+        e.payload->>'session_id'                  AS session_id,
+        e.ts                                      AS started_at,
+        COALESCE(e.payload->>'username', '')      AS username,
+        COALESCE(e.payload->>'remote_ip', '')     AS remote_ip,
+        COALESCE(e.payload->>'auth_method', '')   AS auth_method,
+        COALESCE((e.payload->>'pid')::int, 0)     AS pid
+    FROM raw_events e
+    WHERE e.source = 'auth'
+      AND e.event_type = 'ssh_session_start'
+      AND e.ts >= now() - interval '30 days'
+      AND e.payload ? 'session_id'
+    ORDER BY e.agent_id, e.payload->>'session_id', e.ts
+),
+ends AS (
+    SELECT DISTINCT ON (e.agent_id, e.payload->>'session_id')
+        e.agent_id,
+        e.payload->>'session_id'                  AS session_id,
+        e.ts                                      AS ended_at,
+        COALESCE(e.payload->>'end_reason', '')    AS end_reason
+    FROM raw_events e
+    WHERE e.source = 'auth'
+      AND e.event_type = 'ssh_session_end'
+      AND e.ts >= now() - interval '30 days'
+      AND e.payload ? 'session_id'
+    ORDER BY e.agent_id, e.payload->>'session_id', e.ts
+)
+SELECT
+    st.session_id,
+    a.hostname,
+    st.username,
+    st.remote_ip,
+    st.auth_method,
+    st.pid,
+    st.started_at,
+    en.ended_at,
+    COALESCE(en.end_reason, '') AS end_reason
+FROM starts st
+JOIN agents a ON a.id = st.agent_id
+LEFT JOIN ends en ON en.agent_id = st.agent_id AND en.session_id = st.session_id
+WHERE (st.started_at >= now() - ($1::int || ' minutes')::interval OR en.ended_at IS NULL)
+`
+	args := []any{windowMinutes}
+	argPos := 2
+
+	switch status {
+	case "active":
+		query += " AND en.ended_at IS NULL"
+	case "closed":
+		query += " AND en.ended_at IS NOT NULL"
+	}
+	if host != "" {
+		query += " AND a.hostname = $" + strconv.Itoa(argPos)
+		args = append(args, host)
+		argPos++
+	}
+	if username != "" {
+		query += " AND st.username = $" + strconv.Itoa(argPos)
+		args = append(args, username)
+		argPos++
+	}
+	if ip != "" {
+		query += " AND st.remote_ip = $" + strconv.Itoa(argPos)
+		args = append(args, ip)
+		argPos++
+	}
+
+	query += " ORDER BY (en.ended_at IS NULL) DESC, st.started_at DESC LIMIT $" + strconv.Itoa(argPos)
+	args = append(args, limit)
+
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		log.Printf("Error consultando ssh_sessions: %v", err)
+		http.Error(w, "error consultando sesiones", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var sessions []SSHSession
+	byHost := map[string]*SSHSessionHostSummary{}
+	var hostOrder []string
+
+	for rows.Next() {
+		var ss SSHSession
+		if err := rows.Scan(
+			&ss.SessionID,
+			&ss.Hostname,
+			&ss.Username,
+			&ss.RemoteIP,
+			&ss.AuthMethod,
+			&ss.PID,
+			&ss.StartedAt,
+			&ss.EndedAt,
+			&ss.EndReason,
+		); err != nil {
+			log.Printf("Error escaneando ssh_session: %v", err)
+			http.Error(w, "error leyendo sesiones", http.StatusInternalServerError)
+			return
+		}
+
+		ss.Active = ss.EndedAt == nil
+		end := now
+		if ss.EndedAt != nil {
+			end = *ss.EndedAt
+		}
+		ss.DurationSeconds = int64(end.Sub(ss.StartedAt).Seconds())
+
+		h, ok := byHost[ss.Hostname]
+		if !ok {
+			h = &SSHSessionHostSummary{Hostname: ss.Hostname}
+			byHost[ss.Hostname] = h
+			hostOrder = append(hostOrder, ss.Hostname)
+		}
+		if ss.Active {
+			h.Active++
+		} else {
+			h.Closed++
+		}
+
+		sessions = append(sessions, ss)
+	}
+	if rows.Err() != nil {
+		log.Printf("Error final en rows ssh_sessions: %v", rows.Err())
+		http.Error(w, "error leyendo sesiones", http.StatusInternalServerError)
+		return
+	}
+
+	if sessions == nil {
+		sessions = []SSHSession{}
+	}
+	hosts := []SSHSessionHostSummary{}
+	for _, name := range hostOrder {
+		hosts = append(hosts, *byHost[name])
+	}
+
+	resp := SSHSessionsResponse{
+		WindowMinutes: windowMinutes,
+		Limit:         limit,
+		GeneratedAt:   now,
+		Hosts:         hosts,
+		Sessions:      sessions,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(resp); err != nil {
+		log.Printf("Error serializando respuesta ssh_sessions: %v", err)
+	}
+}
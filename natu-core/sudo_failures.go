@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// ----------------------------------------------------
+// Worker sudo_alerts (fallos y denegaciones)
+// ----------------------------------------------------
+//
+// Complementa al worker de comandos peligrosos: un usuario que falla la
+// contraseña de sudo o al que la política deniega comandos una y otra vez
+// está intentando escalar privilegios. Las alertas van a sudo_alerts con
+// rule = 'sudo_repeated_failure'.
+//
+// Se sigue raw_events.id (event_watermarks): la ventana se cuenta hacia atrás
+// desde cada fallo nuevo y no desde ahora, así que los fallos que el spool
+// entrega tarde también alertan.
+
+const (
+	sudoRuleRepeatedFailure = "sudo_repeated_failure"
+	sudoFailureWatermark    = "sudo_failure_alerts"
+)
+
+func (s *Server) startSudoFailureAlertWorker() {
+	s.startWorker("SudoFailureAlertWorker", func(ctx context.Context, st *Settings) error {
+		return s.runSudoFailureAlertScan(ctx, st.SudoFailure.WindowMinutes, st.SudoFailure.Threshold)
+	})
+}
+
+func (s *Server) runSudoFailureAlertScan(ctx context.Context, windowMinutes int, threshold int) error {
+	from, mark, maxID, err := eventRange(ctx, s.db, sudoFailureWatermark, time.Duration(windowMinutes)*time.Minute)
+	if err != nil {
+		return err
+	}
+	if maxID <= mark {
+		return nil
+	}
+
+	// Cada línea "N incorrect password attempts" cuenta N; cada denegación, 1.
+	// Para cada fallo nuevo se suman los de la ventana que acaba en él y, por
+	// usuario, se queda el último que pasa el umbral; de ese intento se toman
+	// tty/pwd/comando para la alerta.
+	rows, err := s.db.Query(ctx, `
+        WITH fresh AS (
+            SELECT e.agent_id, e.ts, e.payload->>'sudo_user' AS sudo_user
+            FROM raw_events e
+            WHERE e.source = 'auth'
+              AND e.event_type IN ('sudo_auth_failure', 'sudo_denied')
+              AND e.id > $3
+              AND e.id <= $4
+              AND e.payload ? 'sudo_user'
+        ),
+        fails AS (
+            SELECT
+                e.agent_id,
+                e.ts,
+                e.payload->>'sudo_user'                      AS sudo_user,
+                COALESCE(e.payload->>'target_user', '')      AS target_user,
+                COALESCE(e.payload->>'tty', '')              AS tty,
+                COALESCE(e.payload->>'pwd', '')              AS pwd,
+                COALESCE(e.payload->>'command', '')          AS command,
+                CASE
+                    WHEN e.event_type = 'sudo_auth_failure'
+                        THEN GREATEST(COALESCE((e.payload->>'attempts')::int, 1), 1)
+                    ELSE 1
+                END                                          AS weight
+            FROM raw_events e
+            WHERE e.source = 'auth'
+              AND e.event_type IN ('sudo_auth_failure', 'sudo_denied')
+              AND e.ts >= (SELECT min(ts) FROM fresh) - ($1::int || ' minutes')::interval
+              AND e.payload ? 'sudo_user'
+        ),
+        hits AS (
+            SELECT
+                fr.agent_id,
+                fr.sudo_user,
+                fr.ts AS last_ts,
+                (
+                    SELECT SUM(f.weight)::int
+                    FROM fails f
+                    WHERE f.agent_id = fr.agent_id
+                      AND f.sudo_user = fr.sudo_user
+                      AND f.ts > fr.ts - ($1::int || ' minutes')::interval
+                      AND f.ts <= fr.ts
+                ) AS failed_count
+            FROM fresh fr
+        ),
+        agg AS (
+            SELECT DISTINCT ON (agent_id, sudo_user) agent_id, sudo_user, failed_count, last_ts
+            FROM hits
+            WHERE failed_count >= $2
+            ORDER BY agent_id, sudo_user, last_ts DESC
+        )
+        SELECT
+            agg.agent_id::text,
+            a.hostname,
+            agg.sudo_user,
+            agg.failed_count,
+            last.ts,
+            last.target_user,
+            last.tty,
+            last.pwd,
+            last.command,
+            COALESCE(se.remote_ip, '') AS remote_ip
+        FROM agg
+        JOIN agents a ON a.id = agg.agent_id
+        JOIN LATERAL (
+            SELECT f.ts, f.target_user, f.tty, f.pwd, f.command
+            FROM fails f
+            WHERE f.agent_id = agg.agent_id
+              AND f.sudo_user = agg.sudo_user
+              AND f.ts <= agg.last_ts
+            ORDER BY f.ts DESC
+            LIMIT 1
+        ) last ON TRUE
+        LEFT JOIN LATERAL (
+            SELECT se.payload->>'remote_ip' AS remote_ip
+            FROM raw_events se
+            WHERE se.agent_id = agg.agent_id
+              AND se.source = 'auth'
+              AND se.event_type = 'ssh_login_success'
+              AND se.payload->>'username' = agg.sudo_user
+              AND se.ts <= agg.last_ts
+              AND se.payload ? 'remote_ip'
+            ORDER BY se.ts DESC
+            LIMIT 1
+        ) se ON TRUE;
+    `, windowMinutes, threshold, from, maxID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type cand struct {
+		AgentID     string
+		Hostname    string
+		SudoUser    string
+		FailedCount int
+		LastTs      time.Time
+		Target      string
+		TTY         string
+		Pwd         string
+		Command     string
+		RemoteIP    string
+	}
+
+	var cands []cand
+	for rows.Next() {
+		var c cand
+		if err := rows.Scan(&c.AgentID, &c.Hostname, &c.SudoUser, &c.FailedCount, &c.LastTs, &c.Target, &c.TTY, &c.Pwd, &c.Command, &c.RemoteIP); err != nil {
+			return err
+		}
+		cands = append(cands, c)
+	}
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	for _, c := range cands {
+		// Una alerta por usuario y ventana, contada en hora de los eventos
+		var exists bool
+		err := s.db.QueryRow(ctx, `
+            SELECT EXISTS (
+                SELECT 1
+                FROM sudo_alerts
+                WHERE agent_id = $1
+                  AND sudo_user = $2
+                  AND rule = $3
+                  AND sudo_ts > $4::timestamptz - ($5::int || ' minutes')::interval
+                  AND sudo_ts < $4::timestamptz + ($5::int || ' minutes')::interval
+            );
+        `, c.AgentID, c.SudoUser, sudoRuleRepeatedFailure, c.LastTs, windowMinutes).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+
+		_, err = s.db.Exec(ctx, `
+            INSERT INTO sudo_alerts (
+                agent_id, hostname, sudo_user, target_user, remote_ip,
+                tty, pwd, command, window_minutes, sudo_ts, status,
+                rule, failed_count
+            )
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, 'new', $11, $12);
+        `, c.AgentID, c.Hostname, c.SudoUser, c.Target, c.RemoteIP, c.TTY, c.Pwd, c.Command, windowMinutes, c.LastTs,
+			sudoRuleRepeatedFailure, c.FailedCount)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("⚠️  SUDO alert (fallos repetidos): host=%s user=%s fallos=%d ip=%s window=%dmin",
+			c.Hostname, c.SudoUser, c.FailedCount, c.RemoteIP, windowMinutes)
+	}
+
+	return saveEventWatermark(ctx, s.db, sudoFailureWatermark, maxID)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// ----------------------------------------------------
+// Marcas de raw_events.id de los workers
+// ----------------------------------------------------
+//
+// Los workers que convierten eventos en alertas o intervalos no miran los
+// últimos N minutos por la hora del evento: tras una caída de core o de la
+// red el spool del agente entrega eventos con horas antiguas que ya no
+// caerían en la ventana. En su lugar guardan en event_watermarks el último
+// raw_events.id procesado y cada pasada lee los ids nuevos.
+//
+// Los ids se asignan al insertar pero se ven al hacer commit: un lote que
+// estaba a medio insertar puede aparecer por debajo de la marca. Por eso se
+// vuelven a leer los últimos eventRescanIDs ids, y cada paso de los workers
+// tiene que ser idempotente.
+
+const eventRescanIDs = 5000
+
+// dbExecutor es lo común a pgxpool.Pool y pgx.Tx.
+type dbExecutor interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+// eventRange devuelve los ids por procesar de name como (from, to]: desde la
+// marca menos eventRescanIDs hasta el último id de raw_events. La primera vez
+// la marca queda justo antes de los eventos de los últimos firstRun. Si no
+// hay ids nuevos, to <= mark.
+func eventRange(ctx context.Context, db dbExecutor, name string, firstRun time.Duration) (from, mark, to int64, err error) {
+	err = db.QueryRow(ctx, `SELECT last_event_id FROM event_watermarks WHERE name = $1`, name).Scan(&mark)
+	if errors.Is(err, pgx.ErrNoRows) {
+		err = db.QueryRow(ctx, `
+            SELECT COALESCE(
+                (SELECT min(id) - 1 FROM raw_events WHERE ts >= now() - ($1::bigint || ' seconds')::interval),
+                (SELECT max(id) FROM raw_events),
+                0
+            );
+        `, int64(firstRun/time.Second)).Scan(&mark)
+	}
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	if err := db.QueryRow(ctx, `SELECT COALESCE(max(id), 0) FROM raw_events`).Scan(&to); err != nil {
+		return 0, 0, 0, err
+	}
+
+	from = mark - eventRescanIDs
+	if from < 0 {
+		from = 0
+	}
+	return from, mark, to, nil
+}
+
+// saveEventWatermark guarda id como último procesado por name.
+func saveEventWatermark(ctx context.Context, db dbExecutor, name string, id int64) error {
+	_, err := db.Exec(ctx, `
+        INSERT INTO event_watermarks (name, last_event_id, updated_at)
+        VALUES ($1, $2, now())
+        ON CONFLICT (name) DO UPDATE SET last_event_id = EXCLUDED.last_event_id, updated_at = now();
+    `, name, id)
+	return err
+}
@@ -13,6 +13,14 @@ export interface SSHTopIP {
   failed: number;
 }
 
+// /24 (IPv4) o /64 (IPv6), con ?group_by=subnet
+export interface SSHTopSubnet {
+  subnet: string;
+  failed: number;
+  ips: number;
+  hosts: number;
+}
+
 export interface SSHTopUser {
   username: string;
   failed: number;
@@ -24,6 +32,7 @@ export interface SSHSummaryResponse {
   generated_at: string;
   hosts?: SSHHostSummary[];
   top_ips?: SSHTopIP[];
+  top_subnets?: SSHTopSubnet[];
   top_users?: SSHTopUser[];
 }
 
@@ -58,6 +67,7 @@ export interface SSHActivityIP {
   remote_ip: string;
   failed: number;
   success: number;
+  probes?: number;
   last_seen: string;
 }
 
@@ -89,6 +99,12 @@ export interface SSHBanItem {
   reason?: string;
   source?: string;
   synced_at: string;
+  timeout_seconds?: number;
+  expires_at?: string;
+  sets: string[];
+  origin: 'local' | 'federated';
+  first_seen: string;
+  last_seen: string;
 }
 
 export interface SSHBanResponse {
@@ -96,3 +112,200 @@ export interface SSHBanResponse {
   generated_at: string;
   bans: SSHBanItem[];
 }
+
+// Historial de bans (fail2ban.log)
+export interface SSHBanInterval {
+  id: number;
+  hostname: string;
+  jail: string;
+  ip: string;
+  banned_at: string;
+  unbanned_at?: string;
+  duration_seconds: number;
+  found_count: number;
+  restored: boolean;
+  status: 'active' | 'ended';
+}
+
+export interface SSHBanHistoryResponse {
+  window_minutes: number;
+  limit: number;
+  generated_at: string;
+  bans: SSHBanInterval[];
+}
+
+// Historial de ssh_bans_state (apariciones de cada ban)
+export interface SSHBanStateInterval {
+  id: number;
+  hostname: string;
+  ip: string;
+  jail: string;
+  source?: string;
+  origin: 'local' | 'federated';
+  sets: string[];
+  banned_at?: string;
+  first_seen: string;
+  last_seen: string;
+  closed_at?: string;
+  duration_seconds: number;
+  status: 'open' | 'closed';
+}
+
+export interface SSHBanRecurrence {
+  ip: string;
+  intervals: number;
+  hosts: number;
+  open: boolean;
+  first_seen: string;
+  last_seen: string;
+}
+
+export interface SSHBanStateHistoryResponse {
+  window_minutes: number;
+  limit: number;
+  generated_at: string;
+  intervals: SSHBanStateInterval[];
+  recurrence: SSHBanRecurrence[];
+}
+
+// Acciones remotas de ban/unban
+export interface BanActionTarget {
+  hostname: string;
+  status: 'pending' | 'sent' | 'success' | 'failed' | 'cancelled';
+  attempts: number;
+  picked_at?: string;
+  completed_at?: string;
+  output?: string;
+}
+
+export interface BanActionAudit {
+  ts: string;
+  event: string;
+  actor?: string;
+  hostname?: string;
+  detail?: string;
+}
+
+export interface BanAction {
+  id: number;
+  created_at: string;
+  action: 'ban' | 'unban';
+  ip: string;
+  jail: string;
+  method: 'fail2ban' | 'ipset';
+  ipset_set?: string;
+  ttl_seconds?: number;
+  scope: 'host' | 'fleet';
+  hostname?: string;
+  requested_by: string;
+  reason?: string;
+  source_alert?: string;
+  status: 'pending' | 'running' | 'done' | 'partial' | 'failed' | 'cancelled';
+  targets: BanActionTarget[];
+  audit?: BanActionAudit[];
+}
+
+export interface BanActionsResponse {
+  window_minutes: number;
+  limit: number;
+  generated_at: string;
+  actions: BanAction[];
+}
+
+// Federación de bans
+export interface FederatedBan {
+  id: number;
+  ip: string;
+  action_id: number;
+  action_status: string;
+  host_count: number;
+  source_hosts: string[];
+  target_count: number;
+  applied_count: number;
+  ttl_seconds: number;
+  created_at: string;
+  expires_at: string;
+  active: boolean;
+}
+
+export interface FederationAllowEntry {
+  id: number;
+  cidr: string;
+  note?: string;
+  created_by: string;
+  created_at: string;
+}
+
+export interface FederationResponse {
+  enabled: boolean;
+  min_hosts: number;
+  ttl_seconds: number;
+  ipset_set: string;
+  opted_out_hosts: string[];
+  allowlist: FederationAllowEntry[];
+  window_minutes: number;
+  generated_at: string;
+  bans: FederatedBan[];
+}
+
+// Settings de natu-core (/api/v1/settings)
+export interface CoreSettings {
+  worker_interval_seconds: number;
+  ssh_alert: { window_minutes: number; failed_threshold: number };
+  suspicious_login: { window_minutes: number; failed_before_success: number };
+  password_spray: { window_minutes: number; usernames_per_ip: number; ips_per_username: number };
+  distributed_bruteforce: { window_minutes: number; failed_threshold: number; min_hosts: number; subnet_min_ips: number };
+  low_and_slow: {
+    max_per_hour: number;
+    max_interval_cv: number;
+    day: { min_attempts: number; min_active_hours: number };
+    week: { min_attempts: number; min_active_hours: number };
+  };
+  sudo_alert: { window_minutes: number };
+  sudo_failure: { window_minutes: number; threshold: number };
+  account_alert: { window_minutes: number };
+  root_shell: { window_minutes: number };
+  ban_history: { window_minutes: number };
+  federation: { enabled: boolean; min_hosts: number; ttl_seconds: number };
+  ban_actions: { min_prefix_v4: number; min_prefix_v6: number };
+}
+
+export interface CoreSettingsResponse {
+  settings: CoreSettings;
+  source: 'file' | 'api';
+  base: CoreSettings;
+  overrides?: Record<string, unknown>;
+  updated_by?: string;
+  updated_at?: string;
+}
+
+// Alertas del motor de reglas (/api/v1/alerts)
+export type AlertSeverity = 'bajo' | 'medio' | 'alto' | 'crítico';
+export type AlertStatus = 'new' | 'ack' | 'closed';
+
+export interface Alert {
+  id: number;
+  created_at: string;
+  rule: string;
+  rule_type: 'match' | 'threshold' | 'distinct_count' | 'sequence';
+  origin: 'builtin' | 'file' | 'sigma';
+  severity: AlertSeverity;
+  hostname: string;
+  hosts: string[];
+  group_values: Record<string, string>;
+  count: number;
+  distinct_count?: number;
+  first_seen: string;
+  last_seen: string;
+  window_minutes: number;
+  message: string;
+  payload?: Record<string, unknown>;
+  status: AlertStatus;
+}
+
+export interface AlertsResponse {
+  window_minutes: number;
+  limit: number;
+  generated_at: string;
+  alerts: Alert[];
+}